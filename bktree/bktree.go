@@ -0,0 +1,248 @@
+/*
+Package bktree implements a Burkhard-Keller tree of 64-bit signatures, for
+nearest-neighbour searches by Hamming distance.
+
+Each node of the tree has a child for each distance from its signature to those
+below it, so the triangle inequality bounds the distances to every signature in
+a child's subtree, and a search skips the children too far from the target
+without computing any distance.  As Hamming distances are small integers, the
+tree is shallow and each node has few children.  It has the same search
+methods as a vptree.VPTree, so the two can be compared on the same workload.
+
+W. A. Burkhard and R. M. Keller, "Some approaches to best-match file
+searching", Communications of the ACM 16(4), 1973.
+*/
+package bktree
+
+import (
+	"container/heap"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/dgryski/go-simstore/simhash"
+)
+
+// An Item is a signature of a document
+type Item struct {
+	Sig uint64
+	ID  uint64
+}
+
+// maxHamming is the greatest Hamming distance between two signatures
+const maxHamming = 64
+
+type node struct {
+	item Item
+
+	// children are the subtrees of the items at each distance from item,
+	// in order of distance
+	children []child
+}
+
+type child struct {
+	dist int
+	n    *node
+}
+
+// A Tree is a BK-tree.  Its methods are safe for concurrent use: searches
+// run in parallel, and Add waits for them to finish.
+type Tree struct {
+	mu    sync.RWMutex
+	root  *node
+	count int
+}
+
+// New creates a tree of items
+func New(items []Item) *Tree {
+	t := &Tree{}
+	for _, item := range items {
+		t.add(item)
+	}
+	return t
+}
+
+// Len returns the number of items in the tree
+func (t *Tree) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.count
+}
+
+// Add inserts item into the tree.  Unlike a VP-tree, a BK-tree is never
+// rebalanced: its shape depends only on the order of the items added.
+func (t *Tree) Add(item Item) {
+	t.mu.Lock()
+	t.add(item)
+	t.mu.Unlock()
+}
+
+func (t *Tree) add(item Item) {
+
+	t.count++
+
+	if t.root == nil {
+		t.root = &node{item: item}
+		return
+	}
+
+	n := t.root
+	for {
+		d := simhash.Distance(item.Sig, n.item.Sig)
+		i := sort.Search(len(n.children), func(i int) bool { return n.children[i].dist >= d })
+		if i < len(n.children) && n.children[i].dist == d {
+			n = n.children[i].n
+			continue
+		}
+
+		n.children = append(n.children, child{})
+		copy(n.children[i+1:], n.children[i:])
+		n.children[i] = child{dist: d, n: &node{item: item}}
+		return
+	}
+}
+
+// Search searches the tree for the k nearest neighbours of target.  It
+// returns the up to k nearest neighbours and the corresponding distances in
+// order of least distance to largest distance, and then of ID.
+func (t *Tree) Search(target uint64, k int) (results []Item, distances []float64) {
+	return t.SearchApprox(target, k, 0)
+}
+
+// SearchApprox is Search, visiting at most maxNodes nodes of the tree, or all
+// of them if maxNodes < 1.  The children nearest the target are visited
+// first, so a small budget returns items close to target quickly, though
+// some of the k nearest may be missed for others farther away.
+func (t *Tree) SearchApprox(target uint64, k int, maxNodes int) (results []Item, distances []float64) {
+	return t.SearchWithin(target, k, maxHamming, maxNodes)
+}
+
+// SearchWithin is SearchApprox, returning only the items within maxDist of
+// target, so there may be fewer than k
+func (t *Tree) SearchWithin(target uint64, k int, maxDist float64, maxNodes int) (results []Item, distances []float64) {
+	if k < 1 || maxDist < 0 {
+		return
+	}
+
+	s := searcher{
+		target: target,
+		k:      k,
+		tau:    int(maxDist),
+		budget: maxNodes,
+	}
+	if s.tau > maxHamming {
+		s.tau = maxHamming
+	}
+	if s.budget < 1 {
+		// never reaches 0
+		s.budget = -1
+	}
+
+	t.mu.RLock()
+	s.search(t.root)
+	t.mu.RUnlock()
+
+	results = make([]Item, len(s.h))
+	distances = make([]float64, len(s.h))
+	for i := len(s.h) - 1; i >= 0; i-- {
+		hi := heap.Pop(&s.h).(heapItem)
+		results[i], distances[i] = hi.item, float64(hi.dist)
+	}
+
+	return results, distances
+}
+
+// InRange returns every item within maxDistance of sig, in order of least
+// distance to largest, and then of ID
+func (t *Tree) InRange(sig uint64, maxDistance float64) []Item {
+	results, _ := t.SearchWithin(sig, math.MaxInt, maxDistance, 0)
+	return results
+}
+
+// searcher holds the state of a search for the k nearest items to target
+type searcher struct {
+	target uint64
+	k      int
+
+	// tau is the distance of the farthest item which can still be one of
+	// the k nearest
+	tau int
+
+	// budget is the number of nodes left to visit
+	budget int
+
+	// h holds the nearest items found, the farthest at the top
+	h pq
+}
+
+func (s *searcher) search(n *node) {
+	if n == nil || s.budget == 0 {
+		return
+	}
+	s.budget--
+
+	d := simhash.Distance(n.item.Sig, s.target)
+
+	if d < s.tau || d == s.tau && (len(s.h) < s.k || n.item.ID < s.h[0].item.ID) {
+		if len(s.h) == s.k {
+			heap.Pop(&s.h)
+		}
+		heap.Push(&s.h, heapItem{n.item, d})
+		if len(s.h) == s.k {
+			s.tau = s.h[0].dist
+		}
+	}
+
+	// the items under the child at distance c from n are within tau of
+	// the target only if |c-d| <= tau, so visit the children outward from
+	// d, the nearest first, until they're too far
+	ch := n.children
+	j := sort.Search(len(ch), func(i int) bool { return ch[i].dist >= d })
+	i := j - 1
+	for {
+		var c child
+		switch {
+		case i >= 0 && (j == len(ch) || d-ch[i].dist <= ch[j].dist-d):
+			c = ch[i]
+			i--
+		case j < len(ch):
+			c = ch[j]
+			j++
+		default:
+			return
+		}
+
+		if c.dist-d > s.tau || d-c.dist > s.tau {
+			return
+		}
+		s.search(c.n)
+	}
+}
+
+type heapItem struct {
+	item Item
+	dist int
+}
+
+// pq is a max-heap of items by distance and then ID
+type pq []heapItem
+
+func (q pq) Len() int { return len(q) }
+
+func (q pq) Less(i, j int) bool {
+	if q[i].dist != q[j].dist {
+		return q[i].dist > q[j].dist
+	}
+	return q[i].item.ID > q[j].item.ID
+}
+
+func (q pq) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *pq) Push(x interface{}) { *q = append(*q, x.(heapItem)) }
+
+func (q *pq) Pop() interface{} {
+	old := *q
+	x := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,157 @@
+package bktree
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/dgryski/go-simstore/simhash"
+)
+
+// nearest returns the items within maxDist of target, nearest first and then
+// by ID, and their distances, found by a linear scan
+func nearest(target uint64, items []Item, k int, maxDist int) ([]Item, []float64) {
+
+	var found []Item
+	for _, item := range items {
+		if simhash.Distance(item.Sig, target) <= maxDist {
+			found = append(found, item)
+		}
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		di, dj := simhash.Distance(found[i].Sig, target), simhash.Distance(found[j].Sig, target)
+		return di < dj || di == dj && found[i].ID < found[j].ID
+	})
+
+	if len(found) > k {
+		found = found[:k]
+	}
+
+	dists := make([]float64, len(found))
+	for i, item := range found {
+		dists[i] = float64(simhash.Distance(item.Sig, target))
+	}
+	return found, dists
+}
+
+func randomItems(n int) []Item {
+	var items []Item
+	for i := 0; i < n; i++ {
+		items = append(items, Item{Sig: uint64(rand.Int63()), ID: uint64(i)})
+	}
+	return items
+}
+
+func TestEmpty(t *testing.T) {
+	tree := New(nil)
+	if results, distances := tree.Search(0, 3); len(results) != 0 || len(distances) != 0 || tree.Len() != 0 {
+		t.Errorf("empty tree: Search=%v %v, Len()=%d", results, distances, tree.Len())
+	}
+}
+
+func TestSearch(t *testing.T) {
+
+	items := randomItems(1000)
+
+	// the same signature for several documents, and near ones
+	for i := 0; i < 10; i++ {
+		items = append(items, Item{Sig: 0xcafebabe ^ uint64(i&3), ID: uint64(1000 + i)})
+	}
+
+	tree := New(items[:500])
+	for _, item := range items[500:] {
+		tree.Add(item)
+	}
+	if tree.Len() != len(items) {
+		t.Errorf("Len()=%d, want %d", tree.Len(), len(items))
+	}
+
+	targets := []uint64{0xcafebabe}
+	for i := 0; i < 20; i++ {
+		targets = append(targets, uint64(rand.Int63()))
+	}
+
+	for _, target := range targets {
+		for _, k := range []int{1, 5, 10, 100} {
+			want, wantDists := nearest(target, items, k, 64)
+			got, dists := tree.Search(target, k)
+			if !reflect.DeepEqual(got, want) || !reflect.DeepEqual(dists, wantDists) {
+				t.Errorf("Search(%x, %d)=%v %v, want %v %v", target, k, got, dists, want, wantDists)
+			}
+
+			want, wantDists = nearest(target, items, k, 20)
+			got, dists = tree.SearchWithin(target, k, 20, 0)
+			if len(got) != len(want) || len(want) > 0 && (!reflect.DeepEqual(got, want) || !reflect.DeepEqual(dists, wantDists)) {
+				t.Errorf("SearchWithin(%x, %d, 20)=%v %v, want %v %v", target, k, got, dists, want, wantDists)
+			}
+		}
+
+		want, _ := nearest(target, items, len(items), 24)
+		if got := tree.InRange(target, 24); len(got) != len(want) || len(want) > 0 && !reflect.DeepEqual(got, want) {
+			t.Errorf("InRange(%x, 24)=%v, want %v", target, got, want)
+		}
+	}
+}
+
+func TestSearchApprox(t *testing.T) {
+
+	items := randomItems(1000)
+	tree := New(items)
+
+	for i := 0; i < 20; i++ {
+		target := uint64(rand.Int63())
+		_, wantDists := nearest(target, items, 10, 64)
+
+		for _, maxNodes := range []int{1, 10, 100} {
+			got, dists := tree.SearchApprox(target, 10, maxNodes)
+
+			want := 10
+			if maxNodes < want {
+				want = maxNodes
+			}
+			if len(got) != want {
+				t.Fatalf("SearchApprox(%d) returned %d items, want %d", maxNodes, len(got), want)
+			}
+
+			// the i-th nearest found is never nearer than the true i-th
+			for j := range got {
+				if d := float64(simhash.Distance(got[j].Sig, target)); d != dists[j] || d < wantDists[j] || j > 0 && d < dists[j-1] {
+					t.Errorf("SearchApprox(%d)[%d]: distance %v (reported %v), true %d-th nearest %v", maxNodes, j, d, dists[j], j, wantDists[j])
+				}
+			}
+		}
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+
+	items := randomItems(2000)
+	tree := New(items[:1000])
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for _, item := range items[1000:] {
+			tree.Add(item)
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				tree.Search(uint64(rand.Int63()), 10)
+			}
+		}()
+	}
+	wg.Wait()
+
+	target := uint64(rand.Int63())
+	want, wantDists := nearest(target, items, 10, 64)
+	if got, dists := tree.Search(target, 10); !reflect.DeepEqual(got, want) || !reflect.DeepEqual(dists, wantDists) {
+		t.Errorf("Search after concurrent Adds=%v %v, want %v %v", got, dists, want, wantDists)
+	}
+}
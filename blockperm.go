@@ -0,0 +1,248 @@
+package simstore
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// maxBlockTables bounds the number of tables of a store created by New
+const maxBlockTables = 1024
+
+// maxBlocks bounds the number of blocks a blockPerm splits a signature into,
+// keeping them at least 4 bits wide
+const maxBlocks = 16
+
+// New returns a Store for searching hamming distance <= maxDistance, which
+// must be between 1 and 8.  The permutations of its tables are generated by
+// blockPerm rather than being the hand-written ones used by New3 and New6,
+// with 2 prefix blocks unless the PrefixBlocks, PrefixBits or MaxTables option
+// chooses another number.  The tables are created with newStore.
+func New(maxDistance int, hashes int, newStore StorageFactory, opts ...Option) (*Store, error) {
+
+	prefix, err := prefixBlocks(maxDistance, optionsOf(opts))
+	if err != nil {
+		return nil, err
+	}
+
+	s := Store{}
+	s.init(hashes, newBlockPerm(maxDistance, prefix), newStore, opts)
+	return &s, nil
+}
+
+// PrefixBlocks makes New split signatures into maxDistance+k blocks and create
+// a table for each choice of k of them as its prefix, instead of 2.  More
+// prefix blocks make longer prefixes, so each search scans far fewer entries
+// of each table, but need more tables, and so more memory and probes:
+//
+//	distance  k=1          k=2           k=3           k=4
+//	3         4 × 16 bits  10 × 25 bits  20 × 31 bits  35 × 36 bits
+//	6         7 × 9 bits   28 × 16 bits  84 × 21 bits  210 × 24 bits
+//
+// The widths are those of the shortest prefixes; the blocks differ in width
+// by at most a bit.
+func PrefixBlocks(k int) Option {
+	return func(s *Store) { s.prefixBlocks = k }
+}
+
+// PrefixBits makes New choose the fewest prefix blocks for which every table
+// has a prefix of at least n bits, so a search of a skewed corpus, whose
+// signatures crowd into some prefixes, scans runs no longer than the prefix
+// width allows.  New3 takes it too, and keeps its 16 tables of 28-bit prefixes
+// unless a blockPerm needs fewer tables for n bits or n is more than 28, when
+// it uses the blockPerm New would, up to its longest prefixes.  PrefixBlocks
+// overrides it, and it overrides MaxTables.
+func PrefixBits(n int) Option {
+	return func(s *Store) { s.prefixBits = n }
+}
+
+// MaxTables makes New choose the most prefix blocks for which the store has at
+// most n tables, which gives the shortest scans that number of tables can
+// buy.  PrefixBlocks overrides it.
+func MaxTables(n int) Option {
+	return func(s *Store) { s.maxTables = n }
+}
+
+// optionsOf returns a Store with only opts applied, for the functions which
+// need to know the options before creating a store
+func optionsOf(opts []Option) *Store {
+	var s Store
+	for _, o := range opts {
+		o(&s)
+	}
+	return &s
+}
+
+// prefixBlocks returns the number of prefix blocks of the blockPerm New
+// creates for maxDistance with the options of o
+func prefixBlocks(maxDistance int, o *Store) (int, error) {
+
+	if maxDistance < 1 || maxDistance > 8 {
+		return 0, errors.New("simstore: distance must be between 1 and 8")
+	}
+
+	return choosePrefixBlocks(maxDistance, 64, o)
+}
+
+// choosePrefixBlocks returns the number of prefix blocks for maxDistance with
+// the options of o, for signatures of width bits, each word of which is split
+// into at most maxBlocks blocks
+func choosePrefixBlocks(maxDistance, width int, o *Store) (int, error) {
+
+	blocks := maxBlocks * width / 64
+
+	prefix := o.prefixBlocks
+	switch {
+	case prefix > 0:
+	case o.prefixBits > 0:
+		prefix = 1
+		for prefixBlockBits(width, maxDistance, prefix) < o.prefixBits {
+			prefix++
+			if !validBlocks(maxDistance, prefix, blocks) {
+				return 0, fmt.Errorf("simstore: can't make prefixes of %d bits for distance %d", o.prefixBits, maxDistance)
+			}
+		}
+	case o.maxTables > 0:
+		if blockTables(maxDistance, 1) > o.maxTables {
+			return 0, fmt.Errorf("simstore: distance %d needs at least %d tables", maxDistance, blockTables(maxDistance, 1))
+		}
+		prefix = 1
+		for validBlocks(maxDistance, prefix+1, blocks) && blockTables(maxDistance, prefix+1) <= o.maxTables {
+			prefix++
+		}
+	default:
+		prefix = 2
+	}
+
+	if !validBlocks(maxDistance, prefix, blocks) {
+		return 0, fmt.Errorf("simstore: can't split signatures into %d prefix blocks for distance %d", prefix, maxDistance)
+	}
+
+	return prefix, nil
+}
+
+// validBlocks reports whether a signature can be split into prefix blocks for
+// distance: no more than blocks blocks and maxBlockTables tables
+func validBlocks(distance, prefix, blocks int) bool {
+	return prefix >= 1 && distance+prefix <= blocks && blockTables(distance, prefix) <= maxBlockTables
+}
+
+// prefixBlockBits returns the width of the shortest prefix of prefix blocks of
+// a signature of width bits split into distance+prefix blocks, the first of
+// which are a bit wider than the rest
+func prefixBlockBits(width, distance, prefix int) int {
+	n := distance + prefix
+	narrow := n - width%n
+	return prefix*(width/n) + max(0, prefix-narrow)
+}
+
+// blockTables returns the number of tables of a blockPerm, the number of ways
+// to choose prefix of its distance+prefix blocks
+func blockTables(distance, prefix int) int {
+	n := 1
+	for i := 1; i <= prefix; i++ {
+		n = n * (distance + i) / i
+	}
+	return n
+}
+
+// blockPerm splits a signature into distance+prefix blocks of nearly equal
+// width, and has one table for each choice of prefix blocks, which are moved
+// to the top bits in that table.  A signature within the search distance of a
+// query differs from it in at most distance blocks, so it matches the query
+// exactly in all the blocks of at least one choice.
+//
+// With 2 prefix blocks, distance 3 needs 10 tables with prefixes of 25 or 26
+// bits, and distance 8 needs 45 tables with prefixes of 12 to 14 bits.  In
+// general there are C(distance+prefix, prefix) tables with prefixes of about
+// 64*prefix/(distance+prefix) bits.
+type blockPerm struct {
+	distance int
+	prefix   int
+	orders   []blockOrder
+}
+
+// blockOrder is the arrangement of the blocks of a signature in one table
+type blockOrder struct {
+	moves []blockMove
+	mask  uint64
+}
+
+// blockMove moves the bits of one block from one shift to another
+type blockMove struct {
+	bits     uint64
+	from, to uint
+}
+
+func newBlockPerm(distance, prefix int) *blockPerm {
+
+	n := distance + prefix
+
+	// the widths and shifts of the blocks, from the top of the signature
+	widths := make([]uint, n)
+	shifts := make([]uint, n)
+	top := uint(64)
+	for i := range widths {
+		widths[i] = 64 / uint(n)
+		if i < 64%n {
+			widths[i]++
+		}
+		top -= widths[i]
+		shifts[i] = top
+	}
+
+	p := &blockPerm{distance: distance, prefix: prefix}
+
+	// each combination of prefix blocks, as a bitmask of block indexes
+	for c := uint(0); c < 1<<uint(n); c++ {
+		if bits.OnesCount(c) != prefix {
+			continue
+		}
+
+		var o blockOrder
+		to := uint(64)
+
+		place := func(i int) {
+			to -= widths[i]
+			o.moves = append(o.moves, blockMove{bits: 1<<widths[i] - 1, from: shifts[i], to: to})
+		}
+
+		for i := 0; i < n; i++ {
+			if c&(1<<uint(i)) != 0 {
+				place(i)
+			}
+		}
+
+		o.mask = ^uint64(0) << to
+
+		for i := 0; i < n; i++ {
+			if c&(1<<uint(i)) == 0 {
+				place(i)
+			}
+		}
+
+		p.orders = append(p.orders, o)
+	}
+
+	return p
+}
+
+func (p *blockPerm) tables() int      { return len(p.orders) }
+func (p *blockPerm) maxDistance() int { return p.distance }
+
+func (p *blockPerm) shuffle(sig uint64, t int) (uint64, uint64) {
+	o := &p.orders[t]
+	var r uint64
+	for _, m := range o.moves {
+		r |= (sig >> m.from & m.bits) << m.to
+	}
+	return r, o.mask
+}
+
+func (p *blockPerm) unshuffle(sig uint64, t int) uint64 {
+	var r uint64
+	for _, m := range p.orders[t].moves {
+		r |= (sig >> m.to & m.bits) << m.from
+	}
+	return r
+}
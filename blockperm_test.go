@@ -0,0 +1,245 @@
+package simstore
+
+import (
+	"bytes"
+	"math/bits"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"testing/quick"
+)
+
+func TestBlockPerm(t *testing.T) {
+
+	r := rand.New(rand.NewSource(0))
+
+	for d := 1; d <= 8; d++ {
+		if want := (d + 2) * (d + 1) / 2; newBlockPerm(d, 2).tables() != want {
+			t.Errorf("d=%d: %d tables, want %d", d, newBlockPerm(d, 2).tables(), want)
+		}
+	}
+
+	for _, tt := range []struct{ d, k int }{{1, 2}, {2, 2}, {3, 1}, {3, 2}, {3, 4}, {4, 3}, {5, 2}, {6, 3}, {7, 2}, {8, 2}} {
+		d := tt.d
+		p := newBlockPerm(d, tt.k)
+
+		if want := blockTables(d, tt.k); p.tables() != want {
+			t.Errorf("d=%d, k=%d: %d tables, want %d", d, tt.k, p.tables(), want)
+		}
+
+		f := func(sig uint64) bool {
+			for i := 0; i < p.tables(); i++ {
+				if s, _ := p.shuffle(sig, i); p.unshuffle(s, i) != sig {
+					t.Errorf("d=%d: unshuffle(shuffle(%016x, %d)) != %016x", d, sig, i, sig)
+					return false
+				}
+			}
+			return true
+		}
+		quick.Check(f, nil)
+
+		// every signature within d bits shares a prefix with the query in
+		// at least one table
+		for i := 0; i < 10000; i++ {
+			sig := uint64(r.Int63())
+			q := sig
+			for _, b := range r.Perm(64)[:d] {
+				q ^= 1 << uint(b)
+			}
+
+			found := false
+			for t := 0; t < p.tables() && !found; t++ {
+				ps, mask := p.shuffle(sig, t)
+				pq, _ := p.shuffle(q, t)
+				found = ps&mask == pq&mask
+			}
+
+			if !found {
+				t.Fatalf("d=%d: no table has a matching prefix for %016x and %016x", d, sig, q)
+			}
+		}
+	}
+}
+
+func TestPrefixBlocks(t *testing.T) {
+
+	for _, tt := range []struct {
+		d      int
+		opts   []Option
+		tables int
+	}{
+		{4, nil, 15},
+		{4, []Option{PrefixBlocks(3)}, 35},
+		{6, []Option{MaxTables(30)}, 28},
+		{6, []Option{MaxTables(100)}, 84},
+		{3, []Option{MaxTables(4)}, 4},
+		{6, []Option{MaxTables(100), PrefixBlocks(1)}, 7},
+	} {
+		s, err := New(tt.d, 0, NewU64Slice, tt.opts...)
+		if err != nil {
+			t.Errorf("New(%d): %v", tt.d, err)
+			continue
+		}
+		if got := len(s.rhashes); got != tt.tables {
+			t.Errorf("New(%d) with %d options: %d tables, want %d", tt.d, len(tt.opts), got, tt.tables)
+		}
+	}
+
+	for _, opts := range []Option{MaxTables(6), PrefixBlocks(9)} {
+		if _, err := New(6, 0, NewU64Slice, opts); err == nil {
+			o := optionsOf([]Option{opts})
+			t.Errorf("New(6) with PrefixBlocks(%d) MaxTables(%d) didn't fail", o.prefixBlocks, o.maxTables)
+		}
+	}
+
+	s, err := New(6, 64, NewU64Slice, PrefixBlocks(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyBanding(t, "New(6, PrefixBlocks(3))", s, 6)
+
+	// the snapshot header records the prefix blocks
+	var buf bytes.Buffer
+	if _, err := s.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadFrom(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(read.rhashes); got != 84 {
+		t.Errorf("ReadFrom: %d tables, want 84", got)
+	}
+}
+
+func TestPrefixBits(t *testing.T) {
+
+	for _, tt := range []struct {
+		d, bits int
+		tables  int
+	}{
+		{3, 16, 4},
+		{3, 20, 10},
+		{3, 31, 20},
+		{6, 16, 28},
+		{6, 17, 84},
+		{8, 20, 495},
+	} {
+		s, err := New(tt.d, 0, NewU64Slice, PrefixBits(tt.bits), MaxTables(1000))
+		if err != nil {
+			t.Errorf("New(%d) with PrefixBits(%d): %v", tt.d, tt.bits, err)
+			continue
+		}
+		if got := len(s.rhashes); got != tt.tables {
+			t.Errorf("New(%d) with PrefixBits(%d): %d tables, want %d", tt.d, tt.bits, got, tt.tables)
+		}
+		for i := range s.rhashes {
+			if _, mask := s.perm.shuffle(0, i); bits.OnesCount64(mask) < tt.bits {
+				t.Errorf("New(%d) with PrefixBits(%d): table %d has a prefix of %d bits", tt.d, tt.bits, i, bits.OnesCount64(mask))
+			}
+		}
+	}
+
+	if _, err := New(6, 0, NewU64Slice, PrefixBits(40)); err == nil {
+		t.Errorf("New(6) with PrefixBits(40) didn't fail")
+	}
+
+	// New3 keeps its own tables where they're the fewest
+	for _, tt := range []struct {
+		bits, tables, prefix int
+	}{
+		{0, 16, 28},
+		{20, 10, 25},
+		{28, 16, 28},
+		{29, 20, 31},
+		{60, 560, 52},
+	} {
+		s := New3(0, NewU64Slice, PrefixBits(tt.bits))
+
+		shortest := 64
+		for i := range s.rhashes {
+			_, mask := s.perm.shuffle(0, i)
+			shortest = min(shortest, bits.OnesCount64(mask))
+		}
+		if got := len(s.rhashes); got != tt.tables || shortest != tt.prefix {
+			t.Errorf("New3 with PrefixBits(%d): %d tables with prefixes of at least %d bits, want %d of %d", tt.bits, got, shortest, tt.tables, tt.prefix)
+		}
+	}
+
+	s := New3(64, NewU64Slice, PrefixBits(36))
+	verifyBanding(t, "New3(PrefixBits(36))", s, 3)
+}
+
+func TestNew(t *testing.T) {
+
+	for _, d := range []int{0, 9} {
+		if _, err := New(d, 10, NewU64Slice); err == nil {
+			t.Errorf("New(%d) didn't fail", d)
+		}
+	}
+
+	s, err := New(4, 64, NewU64Slice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyBanding(t, "New(4)", s, 4)
+
+	// compare against a linear scan
+	r := rand.New(rand.NewSource(0))
+
+	s, _ = New(5, 5000, NewU64Slice)
+	sigs := make([]uint64, 5000)
+	for i := range sigs {
+		sigs[i] = uint64(r.Int63())
+		if i%2 == 1 {
+			// near duplicates of the previous signature
+			sigs[i] = sigs[i-1]
+			for j := r.Intn(8); j > 0; j-- {
+				sigs[i] ^= 1 << uint(r.Intn(64))
+			}
+		}
+		s.Add(sigs[i], uint64(i))
+	}
+	s.Finish()
+
+	for i := 0; i < 500; i++ {
+		q := sigs[r.Intn(len(sigs))]
+
+		var want []uint64
+		for id, sig := range sigs {
+			if distance(sig, q) <= 5 {
+				want = append(want, uint64(id))
+			}
+		}
+		sort.Sort(u64slice(want))
+
+		if got := s.Find(q); !reflect.DeepEqual(got, want) {
+			t.Errorf("Find(%016x)=%v, want %v", q, got, want)
+		}
+	}
+
+	// snapshots keep the generated permutations
+	var buf bytes.Buffer
+	s.WriteTo(&buf)
+
+	path := filepath.Join(t.TempDir(), "store.snap")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mapped, err := OpenMmap(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mapped.Close()
+
+	for i := 0; i < 100; i++ {
+		q := sigs[r.Intn(len(sigs))]
+		if got, want := mapped.Find(q), s.Find(q); !reflect.DeepEqual(got, want) {
+			t.Errorf("mapped Find(%016x)=%v, want %v", q, got, want)
+		}
+	}
+}
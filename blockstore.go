@@ -0,0 +1,220 @@
+package simstore
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sort"
+	"sync"
+)
+
+// blockStoreSize is the number of hashes in each block of a blockStore
+const blockStoreSize = 256
+
+// BlockCodec compresses the blocks of the tables of NewBlockStore.  It must be
+// safe for concurrent use, as Finish compresses the tables of a store in
+// parallel.  The zstd and s2 encoders and decoders of
+// github.com/klauspost/compress fit it with a few lines of wrapping.
+type BlockCodec interface {
+	// Encode appends the compressed form of src to dst
+	Encode(dst, src []byte) []byte
+
+	// Decode appends the block src, compressed by Encode, to dst
+	Decode(dst, src []byte) ([]byte, error)
+}
+
+// blockStore keeps its sorted hashes in blocks of blockStoreSize, each
+// compressed by a BlockCodec.  The first hash of each block is kept in an
+// index for the binary search, and a search decompresses only the blocks
+// holding its prefix run.  Within a block the hashes are stored as the
+// differences from the hash before, split into planes of their bytes from the
+// most significant, so the high bytes which are zero in every difference make
+// long runs for the codec.
+type blockStore struct {
+	codec BlockCodec
+	u     u64slice // the hashes, until Finish
+	first []uint64 // first hash of each block
+	offs  []int    // offset of each compressed block in b, followed by len(b)
+	b     []byte
+	n     int
+}
+
+// NewBlockStore returns a StorageFactory for U64Stores which keep their sorted
+// hashes in blocks compressed independently by codec.  A general purpose
+// codec compresses less than NewZStore's Huffman coding of the shared prefix
+// lengths, but a fast one such as zstd or s2 decompresses a block faster.
+func NewBlockStore(codec BlockCodec) StorageFactory {
+	return func(hashes int) U64Store {
+		return &blockStore{codec: codec, u: make(u64slice, 0, hashes)}
+	}
+}
+
+func (z *blockStore) Add(p uint64) {
+	z.u = append(z.u, p)
+}
+
+func (z *blockStore) Finish() {
+	z.u.Finish()
+
+	z.n = len(z.u)
+	blocks := (z.n + blockStoreSize - 1) / blockStoreSize
+	z.first = make([]uint64, 0, blocks)
+	z.offs = make([]int, 0, blocks+1)
+
+	raw := make([]byte, 0, 8*blockStoreSize)
+	for i := 0; i < z.n; i += blockStoreSize {
+		block := z.u[i:min(i+blockStoreSize, z.n)]
+
+		z.first = append(z.first, block[0])
+		z.offs = append(z.offs, len(z.b))
+
+		// byte p of delta j is at raw[p*deltas+j]
+		deltas := len(block) - 1
+		raw = raw[:8*deltas]
+		for j := 0; j < deltas; j++ {
+			delta := block[j+1] - block[j]
+			for p := 0; p < 8; p++ {
+				raw[p*deltas+j] = byte(delta >> uint(56-8*p))
+			}
+		}
+		z.b = z.codec.Encode(z.b, raw)
+	}
+	z.offs = append(z.offs, len(z.b))
+
+	// drop the spare capacity of the encoding
+	z.b = append([]byte(nil), z.b...)
+	z.u = nil
+}
+
+// blockBuffers holds the buffers blocks are decompressed into
+var blockBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 8*blockStoreSize)
+		return &b
+	},
+}
+
+func (z *blockStore) Find(sig, mask uint64, d int) []uint64 {
+	ids, _ := z.FindScanned(sig, mask, d)
+	return ids
+}
+
+func (z *blockStore) FindScanned(sig, mask uint64, d int) ([]uint64, int) {
+	return z.findScanned(sig, mask, d, false)
+}
+
+// findScanned is FindScanned, but finds the first block of the prefix run
+// with interpolation search if interpolate is set
+func (z *blockStore) findScanned(sig, mask uint64, d int, interpolate bool) ([]uint64, int) {
+
+	prefix := sig & mask
+
+	// the prefix run may start in the block before the first block whose
+	// first hash is in it
+	var block int
+	if interpolate {
+		block = interpolationSearch(z.first, prefix)
+	} else {
+		block = sort.Search(len(z.first), func(i int) bool { return z.first[i] >= prefix })
+	}
+	if block > 0 {
+		block--
+	}
+
+	buf := blockBuffers.Get().(*[]byte)
+	defer blockBuffers.Put(buf)
+
+	var ids []uint64
+	var scanned int
+
+	for ; block < len(z.first); block++ {
+		raw, err := z.codec.Decode((*buf)[:0], z.b[z.offs[block]:z.offs[block+1]])
+		if err != nil {
+			// the blocks were compressed by Finish, so they can't be
+			// corrupt unless the codec is broken
+			panic("simstore: can't decompress a table block: " + err.Error())
+		}
+		*buf = raw
+
+		deltas := len(raw) / 8
+
+		h := z.first[block]
+		for j := -1; j < deltas; j++ {
+			if j >= 0 {
+				var delta uint64
+				for p := 0; p < 8; p++ {
+					delta = delta<<8 | uint64(raw[p*deltas+j])
+				}
+				h += delta
+			}
+
+			if h >= prefix {
+				if h&mask != prefix {
+					return ids, scanned
+				}
+
+				scanned++
+				if distance(h, sig) <= d {
+					ids = append(ids, h)
+				}
+			}
+		}
+	}
+
+	return ids, scanned
+}
+
+// FlateCodec returns a BlockCodec compressing with compress/flate at level, from
+// flate.BestSpeed to flate.BestCompression
+func FlateCodec(level int) (BlockCodec, error) {
+	w, err := flate.NewWriter(nil, level)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &flateCodec{}
+	c.writers.New = func() interface{} {
+		w, _ := flate.NewWriter(nil, level)
+		return w
+	}
+	c.writers.Put(w)
+
+	return c, nil
+}
+
+// flateCodec keeps pools of the large flate writers and readers
+type flateCodec struct {
+	writers sync.Pool
+	readers sync.Pool
+}
+
+func (c *flateCodec) Encode(dst, src []byte) []byte {
+	b := bytes.NewBuffer(dst)
+
+	w := c.writers.Get().(*flate.Writer)
+	w.Reset(b)
+	w.Write(src)
+	w.Close()
+	c.writers.Put(w)
+
+	return b.Bytes()
+}
+
+func (c *flateCodec) Decode(dst, src []byte) ([]byte, error) {
+	b := bytes.NewBuffer(dst)
+
+	var r io.ReadCloser
+	if pooled := c.readers.Get(); pooled != nil {
+		r = pooled.(io.ReadCloser)
+		r.(flate.Resetter).Reset(bytes.NewReader(src), nil)
+	} else {
+		r = flate.NewReader(bytes.NewReader(src))
+	}
+	defer c.readers.Put(r)
+
+	if _, err := b.ReadFrom(r); err != nil {
+		return dst, err
+	}
+
+	return b.Bytes(), nil
+}
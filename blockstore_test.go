@@ -0,0 +1,95 @@
+package simstore
+
+import (
+	"compress/flate"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestBlockStore(t *testing.T) {
+
+	r := rand.New(rand.NewSource(0))
+
+	// enough hashes for several blocks, with runs sharing a prefix crossing
+	// block boundaries, and repeated hashes
+	var hashes []uint64
+	for i := 0; i < 5000; i++ {
+		h := uint64(r.Int63())
+		hashes = append(hashes, h)
+		if i%7 == 0 {
+			hashes = append(hashes, h, h^1)
+		}
+	}
+
+	codec, err := FlateCodec(flate.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := NewU64Slice(len(hashes))
+	z := NewBlockStore(codec)(len(hashes))
+	for _, h := range hashes {
+		want.Add(h)
+		z.Add(h)
+	}
+	want.Finish()
+	z.Finish()
+
+	for _, mask := range []uint64{0xffff000000000000, 0xffffff0000000000, 0xfff0000000000000} {
+		for i := 0; i < 1000; i++ {
+			sig := hashes[r.Intn(len(hashes))] ^ uint64(r.Int63n(8))
+			if i%2 == 1 {
+				sig = uint64(r.Int63())
+			}
+
+			w, wscanned := want.(ScanCounter).FindScanned(sig, mask, 3)
+			got, scanned := z.(ScanCounter).FindScanned(sig, mask, 3)
+			if !reflect.DeepEqual(got, w) || scanned != wscanned {
+				t.Fatalf("FindScanned(%016x, %016x)=%x, %d, want %x, %d", sig, mask, got, scanned, w, wscanned)
+			}
+		}
+	}
+
+	if got := z.Find(hashes[0], 0, 64); len(got) != len(hashes) {
+		t.Errorf("Find with an empty prefix found %d hashes, want %d", len(got), len(hashes))
+	}
+
+	if got, w := z.(sizer).memoryBytes(), want.(sizer).memoryBytes(); got >= w {
+		t.Errorf("memoryBytes=%d, want less than the %d of a U64Slice", got, w)
+	}
+
+	empty := NewBlockStore(codec)(0)
+	empty.Finish()
+	if got := empty.Find(0, 0xffff000000000000, 3); got != nil {
+		t.Errorf("empty Find=%x, want nil", got)
+	}
+
+	if _, err := FlateCodec(42); err == nil {
+		t.Errorf("FlateCodec(42) didn't fail")
+	}
+}
+
+func TestBlockStoreSearch(t *testing.T) {
+
+	sigs := benchSignatures()[:20000]
+
+	codec, _ := FlateCodec(flate.DefaultCompression)
+
+	want := New6(len(sigs), NewU64Slice)
+	s := New6(len(sigs), NewBlockStore(codec))
+	for i, sig := range sigs {
+		want.Add(sig, uint64(i))
+		s.Add(sig, uint64(i))
+	}
+	want.Finish()
+	s.Finish()
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		q := sigs[r.Intn(len(sigs))] ^ (1 << uint(r.Intn(64))) ^ (1 << uint(r.Intn(64)))
+		if got, w := s.Find(q), want.Find(q); !reflect.DeepEqual(got, w) {
+			t.Fatalf("Find(%016x)=%v, want %v", q, got, w)
+		}
+	}
+}
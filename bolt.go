@@ -0,0 +1,331 @@
+//go:build bolt
+
+package simstore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltStore is a Storage kept in a bbolt database on disk, for stores too
+// large to fit in memory.  It is only built with the bolt build tag:
+//
+//	go get go.etcd.io/bbolt
+//	go build -tags bolt
+//
+// Each permuted table is a bucket whose keys are the permuted signature
+// followed by the docid, both big-endian, so the entries sharing a table's
+// prefix are adjacent and a search reads only the pages holding them.  Memory
+// use is bounded by the operating system's page cache rather than the size of
+// the store, at the cost of a disk read for every probe which misses it.
+//
+// Signatures added before Finish are written in batches; after Finish, each
+// Add is its own transaction.  The first error writing to the database is
+// returned by Err, and searches return no results once it is set.
+type BoltStore struct {
+	db   *bolt.DB
+	perm permutation
+
+	// mu guards the batch and the error
+	mu    sync.Mutex
+	batch table
+	err   error
+
+	finished bool
+}
+
+// boltBatchSize is the number of entries written per transaction while a
+// BoltStore is being built
+const boltBatchSize = 1 << 16
+
+var (
+	boltMeta   = []byte("meta")
+	boltDocIDs = []byte("docids")
+)
+
+// NewBolt opens the bbolt database at path as a store for searching hamming
+// distance <= maxDistance, creating it if it doesn't exist.  An existing
+// database must have been created for the same distance, and is ready to be
+// searched without calling Finish.
+func NewBolt(path string, maxDistance int) (*BoltStore, error) {
+
+	var perm permutation
+	switch maxDistance {
+	case 3:
+		perm = perm3{}
+	case 6:
+		perm = perm6{}
+	default:
+		if maxDistance < 1 || maxDistance > 8 {
+			return nil, fmt.Errorf("simstore: unsupported distance %d", maxDistance)
+		}
+		perm = newBlockPerm(maxDistance, 2)
+	}
+
+	db, err := bolt.Open(path, 0644, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &BoltStore{db: db, perm: perm}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(boltMeta)
+		if err != nil {
+			return err
+		}
+
+		if d := meta.Get([]byte("distance")); d != nil {
+			if string(d) != strconv.Itoa(maxDistance) {
+				return fmt.Errorf("simstore: %s is a store for distance %s, not %d", path, d, maxDistance)
+			}
+			s.finished = true
+		} else if err := meta.Put([]byte("distance"), []byte(strconv.Itoa(maxDistance))); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists(boltDocIDs); err != nil {
+			return err
+		}
+
+		for t := 0; t < perm.tables(); t++ {
+			if _, err := tx.CreateBucketIfNotExists(boltTable(t)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func boltTable(t int) []byte {
+	return []byte("t" + strconv.Itoa(t))
+}
+
+// boltKey returns the key of (hash, docid): the two big-endian words
+func boltKey(hash, docid uint64) []byte {
+	k := make([]byte, 16)
+	binary.BigEndian.PutUint64(k, hash)
+	binary.BigEndian.PutUint64(k[8:], docid)
+	return k
+}
+
+// Add inserts a signature and document id into the store.  After Finish, Add
+// may be called concurrently with searches.
+func (s *BoltStore) Add(sig, docid uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.finished {
+		s.write(table{{hash: sig, docid: docid}})
+		return
+	}
+
+	s.batch = append(s.batch, entry{hash: sig, docid: docid})
+	if len(s.batch) >= boltBatchSize {
+		s.flush()
+	}
+}
+
+// Finish writes the remaining signatures to the database.  The store can be
+// searched once Finish returns.
+func (s *BoltStore) Finish() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.flush()
+	s.finished = true
+}
+
+// flush writes the batch.  The caller must hold the lock.
+func (s *BoltStore) flush() {
+	if len(s.batch) == 0 {
+		return
+	}
+
+	// the keys of each bucket are inserted in order
+	sort.Sort(s.batch)
+	s.write(s.batch)
+	s.batch = s.batch[:0]
+}
+
+// write adds the entries to the database in one transaction.  The caller must
+// hold the lock.
+func (s *BoltStore) write(entries table) {
+	if s.err != nil {
+		return
+	}
+
+	s.err = s.db.Update(func(tx *bolt.Tx) error {
+		docids := tx.Bucket(boltDocIDs)
+		for _, e := range entries {
+			if err := docids.Put(boltKey(e.docid, e.hash), nil); err != nil {
+				return err
+			}
+		}
+
+		keys := make([][]byte, len(entries))
+		for t := 0; t < s.perm.tables(); t++ {
+			for i, e := range entries {
+				p, _ := s.perm.shuffle(e.hash, t)
+				keys[i] = boltKey(p, e.docid)
+			}
+			sort.Slice(keys, func(i, j int) bool { return string(keys[i]) < string(keys[j]) })
+
+			b := tx.Bucket(boltTable(t))
+			for _, k := range keys {
+				if err := b.Put(k, nil); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// Find searches the store for all hashes within the store's distance of the
+// query signature.  It returns the associated list of document ids in
+// ascending order.
+func (s *BoltStore) Find(sig uint64) []uint64 {
+
+	if s.Err() != nil {
+		return nil
+	}
+
+	d := s.perm.maxDistance()
+
+	var ids []uint64
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		for t := 0; t < s.perm.tables(); t++ {
+			p, mask := s.perm.shuffle(sig, t)
+			prefix := p & mask
+
+			c := tx.Bucket(boltTable(t)).Cursor()
+			for k, _ := c.Seek(boltKey(prefix, 0)); k != nil; k, _ = c.Next() {
+				h := binary.BigEndian.Uint64(k)
+				if h&mask != prefix {
+					break
+				}
+				if distance(h, p) <= d {
+					ids = append(ids, binary.BigEndian.Uint64(k[8:]))
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil
+	}
+
+	ids = unique(ids)
+
+	return ids
+}
+
+// Delete removes all the signatures added with docid from the store.  Unlike
+// the in-memory stores, the entries are removed immediately.
+func (s *BoltStore) Delete(docid uint64) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.flush()
+
+	if s.err != nil {
+		return
+	}
+
+	s.err = s.db.Update(func(tx *bolt.Tx) error {
+		docids := tx.Bucket(boltDocIDs)
+
+		var sigs []uint64
+		c := docids.Cursor()
+		for k, _ := c.Seek(boltKey(docid, 0)); k != nil && binary.BigEndian.Uint64(k) == docid; k, _ = c.Next() {
+			sigs = append(sigs, binary.BigEndian.Uint64(k[8:]))
+		}
+
+		for _, sig := range sigs {
+			if err := docids.Delete(boltKey(docid, sig)); err != nil {
+				return err
+			}
+
+			for t := 0; t < s.perm.tables(); t++ {
+				p, _ := s.perm.shuffle(sig, t)
+				if err := tx.Bucket(boltTable(t)).Delete(boltKey(p, docid)); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// Stats returns the statistics of the store.  MemoryBytes is always 0, as the
+// tables are on disk, and DuplicateRatio and BuildTime aren't tracked.
+func (s *BoltStore) Stats() Stats {
+
+	st := Stats{Tables: make([]int, s.perm.tables())}
+
+	s.mu.Lock()
+	st.Pending = len(s.batch)
+	s.mu.Unlock()
+
+	s.db.View(func(tx *bolt.Tx) error {
+		st.Entries = tx.Bucket(boltDocIDs).Stats().KeyN + st.Pending
+		for t := range st.Tables {
+			st.Tables[t] = tx.Bucket(boltTable(t)).Stats().KeyN
+		}
+		return nil
+	})
+
+	return st
+}
+
+// Len returns the number of entries in the store, as in Stats, which walks
+// the pages of the document table
+func (s *BoltStore) Len() int {
+
+	s.mu.Lock()
+	n := len(s.batch)
+	s.mu.Unlock()
+
+	s.db.View(func(tx *bolt.Tx) error {
+		n += tx.Bucket(boltDocIDs).Stats().KeyN
+		return nil
+	})
+
+	return n
+}
+
+// Err returns the first error writing to the database, if any
+func (s *BoltStore) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Close writes any signatures not yet written and closes the database
+func (s *BoltStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.flush()
+	if err := s.db.Close(); err != nil {
+		return err
+	}
+	return s.err
+}
@@ -0,0 +1,83 @@
+//go:build bolt
+
+package simstore
+
+import (
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBoltStore(t *testing.T) {
+
+	r := rand.New(rand.NewSource(0))
+
+	for _, distance := range []int{3, 6} {
+		path := filepath.Join(t.TempDir(), "simstore.db")
+
+		b, err := NewBolt(path, distance)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mem, _ := New(distance, 1000, NewU64Slice)
+		if distance == 3 {
+			mem = New3(1000, NewU64Slice)
+		}
+
+		sigs := make([]uint64, 1000)
+		for i := range sigs {
+			sigs[i] = uint64(r.Int63())
+			b.Add(sigs[i], uint64(i))
+			mem.Add(sigs[i], uint64(i))
+		}
+		b.Finish()
+		mem.Finish()
+
+		check := func(b Storage, when string) {
+			for i := 0; i < 500; i++ {
+				q := sigs[r.Intn(len(sigs))]
+				for j := r.Intn(distance + 2); j > 0; j-- {
+					q ^= 1 << uint(r.Intn(64))
+				}
+
+				if got, want := b.Find(q), mem.Find(q); !reflect.DeepEqual(got, want) {
+					t.Errorf("d=%d %s: Find(%016x)=%v, want %v", distance, when, q, got, want)
+				}
+			}
+		}
+
+		check(b, "built")
+
+		if st := b.Stats(); st.Entries != 1000 || b.Len() != 1000 || len(st.Tables) != b.perm.tables() || st.Tables[0] != 1000 {
+			t.Errorf("d=%d: Stats()=%+v, want 1000 entries in %d tables", distance, st, b.perm.tables())
+		}
+
+		b.Delete(10)
+		mem.Delete(10)
+		b.Add(sigs[10]^1, 1000)
+		mem.Add(sigs[10]^1, 1000)
+
+		if got, want := b.Find(sigs[10]), []uint64{1000}; !reflect.DeepEqual(got, want) {
+			t.Errorf("d=%d: Find after Delete and Add=%v, want %v", distance, got, want)
+		}
+
+		check(b, "modified")
+
+		if err := b.Close(); err != nil {
+			t.Fatalf("d=%d: Close: %v", distance, err)
+		}
+
+		if _, err := NewBolt(path, distance+1); err == nil {
+			t.Errorf("d=%d: reopening for distance %d didn't fail", distance, distance+1)
+		}
+
+		reopened, err := NewBolt(path, distance)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(reopened, "reopened")
+		reopened.Close()
+	}
+}
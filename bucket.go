@@ -0,0 +1,126 @@
+package simstore
+
+import (
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// bucketTarget is the mean number of hashes in each bucket of a bucketStore
+const bucketTarget = 1024
+
+// maxBucketBits bounds the number of buckets of a bucketStore to
+// 2^maxBucketBits
+const maxBucketBits = 20
+
+// bucketStore keeps its sorted hashes in one slice, partitioned into buckets by
+// their top bits.  The buckets are sorted independently by Finish, and a
+// search only looks in the buckets its prefix can be in.
+type bucketStore struct {
+	u    u64slice
+	bits int
+	offs []int // start of each bucket in u, followed by len(u)
+}
+
+// NewBucketStore returns a U64Store which partitions its hashes into buckets by
+// their top bits, with about bucketTarget hashes in each.  Finish sorts the
+// buckets on every processor rather than sorting the whole table in one
+// goroutine, and a search binary-searches only the buckets which can hold its
+// prefix.  The hashes take the same space as with NewU64Slice; the bucket
+// offsets add 8 bytes per bucket.
+func NewBucketStore(hashes int) U64Store {
+	return &bucketStore{u: make(u64slice, 0, hashes)}
+}
+
+func (z *bucketStore) Add(p uint64) {
+	z.u = append(z.u, p)
+}
+
+// bucket returns the bucket of h
+func (z *bucketStore) bucket(h uint64) int {
+	// a shift by 64 with no buckets is 0
+	return int(h >> uint(64-z.bits))
+}
+
+func (z *bucketStore) Finish() {
+
+	n := len(z.u)
+
+	z.bits = 0
+	for z.bits < maxBucketBits && n>>uint(z.bits) > bucketTarget {
+		z.bits++
+	}
+
+	// partition the hashes by bucket, with a counting sort
+	z.index(z.u)
+
+	next := make([]int, len(z.offs)-1)
+	copy(next, z.offs)
+
+	u := make(u64slice, n)
+	for _, h := range z.u {
+		b := z.bucket(h)
+		u[next[b]] = h
+		next[b]++
+	}
+	z.u = u
+
+	// sort the buckets, each claimed by a worker in turn
+	var wg sync.WaitGroup
+	var claimed int64 = -1
+	for w := 0; w < runtime.GOMAXPROCS(0); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				b := int(atomic.AddInt64(&claimed, 1))
+				if b >= len(z.offs)-1 {
+					return
+				}
+				slices.Sort(z.u[z.offs[b]:z.offs[b+1]])
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// index sets the offsets of the buckets from the hashes in u, which must be in
+// order of bucket if u is z.u
+func (z *bucketStore) index(u []uint64) {
+	z.offs = make([]int, 1<<uint(z.bits)+1)
+	for _, h := range u {
+		z.offs[z.bucket(h)+1]++
+	}
+	for b := 1; b < len(z.offs); b++ {
+		z.offs[b] += z.offs[b-1]
+	}
+}
+
+// run returns the hashes of the buckets the prefix of sig can be in
+func (z *bucketStore) run(sig, mask uint64) u64slice {
+	lo, hi := z.bucket(sig&mask), z.bucket(sig|^mask)
+	return z.u[z.offs[lo]:z.offs[hi+1]]
+}
+
+func (z *bucketStore) Find(sig, mask uint64, d int) []uint64 {
+	return z.run(sig, mask).Find(sig, mask, d)
+}
+
+func (z *bucketStore) FindScanned(sig, mask uint64, d int) ([]uint64, int) {
+	return z.run(sig, mask).FindScanned(sig, mask, d)
+}
+
+func (z *bucketStore) findLimit(dst []uint64, sig, mask uint64, d int, limit int, interpolate bool) ([]uint64, int) {
+	return z.run(sig, mask).findLimit(dst, sig, mask, d, limit, interpolate)
+}
+
+func (z *bucketStore) findAny(sig, mask uint64, d int, limit int, interpolate bool) bool {
+	return z.run(sig, mask).findAny(sig, mask, d, limit, interpolate)
+}
+
+func (z *bucketStore) dedup() int {
+	removed := z.u.dedup()
+	z.index(z.u)
+	return removed
+}
@@ -0,0 +1,105 @@
+package simstore
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestBucketStore(t *testing.T) {
+
+	r := rand.New(rand.NewSource(0))
+
+	// enough hashes for 2^6 buckets, and repeated hashes
+	var hashes []uint64
+	for i := 0; i < 50000; i++ {
+		h := uint64(r.Int63())
+		hashes = append(hashes, h)
+		if i%7 == 0 {
+			hashes = append(hashes, h, h^1)
+		}
+	}
+
+	want := NewU64Slice(len(hashes))
+	z := NewBucketStore(len(hashes))
+	for _, h := range hashes {
+		want.Add(h)
+		z.Add(h)
+	}
+	want.Finish()
+	z.Finish()
+
+	if got := z.(*bucketStore).bits; got != 6 {
+		t.Errorf("%d bucket bits, want 6", got)
+	}
+
+	if got, w := z.(*bucketStore).u, *want.(*u64slice); !reflect.DeepEqual(got, w) {
+		t.Fatalf("the buckets aren't sorted")
+	}
+
+	// prefixes longer and shorter than the bucket bits
+	for _, mask := range []uint64{0xffff000000000000, 0xfff0000000000000, 0xf000000000000000} {
+		for i := 0; i < 1000; i++ {
+			sig := hashes[r.Intn(len(hashes))] ^ uint64(r.Int63n(8))
+			if i%2 == 1 {
+				sig = uint64(r.Int63())
+			}
+
+			w, wscanned := want.(ScanCounter).FindScanned(sig, mask, 3)
+			got, scanned := z.(ScanCounter).FindScanned(sig, mask, 3)
+			if !reflect.DeepEqual(got, w) || scanned != wscanned {
+				t.Fatalf("FindScanned(%016x, %016x)=%x, %d, want %x, %d", sig, mask, got, scanned, w, wscanned)
+			}
+
+			if got, w := z.(anyFinder).findAny(sig, mask, 3, 0, false), len(w) > 0; got != w {
+				t.Fatalf("findAny(%016x, %016x)=%v, want %v", sig, mask, got, w)
+			}
+		}
+	}
+
+	if got := z.Find(hashes[0], 0, 64); len(got) != len(hashes) {
+		t.Errorf("Find with an empty prefix found %d hashes, want %d", len(got), len(hashes))
+	}
+
+	if got, w := z.(deduper).dedup(), want.(deduper).dedup(); got != w {
+		t.Errorf("dedup removed %d hashes, want %d", got, w)
+	}
+	for i := 0; i < 100; i++ {
+		sig := hashes[r.Intn(len(hashes))]
+		if got, w := z.Find(sig, 0xffff000000000000, 3), want.Find(sig, 0xffff000000000000, 3); !reflect.DeepEqual(got, w) {
+			t.Fatalf("after dedup: Find(%016x)=%x, want %x", sig, got, w)
+		}
+	}
+
+	empty := NewBucketStore(0)
+	empty.Finish()
+	if got := empty.Find(0, 0xffff000000000000, 3); got != nil {
+		t.Errorf("empty Find=%x, want nil", got)
+	}
+}
+
+func TestBucketStoreSearch(t *testing.T) {
+
+	sigs := benchSignatures()[:20000]
+
+	want := New6(len(sigs), NewU64Slice)
+	s := New6(len(sigs), NewBucketStore, Dedup())
+	for i, sig := range sigs {
+		want.Add(sig, uint64(i))
+		s.Add(sig, uint64(i))
+	}
+	want.Finish()
+	s.Finish()
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		q := sigs[r.Intn(len(sigs))] ^ (1 << uint(r.Intn(64))) ^ (1 << uint(r.Intn(64)))
+		if got, w := s.Find(q), want.Find(q); !reflect.DeepEqual(got, w) {
+			t.Fatalf("Find(%016x)=%v, want %v", q, got, w)
+		}
+	}
+
+	if got, w := s.SnapshotSize(), want.SnapshotSize(); got != w {
+		t.Errorf("SnapshotSize=%d, want %d", got, w)
+	}
+}
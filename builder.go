@@ -0,0 +1,108 @@
+package simstore
+
+import (
+	"context"
+	"io"
+)
+
+// Builder collects the signatures of an Index.  It separates building a store
+// from searching it: a Builder can only Add, and Finish turns it into an Index
+// which can only be searched.  Add may be called from several goroutines at
+// once, as for a Store.
+type Builder struct {
+	s *Store
+}
+
+// NewBuilder returns a Builder for an Index searching hamming distance <=
+// maxDistance, with the same arguments as New.  Distances 3 and 6 use the
+// tables of New3 and New6, unless the PrefixBlocks or MaxTables option is
+// given, or for distance 6 the PrefixBits option.
+func NewBuilder(maxDistance int, hashes int, newStore StorageFactory, opts ...Option) (*Builder, error) {
+	if o := optionsOf(opts); o.prefixBlocks == 0 && o.maxTables == 0 {
+		switch {
+		case maxDistance == 3:
+			return &Builder{s: New3(hashes, newStore, opts...)}, nil
+		case maxDistance == 6 && o.prefixBits == 0:
+			return &Builder{s: &New6(hashes, newStore, opts...).Store}, nil
+		}
+	}
+
+	s, err := New(maxDistance, hashes, newStore, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Builder{s: s}, nil
+}
+
+// Add inserts a signature and document id into the index being built.  Add
+// panics if it's called after Finish.
+func (b *Builder) Add(sig, docid uint64) {
+	if b.s == nil {
+		panic("simstore: Builder.Add after Finish")
+	}
+	b.s.Add(sig, docid)
+}
+
+// Finish sorts the signatures added so far into an Index.  The Builder can't
+// be used afterwards.
+func (b *Builder) Finish() *Index {
+	s := b.s
+	b.s = nil
+	s.Finish()
+	return &Index{s: s}
+}
+
+// Index is a finished store which can't be modified, so it can be shared
+// between any number of goroutines searching it.
+type Index struct {
+	s *Store
+}
+
+// Find returns the sorted ids of the documents with a signature within the
+// index's distance of sig, as Store.Find does
+func (x *Index) Find(sig uint64) []uint64 {
+	return x.s.Find(sig)
+}
+
+// Count returns the number of documents Find would return for sig
+func (x *Index) Count(sig uint64) int {
+	return x.s.Count(sig)
+}
+
+// Contains reports whether any document has a signature within the index's
+// distance of sig
+func (x *Index) Contains(sig uint64) bool {
+	return x.s.Contains(sig)
+}
+
+// Search runs q against the index, as Store.Search does
+func (x *Index) Search(ctx context.Context, q Query) (Result, error) {
+	return x.s.Search(ctx, q)
+}
+
+// Range calls fn with each entry of the index until it returns false, as
+// Store.Range does
+func (x *Index) Range(fn func(sig, docid uint64) bool) {
+	x.s.Range(fn)
+}
+
+// MaxDistance returns the largest hamming distance the index can search
+func (x *Index) MaxDistance() int {
+	return x.s.MaxDistance()
+}
+
+// Stats returns the statistics of the index
+func (x *Index) Stats() Stats {
+	return x.s.Stats()
+}
+
+// MemoryBytes estimates the heap used by the index's tables
+func (x *Index) MemoryBytes() int64 {
+	return x.s.MemoryBytes()
+}
+
+// WriteTo writes a snapshot of the index to w, which ReadFrom and OpenMmap
+// load as a Store
+func (x *Index) WriteTo(w io.Writer) (int64, error) {
+	return x.s.WriteTo(w)
+}
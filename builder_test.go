@@ -0,0 +1,59 @@
+package simstore
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestBuilder(t *testing.T) {
+
+	for _, distance := range []int{3, 4, 6} {
+		b, err := NewBuilder(distance, 10, NewU64Slice)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b.Add(0x1122334455667788, 1)
+		b.Add(0x1122334455667789, 2)
+		b.Add(0xdeadbeefcafebabe, 3)
+
+		x := b.Finish()
+
+		if got, want := x.Find(0x1122334455667788), []uint64{1, 2}; !reflect.DeepEqual(got, want) {
+			t.Errorf("distance %d: Find=%v, want %v", distance, got, want)
+		}
+
+		r, err := x.Search(context.Background(), Query{Sig: 0xdeadbeefcafebabf})
+		if err != nil || !reflect.DeepEqual(r.DocIDs, []uint64{3}) {
+			t.Errorf("distance %d: Search=%v, %v, want [3]", distance, r.DocIDs, err)
+		}
+
+		if got := x.MaxDistance(); got != distance {
+			t.Errorf("MaxDistance=%d, want %d", got, distance)
+		}
+
+		if got := x.Stats().Entries; got != 3 {
+			t.Errorf("distance %d: Stats().Entries=%d, want 3", distance, got)
+		}
+
+		var buf bytes.Buffer
+		if _, err := x.WriteTo(&buf); err != nil {
+			t.Errorf("distance %d: WriteTo failed: %v", distance, err)
+		}
+
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("distance %d: Add after Finish didn't panic", distance)
+				}
+			}()
+			b.Add(0, 4)
+		}()
+	}
+
+	if _, err := NewBuilder(9, 10, NewU64Slice); err == nil {
+		t.Errorf("NewBuilder(9) succeeded")
+	}
+}
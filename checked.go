@@ -0,0 +1,65 @@
+package simstore
+
+// StorageV2 is like Storage, but its Add, Finish and Delete return an error,
+// for stores whose changes can fail, such as a BoltStore, or a Store writing
+// to a write-ahead log.  Checked adapts any Storage to it.
+type StorageV2 interface {
+	Add(sig, docid uint64) error
+	Find(sig uint64) []uint64
+	Finish() error
+	Delete(docid uint64) error
+	Len() int
+	Stats() Stats
+}
+
+// errStore is implemented by stores which keep the first error of a change
+// they couldn't make
+type errStore interface {
+	Err() error
+}
+
+// Checked returns s as a StorageV2.  The error of each change is the first
+// error of s, as returned by its Err method, so once a change has failed the
+// later ones return the same error.  The changes of a store without an Err
+// method never fail.
+func Checked(s Storage) StorageV2 {
+	return checked{s}
+}
+
+type checked struct {
+	s Storage
+}
+
+func (c checked) err() error {
+	if e, ok := c.s.(errStore); ok {
+		return e.Err()
+	}
+	return nil
+}
+
+func (c checked) Add(sig, docid uint64) error {
+	c.s.Add(sig, docid)
+	return c.err()
+}
+
+func (c checked) Find(sig uint64) []uint64 {
+	return c.s.Find(sig)
+}
+
+func (c checked) Finish() error {
+	c.s.Finish()
+	return c.err()
+}
+
+func (c checked) Delete(docid uint64) error {
+	c.s.Delete(docid)
+	return c.err()
+}
+
+func (c checked) Len() int {
+	return c.s.Len()
+}
+
+func (c checked) Stats() Stats {
+	return c.s.Stats()
+}
@@ -0,0 +1,49 @@
+package simstore
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestChecked(t *testing.T) {
+
+	c := Checked(New3Small(0))
+	if err := c.Add(1, 1); err != nil {
+		t.Errorf("Add=%v", err)
+	}
+	if err := c.Finish(); err != nil {
+		t.Errorf("Finish=%v", err)
+	}
+	if got := c.Find(3); !reflect.DeepEqual(got, []uint64{1}) || c.Len() != 1 {
+		t.Errorf("Find=%v Len=%d, want [1] and 1", got, c.Len())
+	}
+
+	// a log whose file can't be written
+	s := New3(0, NewU64Slice)
+	w, err := OpenWAL(filepath.Join(t.TempDir(), "store.wal"), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = Checked(s)
+
+	if err := c.Add(1, 1); err != nil {
+		t.Fatalf("Add=%v", err)
+	}
+	w.f.Close()
+
+	if err := c.Add(2, 2); err == nil {
+		t.Errorf("Add to a store with a failed log succeeded")
+	}
+	if err := c.Delete(1); err == nil {
+		t.Errorf("Delete from a store with a failed log succeeded")
+	}
+	if err := c.Finish(); err == nil || err != s.Err() {
+		t.Errorf("Finish=%v, want the error of the log, %v", err, s.Err())
+	}
+
+	if _, err := Load(strings.NewReader("1 1122334455667788\n"), LoadOptions{Store: s}); err == nil {
+		t.Errorf("Load into a store with a failed log succeeded")
+	}
+}
@@ -0,0 +1,200 @@
+package simstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// The checkpoint format written by Store.WriteCheckpoint, and read by
+// Store.ReadCheckpoint.  The header is that of a snapshot, with a different
+// magic, followed by the caller's position in its input, and like a
+// snapshot's each section is followed by its checksum.  All integers are
+// little-endian.
+//
+//	magic    [8]byte  "simcheck"
+//	version  uint32
+//	distance uint32
+//	tables   uint32
+//	prefix   uint32
+//	entries  uint64
+//	position uint64   the caller's position in its input
+//	crc      uint64   CRC-32C of the header
+//	entries × (signature uint64, docid uint64), in the order they were added
+//	crc      uint64   CRC-32C of the entries
+const checkpointMagic = "simcheck"
+
+// ErrCheckpointFormat is returned when a checkpoint is truncated, corrupt, or
+// of an unknown version
+var ErrCheckpointFormat = errors.New("simstore: invalid checkpoint")
+
+var errFinished = errors.New("simstore: can't checkpoint a finished store")
+
+// WriteCheckpoint writes the entries added to an unfinished store to w, with
+// position, which is returned by ReadCheckpoint.  A build from a long input
+// can write a checkpoint every so often with the position of the input, and
+// after a crash start again from the last one instead of from the beginning.
+// The tables are only built by Finish, so a checkpoint is as small as the
+// document table.
+func (s *Store) WriteCheckpoint(w io.Writer, position uint64) (int64, error) {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.finished {
+		return 0, errFinished
+	}
+
+	sw := newSnapshotWriter(w)
+
+	sw.writeString(checkpointMagic)
+	sw.put32(snapshotVersion)
+	sw.put32(uint32(s.perm.maxDistance()))
+	sw.put32(uint32(len(s.rhashes)))
+
+	var prefix uint32
+	if p, ok := s.perm.(*blockPerm); ok {
+		prefix = uint32(p.prefix)
+	}
+	sw.put32(prefix)
+	sw.put64(uint64(len(s.docids) + s.overflow.n))
+	sw.put64(position)
+	sw.endSection()
+
+	for _, e := range s.docids {
+		sw.put64(e.hash)
+		sw.put64(e.docid)
+	}
+	s.overflow.each(func(e entry) {
+		sw.put64(e.hash)
+		sw.put64(e.docid)
+	})
+	sw.endSection()
+
+	err := sw.flush()
+
+	return sw.n, err
+}
+
+// ReadCheckpoint adds the entries of a checkpoint written by WriteCheckpoint
+// to an unfinished store, and returns the position it was written with.  The
+// store must search the same distance as the one which wrote it.
+func (s *Store) ReadCheckpoint(r io.Reader) (uint64, error) {
+
+	if s.finished {
+		return 0, errFinished
+	}
+
+	var hdr [snapshotHeaderSize + 8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, checkpointReadError(err)
+	}
+
+	if string(hdr[:8]) != checkpointMagic {
+		return 0, ErrCheckpointFormat
+	}
+
+	// the rest of the header is that of a snapshot
+	copy(hdr[:8], snapshotMagic)
+	perm, entries, checksums, err := parseSnapshotHeader(hdr[:snapshotHeaderSize])
+	if err != nil {
+		return 0, ErrCheckpointFormat
+	}
+
+	sr := snapshotReader{r: r, checksums: checksums}
+	copy(hdr[:8], checkpointMagic)
+	sr.sum(hdr[:])
+	if err := sr.check("header"); err != nil {
+		return 0, checkpointReadError(err)
+	}
+
+	if perm.maxDistance() != s.perm.maxDistance() || perm.tables() != s.perm.tables() {
+		return 0, fmt.Errorf("simstore: checkpoint of a store for distance %d, not %d", perm.maxDistance(), s.perm.maxDistance())
+	}
+
+	position := binary.LittleEndian.Uint64(hdr[snapshotHeaderSize:])
+
+	docids := make(table, 0, capHint(entries))
+	var e entry
+	err = sr.words(2*entries, func(i uint64, v uint64) {
+		if i%2 == 0 {
+			e.hash = v
+			return
+		}
+		e.docid = v
+		docids = append(docids, e)
+	})
+	if err == nil {
+		err = sr.check("document table")
+	}
+	if err != nil {
+		return 0, checkpointReadError(err)
+	}
+
+	s.mu.Lock()
+	for _, e := range docids {
+		s.addEntry(e)
+	}
+	s.mu.Unlock()
+
+	return position, nil
+}
+
+// checkpointReadError returns ErrCheckpointFormat for a checkpoint which ended
+// early or doesn't match its checksums
+func checkpointReadError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF || err == ErrSnapshotFormat || errors.Is(err, ErrSnapshotChecksum) {
+		return ErrCheckpointFormat
+	}
+	return err
+}
+
+// SaveCheckpoint writes a checkpoint of s with position to the file path.  The
+// checkpoint is written to a temporary file renamed over path, so a crash
+// while it's being written leaves the previous checkpoint in place.
+func SaveCheckpoint(path string, s *Store, position uint64) error {
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := s.WriteCheckpoint(f, position); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// ResumeCheckpoint reads the checkpoint saved at path by SaveCheckpoint into
+// the unfinished store s, and returns its position.  If there is no file at
+// path, it returns 0 and leaves s alone, so a build can always start with
+// ResumeCheckpoint.
+func ResumeCheckpoint(path string, s *Store) (uint64, error) {
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return s.ReadCheckpoint(bufio.NewReader(f))
+}
@@ -0,0 +1,134 @@
+package simstore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckpoint(t *testing.T) {
+
+	s := New3(10, NewU64Slice)
+	s.Add(0x1122334455667788, 1)
+	s.Add(0xdeadbeefcafebabe, 2)
+
+	var buf bytes.Buffer
+	if _, err := s.WriteCheckpoint(&buf, 42); err != nil {
+		t.Fatal(err)
+	}
+	ckpt := buf.Bytes()
+
+	resumed := New3(10, NewU64Slice)
+	position, err := resumed.ReadCheckpoint(bytes.NewReader(ckpt))
+	if err != nil || position != 42 {
+		t.Fatalf("ReadCheckpoint=%d, %v, want 42", position, err)
+	}
+	resumed.Add(0x1122334455667789, 3)
+	resumed.Finish()
+
+	if got, want := resumed.Find(0x1122334455667788), []uint64{1, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Find=%v, want %v", got, want)
+	}
+
+	if _, err := resumed.WriteCheckpoint(&buf, 0); err == nil {
+		t.Errorf("WriteCheckpoint of a finished store succeeded")
+	}
+
+	if _, err := New6(10, NewU64Slice).ReadCheckpoint(bytes.NewReader(ckpt)); err == nil {
+		t.Errorf("ReadCheckpoint into a store of another distance succeeded")
+	}
+
+	corrupt := append([]byte{}, ckpt...)
+	corrupt[snapshotHeaderSize+8+8+3] ^= 1
+
+	for _, bad := range [][]byte{ckpt[:10], ckpt[:len(ckpt)-1], append([]byte("simstore"), ckpt[8:]...), corrupt} {
+		if _, err := New3(10, NewU64Slice).ReadCheckpoint(bytes.NewReader(bad)); err != ErrCheckpointFormat {
+			t.Errorf("ReadCheckpoint of a %d byte checkpoint: err=%v, want %v", len(bad), err, ErrCheckpointFormat)
+		}
+	}
+}
+
+// failAfter is a reader which fails after n bytes, like a load killed midway
+type failAfter struct {
+	r *strings.Reader
+	n int
+}
+
+var errCrash = errors.New("crash")
+
+func (f *failAfter) Read(p []byte) (int, error) {
+	if f.n <= 0 {
+		return 0, errCrash
+	}
+	if len(p) > f.n {
+		p = p[:f.n]
+	}
+	n, err := f.r.Read(p)
+	f.n -= n
+	return n, err
+}
+
+func TestLoadCheckpoint(t *testing.T) {
+
+	var sb strings.Builder
+	const lines = 10000
+	for i := 0; i < lines; i++ {
+		fmt.Fprintf(&sb, "%d %016x\n", i, uint64(i)*0x9e3779b97f4a7c15)
+	}
+	input := sb.String()
+
+	path := filepath.Join(t.TempDir(), "build.ckpt")
+
+	opts := LoadOptions{
+		Store:           New3(0, NewU64Slice),
+		Workers:         4,
+		CheckpointLines: 1000,
+		CheckpointPath:  path,
+	}
+
+	// the first attempt fails part of the way through the input
+	if _, err := Load(&failAfter{r: strings.NewReader(input), n: len(input) / 2}, opts); err != errCrash {
+		t.Fatalf("Load of a failing input: err=%v, want %v", err, errCrash)
+	}
+
+	var position uint64
+	if position, _ = ResumeCheckpoint(path, New3(0, NewU64Slice)); position == 0 || position%1000 != 0 {
+		t.Fatalf("checkpoint position=%d, want a multiple of 1000", position)
+	}
+
+	// the second attempt resumes from the checkpoint, and skips the lines
+	// it holds, so failing on them shows they aren't parsed again
+	skipped := 0
+	opts.Store = New3(0, NewU64Slice)
+	opts.Invalid = func(int, error) { skipped++ }
+	rest := strings.Join(strings.SplitAfter(input, "\n")[position:], "")
+	s, err := Load(strings.NewReader(strings.Repeat("x\n", int(position))+rest), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skipped != 0 {
+		t.Errorf("%d lines before the checkpoint were parsed", skipped)
+	}
+
+	if got := s.Stats().Entries; got != lines {
+		t.Errorf("Entries=%d, want %d", got, lines)
+	}
+	for _, i := range []uint64{0, position - 1, position, lines - 1} {
+		if got := s.Find(i * 0x9e3779b97f4a7c15); !reflect.DeepEqual(got, []uint64{i}) {
+			t.Errorf("Find(line %d)=%v, want [%d]", i, got, i)
+		}
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("checkpoint not removed after Load: %v", err)
+	}
+
+	if _, err := Load(strings.NewReader(input), LoadOptions{Store: New3Small(0), CheckpointPath: path}); err == nil {
+		t.Errorf("Load checkpointing a small store succeeded")
+	}
+}
@@ -0,0 +1,155 @@
+package simstore
+
+import "sort"
+
+// ranger is implemented by stores which can list their entries
+type ranger interface {
+	Range(fn func(sig, docid uint64) bool)
+}
+
+// Clusters returns the groups of near-duplicate documents in store: the
+// connected components of the graph linking each document to those Find
+// returns for its signatures, so the documents within the store's distance
+// of each other, such as 3 for New3, transitively.  Each cluster is sorted,
+// the clusters are in order of their first docid, and documents with no
+// near-duplicates are left out.  Deleted documents aren't included.
+//
+// Clusters searches the store once per entry, holding a copy of the entries
+// while it does.  It returns nil for a store which can't list its entries;
+// a Store, a SmallStore3, a SmallStore6 and an MIHStore can.
+func Clusters(store Storage) [][]uint64 {
+
+	r, ok := store.(ranger)
+	if !ok {
+		return nil
+	}
+
+	// searching from within Range would take the store's lock again
+	var all table
+	r.Range(func(sig, docid uint64) bool {
+		all = append(all, entry{hash: sig, docid: docid})
+		return true
+	})
+	sort.Sort(all)
+
+	u := make(unionFind)
+	for i, e := range all {
+		if i > 0 && all[i-1].hash == e.hash {
+			// the same signature finds the same documents
+			u.union(all[i-1].docid, e.docid)
+			continue
+		}
+		for _, id := range store.Find(e.hash) {
+			u.union(e.docid, id)
+		}
+	}
+
+	groups := make(map[uint64][]uint64)
+	for id := range u {
+		root := u.find(id)
+		groups[root] = append(groups[root], id)
+	}
+
+	var clusters [][]uint64
+	for _, g := range groups {
+		if len(g) > 1 {
+			sort.Sort(u64slice(g))
+			clusters = append(clusters, g)
+		}
+	}
+	sort.Slice(clusters, func(i, j int) bool { return clusters[i][0] < clusters[j][0] })
+
+	return clusters
+}
+
+// unionFind is a disjoint-set forest of docids, mapping each to its parent
+type unionFind map[uint64]uint64
+
+// find returns the root of the set of x, adding x as a set of its own if it's
+// new, and halving the path to it
+func (u unionFind) find(x uint64) uint64 {
+	p, ok := u[x]
+	if !ok {
+		u[x] = x
+		return x
+	}
+	for p != x {
+		gp := u[p]
+		u[x] = gp
+		x, p = p, gp
+	}
+	return x
+}
+
+// union merges the sets of x and y
+func (u unionFind) union(x, y uint64) {
+	rx, ry := u.find(x), u.find(y)
+	if rx == ry {
+		return
+	}
+	// the smaller root, for a deterministic forest
+	if ry < rx {
+		rx, ry = ry, rx
+	}
+	u[ry] = rx
+}
+
+// rangeTables calls fn with each entry of the tables which searches don't
+// skip, until fn returns false, and reports whether it got to the end.  The
+// caller must hold the lock.
+func (ts *tombstones) rangeTables(fn func(sig, docid uint64) bool, tables ...table) bool {
+	for _, t := range tables {
+		for _, e := range t {
+			if ts.hiding() && ts.hidden(e.hash, e.docid) {
+				continue
+			}
+			if !fn(e.hash, e.docid) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// rangePending is like rangeTables, for the pending table of a store
+func (ts *tombstones) rangePending(fn func(sig, docid uint64) bool, pending table) bool {
+	for i, e := range pending {
+		if ts.hiding() && ts.hiddenPending(i, e) {
+			continue
+		}
+		if !fn(e.hash, e.docid) {
+			return false
+		}
+	}
+	return true
+}
+
+// Range calls fn with the signature and document id of each entry of the
+// store which hasn't been deleted, until fn returns false, in no particular
+// order.  The store's lock is held while fn runs, so fn must not modify the
+// store.
+func (s *SmallStore3) Range(fn func(sig, docid uint64) bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// each entry is in a bucket of every table, so the first has them all
+	s.rangeTables(fn, s.tables[0][:]...)
+}
+
+// Range calls fn with the signature and document id of each entry of the
+// store which hasn't been deleted, as SmallStore3.Range does
+func (s *SmallStore6) Range(fn func(sig, docid uint64) bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	s.rangeTables(fn, s.tables[0][:]...)
+}
+
+// Range calls fn with the signature and document id of each entry of the
+// store which hasn't been deleted, as SmallStore3.Range does
+func (s *MIHStore) Range(fn func(sig, docid uint64) bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	s.rangeTables(fn, s.docids, s.pending)
+}
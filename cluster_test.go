@@ -0,0 +1,58 @@
+package simstore
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestClusters(t *testing.T) {
+
+	const a, b = 0xffff0000ffff0000, 0x00ff00ff00ff00ff
+
+	// 1-2-3 is a chain: 1 and 3 are 4 bits apart, but both within 3 of 2
+	add := func(s Storage) {
+		s.Add(a, 1)
+		s.Add(a^0x3, 2)
+		s.Add(a^0xf, 3)
+		s.Add(b, 4)
+		s.Add(b, 5)
+		s.Add(b^0x7, 6)
+		s.Add(^uint64(a), 7)
+		s.Add(b^0x3f00, 8)
+		s.Add(b^0x3f00, 9)
+		s.Finish()
+		s.Delete(9)
+	}
+
+	want := [][]uint64{{1, 2, 3}, {4, 5, 6}}
+
+	mih, err := NewMIH(3, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		s    Storage
+	}{
+		{"New3", New3(10, NewU64Slice)},
+		{"New3Small", New3Small(10)},
+		{"MIH", mih},
+	} {
+		add(tt.s)
+		if got := Clusters(tt.s); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: Clusters=%v, want %v", tt.name, got, want)
+		}
+	}
+
+	// within distance 6, 8 joins 4, 5 and 6
+	s := New6Small(10)
+	add(s)
+	if got, want := Clusters(s), [][]uint64{{1, 2, 3}, {4, 5, 6, 8}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("New6Small: Clusters=%v, want %v", got, want)
+	}
+
+	if got := Clusters(NewMultiStore()); got != nil {
+		t.Errorf("Clusters of a store without Range=%v", got)
+	}
+}
@@ -0,0 +1,62 @@
+package simstore
+
+import "sync"
+
+// DedupPolicy says which of the documents offered to a Deduplicator are added
+// to its store
+type DedupPolicy int
+
+const (
+	// KeepUnique adds only the documents with no near-duplicates in the
+	// store, so each cluster of near-duplicates is represented by the first
+	// one offered
+	KeepUnique DedupPolicy = iota
+
+	// KeepAll adds every document, so later documents are also checked
+	// against the near-duplicates offered before them
+	KeepAll
+)
+
+// Deduplicator checks a stream of documents for near-duplicates against a
+// store, adding them to it as they are offered.  The check and the add are
+// one step, so two near-duplicates offered at once by different goroutines
+// can't both be found unique.
+type Deduplicator struct {
+	mu     sync.Mutex
+	s      Storage
+	policy DedupPolicy
+}
+
+// NewDeduplicator returns a Deduplicator adding to the finished store s
+// according to policy.  The offers are only atomic with respect to each
+// other, so s must not be added to except through Offer.
+func NewDeduplicator(s Storage, policy DedupPolicy) *Deduplicator {
+	return &Deduplicator{s: s, policy: policy}
+}
+
+// Offer returns the sorted ids of the documents in the store near sig,
+// excluding docid itself, and adds the document if the policy says to.  A nil
+// result means the document is unique.  Offer may be called from several
+// goroutines at once, and concurrently with searches of the store.
+func (d *Deduplicator) Offer(sig, docid uint64) []uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var dups []uint64
+	for _, id := range d.s.Find(sig) {
+		if id != docid {
+			dups = append(dups, id)
+		}
+	}
+
+	if d.policy == KeepAll || dups == nil {
+		d.s.Add(sig, docid)
+	}
+
+	return dups
+}
+
+// Store returns the store the documents are added to
+func (d *Deduplicator) Store() Storage {
+	return d.s
+}
@@ -0,0 +1,62 @@
+package simstore
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestDeduplicator(t *testing.T) {
+
+	const sig = 0xffff0000ffff0000
+
+	d := NewDeduplicator(New3(0, NewU64Slice), KeepUnique)
+	d.Store().Finish()
+
+	if got := d.Offer(sig, 1); got != nil {
+		t.Errorf("Offer of the first document=%v", got)
+	}
+	if got := d.Offer(sig^1, 2); !reflect.DeepEqual(got, []uint64{1}) {
+		t.Errorf("Offer of a near-duplicate=%v, want [1]", got)
+	}
+	// 3 is near 2, which wasn't kept, but not 1
+	if got := d.Offer(sig^0xf, 3); got != nil {
+		t.Errorf("Offer near a duplicate which wasn't kept=%v", got)
+	}
+	if got := d.Offer(sig, 1); got != nil {
+		t.Errorf("Offer of a document again=%v, want it not to find itself", got)
+	}
+
+	d = NewDeduplicator(New3(0, NewU64Slice), KeepAll)
+	d.Store().Finish()
+	d.Offer(sig, 1)
+	d.Offer(sig^1, 2)
+	if got := d.Offer(sig^0xf, 3); !reflect.DeepEqual(got, []uint64{2}) {
+		t.Errorf("Offer near a kept duplicate=%v, want [2]", got)
+	}
+
+	// of the same document offered by many goroutines at once, exactly one
+	// is unique
+	d = NewDeduplicator(New3(0, NewU64Slice), KeepUnique)
+	d.Store().Finish()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var unique int
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if d.Offer(sig, uint64(i)) == nil {
+				mu.Lock()
+				unique++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if unique != 1 || d.Store().Len() != 1 {
+		t.Errorf("%d of the concurrent offers were unique, and the store has %d entries, want 1 and 1", unique, d.Store().Len())
+	}
+}
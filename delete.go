@@ -0,0 +1,458 @@
+package simstore
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// tombstones records the docids deleted from a store until Compact removes
+// their entries, the times documents were added for TTL, and the latest
+// versions of documents.  The lock also guards the tables Compact replaces.
+type tombstones struct {
+	mu      sync.RWMutex
+	deleted map[uint64]struct{}
+
+	// the deleted docids added again since Finish, and the index in the
+	// pending table of their first entry searches don't skip
+	readded map[uint64]int
+
+	times map[uint64]int64 // when each document was added, in unix nanoseconds
+	ttl   time.Duration    // searches skip the documents older than this, with TTL
+
+	versions map[uint64]version // the latest version of each document added with AddVersion
+	stale    int                // the versions superseded since Compact
+}
+
+// tombstone marks docid as deleted
+func (ts *tombstones) tombstone(docid uint64) {
+	ts.mu.Lock()
+	ts.markDeleted(docid)
+	ts.mu.Unlock()
+}
+
+// markDeleted marks docid as deleted.  The caller must hold the lock.
+func (ts *tombstones) markDeleted(docid uint64) {
+	if ts.deleted == nil {
+		ts.deleted = make(map[uint64]struct{})
+	}
+	ts.deleted[docid] = struct{}{}
+	delete(ts.readded, docid)
+	delete(ts.times, docid)
+}
+
+// readd records that a deleted docid is added again, at index i of the
+// pending table, so searches keep skipping its earlier entries but not the
+// later ones.  It does nothing for a docid which isn't deleted or has been
+// added again already.  The caller must hold the lock.
+func (ts *tombstones) readd(docid uint64, i int) {
+	if _, ok := ts.deleted[docid]; !ok {
+		return
+	}
+	if _, ok := ts.readded[docid]; ok {
+		return
+	}
+	if ts.readded == nil {
+		ts.readded = make(map[uint64]int)
+	}
+	ts.readded[docid] = i
+}
+
+// isDeleted reports whether docid has been deleted, or was added longer ago
+// than the TTL.  The caller must hold the lock.
+func (ts *tombstones) isDeleted(docid uint64) bool {
+	if _, ok := ts.deleted[docid]; ok {
+		return true
+	}
+	return ts.expired(docid)
+}
+
+// expired reports whether docid was added longer ago than the TTL.  The
+// caller must hold the lock.
+func (ts *tombstones) expired(docid uint64) bool {
+	if ts.ttl > 0 {
+		t, ok := ts.times[docid]
+		return ok && t < time.Now().Add(-ts.ttl).UnixNano()
+	}
+	return false
+}
+
+// hidden reports whether searches skip the entry of sig and docid, because
+// docid has been deleted or expired, or sig is of an earlier version of it.
+// The caller must hold the lock.
+func (ts *tombstones) hidden(sig, docid uint64) bool {
+	return ts.isDeleted(docid) || ts.superseded(sig, docid)
+}
+
+// hiddenPending is like hidden, for the entry e at index i of the pending
+// table, which searches don't skip if its docid was deleted but added again
+// at or before i.  The caller must hold the lock.
+func (ts *tombstones) hiddenPending(i int, e entry) bool {
+	if start, ok := ts.readded[e.docid]; ok && i >= start {
+		return ts.expired(e.docid) || ts.superseded(e.hash, e.docid)
+	}
+	return ts.hidden(e.hash, e.docid)
+}
+
+// hiding reports whether searches may have to skip the entries of some
+// documents.  The caller must hold the lock.
+func (ts *tombstones) hiding() bool {
+	return len(ts.deleted) > 0 || ts.ttl > 0 || len(ts.versions) > 0
+}
+
+// live removes the docids of the entries of sig searches skip from ids in
+// place.  The caller must hold the lock.
+func (ts *tombstones) live(sig uint64, ids []uint64) []uint64 {
+	if !ts.hiding() {
+		return ids
+	}
+
+	j := 0
+	for _, id := range ids {
+		if !ts.hidden(sig, id) {
+			ids[j] = id
+			j++
+		}
+	}
+
+	return ids[:j]
+}
+
+// Deleted returns the number of deleted docids which haven't been compacted
+func (ts *tombstones) Deleted() int {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	return len(ts.deleted)
+}
+
+var errUncompacted = errors.New("simstore: the store has documents deleted or added since Finish; Compact it first")
+
+// Delete removes all the signatures added with docid from the results of
+// searches of the store.  The entries are only marked as deleted; they still
+// use memory and are still scanned by searches until Compact is called.
+// Delete may be called concurrently with searches.
+func (s *Store) Delete(docid uint64) {
+	s.mu.Lock()
+	s.markDeleted(docid)
+	s.wal.log(walDelete, 0, docid, 0)
+	s.mu.Unlock()
+}
+
+// DeleteFunc deletes the documents with an entry for which fn returns true,
+// such as all those of one customer, and returns how many it deleted.  Like
+// Delete, it removes every signature of a document, including those fn
+// returned false for, and only marks the documents as deleted until Compact
+// removes their entries.  fn is called once for each entry searches don't
+// skip, with the store locked, so it must not use the store.
+func (s *Store) DeleteFunc(fn func(sig, docid uint64) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var docids []uint64
+	match := func(sig, docid uint64) bool {
+		if fn(sig, docid) {
+			docids = append(docids, docid)
+		}
+		return true
+	}
+
+	if s.rangeTables(match, s.entries()) {
+		s.rangePending(match, s.pending)
+	}
+	if !s.finished {
+		s.overflow.each(func(e entry) {
+			if !s.hiding() || !s.hidden(e.hash, e.docid) {
+				match(e.hash, e.docid)
+			}
+		})
+	}
+
+	var n int
+	for _, docid := range docids {
+		// a document with several matching entries
+		if _, ok := s.deleted[docid]; ok {
+			if _, ok := s.readded[docid]; !ok {
+				continue
+			}
+		}
+		s.markDeleted(docid)
+		s.wal.log(walDelete, 0, docid, 0)
+		n++
+	}
+
+	return n
+}
+
+// Compact removes the entries of deleted documents, and those of the earlier
+// versions of documents added with AddVersion, from the store's tables,
+// merges the entries added since Finish into them, and returns how many
+// entries were removed.  With TTL, the documents older than it are expired
+// first.  The new tables are built while the old ones keep serving searches,
+// so Compact needs memory for a second copy of the store, but searches only
+// wait for the tables to be swapped.  Documents deleted or added while
+// Compact is running are left for the next Compact, and a concurrent Compact
+// or Merge waits for it to finish.
+func (s *Store) Compact() int {
+	removed, _ := s.CompactReclaimed()
+	return removed
+}
+
+// CompactReclaimed is like Compact, but also returns the number of bytes of
+// heap the store's tables use less than before, as estimated by MemoryBytes.
+// It's negative when the tables grew, with the entries added since Finish, or
+// when a store opened with OpenMmap moved onto the heap.
+func (s *Store) CompactReclaimed() (int, int64) {
+
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	if s.ttl > 0 {
+		s.Expire(time.Now().Add(-s.ttl))
+	}
+
+	s.mu.RLock()
+
+	deleted := make(map[uint64]struct{}, len(s.deleted))
+	for id := range s.deleted {
+		deleted[id] = struct{}{}
+	}
+
+	// the versions only get later, so an entry superseded now stays so
+	var versions map[uint64]version
+	if s.stale > 0 {
+		versions = make(map[uint64]version, len(s.versions))
+		for id, v := range s.versions {
+			versions[id] = v
+		}
+	}
+	stale := s.stale
+
+	readded := make(map[uint64]int, len(s.readded))
+	for id, i := range s.readded {
+		readded[id] = i
+	}
+
+	pending := s.pending
+
+	if len(deleted) == 0 && len(pending) == 0 && stale == 0 {
+		s.mu.RUnlock()
+		return 0, 0
+	}
+
+	keep := func(e entry) bool {
+		if _, ok := deleted[e.docid]; ok {
+			return false
+		}
+		v, ok := versions[e.docid]
+		return !ok || v.sig == e.hash
+	}
+
+	before := s.memoryBytes()
+
+	all := s.entries()
+	docids := make(table, 0, len(all)+len(pending))
+	for _, e := range all {
+		if keep(e) {
+			docids = append(docids, e)
+		}
+	}
+	removed := len(all) - len(docids)
+
+	s.mu.RUnlock()
+
+	for i, e := range pending {
+		if start, ok := readded[e.docid]; ok && i >= start {
+			// added again after it was deleted
+			if v, ok := versions[e.docid]; ok && v.sig != e.hash {
+				continue
+			}
+		} else if !keep(e) {
+			continue
+		}
+		docids = append(docids, e)
+	}
+
+	if len(pending) > 0 {
+		sort.Sort(docids)
+		if s.dedup {
+			docids.dedup()
+		}
+	}
+
+	newStore := s.newStore
+	if newStore == nil {
+		// a store opened with OpenMmap
+		newStore = NewU64Slice
+	}
+
+	rhashes := make([]U64Store, len(s.rhashes))
+	for t := range rhashes {
+		rhashes[t] = newStore(len(docids))
+		for _, e := range docids {
+			p, _ := s.perm.shuffle(e.hash, t)
+			rhashes[t].Add(p)
+		}
+		rhashes[t].Finish()
+		if d, ok := rhashes[t].(deduper); ok && s.dedup {
+			d.dedup()
+		}
+	}
+
+	var bydocid docTable
+	if s.indexDocIDs {
+		bydocid = make(docTable, len(docids))
+		copy(bydocid, docids)
+		sort.Sort(bydocid)
+	}
+
+	var filters []*xorFilter
+	if s.prefixFilters {
+		filters = s.buildFilters(rhashes, docids)
+	}
+
+	var sets docSets
+	if s.docSets {
+		docids, sets = groupDocIDs(docids)
+	}
+
+	s.mu.Lock()
+	s.docids, s.rhashes, s.bydocid, s.sets, s.filters = docids, rhashes, bydocid, sets, filters
+	s.pending = append(table(nil), s.pending[len(pending):]...)
+	for id := range deleted {
+		_, was := readded[id]
+		start, ok := s.readded[id]
+		if ok && start >= len(pending) || was && !ok {
+			// deleted or added again since, with entries left to hide
+			continue
+		}
+		delete(s.deleted, id)
+		delete(s.readded, id)
+	}
+	for id, start := range s.readded {
+		s.readded[id] = start - len(pending)
+	}
+	s.stale -= stale
+	after := s.memoryBytes()
+	s.mu.Unlock()
+
+	return removed, before - after
+}
+
+// Delete removes all the signatures added with docid from the results of
+// searches of the store, until Compact removes their entries.
+func (s *SmallStore3) Delete(docid uint64) {
+	s.tombstone(docid)
+}
+
+// Compact removes the entries of deleted documents from the store's buckets,
+// and returns how many were removed.  Searches wait until it has finished.
+func (s *SmallStore3) Compact() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var removed int
+	for i := range s.tables {
+		removed += compactBuckets(s.tables[i][:], s.deleted)
+	}
+	s.deleted = nil
+
+	// every entry is stored once per block
+	return removed / len(s.tables)
+}
+
+// Delete removes all the signatures added with docid from the results of
+// searches of the store, until Compact removes their entries.
+func (s *SmallStore6) Delete(docid uint64) {
+	s.tombstone(docid)
+}
+
+// Compact removes the entries of deleted documents from the store's buckets,
+// and returns how many were removed.  Searches wait until it has finished.
+func (s *SmallStore6) Compact() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var removed int
+	for i := range s.tables {
+		removed += compactBuckets(s.tables[i][:], s.deleted)
+	}
+	s.deleted = nil
+
+	// every entry is stored once per block
+	return removed / len(s.tables)
+}
+
+// Collapsed returns the number of duplicate entries removed from the buckets
+// by Finish
+func (s *SmallStore3) Collapsed() int {
+	return s.collapsed
+}
+
+// Collapsed returns the number of duplicate entries removed from the buckets
+// by Finish
+func (s *SmallStore6) Collapsed() int {
+	return s.collapsed
+}
+
+// Delete removes all the signatures added with docid from the results of
+// searches of the store, until Compact removes their entries.
+func (s *MIHStore) Delete(docid uint64) {
+	s.tombstone(docid)
+}
+
+// Compact indexes the entries added since Finish and removes the entries of
+// deleted documents, and returns how many were removed.  Searches wait until
+// it has finished.
+func (s *MIHStore) Compact() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.deleted) == 0 && len(s.pending) == 0 {
+		return 0
+	}
+
+	docids := make(table, 0, len(s.docids)+len(s.pending))
+	docids = append(docids, s.docids...)
+	docids = append(docids, s.pending...)
+
+	j := 0
+	for _, e := range docids {
+		if !s.isDeleted(e.docid) {
+			docids[j] = e
+			j++
+		}
+	}
+	removed := len(docids) - j
+	docids = docids[:j]
+
+	sort.Sort(docids)
+	docids.dedup()
+
+	s.docids, s.indexes, s.pending, s.deleted = docids, s.index(docids), nil, nil
+
+	return removed
+}
+
+// Collapsed returns the number of duplicate entries removed by Finish
+func (s *MIHStore) Collapsed() int {
+	return s.collapsed
+}
+
+// compactBuckets removes the entries of the deleted docids from the buckets in
+// place, and returns how many were removed
+func compactBuckets(buckets []table, deleted map[uint64]struct{}) int {
+	var removed int
+	for b, t := range buckets {
+		j := 0
+		for _, e := range t {
+			if _, ok := deleted[e.docid]; !ok {
+				t[j] = e
+				j++
+			}
+		}
+		removed += len(t) - j
+		buckets[b] = t[:j]
+	}
+	return removed
+}
@@ -0,0 +1,333 @@
+package simstore
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestDelete(t *testing.T) {
+
+	r := rand.New(rand.NewSource(0))
+
+	// clusters of near-duplicate signatures, with every third doc deleted
+	var sigs []uint64
+	for i := 0; i < 300; i++ {
+		sig := uint64(r.Int63())
+		if i%3 != 0 {
+			sig = sigs[i-1] ^ 1<<uint(r.Intn(64))
+		}
+		sigs = append(sigs, sig)
+	}
+
+	deleted := func(id uint64) bool { return id%3 == 1 }
+
+	stores := []struct {
+		name  string
+		s     Storage
+		clean Storage
+	}{
+		{"New3", New3(len(sigs), NewU64Slice, IndexDocIDs()), New3(len(sigs), NewU64Slice)},
+		{"New6", New6(len(sigs), NewU64Slice), New6(len(sigs), NewU64Slice)},
+		{"New3Small", New3Small(len(sigs)), New3Small(len(sigs))},
+		{"New6Small", New6Small(len(sigs)), New6Small(len(sigs))},
+	}
+
+	for _, st := range stores {
+		for i, sig := range sigs {
+			st.s.Add(sig, uint64(i))
+			if !deleted(uint64(i)) {
+				st.clean.Add(sig, uint64(i))
+			}
+		}
+		st.s.Finish()
+		st.clean.Finish()
+
+		for i := range sigs {
+			if deleted(uint64(i)) {
+				st.s.Delete(uint64(i))
+			}
+		}
+
+		compare := func(when string) {
+			for _, sig := range sigs {
+				if got, want := st.s.Find(sig), st.clean.Find(sig); !reflect.DeepEqual(got, want) {
+					t.Errorf("%s %s: Find(%016x)=%v, want %v", st.name, when, sig, got, want)
+				}
+			}
+		}
+
+		compare("before Compact")
+
+		compactor := st.s.(interface{ Compact() int })
+		if n := compactor.Compact(); n != len(sigs)/3 {
+			t.Errorf("%s: Compact removed %d entries, want %d", st.name, n, len(sigs)/3)
+		}
+
+		compare("after Compact")
+
+		if n := compactor.Compact(); n != 0 {
+			t.Errorf("%s: second Compact removed %d entries, want 0", st.name, n)
+		}
+	}
+}
+
+func TestDeleteStore(t *testing.T) {
+
+	s := New3(10, NewU64Slice)
+	for i := 0; i < 10; i++ {
+		s.Add(0xff, uint64(i))
+	}
+	s.Finish()
+
+	s.Delete(3)
+	s.Delete(5)
+
+	if s.Deleted() != 2 {
+		t.Errorf("Deleted()=%d, want 2", s.Deleted())
+	}
+
+	want := []uint64{0, 1, 2, 4, 6, 7, 8, 9}
+	if got := s.FindExact(0xff); !reflect.DeepEqual(got, want) {
+		t.Errorf("FindExact=%v, want %v", got, want)
+	}
+	if got := s.FindN(0xff, 3); !reflect.DeepEqual(got, want[:3]) {
+		t.Errorf("FindN=%v, want %v", got, want[:3])
+	}
+	if got := s.FindByDocID(3); got != nil {
+		t.Errorf("FindByDocID(deleted)=%v, want nil", got)
+	}
+	if got := s.FindByDocID(0); !reflect.DeepEqual(got, want[1:]) {
+		t.Errorf("FindByDocID(0)=%v, want %v", got, want[1:])
+	}
+
+	var buf bytes.Buffer
+	if _, err := s.WriteTo(&buf); err != errUncompacted {
+		t.Errorf("WriteTo with deleted documents: err=%v, want %v", err, errUncompacted)
+	}
+
+	s.Compact()
+
+	if s.Deleted() != 0 || len(s.docids) != 8 || s.tableLen(0) != 8 {
+		t.Errorf("after Compact: Deleted()=%d, %d docids, %d hashes, want 0, 8, 8", s.Deleted(), len(s.docids), s.tableLen(0))
+	}
+
+	if _, err := s.WriteTo(&buf); err != nil {
+		t.Errorf("WriteTo after Compact: %v", err)
+	}
+
+	// deleting every document of a signature hides it from existence checks
+	for _, id := range want {
+		s.Delete(id)
+	}
+	if s.contains(0xff, 3) {
+		t.Errorf("contains found a signature whose documents are all deleted")
+	}
+}
+
+func TestCompactReclaimed(t *testing.T) {
+
+	s := New6(10000, NewU64Slice)
+	for i := 0; i < 10000; i++ {
+		s.Add(uint64(i)*0x9e3779b97f4a7c15, uint64(i))
+	}
+	s.Finish()
+
+	for i := 0; i < 10000; i += 2 {
+		s.Delete(uint64(i))
+	}
+
+	// searches go on while the tables are rebuilt
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 1; i < 10000; i += 2 {
+			sig := uint64(i) * 0x9e3779b97f4a7c15
+			if got := s.Find(sig); !reflect.DeepEqual(got, []uint64{uint64(i)}) {
+				t.Errorf("Find(%016x) during Compact=%v, want [%d]", sig, got, i)
+				return
+			}
+		}
+	}()
+
+	before := s.MemoryBytes()
+	removed, reclaimed := s.CompactReclaimed()
+	<-done
+
+	if removed != 5000 {
+		t.Errorf("CompactReclaimed removed %d entries, want 5000", removed)
+	}
+	if want := before - s.MemoryBytes(); reclaimed != want || reclaimed <= 0 {
+		t.Errorf("CompactReclaimed reclaimed %d bytes, want %d", reclaimed, want)
+	}
+
+	if removed, reclaimed := s.CompactReclaimed(); removed != 0 || reclaimed != 0 {
+		t.Errorf("second CompactReclaimed=%d, %d, want 0, 0", removed, reclaimed)
+	}
+}
+
+func TestCompactConcurrent(t *testing.T) {
+
+	sig := func(i int) uint64 { return uint64(i) * 0x9e3779b97f4a7c15 }
+
+	s := New3(1000, NewU64Slice)
+	for i := 0; i < 1000; i++ {
+		s.Add(sig(i), uint64(i))
+	}
+	s.Finish()
+
+	// compactions run while documents are added and deleted, and none of
+	// the changes are lost
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				id := 1000 + 50*g + i
+				s.Add(sig(id), uint64(id))
+				s.Delete(uint64(50*g + i))
+				s.Compact()
+			}
+		}(g)
+	}
+	wg.Wait()
+	s.Compact()
+
+	if s.Len() != 1000 || s.Deleted() != 0 {
+		t.Errorf("after concurrent Compacts: Len()=%d, Deleted()=%d, want 1000, 0", s.Len(), s.Deleted())
+	}
+	for i := 0; i < 1200; i++ {
+		var want []uint64
+		if i >= 200 {
+			want = []uint64{uint64(i)}
+		}
+		if got := s.Find(sig(i)); !reflect.DeepEqual(got, want) {
+			t.Errorf("Find(sig(%d)) after concurrent Compacts=%v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestDeleteAddAgain(t *testing.T) {
+
+	sig := func(i int) uint64 { return uint64(i) * 0x9e3779b97f4a7c15 }
+
+	s := New3(10, NewU64Slice, IndexDocIDs())
+	for i := 0; i < 10; i++ {
+		s.Add(sig(i), uint64(i))
+	}
+	s.Finish()
+	s.Add(sig(50), 1)
+
+	// a document deleted and then added again with a new signature is only
+	// found by it, before and after Compact
+	s.Delete(1)
+	s.Add(sig(60), 1)
+	s.Add(sig(61), 1)
+
+	check := func(when string) {
+		for _, i := range []int{1, 50} {
+			if got := s.Find(sig(i)); got != nil {
+				t.Errorf("%s: Find(sig(%d))=%v, want nil", when, i, got)
+			}
+		}
+		for _, i := range []int{60, 61} {
+			if got := s.Find(sig(i)); !reflect.DeepEqual(got, []uint64{1}) {
+				t.Errorf("%s: Find(sig(%d))=%v, want [1]", when, i, got)
+			}
+		}
+		want := unique([]uint64{sig(60), sig(61)})
+		if got := s.SignaturesOf(1); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: SignaturesOf(1)=%x, want %x", when, got, want)
+		}
+		var n int
+		s.Range(func(sig, docid uint64) bool {
+			if docid == 1 {
+				n++
+			}
+			return true
+		})
+		if n != 2 {
+			t.Errorf("%s: Range got %d entries of docid 1, want 2", when, n)
+		}
+	}
+
+	check("before Compact")
+	if removed := s.Compact(); removed != 1 {
+		t.Errorf("Compact()=%d, want the 1 entry of docid 1 in the tables", removed)
+	}
+	if s.Deleted() != 0 || s.Len() != 11 {
+		t.Errorf("after Compact: Deleted()=%d, Len()=%d, want 0, 11", s.Deleted(), s.Len())
+	}
+	check("after Compact")
+
+	// deleted again, it's gone
+	s.Delete(1)
+	if got := s.Find(sig(60)); got != nil {
+		t.Errorf("Find(sig(60)) after deleting again=%v, want nil", got)
+	}
+
+	// documents deleted and added again while Compact runs keep their new
+	// entries and lose their old ones
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			s.Compact()
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		s.Add(sig(100+i), 2)
+		s.Delete(2)
+		s.Add(sig(200+i), 2)
+	}
+	wg.Wait()
+	s.Compact()
+
+	if got := s.SignaturesOf(2); !reflect.DeepEqual(got, []uint64{sig(249)}) {
+		t.Errorf("SignaturesOf(2) after concurrent Compacts=%x, want [%x]", got, sig(249))
+	}
+	if s.Deleted() != 0 {
+		t.Errorf("Deleted() after concurrent Compacts=%d, want 0", s.Deleted())
+	}
+}
+
+func TestDeleteFunc(t *testing.T) {
+
+	sig := func(i int) uint64 { return uint64(i) * 0x9e3779b97f4a7c15 }
+
+	// the customer of a document is its docid / 1000
+	s := New3(10, NewU64Slice)
+	for i := 0; i < 30; i++ {
+		s.Add(sig(i), uint64(i%3*1000+i))
+	}
+	s.Add(sig(100), 1001)
+	s.Finish()
+	s.Add(sig(101), 1002)
+	s.Delete(1004)
+
+	n := s.DeleteFunc(func(sig, docid uint64) bool { return docid/1000 == 1 })
+	if n != 10 {
+		t.Errorf("DeleteFunc deleted %d documents, want the 10 of customer 1 not already deleted", n)
+	}
+
+	for i := 0; i < 30; i++ {
+		if got := s.Find(sig(i)); (got == nil) != (i%3 == 1) {
+			t.Errorf("Find(sig(%d))=%v", i, got)
+		}
+	}
+	if s.Find(sig(100)) != nil || s.Find(sig(101)) != nil {
+		t.Errorf("found a document of customer 1 added twice, or since Finish")
+	}
+
+	// a document is deleted with all its signatures
+	if n := s.DeleteFunc(func(s, docid uint64) bool { return docid == 2005 && s == sig(5) }); n != 1 {
+		t.Errorf("DeleteFunc of one entry deleted %d documents, want 1", n)
+	}
+	if s.DeleteFunc(func(sig, docid uint64) bool { return true }) != 19 {
+		t.Errorf("DeleteFunc of everything didn't delete the 19 documents left")
+	}
+}
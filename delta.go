@@ -0,0 +1,116 @@
+package simstore
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// deltaBlockSize is the number of hashes in each block of a deltaStore
+const deltaBlockSize = 128
+
+// deltaStore keeps its sorted hashes in blocks of deltaBlockSize.  The first
+// hash of each block is kept in an index for the binary search, and the rest
+// as uvarint-encoded differences from the hash before.
+type deltaStore struct {
+	u     u64slice // the hashes, until Finish
+	first []uint64 // first hash of each block
+	offs  []int    // offset of each block's deltas in b
+	b     []byte
+	n     int
+}
+
+// NewDeltaStore returns a U64Store which keeps its sorted hashes as
+// varint-encoded deltas.  The hashes of n uniformly distributed signatures
+// are about 2^64/n apart, so each takes about (64-log2(n))/7 bytes rather than
+// 8.  Unlike NewZStore, a search decodes only the hashes it scans, without a
+// block decompression or allocation.
+func NewDeltaStore(hashes int) U64Store {
+	return &deltaStore{u: make(u64slice, 0, hashes)}
+}
+
+func (z *deltaStore) Add(p uint64) {
+	z.u = append(z.u, p)
+}
+
+func (z *deltaStore) Finish() {
+	z.u.Finish()
+
+	z.n = len(z.u)
+	blocks := (z.n + deltaBlockSize - 1) / deltaBlockSize
+	z.first = make([]uint64, 0, blocks)
+	z.offs = make([]int, 0, blocks)
+
+	var buf [binary.MaxVarintLen64]byte
+	for i, h := range z.u {
+		if i%deltaBlockSize == 0 {
+			z.first = append(z.first, h)
+			z.offs = append(z.offs, len(z.b))
+			continue
+		}
+		n := binary.PutUvarint(buf[:], h-z.u[i-1])
+		z.b = append(z.b, buf[:n]...)
+	}
+
+	// drop the spare capacity of the encoding
+	z.b = append([]byte(nil), z.b...)
+	z.u = nil
+}
+
+func (z *deltaStore) Find(sig, mask uint64, d int) []uint64 {
+	ids, _ := z.FindScanned(sig, mask, d)
+	return ids
+}
+
+func (z *deltaStore) FindScanned(sig, mask uint64, d int) ([]uint64, int) {
+	return z.findScanned(sig, mask, d, false)
+}
+
+// findScanned is FindScanned, but finds the first block of the prefix run
+// with interpolation search if interpolate is set
+func (z *deltaStore) findScanned(sig, mask uint64, d int, interpolate bool) ([]uint64, int) {
+
+	prefix := sig & mask
+
+	// the prefix run may start in the block before the first block whose
+	// first hash is in it
+	var block int
+	if interpolate {
+		block = interpolationSearch(z.first, prefix)
+	} else {
+		block = sort.Search(len(z.first), func(i int) bool { return z.first[i] >= prefix })
+	}
+	if block > 0 {
+		block--
+	}
+
+	var ids []uint64
+	var scanned int
+
+	for ; block < len(z.first); block++ {
+		h := z.first[block]
+		off := z.offs[block]
+
+		for i := block * deltaBlockSize; i < z.n && i < (block+1)*deltaBlockSize; i++ {
+			if i > block*deltaBlockSize {
+				delta, n := binary.Uvarint(z.b[off:])
+				h += delta
+				off += n
+			}
+
+			if h < prefix {
+				continue
+			}
+
+			if h&mask != prefix {
+				return ids, scanned
+			}
+
+			scanned++
+			if distance(h, sig) <= d {
+				ids = append(ids, h)
+			}
+		}
+	}
+
+	return ids, scanned
+}
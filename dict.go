@@ -0,0 +1,248 @@
+package simstore
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+)
+
+// The format written by Dictionary.WriteTo, and read by ReadDictionary.  Like
+// a snapshot's, each section is followed by its checksum.  All integers are
+// little-endian.
+//
+//	magic    [8]byte  "simdocid"
+//	version  uint32
+//	keys     uint64   number of keys
+//	crc      uint64   CRC-32C of the header
+//	keys × (
+//	  length uint64
+//	  key    [length]byte
+//	), in the order of their docids
+//	crc      uint64   CRC-32C of the keys
+const (
+	dictionaryMagic   = "simdocid"
+	dictionaryVersion = 1
+)
+
+// ErrDictionaryFormat is returned when a dictionary is truncated, corrupt, or
+// of an unknown version
+var ErrDictionaryFormat = errors.New("simstore: invalid docid dictionary")
+
+// Dictionary maps string document identifiers, such as URLs or UUIDs, to
+// dense docids, starting from 0 in the order the keys were first seen, and
+// back, so a store can index documents which aren't identified by a uint64.
+// Each key costs its length plus a map entry and a string header.
+type Dictionary struct {
+	mu   sync.RWMutex
+	ids  map[string]uint64
+	keys []string
+}
+
+// NewDictionary returns an empty Dictionary
+func NewDictionary() *Dictionary {
+	return &Dictionary{ids: make(map[string]uint64)}
+}
+
+// ID returns the docid of key, assigning it the next one if it has none
+func (d *Dictionary) ID(key string) uint64 {
+	d.mu.RLock()
+	id, ok := d.ids[key]
+	d.mu.RUnlock()
+	if ok {
+		return id
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if id, ok := d.ids[key]; ok {
+		return id
+	}
+	id = uint64(len(d.keys))
+	d.ids[key] = id
+	d.keys = append(d.keys, key)
+	return id
+}
+
+// Lookup returns the docid of key, and whether it has one
+func (d *Dictionary) Lookup(key string) (uint64, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	id, ok := d.ids[key]
+	return id, ok
+}
+
+// Key returns the key of docid, and whether it has one
+func (d *Dictionary) Key(docid uint64) (string, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if docid >= uint64(len(d.keys)) {
+		return "", false
+	}
+	return d.keys[docid], true
+}
+
+// Keys returns the keys of docids, as returned by the searches of a store.
+// Unknown docids are skipped.
+func (d *Dictionary) Keys(docids []uint64) []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var keys []string
+	for _, id := range docids {
+		if id < uint64(len(d.keys)) {
+			keys = append(keys, d.keys[id])
+		}
+	}
+	return keys
+}
+
+// Len returns the number of keys
+func (d *Dictionary) Len() int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return len(d.keys)
+}
+
+// WriteTo writes the dictionary to w, to be read by ReadDictionary alongside
+// a snapshot of the store whose docids it assigned
+func (d *Dictionary) WriteTo(w io.Writer) (int64, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	sw := newSnapshotWriter(w)
+
+	sw.writeString(dictionaryMagic)
+	sw.put32(dictionaryVersion)
+	sw.put64(uint64(len(d.keys)))
+	sw.endSection()
+
+	for _, k := range d.keys {
+		sw.put64(uint64(len(k)))
+		sw.writeString(k)
+	}
+	sw.endSection()
+
+	err := sw.flush()
+	return sw.n, err
+}
+
+// ReadDictionary reads a dictionary written by Dictionary.WriteTo
+func ReadDictionary(r io.Reader) (*Dictionary, error) {
+
+	sr := snapshotReader{r: r, checksums: true}
+
+	hdr, err := sr.bytes(8 + 4)
+	if err != nil {
+		return nil, dictionaryReadError(err)
+	}
+	if string(hdr[:8]) != dictionaryMagic || binary.LittleEndian.Uint32(hdr[8:]) != dictionaryVersion {
+		return nil, ErrDictionaryFormat
+	}
+
+	n, err := sr.word()
+	if err == nil {
+		err = sr.check("header")
+	}
+	if err != nil {
+		return nil, dictionaryReadError(err)
+	}
+
+	d := &Dictionary{
+		ids:  make(map[string]uint64, capHint(n)),
+		keys: make([]string, 0, capHint(n)),
+	}
+	for i := uint64(0); i < n; i++ {
+		l, err := sr.word()
+		if err != nil {
+			return nil, dictionaryReadError(err)
+		}
+		if l > 1<<32 {
+			return nil, ErrDictionaryFormat
+		}
+		b, err := sr.bytes(l)
+		if err != nil {
+			return nil, dictionaryReadError(err)
+		}
+		k := string(b)
+		if _, ok := d.ids[k]; ok {
+			return nil, ErrDictionaryFormat
+		}
+		d.ids[k] = i
+		d.keys = append(d.keys, k)
+	}
+	if err := sr.check("keys"); err != nil {
+		return nil, dictionaryReadError(err)
+	}
+
+	return d, nil
+}
+
+// dictionaryReadError returns ErrDictionaryFormat for a dictionary which
+// ended early or doesn't match its checksums
+func dictionaryReadError(err error) error {
+	if err == ErrSnapshotFormat || errors.Is(err, ErrSnapshotChecksum) {
+		return ErrDictionaryFormat
+	}
+	return err
+}
+
+// StringStore is a Store whose documents are identified by strings, mapped
+// to its docids by a Dictionary.  Unlike a PayloadStore[string], adding a key
+// again adds to the same document, and the dictionary can be written out and
+// read back with a snapshot of the store.
+type StringStore struct {
+	s    *Store
+	dict *Dictionary
+}
+
+// NewStringStore returns a StringStore keeping its signatures in s and its
+// keys in dict, such as a store read by ReadFrom and the dictionary read by
+// ReadDictionary with it.  A nil dict is a new, empty one, and s must then be
+// empty too.
+func NewStringStore(s *Store, dict *Dictionary) *StringStore {
+	if dict == nil {
+		dict = NewDictionary()
+	}
+	return &StringStore{s: s, dict: dict}
+}
+
+// Add inserts a signature of the document key.  After Finish, Add may be
+// called concurrently with searches.
+func (ss *StringStore) Add(sig uint64, key string) {
+	ss.s.Add(sig, ss.dict.ID(key))
+}
+
+// Finish prepares the store for searching, as Store.Finish does
+func (ss *StringStore) Finish() {
+	ss.s.Finish()
+}
+
+// Find returns the sorted keys of the documents Find would return for sig
+func (ss *StringStore) Find(sig uint64) []string {
+	keys := ss.dict.Keys(ss.s.Find(sig))
+	sort.Strings(keys)
+	return keys
+}
+
+// Delete removes the document key from the results of searches.  Like
+// Store.Delete, it applies to the key's docid, which it keeps, so signatures
+// added for key again before the store is compacted are hidden too.
+func (ss *StringStore) Delete(key string) {
+	if id, ok := ss.dict.Lookup(key); ok {
+		ss.s.Delete(id)
+	}
+}
+
+// Store returns the underlying store, for the searches StringStore doesn't
+// wrap.  Its results are docids, which the dictionary maps back to keys.
+func (ss *StringStore) Store() *Store {
+	return ss.s
+}
+
+// Dictionary returns the dictionary mapping the keys to docids
+func (ss *StringStore) Dictionary() *Dictionary {
+	return ss.dict
+}
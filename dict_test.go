@@ -0,0 +1,74 @@
+package simstore
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestStringStore(t *testing.T) {
+
+	const sig = 0xdeadbeefcafebabe
+
+	ss := NewStringStore(New3(10, NewU64Slice), nil)
+	ss.Add(sig, "https://example.com/b")
+	ss.Add(sig^1, "https://example.com/a")
+	ss.Add(^uint64(sig), "https://example.com/c")
+	ss.Add(sig^0xff00ff, "https://example.com/a")
+	ss.Finish()
+
+	if got, want := ss.Find(sig), []string{"https://example.com/a", "https://example.com/b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Find=%q, want %q", got, want)
+	}
+	if d := ss.Dictionary(); d.Len() != 3 {
+		t.Errorf("dictionary of %d keys, want 3", d.Len())
+	}
+
+	ss.Delete("https://example.com/b")
+	ss.Delete("https://example.com/unknown")
+	ss.Store().Compact()
+
+	// the store and its dictionary, written out and read back
+	var snap, dict bytes.Buffer
+	if _, err := ss.Store().WriteTo(&snap); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ss.Dictionary().WriteTo(&dict); err != nil {
+		t.Fatal(err)
+	}
+	raw := dict.Bytes()
+
+	s, err := ReadFrom(&snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := ReadDictionary(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss = NewStringStore(s, d)
+
+	if got, want := ss.Find(sig^0xff00fe), []string{"https://example.com/a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Find after ReadDictionary=%q, want %q", got, want)
+	}
+	if id, ok := d.Lookup("https://example.com/c"); id != 2 || !ok {
+		t.Errorf("Lookup=%d,%v, want 2,true", id, ok)
+	}
+	if d.ID("https://example.com/d") != 3 {
+		t.Errorf("a new key after ReadDictionary didn't get the next docid")
+	}
+
+	for _, tt := range []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"magic", append([]byte("simstore"), raw[8:]...)},
+		{"truncated", raw[:len(raw)-3]},
+		{"corrupt", append(append([]byte{}, raw[:30]...), append([]byte{raw[30] ^ 1}, raw[31:]...)...)},
+	} {
+		if _, err := ReadDictionary(bytes.NewReader(tt.data)); err != ErrDictionaryFormat {
+			t.Errorf("%s: ReadDictionary=%v, want ErrDictionaryFormat", tt.name, err)
+		}
+	}
+}
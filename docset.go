@@ -0,0 +1,229 @@
+package simstore
+
+import (
+	"math/bits"
+	"sort"
+)
+
+// docSetMin is the number of documents a signature needs for DocIDSets to
+// store them as a docSet rather than as entries of the document table
+const docSetMin = 16
+
+// DocIDSets makes Finish store the document ids of each signature added with
+// many documents as a compressed bitmap instead of an entry per document in the
+// document table, which costs 16 bytes each.  The bitmap is a set, so repeated
+// entries are collapsed as they are by Dedup.  Finding the documents of such a
+// signature then iterates its bitmap rather than scanning a run of the table.
+// A store opened with OpenMmap doesn't use the bitmaps.
+func DocIDSets() Option {
+	return func(s *Store) { s.docSets = true }
+}
+
+// docSets holds the docSet of each signature with one, sorted by signature
+type docSets struct {
+	hashes []uint64
+	sets   []*docSet
+	n      int // total documents in the sets
+}
+
+// find returns the docSet of sig, or nil if it doesn't have one
+func (d *docSets) find(sig uint64) *docSet {
+	i := sort.Search(len(d.hashes), func(i int) bool { return d.hashes[i] >= sig })
+	if i < len(d.hashes) && d.hashes[i] == sig {
+		return d.sets[i]
+	}
+	return nil
+}
+
+// entries appends the (signature, document id) entries of the sets to t
+func (d *docSets) entries(t table) table {
+	for i, set := range d.sets {
+		set.each(func(docid uint64) { t = append(t, entry{hash: d.hashes[i], docid: docid}) })
+	}
+	return t
+}
+
+func (d *docSets) memoryBytes() int64 {
+	n := 16 * int64(len(d.hashes))
+	for _, set := range d.sets {
+		n += set.memoryBytes()
+	}
+	return n
+}
+
+// groupDocIDs moves the runs of at least docSetMin entries sharing a signature
+// out of the sorted table t into docSets, and returns the rest of the table.
+func groupDocIDs(t table) (table, docSets) {
+
+	var sets docSets
+	var rest table
+
+	for i := 0; i < len(t); {
+		j := i + 1
+		for j < len(t) && t[j].hash == t[i].hash {
+			j++
+		}
+
+		if j-i < docSetMin {
+			rest = append(rest, t[i:j]...)
+			i = j
+			continue
+		}
+
+		set := &docSet{}
+		for _, e := range t[i:j] {
+			set.push(e.docid)
+		}
+		sets.hashes = append(sets.hashes, t[i].hash)
+		sets.sets = append(sets.sets, set)
+		sets.n += set.n
+		i = j
+	}
+
+	if len(sets.hashes) == 0 {
+		return t, sets
+	}
+
+	// a copy, so the memory of the original table is freed
+	return append(table(nil), rest...), sets
+}
+
+// docSet is a set of document ids stored as a roaring bitmap: the ids are
+// split by their high 48 bits into containers holding the low 16 bits, either
+// as a sorted array while there are at most arrayMax of them, or as a bitmap
+// of all 65536.  An array costs 2 bytes per id and a bitmap 8k, so a container
+// never needs more than 8k, while the ids of a dense range cost a bit each.
+type docSet struct {
+	keys       []uint64 // the high 48 bits of the ids of each container
+	containers []container
+	n          int
+}
+
+// arrayMax is the most ids an array container holds
+const arrayMax = 4096
+
+type container struct {
+	array  []uint16
+	bitmap *[1 << 10]uint64
+}
+
+// push adds docid to the set.  The ids must be pushed in ascending order.
+func (d *docSet) push(docid uint64) {
+
+	key, low := docid>>16, uint16(docid)
+
+	if k := len(d.keys); k == 0 || d.keys[k-1] != key {
+		d.keys = append(d.keys, key)
+		d.containers = append(d.containers, container{})
+	}
+
+	c := &d.containers[len(d.containers)-1]
+
+	if c.bitmap != nil {
+		if c.bitmap[low>>6]&(1<<(low&63)) == 0 {
+			c.bitmap[low>>6] |= 1 << (low & 63)
+			d.n++
+		}
+		return
+	}
+
+	if n := len(c.array); n > 0 && c.array[n-1] == low {
+		return
+	}
+
+	if len(c.array) < arrayMax {
+		c.array = append(c.array, low)
+		d.n++
+		return
+	}
+
+	// convert to a bitmap
+	c.bitmap = new([1 << 10]uint64)
+	for _, v := range c.array {
+		c.bitmap[v>>6] |= 1 << (v & 63)
+	}
+	c.array = nil
+	c.bitmap[low>>6] |= 1 << (low & 63)
+	d.n++
+}
+
+// contains reports whether docid is in the set
+func (d *docSet) contains(docid uint64) bool {
+
+	key, low := docid>>16, uint16(docid)
+
+	i := sort.Search(len(d.keys), func(i int) bool { return d.keys[i] >= key })
+	if i == len(d.keys) || d.keys[i] != key {
+		return false
+	}
+
+	c := &d.containers[i]
+	if c.bitmap != nil {
+		return c.bitmap[low>>6]&(1<<(low&63)) != 0
+	}
+
+	j := sort.Search(len(c.array), func(j int) bool { return c.array[j] >= low })
+	return j < len(c.array) && c.array[j] == low
+}
+
+// each calls fn with the ids of the set in ascending order
+func (d *docSet) each(fn func(docid uint64)) {
+	for i, c := range d.containers {
+		high := d.keys[i] << 16
+
+		if c.bitmap == nil {
+			for _, v := range c.array {
+				fn(high | uint64(v))
+			}
+			continue
+		}
+
+		for w, word := range c.bitmap {
+			for word != 0 {
+				fn(high | uint64(w<<6+bits.TrailingZeros64(word)))
+				word &= word - 1
+			}
+		}
+	}
+}
+
+// appendTo appends the ids of the set to dst in ascending order
+func (d *docSet) appendTo(dst []uint64) []uint64 {
+	d.each(func(docid uint64) { dst = append(dst, docid) })
+	return dst
+}
+
+func (d *docSet) memoryBytes() int64 {
+	n := 8*int64(cap(d.keys)) + 32*int64(cap(d.containers))
+	for _, c := range d.containers {
+		n += 2 * int64(cap(c.array))
+		if c.bitmap != nil {
+			n += 8 << 10
+		}
+	}
+	return n
+}
+
+// entryCount returns the number of entries in the document table, counting
+// those of the docid sets and the slabs of an unfinished store.  The caller
+// must hold the lock.
+func (s *Store) entryCount() int {
+	return len(s.docids) + s.sets.n + s.overflow.n
+}
+
+// entries returns the sorted document table, with the entries of the docid
+// sets put back into it.  The caller must hold the lock.  The table may alias
+// the mapping of a store opened with OpenMmap, so the caller must also keep s
+// reachable while using it, as a deferred unlock does, or with
+// runtime.KeepAlive.
+func (s *Store) entries() table {
+	if len(s.sets.hashes) == 0 {
+		return s.docids
+	}
+
+	t := make(table, 0, s.entryCount())
+	t = append(t, s.docids...)
+	t = s.sets.entries(t)
+	sort.Sort(t)
+	return t
+}
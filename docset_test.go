@@ -0,0 +1,133 @@
+package simstore
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestDocSet(t *testing.T) {
+
+	r := rand.New(rand.NewSource(0))
+
+	// sparse ids in several containers, and a dense run which needs a bitmap
+	var ids []uint64
+	for i := 0; i < 1000; i++ {
+		ids = append(ids, uint64(r.Int63n(1<<20)))
+	}
+	for i := uint64(0); i < 3*arrayMax; i++ {
+		ids = append(ids, 5<<16+2*i)
+	}
+	want := ids[:sortUnique(ids)]
+
+	var d docSet
+	for _, id := range want {
+		d.push(id)
+	}
+
+	if d.n != len(want) {
+		t.Errorf("n=%d, want %d", d.n, len(want))
+	}
+
+	if got := d.appendTo(nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("appendTo returned %d ids, want %d", len(got), len(want))
+	}
+
+	for _, id := range want[:100] {
+		if !d.contains(id) {
+			t.Errorf("contains(%d)=false", id)
+		}
+	}
+	for _, id := range []uint64{5<<16 + 1, 1 << 40} {
+		if d.contains(id) {
+			t.Errorf("contains(%d)=true", id)
+		}
+	}
+
+	if got := d.memoryBytes(); got >= 16*int64(len(want)) {
+		t.Errorf("memoryBytes=%d, want less than the %d of table entries", got, 16*len(want))
+	}
+}
+
+func TestDocIDSets(t *testing.T) {
+
+	r := rand.New(rand.NewSource(1))
+
+	// a few signatures shared by many documents, and many unique ones
+	var sigs, docids []uint64
+	shared := []uint64{0x1111111111111111, 0x2222222222222222, 0x3333333333333333}
+	for i := 0; i < 5000; i++ {
+		sig := uint64(r.Int63())
+		if i%3 == 0 {
+			sig = shared[i/3%len(shared)]
+		}
+		sigs = append(sigs, sig)
+		docids = append(docids, uint64(i))
+	}
+
+	want := New3(len(sigs), NewU64Slice, IndexDocIDs())
+	s := New3(len(sigs), NewU64Slice, IndexDocIDs(), DocIDSets())
+	for i, sig := range sigs {
+		want.Add(sig, docids[i])
+		s.Add(sig, docids[i])
+	}
+	want.Finish()
+	s.Finish()
+
+	if len(s.sets.hashes) != len(shared) {
+		t.Fatalf("%d docid sets, want %d", len(s.sets.hashes), len(shared))
+	}
+
+	check := func(stage string) {
+		t.Helper()
+		for _, q := range append(shared, sigs[1], sigs[2]^1, shared[0]^7) {
+			if got, w := s.Find(q), want.Find(q); !reflect.DeepEqual(got, w) {
+				t.Errorf("%s: Find(%016x) found %d docids, want %d", stage, q, len(got), len(w))
+			}
+			if got, w := s.FindInto(q, nil), want.FindInto(q, nil); !reflect.DeepEqual(got, w) {
+				t.Errorf("%s: FindInto(%016x) found %d docids, want %d", stage, q, len(got), len(w))
+			}
+		}
+		if got, w := s.FindByDocID(3), want.FindByDocID(3); !reflect.DeepEqual(got, w) {
+			t.Errorf("%s: FindByDocID(3) found %d docids, want %d", stage, len(got), len(w))
+		}
+		if got, w := s.Stats(), want.Stats(); got.Entries != w.Entries || got.DuplicateRatio != w.DuplicateRatio {
+			t.Errorf("%s: Stats=%+v, want %+v", stage, got, w)
+		}
+	}
+
+	check("finished")
+
+	if got, w := s.Stats().MemoryBytes, want.Stats().MemoryBytes; got >= w {
+		t.Errorf("MemoryBytes=%d, want less than %d", got, w)
+	}
+
+	for _, st := range []*Store{want, s} {
+		st.Delete(0)
+		st.Add(shared[0], 10000)
+		st.Compact()
+	}
+
+	check("compacted")
+
+	var buf bytes.Buffer
+	if _, err := s.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var wbuf bytes.Buffer
+	want.WriteTo(&wbuf)
+	if !bytes.Equal(buf.Bytes(), wbuf.Bytes()) {
+		t.Errorf("snapshot differs from that of a store without DocIDSets")
+	}
+
+	s, err := ReadFrom(&buf, IndexDocIDs(), DocIDSets())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.sets.hashes) != len(shared) {
+		t.Errorf("ReadFrom: %d docid sets, want %d", len(s.sets.hashes), len(shared))
+	}
+
+	check("read")
+}
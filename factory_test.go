@@ -0,0 +1,102 @@
+package simstore_test
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/dgryski/go-bits"
+	"github.com/dgryski/go-simstore"
+)
+
+// linearStore is a U64Store which scans all its hashes on every Find
+type linearStore struct {
+	hashes   []uint64
+	finished bool
+	finds    *int
+}
+
+func (l *linearStore) Add(hash uint64) {
+	if l.finished {
+		panic("Add after Finish")
+	}
+	l.hashes = append(l.hashes, hash)
+}
+
+func (l *linearStore) Find(sig, mask uint64, d int) []uint64 {
+	if !l.finished {
+		panic("Find before Finish")
+	}
+	*l.finds++
+
+	var ids []uint64
+	for _, h := range l.hashes {
+		if h&mask == sig&mask && int(bits.Popcnt(h^sig)) <= d {
+			ids = append(ids, h)
+		}
+	}
+	return ids
+}
+
+func (l *linearStore) Finish() {
+	l.finished = true
+}
+
+func TestStorageFactory(t *testing.T) {
+
+	var tables, finds int
+	var sizes []int
+
+	factory := func(hashes int) simstore.U64Store {
+		tables++
+		sizes = append(sizes, hashes)
+		return &linearStore{hashes: make([]uint64, 0, hashes), finds: &finds}
+	}
+
+	const size = 10000
+
+	s := simstore.New6(2*size, factory)
+	want := simstore.New6(size, simstore.NewU64Slice)
+
+	// the tables are created by Finish, for the entries added
+	if tables != 0 {
+		t.Errorf("factory called %d times before Finish, want 0", tables)
+	}
+
+	rand.Seed(0)
+
+	var sigs []uint64
+	for i := 0; i < size; i++ {
+		sig := uint64(rand.Int63())
+		sigs = append(sigs, sig)
+		s.Add(sig, uint64(i))
+		want.Add(sig, uint64(i))
+	}
+
+	s.Finish()
+	want.Finish()
+
+	if tables != 49 {
+		t.Errorf("factory called %d times, want 49", tables)
+	}
+	for _, n := range sizes {
+		if n != size {
+			t.Fatalf("factory called for %d hashes, want %d", n, size)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		q := sigs[rand.Intn(len(sigs))]
+		for j := 0; j < rand.Intn(7); j++ {
+			q ^= 1 << uint(rand.Intn(64))
+		}
+
+		if got, w := s.Find(q), want.Find(q); !reflect.DeepEqual(got, w) {
+			t.Errorf("Find(%016x)=%v, want %v", q, got, w)
+		}
+	}
+
+	if finds != 100*49 {
+		t.Errorf("U64Store.Find called %d times, want %d", finds, 100*49)
+	}
+}
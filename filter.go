@@ -0,0 +1,203 @@
+package simstore
+
+import (
+	"runtime"
+	"sync"
+)
+
+// xorFilter is an xor filter with 8-bit fingerprints: a set of keys which
+// reports a key that isn't in it as present with probability 1/256, in about
+// 1.23 bytes per key.  See Graf and Lemire, "Xor Filters: Faster and Smaller
+// Than Bloom and Cuckoo Filters".  A nil filter contains every key.
+type xorFilter struct {
+	seed         uint64
+	blockLength  uint32
+	fingerprints []uint8
+}
+
+// xorFilterAttempts bounds the seeds tried to build a filter, each of which
+// fails with a small probability for distinct keys
+const xorFilterAttempts = 100
+
+// newXorFilter returns a filter of keys, which must be distinct, or nil if it
+// can't be built
+func newXorFilter(keys []uint64) *xorFilter {
+
+	capacity := 32 + uint32(1.23*float64(len(keys)))
+	capacity = capacity / 3 * 3
+
+	f := &xorFilter{
+		blockLength:  capacity / 3,
+		fingerprints: make([]uint8, capacity),
+	}
+
+	// for each slot, the xor of the hashes of the keys mapped to it and their
+	// number
+	xormask := make([]uint64, capacity)
+	count := make([]uint32, capacity)
+
+	queue := make([]uint32, 0, capacity)
+
+	type peeled struct {
+		slot uint32
+		hash uint64
+	}
+	stack := make([]peeled, 0, len(keys))
+
+	for attempt := 0; attempt < xorFilterAttempts; attempt++ {
+
+		f.seed = mix64(uint64(attempt) + 0x9e3779b97f4a7c15)
+
+		for i := range xormask {
+			xormask[i], count[i] = 0, 0
+		}
+		for _, k := range keys {
+			h := f.hash(k)
+			for _, slot := range f.slots(h) {
+				xormask[slot] ^= h
+				count[slot]++
+			}
+		}
+
+		// peel the slots with a single key until none are left
+		queue = queue[:0]
+		for i, c := range count {
+			if c == 1 {
+				queue = append(queue, uint32(i))
+			}
+		}
+
+		stack = stack[:0]
+		for len(queue) > 0 {
+			i := queue[len(queue)-1]
+			queue = queue[:len(queue)-1]
+			if count[i] == 0 {
+				continue
+			}
+
+			h := xormask[i]
+			stack = append(stack, peeled{i, h})
+			for _, slot := range f.slots(h) {
+				xormask[slot] ^= h
+				count[slot]--
+				if count[slot] == 1 {
+					queue = append(queue, slot)
+				}
+			}
+		}
+
+		if len(stack) == len(keys) {
+			break
+		}
+	}
+
+	if len(stack) != len(keys) {
+		return nil
+	}
+
+	// assign the fingerprints in the reverse order of peeling, so each slot
+	// is set after the other slots of its key
+	for i := len(stack) - 1; i >= 0; i-- {
+		p := stack[i]
+		fp := fingerprint(p.hash)
+		for _, slot := range f.slots(p.hash) {
+			fp ^= f.fingerprints[slot]
+		}
+		f.fingerprints[p.slot] = fp
+	}
+
+	return f
+}
+
+// contains reports whether key may be in the filter
+func (f *xorFilter) contains(key uint64) bool {
+	if f == nil {
+		return true
+	}
+
+	h := f.hash(key)
+	s := f.slots(h)
+	return fingerprint(h) == f.fingerprints[s[0]]^f.fingerprints[s[1]]^f.fingerprints[s[2]]
+}
+
+func (f *xorFilter) hash(key uint64) uint64 {
+	return mix64(key + f.seed)
+}
+
+// slots returns the slot of h in each of the three blocks
+func (f *xorFilter) slots(h uint64) [3]uint32 {
+	return [3]uint32{
+		reduce(uint32(h), f.blockLength),
+		reduce(uint32(h>>21|h<<43), f.blockLength) + f.blockLength,
+		reduce(uint32(h>>42|h<<22), f.blockLength) + 2*f.blockLength,
+	}
+}
+
+func (f *xorFilter) memoryBytes() int64 {
+	if f == nil {
+		return 0
+	}
+	return int64(cap(f.fingerprints))
+}
+
+func fingerprint(h uint64) uint8 {
+	return uint8(h ^ h>>32)
+}
+
+// reduce maps h to [0,n) without a division
+func reduce(h, n uint32) uint32 {
+	return uint32(uint64(h) * uint64(n) >> 32)
+}
+
+// mix64 is the finalizer of MurmurHash3
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// buildFilters returns the xor filters of the distinct prefixes of each of the
+// tables rhashes, holding the entries docids
+func (s *Store) buildFilters(rhashes []U64Store, docids table) []*xorFilter {
+
+	filters := make([]*xorFilter, len(rhashes))
+
+	l := make(limiter, runtime.GOMAXPROCS(0))
+
+	var wg sync.WaitGroup
+	for t := range rhashes {
+		l.enter()
+		wg.Add(1)
+		go func(t int) {
+			defer func() { l.leave(); wg.Done() }()
+
+			hashes := sortedHashes(rhashes[t])
+			if hashes == nil {
+				hashes = s.permutedHashes(docids, t)
+			}
+
+			_, mask := s.perm.shuffle(0, t)
+
+			var prefixes []uint64
+			for i, h := range hashes {
+				if i == 0 || h&mask != hashes[i-1]&mask {
+					prefixes = append(prefixes, h&mask)
+				}
+			}
+
+			filters[t] = newXorFilter(prefixes)
+		}(t)
+	}
+	wg.Wait()
+
+	return filters
+}
+
+// mayHavePrefix reports whether table t may hold a hash with the prefix of the
+// permuted signature p, which is false only if its prefix filter rules it out
+func (s *Store) mayHavePrefix(t int, p, mask uint64) bool {
+	return s.filters == nil || s.filters[t].contains(p&mask)
+}
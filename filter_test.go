@@ -0,0 +1,189 @@
+package simstore
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestXorFilter(t *testing.T) {
+
+	r := rand.New(rand.NewSource(0))
+
+	for _, n := range []int{0, 1, 100, 100000} {
+		seen := make(map[uint64]bool)
+		var keys []uint64
+		for len(keys) < n {
+			k := r.Uint64()
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+
+		f := newXorFilter(keys)
+		if f == nil {
+			t.Fatalf("n=%d: can't build the filter", n)
+		}
+
+		for _, k := range keys {
+			if !f.contains(k) {
+				t.Fatalf("n=%d: filter doesn't contain %016x", n, k)
+			}
+		}
+
+		// 1 in 256 absent keys pass
+		var passed int
+		const probes = 100000
+		for i := 0; i < probes; i++ {
+			if f.contains(r.Uint64()) {
+				passed++
+			}
+		}
+		if n > 0 && passed > 2*probes/256 {
+			t.Errorf("n=%d: %d of %d absent keys passed", n, passed, probes)
+		}
+
+		if got, max := f.memoryBytes(), int64(1.23*float64(n))+32; got > max {
+			t.Errorf("n=%d: memoryBytes=%d, want at most %d", n, got, max)
+		}
+	}
+
+	var f *xorFilter
+	if !f.contains(1) {
+		t.Errorf("a nil filter doesn't contain every key")
+	}
+}
+
+func TestPrefixFilters(t *testing.T) {
+
+	r := rand.New(rand.NewSource(0))
+
+	sigs := make([]uint64, 20000)
+	for i := range sigs {
+		sigs[i] = r.Uint64()
+	}
+
+	want := New6(len(sigs), NewU64Slice)
+	filtered := New6(len(sigs), NewU64Slice, PrefixFilters())
+	zfiltered := New6(len(sigs), NewZStore, PrefixFilters())
+	for i, sig := range sigs {
+		want.Add(sig, uint64(i))
+		filtered.Add(sig, uint64(i))
+		zfiltered.Add(sig, uint64(i))
+	}
+	want.Finish()
+	filtered.Finish()
+	zfiltered.Finish()
+
+	if len(filtered.filters) != 49 {
+		t.Fatalf("%d filters, want 49", len(filtered.filters))
+	}
+
+	check := func(name string, s *Store) {
+		t.Helper()
+
+		var missScanned, wantScanned int
+		for i := 0; i < 500; i++ {
+			q := sigs[r.Intn(len(sigs))]
+			for j := r.Intn(8); j > 0; j-- {
+				q ^= 1 << uint(r.Intn(64))
+			}
+			if i%2 == 1 {
+				q = r.Uint64()
+			}
+
+			w := want.Find(q)
+			if got := s.Find(q); !reflect.DeepEqual(got, w) {
+				t.Fatalf("%s: Find(%016x)=%v, want %v", name, q, got, w)
+			}
+			if got := s.Contains(q); got != (len(w) > 0) {
+				t.Fatalf("%s: Contains(%016x)=%v, want %v", name, q, got, len(w) > 0)
+			}
+
+			got, scanned := s.FindScanned(q)
+			if !reflect.DeepEqual(got, w) {
+				t.Fatalf("%s: FindScanned(%016x)=%v, want %v", name, q, got, w)
+			}
+			if i%2 == 1 {
+				_, n := want.FindScanned(q)
+				missScanned += scanned
+				wantScanned += n
+			}
+		}
+
+		if missScanned > wantScanned {
+			t.Errorf("%s: random queries scanned %d entries, more than %d without the filters", name, missScanned, wantScanned)
+		}
+	}
+
+	check("U64Slice", &filtered.Store)
+	check("ZStore", &zfiltered.Store)
+
+	// the filters are rebuilt with the tables
+	for i := 0; i < 1000; i++ {
+		want.Delete(uint64(i))
+		filtered.Delete(uint64(i))
+	}
+	want.Compact()
+	filtered.Compact()
+	check("compacted", &filtered.Store)
+
+	var buf bytes.Buffer
+	if _, err := filtered.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := ReadFrom(&buf, PrefixFilters())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.filters) != 49 {
+		t.Fatalf("%d filters after ReadSnapshot, want 49", len(loaded.filters))
+	}
+	check("snapshot", loaded)
+
+	if got, w := filtered.MemoryBytes(), want.MemoryBytes(); got <= w {
+		t.Errorf("MemoryBytes=%d with the filters, want more than %d", got, w)
+	}
+}
+
+// BenchmarkPrefixFilters compares searches for signatures with no match in a
+// sparse store, with and without the prefix filters.  The store has 10 tables
+// with 25-bit prefixes, so it's sparse below about 2^25 signatures.
+//
+//	go test -run=NONE -bench=PrefixFilters -benchsigs=1000000
+func BenchmarkPrefixFilters(b *testing.B) {
+
+	// not the source of benchSignatures, whose values the queries would share
+	r := rand.New(rand.NewSource(1))
+	sigs := benchSignatures()
+
+	queries := make([]uint64, 1<<12)
+	for i := range queries {
+		queries[i] = r.Uint64()
+	}
+
+	for _, bm := range []struct {
+		name string
+		opts []Option
+	}{
+		{"none", nil},
+		{"filters", []Option{PrefixFilters()}},
+	} {
+		s, err := New(3, len(sigs), NewU64Slice, append(bm.opts, PrefixBlocks(2))...)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for i, sig := range sigs {
+			s.Add(sig, uint64(i))
+		}
+		s.Finish()
+
+		b.Run(bm.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				s.Find(queries[i%len(queries)])
+			}
+		})
+	}
+}
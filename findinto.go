@@ -0,0 +1,136 @@
+package simstore
+
+import (
+	"sync"
+)
+
+// scratch holds the buffers of candidate signatures reused by FindInto and
+// FindFunc
+var scratch = sync.Pool{
+	New: func() interface{} { return new([]uint64) },
+}
+
+// FindInto appends the result of Find for sig to dst and returns the extended
+// slice, like the append functions of strconv.  Pass dst[:0] to reuse a
+// buffer.  The signatures found in the tables are collected in a buffer shared
+// between calls and deduplicated by sorting, so once dst is large enough a
+// search of tables created by NewU64Slice doesn't allocate.
+func (s *Store) FindInto(sig uint64, dst []uint64) []uint64 {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	buf := scratch.Get().(*[]uint64)
+	sigs := s.candidates((*buf)[:0], sig)
+
+	n := len(dst)
+	for _, h := range sigs {
+		dst = s.appendDocIDs(dst, h)
+	}
+
+	*buf = sigs[:0]
+	scratch.Put(buf)
+
+	return dst[:n+sortUnique(dst[n:])]
+}
+
+// FindFunc calls fn with each document id Find would return for sig, in
+// ascending order, without allocating for tables created by NewU64Slice.  The
+// store's lock is held while fn runs, so fn must not modify the store.
+func (s *Store) FindFunc(sig uint64, fn func(docid uint64)) {
+	s.withDocIDs(sig, func(ids []uint64) {
+		for _, id := range ids {
+			fn(id)
+		}
+	})
+}
+
+// Count returns the number of documents Find would return for sig, without
+// allocating the result for tables created by NewU64Slice.
+func (s *Store) Count(sig uint64) int {
+	var n int
+	s.withDocIDs(sig, func(ids []uint64) { n = len(ids) })
+	return n
+}
+
+// withDocIDs calls fn with the sorted ids of the documents Find would return
+// for sig, in a buffer shared between calls which fn must not keep.  The lock
+// is held while fn runs.
+func (s *Store) withDocIDs(sig uint64, fn func(ids []uint64)) {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sbuf := scratch.Get().(*[]uint64)
+	dbuf := scratch.Get().(*[]uint64)
+
+	sigs := s.candidates((*sbuf)[:0], sig)
+
+	ids := (*dbuf)[:0]
+	for _, h := range sigs {
+		ids = s.appendDocIDs(ids, h)
+	}
+	ids = ids[:sortUnique(ids)]
+
+	fn(ids)
+
+	*sbuf, *dbuf = sigs[:0], ids[:0]
+	scratch.Put(sbuf)
+	scratch.Put(dbuf)
+}
+
+// candidates appends the distinct signatures within the store's distance of
+// sig to dst.  The caller must hold the lock.
+func (s *Store) candidates(dst []uint64, sig uint64) []uint64 {
+
+	// empty store
+	if s.entryCount() == 0 && len(s.pending) == 0 {
+		return dst
+	}
+
+	d := s.perm.maxDistance()
+
+	for _, e := range s.pending {
+		if distance(e.hash, sig) <= d {
+			dst = append(dst, e.hash)
+		}
+	}
+
+	for _, t := range s.probes {
+		p, mask := s.perm.shuffle(sig, t)
+		n := len(dst)
+		dst = s.probeAppend(dst, t, p, mask, d)
+		s.unshuffleList(dst[n:], t)
+	}
+
+	return dst[:sortUnique(dst)]
+}
+
+// appendDocIDs appends the ids of the documents with exactly the signature sig
+// which haven't been deleted to dst, in no particular order.  The caller must
+// hold the lock.
+func (s *Store) appendDocIDs(dst []uint64, sig uint64) []uint64 {
+
+	t := s.docids
+	for i := t.search(sig, s.interpolate); i < len(t) && t[i].hash == sig; i++ {
+		if !s.hiding() || !s.hidden(sig, t[i].docid) {
+			dst = append(dst, t[i].docid)
+		}
+	}
+
+	if set := s.sets.find(sig); set != nil {
+		set.each(func(docid uint64) {
+			if !s.hiding() || !s.hidden(sig, docid) {
+				dst = append(dst, docid)
+			}
+		})
+	}
+
+	for i, e := range s.pending {
+		if e.hash == sig && (!s.hiding() || !s.hiddenPending(i, e)) {
+			dst = append(dst, e.docid)
+		}
+	}
+
+	return dst
+}
@@ -0,0 +1,115 @@
+package simstore
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestFindInto(t *testing.T) {
+
+	r := rand.New(rand.NewSource(0))
+
+	s := New3(10000, NewU64Slice)
+	sigs := make([]uint64, 10000)
+	for i := range sigs {
+		sigs[i] = uint64(r.Int63())
+		s.Add(sigs[i], uint64(i))
+		if i%10 == 0 {
+			// a second document with a near-duplicate signature
+			s.Add(sigs[i]^1, uint64(i+100000))
+		}
+	}
+	s.Finish()
+
+	s.Add(sigs[0]^2, 200000)
+	s.Delete(10)
+
+	dst := []uint64{42}
+	for i := 0; i < 1000; i++ {
+		q := sigs[r.Intn(100)]
+		for j := r.Intn(5); j > 0; j-- {
+			q ^= 1 << uint(r.Intn(64))
+		}
+
+		want := s.Find(q)
+
+		dst = s.FindInto(q, dst[:1])
+		if prefixed := append([]uint64{42}, want...); !reflect.DeepEqual(dst, prefixed) {
+			t.Fatalf("FindInto(%016x)=%v, want %v", q, dst, prefixed)
+		}
+
+		var got []uint64
+		s.FindFunc(q, func(id uint64) { got = append(got, id) })
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("FindFunc(%016x) called with %v, want %v", q, got, want)
+		}
+
+		if got := s.Count(q); got != len(want) {
+			t.Fatalf("Count(%016x)=%d, want %d", q, got, len(want))
+		}
+	}
+
+	if got := New3(0, NewU64Slice).FindInto(0, nil); got != nil {
+		t.Errorf("FindInto on an empty store=%v, want nil", got)
+	}
+	if got := New3(0, NewU64Slice).Count(0); got != 0 {
+		t.Errorf("Count on an empty store=%d, want 0", got)
+	}
+
+	if raceEnabled {
+		return
+	}
+
+	dst = make([]uint64, 0, 100)
+	allocs := testing.AllocsPerRun(100, func() {
+		dst = s.FindInto(sigs[0], dst[:0])
+	})
+	if allocs != 0 {
+		t.Errorf("FindInto made %v allocations, want 0", allocs)
+	}
+
+	var n int
+	count := func(uint64) { n++ }
+	allocs = testing.AllocsPerRun(100, func() {
+		s.FindFunc(sigs[0], count)
+	})
+	if allocs != 0 {
+		t.Errorf("FindFunc made %v allocations, want 0", allocs)
+	}
+
+	allocs = testing.AllocsPerRun(100, func() {
+		n = s.Count(sigs[0])
+	})
+	if allocs != 0 {
+		t.Errorf("Count made %v allocations, want 0", allocs)
+	}
+}
+
+func BenchmarkFindInto(b *testing.B) {
+
+	r := rand.New(rand.NewSource(0))
+
+	s := New3(1<<20, NewU64Slice)
+	sigs := make([]uint64, 1<<20)
+	for i := range sigs {
+		sigs[i] = uint64(r.Int63())
+		s.Add(sigs[i], uint64(i))
+	}
+	s.Finish()
+
+	b.Run("Find", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			s.Find(sigs[i%len(sigs)])
+		}
+	})
+
+	b.Run("FindInto", func(b *testing.B) {
+		b.ReportAllocs()
+		var dst []uint64
+		for i := 0; i < b.N; i++ {
+			dst = s.FindInto(sigs[i%len(sigs)], dst[:0])
+		}
+	})
+}
@@ -0,0 +1,40 @@
+package simstore
+
+// withinChunk is the number of hashes handed to withinDistance at once by
+// appendWithin, which collects the matches on the stack
+const withinChunk = 64
+
+// appendWithin appends the hashes within hamming distance d of sig to dst.  The
+// distances are computed by withinDistance, which has vectorized versions for
+// amd64 and arm64 unless the purego build tag is set.
+func appendWithin(dst []uint64, hashes []uint64, sig uint64, d int) []uint64 {
+
+	var buf [withinChunk]uint64
+
+	for len(hashes) > 0 {
+		chunk := hashes
+		if len(chunk) > withinChunk {
+			chunk = chunk[:withinChunk]
+		}
+		hashes = hashes[len(chunk):]
+
+		n := withinDistance(buf[:], chunk, sig, d)
+		dst = append(dst, buf[:n]...)
+	}
+
+	return dst
+}
+
+// withinGeneric stores the hashes within distance d of sig in out, which must
+// be at least as long as hashes, and returns how many there are.  It is the
+// portable version of withinDistance.
+func withinGeneric(out []uint64, hashes []uint64, sig uint64, d int) int {
+	var n int
+	for _, h := range hashes {
+		if distance(h, sig) <= d {
+			out[n] = h
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,58 @@
+//go:build !purego
+
+package simstore
+
+var (
+	useAVX2   = hasAVX2()
+	usePOPCNT = hasPOPCNT()
+)
+
+// withinDistance is withinAVX2 on processors with AVX2, withinPOPCNT on those
+// with only POPCNT, and otherwise withinGeneric
+func withinDistance(out []uint64, hashes []uint64, sig uint64, d int) int {
+	switch {
+	case useAVX2:
+		return withinAVX2(out, hashes, sig, d)
+	case usePOPCNT:
+		return withinPOPCNT(out, hashes, sig, d)
+	}
+	return withinGeneric(out, hashes, sig, d)
+}
+
+// withinAVX2 is withinGeneric, computing the distances of four hashes at once
+// with the nibble lookup table popcount of Muła et al.
+//
+//go:noescape
+func withinAVX2(out []uint64, hashes []uint64, sig uint64, d int) int
+
+// withinPOPCNT is withinGeneric with a POPCNT instruction per hash
+//
+//go:noescape
+func withinPOPCNT(out []uint64, hashes []uint64, sig uint64, d int) int
+
+func cpuid(eaxArg, ecxArg uint32) (eax, ebx, ecx, edx uint32)
+
+func xgetbv() (eax, edx uint32)
+
+func hasPOPCNT() bool {
+	_, _, ecx, _ := cpuid(1, 0)
+	return ecx&(1<<23) != 0
+}
+
+func hasAVX2() bool {
+	if max, _, _, _ := cpuid(0, 0); max < 7 {
+		return false
+	}
+
+	// the processor has AVX and the OS saves the YMM registers
+	const osxsave, avx = 1 << 27, 1 << 28
+	if _, _, ecx, _ := cpuid(1, 0); ecx&(osxsave|avx) != osxsave|avx {
+		return false
+	}
+	if eax, _ := xgetbv(); eax&6 != 6 {
+		return false
+	}
+
+	_, ebx, _, _ := cpuid(7, 0)
+	return ebx&(1<<5) != 0 && hasPOPCNT()
+}
@@ -0,0 +1,164 @@
+//go:build !purego
+
+#include "textflag.h"
+
+// popcount of each nibble value
+DATA nibbleCount<>+0x00(SB)/8, $0x0302020102010100
+DATA nibbleCount<>+0x08(SB)/8, $0x0403030203020201
+DATA nibbleCount<>+0x10(SB)/8, $0x0302020102010100
+DATA nibbleCount<>+0x18(SB)/8, $0x0403030203020201
+GLOBL nibbleCount<>(SB), RODATA|NOPTR, $32
+
+DATA lowNibbles<>+0x00(SB)/8, $0x0f0f0f0f0f0f0f0f
+DATA lowNibbles<>+0x08(SB)/8, $0x0f0f0f0f0f0f0f0f
+DATA lowNibbles<>+0x10(SB)/8, $0x0f0f0f0f0f0f0f0f
+DATA lowNibbles<>+0x18(SB)/8, $0x0f0f0f0f0f0f0f0f
+GLOBL lowNibbles<>(SB), RODATA|NOPTR, $32
+
+// Every hash is stored at out[n], and n is only advanced past the ones within
+// the distance, so the loops don't branch on the distances.  n <= i, so the
+// stores stay within out.
+
+// func withinAVX2(out []uint64, hashes []uint64, sig uint64, d int) int
+TEXT ·withinAVX2(SB), NOSPLIT, $0-72
+	MOVQ out_base+0(FP), DI
+	MOVQ hashes_base+24(FP), SI
+	MOVQ hashes_len+32(FP), CX
+	MOVQ sig+48(FP), R8
+	MOVQ d+56(FP), R9
+	XORQ AX, AX // n
+	XORQ DX, DX // i
+
+	CMPQ CX, $4
+	JLT  tail
+
+	VPBROADCASTQ sig+48(FP), Y0
+	VPBROADCASTQ d+56(FP), Y1
+	VMOVDQU      nibbleCount<>(SB), Y2
+	VMOVDQU      lowNibbles<>(SB), Y3
+	VPXOR        Y4, Y4, Y4
+
+	MOVQ CX, R10
+	SUBQ $4, R10
+
+loop4:
+	CMPQ DX, R10
+	JGT  done4
+
+	// the popcounts of the four hashes xor sig
+	VMOVDQU (SI)(DX*8), Y5
+	VPXOR   Y0, Y5, Y6
+	VPAND   Y3, Y6, Y7
+	VPSRLQ  $4, Y6, Y6
+	VPAND   Y3, Y6, Y6
+	VPSHUFB Y7, Y2, Y7
+	VPSHUFB Y6, Y2, Y6
+	VPADDB  Y6, Y7, Y7
+	VPSADBW Y4, Y7, Y7
+
+	// BX has bit j set if hash j is within d
+	VPCMPGTQ  Y1, Y7, Y8
+	VMOVMSKPD Y8, BX
+	XORQ      $15, BX
+
+	MOVQ 0(SI)(DX*8), R11
+	MOVQ R11, (DI)(AX*8)
+	MOVQ BX, R12
+	ANDQ $1, R12
+	ADDQ R12, AX
+
+	MOVQ 8(SI)(DX*8), R11
+	MOVQ R11, (DI)(AX*8)
+	MOVQ BX, R12
+	SHRQ $1, R12
+	ANDQ $1, R12
+	ADDQ R12, AX
+
+	MOVQ 16(SI)(DX*8), R11
+	MOVQ R11, (DI)(AX*8)
+	MOVQ BX, R12
+	SHRQ $2, R12
+	ANDQ $1, R12
+	ADDQ R12, AX
+
+	MOVQ 24(SI)(DX*8), R11
+	MOVQ R11, (DI)(AX*8)
+	SHRQ $3, BX
+	ADDQ BX, AX
+
+	ADDQ $4, DX
+	JMP  loop4
+
+done4:
+	VZEROUPPER
+
+tail:
+	CMPQ DX, CX
+	JGE  done
+
+	MOVQ    (SI)(DX*8), R11
+	MOVQ    R11, (DI)(AX*8)
+	MOVQ    R11, R12
+	XORQ    R8, R12
+	POPCNTQ R12, R12
+	XORQ    R13, R13
+	CMPQ    R12, R9
+	SETLE   R13
+	ADDQ    R13, AX
+
+	INCQ DX
+	JMP  tail
+
+done:
+	MOVQ AX, ret+64(FP)
+	RET
+
+// func withinPOPCNT(out []uint64, hashes []uint64, sig uint64, d int) int
+TEXT ·withinPOPCNT(SB), NOSPLIT, $0-72
+	MOVQ out_base+0(FP), DI
+	MOVQ hashes_base+24(FP), SI
+	MOVQ hashes_len+32(FP), CX
+	MOVQ sig+48(FP), R8
+	MOVQ d+56(FP), R9
+	XORQ AX, AX // n
+	XORQ DX, DX // i
+
+loop:
+	CMPQ DX, CX
+	JGE  done
+
+	MOVQ    (SI)(DX*8), R11
+	MOVQ    R11, (DI)(AX*8)
+	MOVQ    R11, R12
+	XORQ    R8, R12
+	POPCNTQ R12, R12
+	XORQ    R13, R13
+	CMPQ    R12, R9
+	SETLE   R13
+	ADDQ    R13, AX
+
+	INCQ DX
+	JMP  loop
+
+done:
+	MOVQ AX, ret+64(FP)
+	RET
+
+// func cpuid(eaxArg, ecxArg uint32) (eax, ebx, ecx, edx uint32)
+TEXT ·cpuid(SB), NOSPLIT, $0-24
+	MOVL eaxArg+0(FP), AX
+	MOVL ecxArg+4(FP), CX
+	CPUID
+	MOVL AX, eax+8(FP)
+	MOVL BX, ebx+12(FP)
+	MOVL CX, ecx+16(FP)
+	MOVL DX, edx+20(FP)
+	RET
+
+// func xgetbv() (eax, edx uint32)
+TEXT ·xgetbv(SB), NOSPLIT, $0-8
+	MOVL $0, CX
+	XGETBV
+	MOVL AX, eax+0(FP)
+	MOVL DX, edx+4(FP)
+	RET
@@ -0,0 +1,14 @@
+//go:build !purego
+
+package simstore
+
+// withinDistance is withinNEON
+func withinDistance(out []uint64, hashes []uint64, sig uint64, d int) int {
+	return withinNEON(out, hashes, sig, d)
+}
+
+// withinNEON is withinGeneric, counting the bits of each hash xor sig with the
+// NEON VCNT and UADDLV instructions
+//
+//go:noescape
+func withinNEON(out []uint64, hashes []uint64, sig uint64, d int) int
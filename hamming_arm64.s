@@ -0,0 +1,37 @@
+//go:build !purego
+
+#include "textflag.h"
+
+// Every hash is stored at out[n], and n is only advanced past the ones within
+// the distance, so the loop doesn't branch on the distances.  n <= i, so the
+// stores stay within out.
+
+// func withinNEON(out []uint64, hashes []uint64, sig uint64, d int) int
+TEXT ·withinNEON(SB), NOSPLIT, $0-72
+	MOVD out_base+0(FP), R0
+	MOVD hashes_base+24(FP), R1
+	MOVD hashes_len+32(FP), R2
+	MOVD sig+48(FP), R3
+	MOVD d+56(FP), R4
+	MOVD $0, R5 // n
+
+loop:
+	CBZ R2, done
+
+	MOVD.P  8(R1), R6
+	EOR     R3, R6, R7
+	FMOVD   R7, F0
+	VCNT    V0.B8, V0.B8
+	VUADDLV V0.B8, V0
+	FMOVD   F0, R7
+
+	MOVD R6, (R0)(R5<<3)
+	CMP  R4, R7
+	CINC LE, R5, R5
+
+	SUB $1, R2
+	B   loop
+
+done:
+	MOVD R5, ret+64(FP)
+	RET
@@ -0,0 +1,8 @@
+//go:build purego || !(amd64 || arm64)
+
+package simstore
+
+// withinDistance is withinGeneric where there is no assembly version
+func withinDistance(out []uint64, hashes []uint64, sig uint64, d int) int {
+	return withinGeneric(out, hashes, sig, d)
+}
@@ -0,0 +1,101 @@
+package simstore
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestWithinDistance(t *testing.T) {
+
+	r := rand.New(rand.NewSource(0))
+
+	sig := uint64(r.Int63())
+
+	// hashes at every distance from sig, in runs of every length around
+	// the width of the vector loops
+	hashes := make([]uint64, 300)
+	for i := range hashes {
+		h := sig
+		for _, b := range r.Perm(64)[:r.Intn(12)] {
+			h ^= 1 << uint(b)
+		}
+		hashes[i] = h
+	}
+
+	for n := 0; n <= 70; n++ {
+		for _, d := range []int{0, 3, 6, 64} {
+			want := make([]uint64, n)
+			want = want[:withinGeneric(want, hashes[:n], sig, d)]
+
+			got := make([]uint64, n)
+			got = got[:withinDistance(got, hashes[:n], sig, d)]
+
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("withinDistance of %d hashes, d=%d: %x, want %x", n, d, got, want)
+			}
+		}
+	}
+
+	var want []uint64
+	for _, h := range hashes {
+		if distance(h, sig) <= 5 {
+			want = append(want, h)
+		}
+	}
+	if got := appendWithin([]uint64{1}, hashes, sig, 5); !reflect.DeepEqual(got, append([]uint64{1}, want...)) {
+		t.Errorf("appendWithin=%x, want %x", got, want)
+	}
+}
+
+func TestRunLength(t *testing.T) {
+
+	const mask = 0xff00000000000000
+
+	u := []uint64{0x0100000000000000}
+	for i := 0; i < 100; i++ {
+		u = append(u, 0x0200000000000000+uint64(i))
+	}
+	u = append(u, 0x0300000000000000)
+
+	for _, tt := range []struct {
+		start  int
+		prefix uint64
+		want   int
+	}{
+		{0, 0x0100000000000000, 1},
+		{1, 0x0200000000000000, 100},
+		{50, 0x0200000000000000, 51},
+		{101, 0x0300000000000000, 1},
+		{1, 0x0100000000000000, 0},
+		{102, 0x0400000000000000, 0},
+	} {
+		if got := runLength(u[tt.start:], tt.prefix, mask); got != tt.want {
+			t.Errorf("runLength(u[%d:], %016x)=%d, want %d", tt.start, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func BenchmarkWithinDistance(b *testing.B) {
+
+	r := rand.New(rand.NewSource(0))
+	hashes := make([]uint64, withinChunk)
+	for i := range hashes {
+		hashes[i] = uint64(r.Int63())
+	}
+	out := make([]uint64, len(hashes))
+
+	for _, bb := range []struct {
+		name   string
+		within func([]uint64, []uint64, uint64, int) int
+	}{
+		{"generic", withinGeneric},
+		{"asm", withinDistance},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				bb.within(out, hashes, hashes[0], 30)
+			}
+		})
+	}
+}
@@ -0,0 +1,400 @@
+/*
+Package hnsw implements a Hierarchical Navigable Small World graph of 64-bit
+signatures, for approximate nearest-neighbour searches by Hamming distance.
+
+Each signature is a node in the bottom layer of the graph, linked to those
+nearest it, and in each layer above it with a probability falling
+exponentially with the layer, so the top layers are sparse and their links
+long.  A search descends greedily through the layers to a node near the
+target, then explores the bottom layer outward from it, keeping the ef nearest
+nodes found.  The cost of a search grows with the logarithm of the number of
+signatures, rather than the root of it or worse for a tree in 64 dimensions,
+so it's much faster on large datasets, at the price of sometimes missing one of
+the nearest: the larger ef, the fewer missed.
+
+Yu. A. Malkov and D. A. Yashunin, "Efficient and robust approximate nearest
+neighbor search using Hierarchical Navigable Small World graphs", 2016.
+*/
+package hnsw
+
+import (
+	"container/heap"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+
+	"github.com/dgryski/go-simstore/simhash"
+)
+
+// An Item is a signature of a document
+type Item struct {
+	Sig uint64
+	ID  uint64
+}
+
+// Params are the parameters of an index
+type Params struct {
+	// M is the number of links of each node on each layer but the bottom,
+	// which has twice as many.  More links give better recall, for more
+	// memory and slower searches.  It's 16 if 0.
+	M int
+
+	// EfConstruction is the number of nodes kept by the searches for the
+	// neighbours of each node added.  More give a better graph, for a
+	// slower build.  It's 200 if 0.
+	EfConstruction int
+
+	// EfSearch is the number of nodes kept by Search, or k if larger.
+	// More give better recall, for slower searches.  It's 50 if 0.
+	EfSearch int
+}
+
+type node struct {
+	item Item
+
+	// links holds the nodes linked to this one on each layer it's in, from
+	// the bottom
+	links [][]int32
+}
+
+// An Index is an HNSW graph.  Its methods are safe for concurrent use:
+// searches run in parallel, and Add waits for them to finish.
+type Index struct {
+	mu sync.RWMutex
+
+	p Params
+
+	// ml is the normalization of the random layers of the nodes
+	ml float64
+
+	nodes []node
+
+	// entry is the node searches start from, in the top layer
+	entry int32
+
+	rand *rand.Rand
+}
+
+// New creates an index of items with the parameters p
+func New(items []Item, p Params) *Index {
+
+	if p.M < 1 {
+		p.M = 16
+	}
+	if p.EfConstruction < 1 {
+		p.EfConstruction = 200
+	}
+	if p.EfSearch < 1 {
+		p.EfSearch = 50
+	}
+
+	idx := &Index{
+		p:     p,
+		ml:    1 / math.Log(float64(max(p.M, 2))),
+		nodes: make([]node, 0, len(items)),
+		rand:  rand.New(rand.NewSource(1)),
+	}
+
+	for _, item := range items {
+		idx.add(item)
+	}
+
+	return idx
+}
+
+// Len returns the number of items in the index
+func (idx *Index) Len() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return len(idx.nodes)
+}
+
+// Params returns the parameters of the index
+func (idx *Index) Params() Params {
+	return idx.p
+}
+
+// Add inserts item into the index
+func (idx *Index) Add(item Item) {
+	idx.mu.Lock()
+	idx.add(item)
+	idx.mu.Unlock()
+}
+
+// maxLinks returns the number of links a node may have on layer
+func (idx *Index) maxLinks(layer int) int {
+	if layer == 0 {
+		return 2 * idx.p.M
+	}
+	return idx.p.M
+}
+
+func (idx *Index) add(item Item) {
+
+	layer := int(-math.Log(1-idx.rand.Float64()) * idx.ml)
+
+	id := int32(len(idx.nodes))
+	idx.nodes = append(idx.nodes, node{item: item, links: make([][]int32, layer+1)})
+
+	if id == 0 {
+		idx.entry = id
+		return
+	}
+
+	top := len(idx.nodes[idx.entry].links) - 1
+
+	// down to the layers of the new node, the nearest node is enough
+	ep := []candidate{{idx.distance(idx.entry, item.Sig), idx.entry}}
+	for l := top; l > layer; l-- {
+		ep = idx.searchLayer(item.Sig, ep, 1, l)
+	}
+
+	// then link it to the nearest of those found in each of its layers
+	for l := min(layer, top); l >= 0; l-- {
+		ep = idx.searchLayer(item.Sig, ep, idx.p.EfConstruction, l)
+
+		for _, c := range idx.selectNeighbours(ep, idx.p.M) {
+			idx.nodes[id].links[l] = append(idx.nodes[id].links[l], c.id)
+			idx.link(c.id, id, l)
+		}
+	}
+
+	if layer > top {
+		idx.entry = id
+	}
+}
+
+// link adds a link from node from to node to on layer, reselecting the links
+// of from if it then has too many
+func (idx *Index) link(from, to int32, layer int) {
+
+	links := append(idx.nodes[from].links[layer], to)
+	if len(links) > idx.maxLinks(layer) {
+		sig := idx.nodes[from].item.Sig
+		candidates := make([]candidate, len(links))
+		for i, n := range links {
+			candidates[i] = candidate{idx.distance(n, sig), n}
+		}
+		sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].dist < candidates[j].dist })
+
+		links = links[:0]
+		for _, c := range idx.selectNeighbours(candidates, idx.maxLinks(layer)) {
+			links = append(links, c.id)
+		}
+	}
+	idx.nodes[from].links[layer] = links
+}
+
+// selectNeighbours returns up to m of the candidates, which are in order of
+// distance, to link to.  A candidate nearer one already selected than the
+// node is skipped while there are others, as the selected one leads to it:
+// linking only the nearest would link the nodes of a cluster only among
+// themselves, and leave searches stuck in the first cluster they reach.
+func (idx *Index) selectNeighbours(candidates []candidate, m int) []candidate {
+
+	if len(candidates) <= m {
+		return candidates
+	}
+
+	var selected, skipped []candidate
+	for _, c := range candidates {
+		if len(selected) == m {
+			break
+		}
+
+		sig := idx.nodes[c.id].item.Sig
+		keep := true
+		for _, s := range selected {
+			if idx.distance(s.id, sig) < c.dist {
+				keep = false
+				break
+			}
+		}
+
+		if keep {
+			selected = append(selected, c)
+		} else {
+			skipped = append(skipped, c)
+		}
+	}
+
+	// fill any links left with the nearest skipped
+	for _, c := range skipped {
+		if len(selected) == m {
+			break
+		}
+		selected = append(selected, c)
+	}
+
+	return selected
+}
+
+func (idx *Index) distance(n int32, sig uint64) int {
+	return simhash.Distance(idx.nodes[n].item.Sig, sig)
+}
+
+// searchLayer returns the ef nodes nearest target on layer found from the
+// nodes ep, nearest first
+func (idx *Index) searchLayer(target uint64, ep []candidate, ef int, layer int) []candidate {
+
+	visited := make(map[int32]bool, ef*idx.p.M)
+
+	// the nodes to explore, nearest first, and the ef nearest found,
+	// farthest first
+	var explore nearest
+	var found farthest
+	for _, c := range ep {
+		visited[c.id] = true
+		heap.Push(&explore, c)
+		heap.Push(&found, c)
+		if len(found) > ef {
+			heap.Pop(&found)
+		}
+	}
+
+	for len(explore) > 0 {
+		c := heap.Pop(&explore).(candidate)
+		if len(found) == ef && c.dist > found[0].dist {
+			// nothing left to explore is nearer than the farthest found
+			break
+		}
+
+		for _, n := range idx.nodes[c.id].links[layer] {
+			if visited[n] {
+				continue
+			}
+			visited[n] = true
+
+			d := idx.distance(n, target)
+			if len(found) < ef || d < found[0].dist {
+				heap.Push(&explore, candidate{d, n})
+				heap.Push(&found, candidate{d, n})
+				if len(found) > ef {
+					heap.Pop(&found)
+				}
+			}
+		}
+	}
+
+	result := make([]candidate, len(found))
+	for i := len(found) - 1; i >= 0; i-- {
+		result[i] = heap.Pop(&found).(candidate)
+	}
+	return result
+}
+
+// Search returns the k nearest neighbours of target found, and their
+// distances, in order of least distance to largest, and then of ID.  It keeps
+// the EfSearch nearest nodes found, or k if more, and may miss some of the
+// nearest for others farther away.
+func (idx *Index) Search(target uint64, k int) (results []Item, distances []float64) {
+	return idx.SearchEf(target, k, idx.p.EfSearch)
+}
+
+// SearchEf is Search, keeping the ef nearest nodes found, or k if more,
+// instead of EfSearch
+func (idx *Index) SearchEf(target uint64, k int, ef int) (results []Item, distances []float64) {
+	return idx.search(target, k, ef, maxHamming)
+}
+
+// SearchWithin is Search, returning only the items within maxDist of target,
+// so there may be fewer than k
+func (idx *Index) SearchWithin(target uint64, k int, maxDist float64) (results []Item, distances []float64) {
+	if maxDist < 0 {
+		return
+	}
+	return idx.search(target, k, idx.p.EfSearch, int(maxDist))
+}
+
+// InRange returns the items found within maxDistance of sig, in order of
+// least distance to largest, and then of ID.  It keeps the EfSearch nearest
+// nodes found, or twice as many while they're all within maxDistance, so
+// with more items than that near sig, some are missed.
+func (idx *Index) InRange(sig uint64, maxDistance float64) []Item {
+
+	for ef := idx.p.EfSearch; ; ef *= 2 {
+		results, _ := idx.search(sig, ef, ef, int(maxDistance))
+		if len(results) < ef || ef >= idx.Len() {
+			return results
+		}
+	}
+}
+
+// maxHamming is the greatest Hamming distance between two signatures
+const maxHamming = 64
+
+func (idx *Index) search(target uint64, k int, ef int, maxDist int) (results []Item, distances []float64) {
+	if k < 1 {
+		return
+	}
+	if ef < k {
+		ef = k
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	if len(idx.nodes) == 0 {
+		return
+	}
+
+	ep := []candidate{{idx.distance(idx.entry, target), idx.entry}}
+	for l := len(idx.nodes[idx.entry].links) - 1; l > 0; l-- {
+		ep = idx.searchLayer(target, ep, 1, l)
+	}
+	found := idx.searchLayer(target, ep, ef, 0)
+
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].dist != found[j].dist {
+			return found[i].dist < found[j].dist
+		}
+		return idx.nodes[found[i].id].item.ID < idx.nodes[found[j].id].item.ID
+	})
+
+	for _, c := range found {
+		if len(results) == k || c.dist > maxDist {
+			break
+		}
+		results = append(results, idx.nodes[c.id].item)
+		distances = append(distances, float64(c.dist))
+	}
+
+	return results, distances
+}
+
+// candidate is a node found by a search, and its distance from the target
+type candidate struct {
+	dist int
+	id   int32
+}
+
+// nearest is a min-heap of candidates by distance
+type nearest []candidate
+
+func (q nearest) Len() int            { return len(q) }
+func (q nearest) Less(i, j int) bool  { return q[i].dist < q[j].dist }
+func (q nearest) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *nearest) Push(x interface{}) { *q = append(*q, x.(candidate)) }
+
+func (q *nearest) Pop() interface{} {
+	old := *q
+	x := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return x
+}
+
+// farthest is a max-heap of candidates by distance
+type farthest []candidate
+
+func (q farthest) Len() int            { return len(q) }
+func (q farthest) Less(i, j int) bool  { return q[i].dist > q[j].dist }
+func (q farthest) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *farthest) Push(x interface{}) { *q = append(*q, x.(candidate)) }
+
+func (q *farthest) Pop() interface{} {
+	old := *q
+	x := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return x
+}
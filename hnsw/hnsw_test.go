@@ -0,0 +1,155 @@
+package hnsw
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/dgryski/go-simstore/simhash"
+)
+
+// nearest returns the k items nearest target, nearest first and then by ID,
+// and their distances, found by a linear scan
+func nearestItems(target uint64, items []Item, k int) ([]Item, []float64) {
+
+	found := append([]Item(nil), items...)
+	sort.Slice(found, func(i, j int) bool {
+		di, dj := simhash.Distance(found[i].Sig, target), simhash.Distance(found[j].Sig, target)
+		return di < dj || di == dj && found[i].ID < found[j].ID
+	})
+
+	if len(found) > k {
+		found = found[:k]
+	}
+
+	dists := make([]float64, len(found))
+	for i, item := range found {
+		dists[i] = float64(simhash.Distance(item.Sig, target))
+	}
+	return found, dists
+}
+
+// clusteredItems returns n items in clusters of near signatures, like the
+// signatures of near-duplicate documents
+func clusteredItems(n int) []Item {
+	var items []Item
+	var centre uint64
+	for i := 0; i < n; i++ {
+		if i%10 == 0 {
+			centre = uint64(rand.Int63())
+		}
+		sig := centre
+		for b := rand.Intn(6); b > 0; b-- {
+			sig ^= 1 << uint(rand.Intn(64))
+		}
+		items = append(items, Item{Sig: sig, ID: uint64(i)})
+	}
+	return items
+}
+
+func TestEmpty(t *testing.T) {
+	idx := New(nil, Params{})
+	if results, distances := idx.Search(0, 3); len(results) != 0 || len(distances) != 0 || idx.Len() != 0 {
+		t.Errorf("empty index: Search=%v %v, Len()=%d", results, distances, idx.Len())
+	}
+	if p := idx.Params(); p != (Params{M: 16, EfConstruction: 200, EfSearch: 50}) {
+		t.Errorf("default Params()=%+v", p)
+	}
+}
+
+func TestSearch(t *testing.T) {
+
+	items := clusteredItems(5000)
+	idx := New(items[:2500], Params{})
+	for _, item := range items[2500:] {
+		idx.Add(item)
+	}
+	if idx.Len() != len(items) {
+		t.Errorf("Len()=%d, want %d", idx.Len(), len(items))
+	}
+
+	// near-duplicates of the items are found, with good recall of the rest
+	var found, total int
+	for i := 0; i < 100; i++ {
+		target := items[rand.Intn(len(items))].Sig ^ 1<<uint(rand.Intn(64))
+		want, wantDists := nearestItems(target, items, 10)
+
+		got, dists := idx.Search(target, 10)
+		if len(got) != 10 || dists[0] != wantDists[0] {
+			t.Errorf("Search(%x) nearest %v at %v, want %v at %v", target, got[:1], dists[:1], want[0], wantDists[0])
+		}
+		for j := range got {
+			if d := float64(simhash.Distance(got[j].Sig, target)); d != dists[j] || d < wantDists[j] || j > 0 && d < dists[j-1] {
+				t.Errorf("Search(%x)[%d]: distance %v (reported %v), true %d-th nearest %v", target, j, d, dists[j], j, wantDists[j])
+			}
+		}
+
+		total += len(want)
+		for j := range got {
+			if dists[j] <= wantDists[len(wantDists)-1] {
+				found++
+			}
+		}
+
+		// within the distance of the nearest few
+		within, _ := idx.SearchWithin(target, 10, wantDists[2])
+		for _, item := range within {
+			if float64(simhash.Distance(item.Sig, target)) > wantDists[2] {
+				t.Errorf("SearchWithin(%x, %v) returned %v", target, wantDists[2], item)
+			}
+		}
+		if len(within) < 3 {
+			t.Errorf("SearchWithin(%x, %v) returned %d items, want at least 3", target, wantDists[2], len(within))
+		}
+
+		if got := idx.InRange(target, wantDists[2]); !reflect.DeepEqual(got, within) && len(within) < 10 {
+			t.Errorf("InRange(%x, %v)=%v, want %v", target, wantDists[2], got, within)
+		}
+	}
+
+	if recall := float64(found) / float64(total); recall < 0.95 {
+		t.Errorf("recall %.3f, want at least 0.95", recall)
+	}
+
+	// an ef of every item is exact
+	target := uint64(rand.Int63())
+	want, wantDists := nearestItems(target, items, 10)
+	if got, dists := idx.SearchEf(target, 10, len(items)); !reflect.DeepEqual(got, want) || !reflect.DeepEqual(dists, wantDists) {
+		t.Errorf("SearchEf(all)=%v %v, want %v %v", got, dists, want, wantDists)
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+
+	items := clusteredItems(2000)
+	idx := New(items[:1000], Params{M: 8, EfConstruction: 50})
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for _, item := range items[1000:] {
+			idx.Add(item)
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				idx.Search(uint64(rand.Int63()), 10)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if idx.Len() != len(items) {
+		t.Errorf("Len()=%d, want %d", idx.Len(), len(items))
+	}
+	for _, item := range items[1000:1100] {
+		if got, _ := idx.Search(item.Sig, 1); len(got) != 1 || got[0].Sig != item.Sig {
+			t.Errorf("Search(%x) after concurrent Adds=%v", item.Sig, got)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package simstore
+
+import "time"
+
+// Hooks are functions a Store calls on its operations, so a program can feed
+// them to its own metrics without wrapping every call.  Each is called on the
+// goroutine of the operation, once it has released the store's lock, so it
+// must be safe for concurrent use, and a slow hook slows the caller.  A nil
+// hook isn't called.
+type Hooks struct {
+	// OnFind is called after each search by Search, and so Find,
+	// FindContext and FindAtMost, with how long it took, the number of
+	// signatures within the distance found in the tables, counting those
+	// found by several tables more than once, and the number of documents
+	// returned.  Searches which fail aren't reported.
+	OnFind func(d time.Duration, candidates, matches int)
+
+	// OnAdd is called after each Add or AddAt, and for each entry of AddBatch
+	OnAdd func(sig, docid uint64)
+}
+
+// Instrument makes the store call the hooks of h
+func Instrument(h Hooks) Option {
+	return func(s *Store) { s.hooks = h }
+}
@@ -0,0 +1,46 @@
+package simstore
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHooks(t *testing.T) {
+
+	var adds, finds, candidates, matches int64
+
+	s := New3(10, NewU64Slice, Instrument(Hooks{
+		OnFind: func(d time.Duration, c, m int) {
+			if d < 0 {
+				t.Errorf("OnFind duration %v", d)
+			}
+			atomic.AddInt64(&finds, 1)
+			atomic.AddInt64(&candidates, int64(c))
+			atomic.AddInt64(&matches, int64(m))
+		},
+		OnAdd: func(sig, docid uint64) { atomic.AddInt64(&adds, 1) },
+	}))
+
+	s.Add(0xff, 1)
+	s.Add(0xff, 2)
+	s.Add(0xf0f0f0f0f0f0f0f0, 3)
+	s.Finish()
+	s.AddAt(0xfe, 4, time.Now())
+
+	if adds != 4 {
+		t.Errorf("OnAdd called %d times, want 4", adds)
+	}
+
+	s.Find(0xff)
+	s.FindAtMost(0xff, 1)
+	if _, err := s.FindAtMost(0xff, 4); err == nil {
+		t.Errorf("FindAtMost beyond the store's distance succeeded")
+	}
+
+	// 0xfe in the pending entries, and 0xff for documents 1 and 2 in each of
+	// the 16 tables
+	if finds != 2 || candidates != 2*(1+2*16) || matches != 2*3 {
+		t.Errorf("OnFind called %d times with %d candidates and %d matches, want 2, %d and 6", finds, candidates, matches, 2*(1+2*16))
+	}
+}
@@ -0,0 +1,298 @@
+package simstore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// LoadOptions configures Load and Scan
+type LoadOptions struct {
+	// Store receives the signatures loaded by Load.  If it is nil, Load
+	// creates a store with New6 and NewU64Slice.
+	Store Storage
+
+	// Shard and Shards keep only the signatures with sig%Shards == Shard, to
+	// split a corpus between machines.  With Shards 0 or 1 every signature
+	// is kept.
+	Shard, Shards int
+
+	// Exclude, if not nil, skips the lines whose docid it returns true for
+	Exclude func(docid uint64) bool
+
+	// Workers is the number of goroutines parsing lines.  With more than
+	// one, the callbacks are called concurrently.
+	Workers int
+
+	// Progress, if not nil, is called every LoadProgressLines lines with
+	// the number of lines read so far
+	Progress func(lines int)
+
+	// Invalid, if not nil, is called with the line number and the error of
+	// each line which can't be parsed.  Those lines are skipped.
+	Invalid func(line int, err error)
+
+	// Skip is the number of lines at the start of r which are read but not
+	// parsed, because they were loaded before a checkpoint
+	Skip int
+
+	// Checkpoint, if not nil, is called by Scan every CheckpointLines lines,
+	// once the signatures of all the lines read so far have been added, with
+	// the number of lines read.  An error stops the scan.
+	Checkpoint func(lines int) error
+
+	// CheckpointLines is the number of lines between checkpoints.  The
+	// default is DefaultCheckpointLines.
+	CheckpointLines int
+
+	// CheckpointPath, if set, makes Load save a checkpoint of the store
+	// there every CheckpointLines lines, and resume from the checkpoint
+	// saved there if there is one.  The checkpoint is removed once the store
+	// is finished.  The Store must be nil, or one created by New, New3 or
+	// New6, and r must be the same input each time.
+	CheckpointPath string
+}
+
+// LoadCounts are the line counts of Scan
+type LoadCounts struct {
+	Lines    int // lines read
+	Invalid  int // lines which couldn't be parsed
+	Excluded int // lines skipped by LoadOptions.Exclude
+	Added    int // signatures passed to add
+}
+
+// LoadProgressLines is the number of lines between the calls of
+// LoadOptions.Progress
+const LoadProgressLines = 1 << 20
+
+// DefaultCheckpointLines is the default of LoadOptions.CheckpointLines
+const DefaultCheckpointLines = 1 << 24
+
+// loadBatchLines is the number of lines read before they're handed to a
+// worker of Scan
+const loadBatchLines = 4096
+
+var errLineFields = errors.New("expected an id and a signature")
+
+// Load reads signatures from r into a store and finishes it.  Each line of r
+// is a decimal docid and a hex signature, separated by spaces, and any further
+// fields are ignored.  Only the signatures passing the shard and exclusion
+// filters of opts are loaded, and lines which can't be parsed are skipped.  The
+// error is that of reading r, or of the store, as returned by Checked.
+func Load(r io.Reader, opts LoadOptions) (Storage, error) {
+
+	s := opts.Store
+	if s == nil {
+		s = New6(0, NewU64Slice)
+	}
+
+	if path := opts.CheckpointPath; path != "" {
+		var cs *Store
+		switch st := s.(type) {
+		case *Store:
+			cs = st
+		case *Store6:
+			cs = &st.Store
+		default:
+			return nil, fmt.Errorf("simstore: can't checkpoint a %T", s)
+		}
+
+		position, err := ResumeCheckpoint(path, cs)
+		if err != nil {
+			return nil, err
+		}
+
+		opts.Skip = int(position)
+		opts.Checkpoint = func(lines int) error {
+			return SaveCheckpoint(path, cs, uint64(lines))
+		}
+	}
+
+	add := func(sigs, docids []uint64) {
+		for i, sig := range sigs {
+			s.Add(sig, docids[i])
+		}
+	}
+	if b, ok := s.(BatchAdder); ok {
+		add = b.AddBatch
+	}
+
+	if _, err := ScanBatches(r, opts, add); err != nil {
+		return nil, err
+	}
+
+	if err := Checked(s).Finish(); err != nil {
+		return nil, err
+	}
+
+	if opts.CheckpointPath != "" {
+		if err := os.Remove(opts.CheckpointPath); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Scan parses the lines of r as Load does, but calls add with each signature
+// and docid instead of adding them to a store, so the caller can load several
+// inputs into one store, or build something else from them.  It returns the
+// counts of the lines read.
+func Scan(r io.Reader, opts LoadOptions, add func(sig, docid uint64)) (LoadCounts, error) {
+	return ScanBatches(r, opts, func(sigs, docids []uint64) {
+		for i, sig := range sigs {
+			add(sig, docids[i])
+		}
+	})
+}
+
+// ScanBatches is like Scan, but each worker collects the signatures and docids
+// of a run of lines and calls add once with them, such as to add them to a
+// BatchAdder.  The slices are reused once add returns.
+func ScanBatches(r io.Reader, opts LoadOptions, add func(sigs, docids []uint64)) (LoadCounts, error) {
+
+	workers := opts.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	// each batch is a run of lines, starting at line first
+	type batch struct {
+		first int
+		lines []string
+	}
+
+	checkpointLines := opts.CheckpointLines
+	if checkpointLines <= 0 {
+		checkpointLines = DefaultCheckpointLines
+	}
+
+	batches := make(chan batch, workers)
+	counts := make([]LoadCounts, workers)
+
+	// inflight counts the batches sent and not yet parsed, which a
+	// checkpoint waits for
+	var wg, inflight sync.WaitGroup
+	for w := range counts {
+		wg.Add(1)
+		go func(c *LoadCounts) {
+			defer wg.Done()
+			var sigs, docids []uint64
+			collect := func(sig, docid uint64) {
+				sigs = append(sigs, sig)
+				docids = append(docids, docid)
+			}
+			for b := range batches {
+				for i, line := range b.lines {
+					opts.scanLine(b.first+i, line, c, collect)
+				}
+				if len(sigs) > 0 {
+					add(sigs, docids)
+				}
+				sigs, docids = sigs[:0], docids[:0]
+				inflight.Done()
+			}
+		}(&counts[w])
+	}
+
+	var c LoadCounts
+	var err error
+
+	b := batch{first: opts.Skip + 1}
+	send := func() {
+		if len(b.lines) > 0 {
+			inflight.Add(1)
+			batches <- b
+		}
+		b = batch{first: c.Lines + 1}
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		c.Lines++
+
+		if opts.Progress != nil && c.Lines%LoadProgressLines == 0 {
+			opts.Progress(c.Lines)
+		}
+
+		if c.Lines <= opts.Skip {
+			continue
+		}
+
+		b.lines = append(b.lines, scanner.Text())
+		if len(b.lines) == loadBatchLines {
+			send()
+		}
+
+		if opts.Checkpoint != nil && c.Lines%checkpointLines == 0 {
+			send()
+			inflight.Wait()
+			if err = opts.Checkpoint(c.Lines); err != nil {
+				break
+			}
+		}
+	}
+
+	send()
+	close(batches)
+	wg.Wait()
+
+	for _, wc := range counts {
+		c.Invalid += wc.Invalid
+		c.Excluded += wc.Excluded
+		c.Added += wc.Added
+	}
+
+	if err != nil {
+		return c, err
+	}
+
+	return c, scanner.Err()
+}
+
+// scanLine parses line number n, counting it in c, and calls add with its
+// signature if it passes the filters
+func (opts *LoadOptions) scanLine(n int, line string, c *LoadCounts, add func(sig, docid uint64)) {
+
+	invalid := func(err error) {
+		c.Invalid++
+		if opts.Invalid != nil {
+			opts.Invalid(n, err)
+		}
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		invalid(errLineFields)
+		return
+	}
+
+	id, err := strconv.Atoi(fields[0])
+	if err != nil {
+		invalid(fmt.Errorf("error parsing id: %v", err))
+		return
+	}
+
+	if opts.Exclude != nil && opts.Exclude(uint64(id)) {
+		c.Excluded++
+		return
+	}
+
+	sig, err := strconv.ParseUint(fields[1], 16, 64)
+	if err != nil {
+		invalid(fmt.Errorf("error parsing signature: %v", err))
+		return
+	}
+
+	if opts.Shards > 1 && sig%uint64(opts.Shards) != uint64(opts.Shard) {
+		return
+	}
+
+	c.Added++
+	add(sig, uint64(id))
+}
@@ -0,0 +1,132 @@
+package simstore
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+)
+
+func TestLoad(t *testing.T) {
+
+	input := strings.Join([]string{
+		"1 1122334455667788",
+		"2 1122334455667789 extra fields",
+		"",
+		"x 1122334455667788",
+		"3 nothex",
+		"4 1122334455667788",
+		"5 deadbeefcafebabe",
+	}, "\n")
+
+	var invalid []int
+	s, err := Load(strings.NewReader(input), LoadOptions{
+		Store:   New3(0, NewU64Slice),
+		Exclude: func(docid uint64) bool { return docid == 4 },
+		Invalid: func(line int, err error) { invalid = append(invalid, line) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := s.Find(0x1122334455667788), []uint64{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Find=%v, want %v", got, want)
+	}
+	if got, want := invalid, []int{3, 4, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("invalid lines=%v, want %v", got, want)
+	}
+
+	// the default store searches distance 6
+	s, err = Load(strings.NewReader(input), LoadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.Find(0x1122334455667788^0x3f), []uint64{1, 2, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("default store Find=%v, want %v", got, want)
+	}
+
+	readErr := errors.New("read failed")
+	if _, err := Load(iotest.ErrReader(readErr), LoadOptions{}); err != readErr {
+		t.Errorf("Load of a failing reader returned %v, want %v", err, readErr)
+	}
+}
+
+func TestScan(t *testing.T) {
+
+	var sb strings.Builder
+	const lines = 3*loadBatchLines + 10
+	for i := 0; i < lines; i++ {
+		fmt.Fprintf(&sb, "%d %016x\n", i, uint64(i)*0x9e3779b97f4a7c15)
+	}
+
+	for _, workers := range []int{1, 4} {
+		var mu sync.Mutex
+		got := make(map[uint64]uint64)
+
+		var progress []int
+		c, err := Scan(strings.NewReader(sb.String()), LoadOptions{
+			Shard:    1,
+			Shards:   3,
+			Workers:  workers,
+			Exclude:  func(docid uint64) bool { return docid%10 == 0 },
+			Progress: func(n int) { progress = append(progress, n) },
+		}, func(sig, docid uint64) {
+			mu.Lock()
+			got[docid] = sig
+			mu.Unlock()
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := make(map[uint64]uint64)
+		var excluded int
+		for i := uint64(0); i < lines; i++ {
+			sig := i * 0x9e3779b97f4a7c15
+			switch {
+			case i%10 == 0:
+				excluded++
+			case sig%3 == 1:
+				want[i] = sig
+			}
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%d workers: added %d signatures, want %d", workers, len(got), len(want))
+		}
+		if wc := (LoadCounts{Lines: lines, Excluded: excluded, Added: len(want)}); c != wc {
+			t.Errorf("%d workers: counts=%+v, want %+v", workers, c, wc)
+		}
+		if len(progress) != 0 {
+			t.Errorf("%d workers: progress called with %v before %d lines", workers, progress, LoadProgressLines)
+		}
+	}
+}
+
+func BenchmarkLoadWorkers(b *testing.B) {
+
+	const lines = 1 << 18
+
+	var sb strings.Builder
+	for i := 0; i < lines; i++ {
+		fmt.Fprintf(&sb, "%d %016x\n", i, uint64(i)*0x9e3779b97f4a7c15)
+	}
+	input := sb.String()
+
+	// each worker adds a batch of lines at once, so loading scales with them
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			b.SetBytes(int64(len(input)))
+			for i := 0; i < b.N; i++ {
+				s := New3(lines, NewU64Slice)
+				opts := LoadOptions{Store: s, Workers: workers}
+				if _, err := ScanBatches(strings.NewReader(input), opts, s.AddBatch); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
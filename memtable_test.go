@@ -0,0 +1,115 @@
+package simstore
+
+import (
+	"math/rand"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestAddAfterFinish(t *testing.T) {
+
+	r := rand.New(rand.NewSource(0))
+
+	sigs := make([]uint64, 2000)
+	for i := range sigs {
+		sigs[i] = uint64(r.Int63())
+		if i%2 == 1 {
+			sigs[i] = sigs[i-1] ^ 1<<uint(r.Intn(64))
+		}
+	}
+
+	for _, st := range []struct {
+		name string
+		s    Storage
+		want Storage
+	}{
+		{"New3", New3(1000, NewU64Slice), New3(len(sigs), NewU64Slice)},
+		{"New6", New6(1000, NewU64Slice, Dedup()), New6(len(sigs), NewU64Slice, Dedup())},
+		{"empty New3", New3(0, NewU64Slice), New3(len(sigs), NewU64Slice)},
+		{"New3Small", New3Small(1000), New3Small(len(sigs))},
+	} {
+		start := 1000
+		if st.name == "empty New3" {
+			start = 0
+		}
+
+		for i, sig := range sigs {
+			if i < start {
+				st.s.Add(sig, uint64(i))
+			}
+			st.want.Add(sig, uint64(i))
+		}
+		st.s.Finish()
+		st.want.Finish()
+
+		// searches run while the rest of the signatures are added
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, sig := range sigs[:100] {
+				st.s.Find(sig)
+			}
+		}()
+
+		for i := start; i < len(sigs); i++ {
+			st.s.Add(sigs[i], uint64(i))
+		}
+		wg.Wait()
+
+		compare := func(when string) {
+			for _, sig := range sigs {
+				if got, want := st.s.Find(sig), st.want.Find(sig); !reflect.DeepEqual(got, want) {
+					t.Fatalf("%s %s: Find(%016x)=%v, want %v", st.name, when, sig, got, want)
+				}
+			}
+		}
+
+		compare("before Compact")
+
+		if c, ok := st.s.(interface{ Compact() int }); ok {
+			c.Compact()
+			compare("after Compact")
+		}
+	}
+}
+
+func TestAddAfterFinishStore(t *testing.T) {
+
+	s := New3(10, NewU64Slice)
+	s.Add(0xff00, 1)
+	s.Finish()
+
+	s.Add(0xff00, 2)
+	s.Add(0xff01, 3)
+
+	if got, want := s.FindExact(0xff00), []uint64{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("FindExact=%v, want %v", got, want)
+	}
+	if got, want := s.FindN(0xff00, 2), []uint64{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("FindN=%v, want %v", got, want)
+	}
+	if got, want := s.FindByDocID(3), []uint64{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("FindByDocID=%v, want %v", got, want)
+	}
+	if !s.contains(0xff03, 3) {
+		t.Errorf("contains missed an added signature")
+	}
+	if _, err := s.WriteTo(discardWriter{}); err != errUncompacted {
+		t.Errorf("WriteTo before Compact: err=%v, want %v", err, errUncompacted)
+	}
+
+	s.Compact()
+
+	if len(s.pending) != 0 || len(s.docids) != 3 || s.tableLen(0) != 3 {
+		t.Errorf("after Compact: %d pending, %d docids, %d hashes, want 0, 3, 3", len(s.pending), len(s.docids), s.tableLen(0))
+	}
+	if _, err := s.WriteTo(discardWriter{}); err != nil {
+		t.Errorf("WriteTo after Compact: %v", err)
+	}
+}
+
+type discardWriter struct{}
+
+func (discardWriter) Write(p []byte) (int, error) { return len(p), nil }
@@ -0,0 +1,157 @@
+package simstore
+
+import (
+	"errors"
+	"reflect"
+	"runtime"
+)
+
+var errMergePerm = errors.New("simstore: can't merge stores with different tables")
+
+// Merge adds the entries of other to the finished store s, by merging their
+// sorted tables instead of adding each signature again and sorting.  Both
+// stores must have been created with the same distance and table layout, and
+// be compacted.  The options of s, such as Dedup, apply to the merged store.
+// Searches of s wait until the merge has finished, and other is unchanged.
+// A Compact of s waits for Merge to finish, and Merge for Compact.
+func (s *Store) Merge(other *Store) error {
+
+	if s == other {
+		return errors.New("simstore: can't merge a store with itself")
+	}
+
+	if !reflect.DeepEqual(s.perm, other.perm) {
+		return errMergePerm
+	}
+
+	// other is read first and unlocked, so Merges of two stores into each
+	// other don't each wait for the other's lock
+	other.mu.RLock()
+	if err := other.mergeable(); err != nil {
+		other.mu.RUnlock()
+		return err
+	}
+	entries := other.entries()
+	hashes := make([][]uint64, len(other.rhashes))
+	for t := range hashes {
+		hashes[t] = other.tableHashes(t)
+	}
+	other.mu.RUnlock()
+
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.mergeable(); err != nil {
+		return err
+	}
+
+	docids := mergeTables(s.entries(), entries)
+
+	newStore := s.newStore
+	if newStore == nil {
+		// a store opened with OpenMmap
+		newStore = NewU64Slice
+	}
+
+	rhashes := make([]U64Store, len(s.rhashes))
+	for t := range rhashes {
+		rhashes[t] = newStore(len(docids))
+		mergeU64(s.tableHashes(t), hashes[t], rhashes[t].Add)
+		rhashes[t].Finish()
+		if d, ok := rhashes[t].(deduper); ok && s.dedup {
+			s.collapsed += d.dedup()
+		}
+	}
+
+	// entries and hashes may alias the mapping of a store opened with
+	// OpenMmap, which its finalizer would release
+	runtime.KeepAlive(other)
+
+	if s.dedup {
+		s.collapsed += docids.dedup()
+	}
+
+	s.docids, s.rhashes, s.sets = docids, rhashes, docSets{}
+
+	if s.indexDocIDs {
+		s.indexByDocID()
+	}
+
+	if s.prefixFilters {
+		s.filters = s.buildFilters(s.rhashes, s.docids)
+	}
+
+	if s.docSets {
+		s.docids, s.sets = groupDocIDs(s.docids)
+	}
+
+	if s.orderProbes {
+		s.sortProbes()
+	}
+
+	return nil
+}
+
+// mergeable returns why the store can't be merged, if it's unfinished or
+// uncompacted.  The caller must hold the lock.
+func (s *Store) mergeable() error {
+	if !s.finished {
+		return errors.New("simstore: can't merge unfinished stores")
+	}
+	if len(s.deleted) != 0 || len(s.pending) != 0 || s.stale != 0 {
+		return errUncompacted
+	}
+	return nil
+}
+
+// mergeTables returns the sorted table of the entries of the sorted tables a
+// and b
+func mergeTables(a, b table) table {
+
+	t := make(table, 0, len(a)+len(b))
+
+	for len(a) > 0 && len(b) > 0 {
+		if lessEntry(b[0], a[0]) {
+			t = append(t, b[0])
+			b = b[1:]
+		} else {
+			t = append(t, a[0])
+			a = a[1:]
+		}
+	}
+
+	t = append(t, a...)
+	return append(t, b...)
+}
+
+// lessEntry orders entries as table.Less does
+func lessEntry(x, y entry) bool {
+	if x.hash != y.hash {
+		return x.hash < y.hash
+	}
+	return x.docid < y.docid
+}
+
+// mergeU64 calls add with the values of the sorted slices a and b in order
+func mergeU64(a, b []uint64, add func(uint64)) {
+
+	for len(a) > 0 && len(b) > 0 {
+		if b[0] < a[0] {
+			add(b[0])
+			b = b[1:]
+		} else {
+			add(a[0])
+			a = a[1:]
+		}
+	}
+
+	for _, v := range a {
+		add(v)
+	}
+	for _, v := range b {
+		add(v)
+	}
+}
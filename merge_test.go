@@ -0,0 +1,200 @@
+package simstore
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestMerge(t *testing.T) {
+
+	r := rand.New(rand.NewSource(0))
+
+	sigs := make([]uint64, 3000)
+	for i := range sigs {
+		sigs[i] = uint64(r.Int63())
+		if i%20 == 0 {
+			// a signature in both stores
+			sigs[i] = 0xff
+		}
+	}
+
+	for _, tt := range []struct {
+		name     string
+		newStore StorageFactory
+		opts     []Option
+	}{
+		{"U64Slice", NewU64Slice, nil},
+		{"ZStore", NewZStore, nil},
+		{"DocIDSets", NewU64Slice, []Option{IndexDocIDs(), DocIDSets()}},
+	} {
+		want := New3(len(sigs), tt.newStore, tt.opts...)
+		day1 := New3(len(sigs), tt.newStore, tt.opts...)
+		day2 := New3(len(sigs), tt.newStore, tt.opts...)
+		for i, sig := range sigs {
+			want.Add(sig, uint64(i))
+			if i < 2000 {
+				day1.Add(sig, uint64(i))
+			} else {
+				day2.Add(sig, uint64(i))
+			}
+		}
+		want.Finish()
+		day1.Finish()
+		day2.Finish()
+
+		if err := day1.Merge(day2); err != nil {
+			t.Fatalf("%s: Merge: %v", tt.name, err)
+		}
+
+		if got, w := day1.Stats().Entries, want.Stats().Entries; got != w {
+			t.Errorf("%s: %d entries, want %d", tt.name, got, w)
+		}
+
+		for i := 0; i < 1000; i++ {
+			q := sigs[r.Intn(len(sigs))]
+			for j := r.Intn(5); j > 0; j-- {
+				q ^= 1 << uint(r.Intn(64))
+			}
+			if got, w := day1.Find(q), want.Find(q); !reflect.DeepEqual(got, w) {
+				t.Fatalf("%s: Find(%016x)=%v, want %v", tt.name, q, got, w)
+			}
+		}
+
+		if got, w := day1.FindByDocID(2500), want.FindByDocID(2500); !reflect.DeepEqual(got, w) {
+			t.Errorf("%s: FindByDocID(2500)=%v, want %v", tt.name, got, w)
+		}
+
+		if got := day2.Stats().Entries; got != 1000 {
+			t.Errorf("%s: the merged store has %d entries, want 1000", tt.name, got)
+		}
+	}
+}
+
+func TestMergeErrors(t *testing.T) {
+
+	finished := func(s *Store) *Store {
+		s.Add(1, 1)
+		s.Finish()
+		return s
+	}
+
+	s := finished(New3(0, NewU64Slice))
+
+	if err := s.Merge(finished(&New6(0, NewU64Slice).Store)); err != errMergePerm {
+		t.Errorf("Merge of a New6 store: err=%v, want %v", err, errMergePerm)
+	}
+
+	if err := s.Merge(New3(0, NewU64Slice)); err == nil {
+		t.Errorf("Merge of an unfinished store: err=nil")
+	}
+
+	if err := s.Merge(s); err == nil {
+		t.Errorf("Merge of the store itself: err=nil")
+	}
+
+	other := finished(New3(0, NewU64Slice))
+	other.Delete(1)
+	if err := s.Merge(other); err != errUncompacted {
+		t.Errorf("Merge of an uncompacted store: err=%v, want %v", err, errUncompacted)
+	}
+}
+
+func TestMergeEachOther(t *testing.T) {
+
+	sig := func(i int) uint64 { return uint64(i) * 0x9e3779b97f4a7c15 }
+
+	// the stores are merged into each other at once, without deadlocking,
+	// many times, as the window for it is small
+	for i := 0; i < 1000; i++ {
+		a, b := New3(10, NewU64Slice), New3(10, NewU64Slice)
+		a.Add(sig(1), 1)
+		b.Add(sig(2), 2)
+		a.Finish()
+		b.Finish()
+
+		done := make(chan error, 2)
+		go func() { done <- a.Merge(b) }()
+		go func() { done <- b.Merge(a) }()
+
+		for j := 0; j < 2; j++ {
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatalf("Merge: %v", err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("Merges of two stores into each other deadlocked")
+			}
+		}
+
+		// each has its own entry, and those of the other before or after
+		// it was merged
+		for _, s := range []*Store{a, b} {
+			if n := s.Len(); n != 2 && n != 3 {
+				t.Fatalf("merged store has %d entries, want 2 or 3", n)
+			}
+			if s.Find(sig(1)) == nil || s.Find(sig(2)) == nil {
+				t.Fatalf("merged store is missing the entries of one store")
+			}
+		}
+	}
+}
+
+func TestMergeMmap(t *testing.T) {
+
+	sig := func(i int) uint64 { return uint64(i) * 0x9e3779b97f4a7c15 }
+
+	m := New3(200000, NewU64Slice)
+	for i := 0; i < 200000; i++ {
+		m.Add(sig(i), uint64(i))
+	}
+	m.Finish()
+
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "store.snap")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the garbage collector runs throughout the merges, and would release
+	// the mapping of the merged store while its tables are read
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				runtime.GC()
+			}
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		s := New3(10, NewU64Slice)
+		s.Add(sig(200000), 200000)
+		s.Finish()
+
+		mapped, err := OpenMmap(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Merge(mapped); err != nil {
+			t.Fatal(err)
+		}
+
+		if s.Len() != 200001 || s.Find(sig(199999)) == nil {
+			t.Fatalf("merge of a mapped store has %d entries, want 200001", s.Len())
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package simstore
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxMIHDistance bounds the search distance of an MIHStore.  The substrings
+// looked up for each search grow as about C(64/m, distance/m).
+const maxMIHDistance = 16
+
+// minSubstringBits and maxSubstringBits bound the width of the substrings an
+// MIHStore indexes, and so the size of the bucket offsets of each index
+const (
+	minSubstringBits = 8
+	maxSubstringBits = 24
+)
+
+// MIHStore is a storage engine using multi-index hashing, as described in
+// Norouzi, Punjani and Fleet, "Fast Search in Hamming Space with Multi-Index
+// Hashing".  It splits each signature into m disjoint substrings and indexes
+// the entries by each of them.  Two signatures within distance r of each other
+// differ in at most r/m bits of at least one substring, so a search looks up
+// every substring within that distance of the query's in each index, and
+// checks the distance of the entries found.
+//
+// A search for distance r needs only m indexes, where a store created by New
+// needs C(r+k, k) tables, so the MIHStore handles distances up to about 10 in
+// a few bytes per signature per index.  Its searches enumerate the substrings
+// near the query's, so they get slower quickly as the distance grows past m.
+// An MIHStore holds at most 2^32 entries.
+type MIHStore struct {
+	distance int
+	subs     []substring
+
+	docids  table // sorted by signature after Finish
+	indexes []mihIndex
+	pending table // entries added after Finish, until Compact
+
+	tombstones
+	finished  bool
+	buildTime time.Duration
+	collapsed int
+}
+
+// substring is a block of bits of a signature
+type substring struct {
+	shift, width uint
+}
+
+func (sub substring) of(sig uint64) uint64 {
+	return sig >> sub.shift & (1<<sub.width - 1)
+}
+
+// mihIndex holds the positions in the document table of the entries with each
+// value of a substring, in the order of the values
+type mihIndex struct {
+	offs []uint32 // start of the entries of each value, followed by their number
+	ents []uint32
+}
+
+// NewMIH returns an MIHStore for searching hamming distance <= maxDistance,
+// between 1 and 16, for about hashes signatures.  The number of substrings is
+// chosen for hashes as in the paper: about 64/log2(hashes), so each bucket of
+// an index holds about one entry.
+func NewMIH(maxDistance int, hashes int) (*MIHStore, error) {
+
+	if maxDistance < 1 || maxDistance > maxMIHDistance {
+		return nil, errors.New("simstore: MIH distance must be between 1 and 16")
+	}
+
+	// m substrings of nearly equal width, from the top of the signature
+	m := mihSubstrings(hashes)
+	s := &MIHStore{distance: maxDistance, docids: make(table, 0, hashes)}
+	top := uint(64)
+	for i := 0; i < m; i++ {
+		w := uint(64 / m)
+		if i < 64%m {
+			w++
+		}
+		top -= w
+		s.subs = append(s.subs, substring{shift: top, width: w})
+	}
+
+	return s, nil
+}
+
+// mihSubstrings returns the number of substrings of an MIHStore for hashes
+// signatures
+func mihSubstrings(hashes int) int {
+	m := 64 / minSubstringBits
+	if hashes > 1 {
+		m = int(math.Round(64 / math.Log2(float64(hashes))))
+	}
+	return max((64+maxSubstringBits-1)/maxSubstringBits, min(m, 64/minSubstringBits))
+}
+
+// Substrings returns the number of substrings the store indexes its
+// signatures by
+func (s *MIHStore) Substrings() int {
+	return len(s.subs)
+}
+
+// MaxDistance returns the maximum hamming distance the store can search
+func (s *MIHStore) MaxDistance() int {
+	return s.distance
+}
+
+// Add inserts a signature and document id into the store.  Add may be called
+// from several goroutines at once, and after Finish concurrently with
+// searches; entries added after Finish are scanned by each search until
+// Compact indexes them.
+func (s *MIHStore) Add(sig uint64, docid uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.finished {
+		s.pending = append(s.pending, entry{hash: sig, docid: docid})
+		return
+	}
+
+	s.docids = append(s.docids, entry{hash: sig, docid: docid})
+}
+
+// Finish prepares the store for searching.  This must be called once after all
+// the signatures have been added via Add().  Entries added more than once with
+// the same signature and document id are stored once.
+func (s *MIHStore) Finish() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.finished {
+		return
+	}
+
+	start := time.Now()
+
+	sort.Sort(s.docids)
+	s.collapsed = s.docids.dedup()
+	s.indexes = s.index(s.docids)
+
+	s.finished = true
+	s.buildTime = time.Since(start)
+}
+
+// index returns the indexes of the substrings of the entries of docids
+func (s *MIHStore) index(docids table) []mihIndex {
+
+	indexes := make([]mihIndex, len(s.subs))
+
+	var wg sync.WaitGroup
+	for i, sub := range s.subs {
+		wg.Add(1)
+		go func(ix *mihIndex, sub substring) {
+			defer wg.Done()
+
+			// a counting sort of the entries by the value of the substring
+			ix.offs = make([]uint32, 1<<sub.width+1)
+			for _, e := range docids {
+				ix.offs[sub.of(e.hash)+1]++
+			}
+			for v := 1; v < len(ix.offs); v++ {
+				ix.offs[v] += ix.offs[v-1]
+			}
+
+			next := make([]uint32, len(ix.offs)-1)
+			copy(next, ix.offs)
+
+			ix.ents = make([]uint32, len(docids))
+			for j, e := range docids {
+				v := sub.of(e.hash)
+				ix.ents[next[v]] = uint32(j)
+				next[v]++
+			}
+		}(&indexes[i], sub)
+	}
+	wg.Wait()
+
+	return indexes
+}
+
+// radius returns the distance from the query's substring i to search for a
+// store distance of d: with d = q*m + a, a signature within d of the query is
+// within q in one of the first a+1 substrings, or within q-1 in one of the
+// others.  It's negative for substrings which needn't be searched.
+func (s *MIHStore) radius(i, d int) int {
+	q, a := d/len(s.subs), d%len(s.subs)
+	if i <= a {
+		return q
+	}
+	return q - 1
+}
+
+// Find searches the store for all hashes within the store's hamming distance
+// of the query signature.  It returns the associated list of document ids in
+// ascending order.
+func (s *MIHStore) Find(sig uint64) []uint64 {
+	ids, _ := s.FindScanned(sig)
+	return ids
+}
+
+// FindScanned is like Find, but also returns the number of entries whose
+// distance from the query was checked.
+func (s *MIHStore) FindScanned(sig uint64) ([]uint64, int) {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ids []uint64
+	var scanned int
+
+	check := func(e entry) {
+		scanned++
+		if distance(e.hash, sig) <= s.distance && !s.isDeleted(e.docid) {
+			ids = append(ids, e.docid)
+		}
+	}
+
+	for i, ix := range s.indexes {
+		sub := s.subs[i]
+		eachWithin(sub.of(sig), sub.width, s.radius(i, s.distance), func(v uint64) {
+			for _, j := range ix.ents[ix.offs[v]:ix.offs[v+1]] {
+				check(s.docids[j])
+			}
+		})
+	}
+
+	for _, e := range s.pending {
+		check(e)
+	}
+
+	return unique(ids), scanned
+}
+
+// eachWithin calls fn with every value of width bits within distance r of v,
+// v itself first.  It calls nothing if r is negative.
+func eachWithin(v uint64, width uint, r int, fn func(uint64)) {
+	if r < 0 {
+		return
+	}
+
+	fn(v)
+
+	// flip each combination of up to r bits, in increasing order of bit
+	var flip func(u uint64, from uint, left int)
+	flip = func(u uint64, from uint, left int) {
+		for b := from; b < width; b++ {
+			w := u ^ 1<<b
+			fn(w)
+			if left > 1 {
+				flip(w, b+1, left-1)
+			}
+		}
+	}
+	if r > 0 {
+		flip(v, 0, r)
+	}
+}
@@ -0,0 +1,220 @@
+package simstore
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestMIHStore(t *testing.T) {
+
+	r := rand.New(rand.NewSource(0))
+
+	// random signatures, and clusters of signatures close to them
+	var sigs []uint64
+	for i := 0; i < 20000; i++ {
+		sig := r.Uint64()
+		if i%2 == 1 {
+			sig = sigs[r.Intn(len(sigs))]
+			for j := r.Intn(12); j > 0; j-- {
+				sig ^= 1 << uint(r.Intn(64))
+			}
+		}
+		sigs = append(sigs, sig)
+	}
+
+	for _, d := range []int{1, 3, 6, 10} {
+		s, err := NewMIH(d, len(sigs))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.Substrings(); got != 4 {
+			t.Errorf("d=%d: %d substrings, want 4 for 2^14 signatures", d, got)
+		}
+
+		// the first half before Finish, the rest after
+		for i, sig := range sigs[:len(sigs)/2] {
+			s.Add(sig, uint64(i))
+		}
+		s.Finish()
+		for i, sig := range sigs[len(sigs)/2:] {
+			s.Add(sig, uint64(len(sigs)/2+i))
+		}
+
+		check := func(when string, deleted map[uint64]bool) {
+			t.Helper()
+			for i := 0; i < 300; i++ {
+				q := sigs[r.Intn(len(sigs))]
+				for j := r.Intn(2 * d); j > 0; j-- {
+					q ^= 1 << uint(r.Intn(64))
+				}
+
+				var want []uint64
+				for id, sig := range sigs {
+					if distance(sig, q) <= d && !deleted[uint64(id)] {
+						want = append(want, uint64(id))
+					}
+				}
+
+				if got := s.Find(q); !reflect.DeepEqual(got, want) {
+					t.Fatalf("d=%d %s: Find(%016x)=%v, want %v", d, when, q, got, want)
+				}
+			}
+		}
+
+		check("with pending entries", nil)
+
+		deleted := make(map[uint64]bool)
+		for i := 0; i < len(sigs); i += 7 {
+			s.Delete(uint64(i))
+			deleted[uint64(i)] = true
+		}
+		check("with deletions", deleted)
+
+		if got, want := s.Compact(), len(deleted); got != want {
+			t.Errorf("d=%d: Compact removed %d entries, want %d", d, got, want)
+		}
+
+		st := s.Stats()
+		if st.Entries != len(sigs)-len(deleted) || st.Pending != 0 || st.Deleted != 0 || len(st.Tables) != 4 || s.Len() != st.Entries {
+			t.Errorf("d=%d: Stats after Compact=%+v", d, st)
+		}
+		check("compacted", deleted)
+	}
+}
+
+func TestMIHDedup(t *testing.T) {
+
+	s, err := NewMIH(3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Add(1, 1)
+	s.Add(1, 1)
+	s.Add(1, 2)
+	s.Finish()
+
+	if got := s.Collapsed(); got != 1 {
+		t.Errorf("Collapsed=%d, want 1", got)
+	}
+	if got, want := s.Find(3), []uint64{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Find=%v, want %v", got, want)
+	}
+	if got := s.Stats().DuplicateRatio; got != 0.5 {
+		t.Errorf("DuplicateRatio=%v, want 0.5", got)
+	}
+}
+
+func TestEstimateMIHMemory(t *testing.T) {
+
+	sigs := benchSignatures()[:100000]
+
+	s, err := NewMIH(6, len(sigs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, sig := range sigs {
+		s.Add(sig, uint64(i))
+	}
+	s.Finish()
+
+	if got, want := EstimateMIHMemory(len(sigs)), uint64(s.MemoryBytes()); got != want {
+		t.Errorf("EstimateMIHMemory=%d, want %d", got, want)
+	}
+}
+
+func TestNewMIH(t *testing.T) {
+
+	for _, tt := range []struct {
+		hashes int
+		widths []int
+	}{
+		{0, []int{8, 8, 8, 8, 8, 8, 8, 8}},
+		{1000, []int{11, 11, 11, 11, 10, 10}},
+		{1 << 20, []int{22, 21, 21}},
+	} {
+		s, err := NewMIH(10, tt.hashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var widths []int
+		var bits uint64
+		for _, sub := range s.subs {
+			widths = append(widths, int(sub.width))
+			bits |= (1<<sub.width - 1) << sub.shift
+		}
+		if !reflect.DeepEqual(widths, tt.widths) || bits != ^uint64(0) {
+			t.Errorf("hashes=%d: substrings of %v bits covering %016x, want %v", tt.hashes, widths, bits, tt.widths)
+		}
+	}
+
+	for _, d := range []int{0, 17} {
+		if _, err := NewMIH(d, 1000); err == nil {
+			t.Errorf("NewMIH(%d) succeeded", d)
+		}
+	}
+}
+
+func TestEachWithin(t *testing.T) {
+
+	for _, tt := range []struct {
+		width uint
+		r     int
+		want  int
+	}{
+		{16, -1, 0},
+		{16, 0, 1},
+		{16, 1, 17},
+		{16, 2, 1 + 16 + 120},
+		{8, 8, 256},
+	} {
+		seen := make(map[uint64]bool)
+		eachWithin(0x5a, tt.width, tt.r, func(v uint64) {
+			if seen[v] || distance(v, 0x5a) > tt.r || v>>tt.width != 0 {
+				t.Errorf("width=%d r=%d: value %x repeated or out of range", tt.width, tt.r, v)
+			}
+			seen[v] = true
+		})
+		if len(seen) != tt.want {
+			t.Errorf("width=%d r=%d: %d values, want %d", tt.width, tt.r, len(seen), tt.want)
+		}
+	}
+}
+
+// BenchmarkMIH measures searches of an MIHStore by distance, for queries near
+// a signature in the store.
+//
+//	go test -run=NONE -bench=MIH -benchsigs=10000000
+func BenchmarkMIH(b *testing.B) {
+
+	sigs := benchSignatures()
+
+	r := rand.New(rand.NewSource(1))
+	queries := make([]uint64, 1<<12)
+	for i := range queries {
+		q := sigs[r.Intn(len(sigs))]
+		for j := r.Intn(4); j > 0; j-- {
+			q ^= 1 << uint(r.Intn(64))
+		}
+		queries[i] = q
+	}
+
+	for _, d := range []int{3, 6, 10} {
+		s, err := NewMIH(d, len(sigs))
+		if err != nil {
+			b.Fatal(err)
+		}
+		for i, sig := range sigs {
+			s.Add(sig, uint64(i))
+		}
+		s.Finish()
+
+		b.Run(fmt.Sprintf("d=%d", d), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				s.Find(queries[i%len(queries)])
+			}
+		})
+	}
+}
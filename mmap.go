@@ -0,0 +1,179 @@
+package simstore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"runtime"
+	"unsafe"
+)
+
+// OpenMmap opens a snapshot written by WriteTo as a read-only Store whose
+// tables are the memory-mapped file itself, so the operating system's page
+// cache decides how much of the store is resident rather than the Go heap.
+// The file may be removed once it is open, and every process mapping the same
+// file shares the pages cached for it.  The file must not be modified while
+// it is mapped: replace it by renaming a new snapshot over it.  The returned
+// store is already finished, so entries added to it are kept on the heap until
+// Compact, which moves the whole store onto the heap.
+//
+// The options apply as they would to a store built in memory, except Dedup,
+// which only has an effect when a store is built.
+//
+// OpenMmap reads the whole file once to check its checksums.  The mapping is
+// released by Close, or when the Store is garbage collected, so no slice of
+// its tables may outlive the Store: the results of its methods are copies,
+// and a copy made by Snapshot keeps the Store reachable.
+func OpenMmap(path string, opts ...Option) (*Store, error) {
+
+	data, err := mmapFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := openSnapshot(data, opts)
+	if err != nil {
+		munmap(data)
+		return nil, err
+	}
+
+	if s.indexDocIDs {
+		s.indexByDocID()
+	}
+
+	if s.prefixFilters {
+		s.filters = s.buildFilters(s.rhashes, s.docids)
+	}
+
+	if s.orderProbes {
+		s.sortProbes()
+	}
+
+	s.mapped = data
+	s.finished = true
+	runtime.SetFinalizer(s, (*Store).Close)
+
+	return s, nil
+}
+
+// Close releases the memory map of a store opened with OpenMmap.  The store
+// must not be used afterwards, nor while Close is running, and neither must
+// its copies made by Snapshot.  Close does nothing for other stores, nor for
+// the copies, which leave the mapping to the store they were made from.
+func (s *Store) Close() error {
+	if s.mapped == nil || s.owner != nil {
+		return nil
+	}
+
+	runtime.SetFinalizer(s, nil)
+
+	data := s.mapped
+	s.mapped = nil
+	s.docids = nil
+	for i := range s.rhashes {
+		s.rhashes[i] = nil
+	}
+	s.filters = nil
+
+	return munmap(data)
+}
+
+// openSnapshot returns a Store whose tables alias the snapshot in data
+func openSnapshot(data []byte, opts []Option) (*Store, error) {
+
+	var one uint16 = 1
+	if *(*byte)(unsafe.Pointer(&one)) != 1 {
+		return nil, errors.New("simstore: snapshots can only be mapped on little-endian machines")
+	}
+
+	if len(data) < snapshotHeaderSize {
+		return nil, ErrSnapshotFormat
+	}
+
+	perm, entries, checksums, err := parseSnapshotHeader(data[:snapshotHeaderSize])
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{}
+	s.init(0, perm, nil, opts)
+
+	rest := data[snapshotHeaderSize:]
+
+	// check compares the checksum following rest with that of the section
+	// which ends there, the bytes of data from start
+	start := data
+	check := func(section string) error {
+		if !checksums {
+			return nil
+		}
+		if len(rest) < 8 {
+			return ErrSnapshotFormat
+		}
+		sum := crc32.Checksum(start[:len(start)-len(rest)], castagnoli)
+		if binary.LittleEndian.Uint64(rest) != uint64(sum) {
+			return fmt.Errorf("%w: %s", ErrSnapshotChecksum, section)
+		}
+		rest = rest[8:]
+		start = rest
+		return nil
+	}
+
+	if err := check("header"); err != nil {
+		return nil, err
+	}
+
+	// next returns the next n 8-byte words of the snapshot
+	next := func(n uint64) (unsafe.Pointer, bool) {
+		if n > uint64(len(rest))/8 {
+			return nil, false
+		}
+		if n == 0 {
+			return nil, true
+		}
+		p := unsafe.Pointer(&rest[0])
+		rest = rest[8*n:]
+		return p, true
+	}
+
+	p, ok := next(2 * entries)
+	if !ok {
+		return nil, ErrSnapshotFormat
+	}
+	if p != nil {
+		s.docids = unsafe.Slice((*entry)(p), entries)
+	}
+	if err := check("document table"); err != nil {
+		return nil, err
+	}
+
+	for t := range s.rhashes {
+		if len(rest) < 8 {
+			return nil, ErrSnapshotFormat
+		}
+		n := binary.LittleEndian.Uint64(rest)
+		rest = rest[8:]
+
+		p, ok := next(n)
+		if !ok {
+			return nil, ErrSnapshotFormat
+		}
+
+		var u u64slice
+		if p != nil {
+			u = unsafe.Slice((*uint64)(p), n)
+		}
+		s.rhashes[t] = &u
+
+		if err := check(fmt.Sprintf("table %d", t)); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(rest) != 0 {
+		return nil, ErrSnapshotFormat
+	}
+
+	return s, nil
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package simstore
+
+import "errors"
+
+var errNoMmap = errors.New("simstore: memory-mapped stores are not supported on this platform")
+
+func mmapFile(path string) ([]byte, error) { return nil, errNoMmap }
+
+func munmap(data []byte) error { return errNoMmap }
@@ -0,0 +1,234 @@
+package simstore
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestOpenMmap(t *testing.T) {
+
+	r := rand.New(rand.NewSource(0))
+
+	for _, distance := range []int{3, 6} {
+		newStore := func(factory StorageFactory) *Store {
+			if distance == 6 {
+				return &New6(1000, factory).Store
+			}
+			return New3(1000, factory)
+		}
+
+		heap := newStore(NewU64Slice)
+		discarded := newStore(NewDiscard)
+
+		sigs := make([]uint64, 1000)
+		for i := range sigs {
+			sigs[i] = uint64(r.Int63())
+			heap.Add(sigs[i], uint64(i))
+			discarded.Add(sigs[i], uint64(i))
+		}
+		heap.Finish()
+		discarded.Finish()
+
+		var want, got bytes.Buffer
+		heap.WriteTo(&want)
+		discarded.WriteTo(&got)
+
+		if !bytes.Equal(got.Bytes(), want.Bytes()) {
+			t.Fatalf("d=%d: snapshot of a NewDiscard store differs", distance)
+		}
+
+		path := filepath.Join(t.TempDir(), "store.snap")
+		if err := os.WriteFile(path, want.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		mapped, err := OpenMmap(path)
+		if err != nil {
+			t.Fatalf("d=%d: OpenMmap: %v", distance, err)
+		}
+
+		// the mapping outlives the file
+		os.Remove(path)
+
+		for i := 0; i < 1000; i++ {
+			q := sigs[r.Intn(len(sigs))]
+			for j := r.Intn(distance + 2); j > 0; j-- {
+				q ^= 1 << uint(r.Intn(64))
+			}
+
+			if got, want := mapped.Find(q), heap.Find(q); !reflect.DeepEqual(got, want) {
+				t.Errorf("d=%d: mapped Find(%016x)=%v, want %v", distance, q, got, want)
+			}
+		}
+
+		mapped.Finish()
+
+		if err := mapped.Close(); err != nil {
+			t.Errorf("d=%d: Close: %v", distance, err)
+		}
+	}
+}
+
+func TestOpenMmapInvalid(t *testing.T) {
+
+	s := New3(10, NewU64Slice)
+	for i := 0; i < 10; i++ {
+		s.Add(uint64(i)<<40, uint64(i))
+	}
+	s.Finish()
+
+	var buf bytes.Buffer
+	s.WriteTo(&buf)
+	snap := buf.Bytes()
+
+	dir := t.TempDir()
+
+	for _, tt := range []struct {
+		name string
+		data []byte
+	}{
+		{"truncated", snap[:len(snap)-8]},
+		{"trailing", append(append([]byte{}, snap...), 0, 0, 0, 0, 0, 0, 0, 0)},
+		{"header", snap[:10]},
+		{"magic", append([]byte("notsimst"), snap[8:]...)},
+		{"empty", nil},
+	} {
+		path := filepath.Join(dir, tt.name)
+		if err := os.WriteFile(path, tt.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := OpenMmap(path); err != ErrSnapshotFormat {
+			t.Errorf("%s: OpenMmap error=%v, want ErrSnapshotFormat", tt.name, err)
+		}
+	}
+
+	path := filepath.Join(dir, "valid")
+	os.WriteFile(path, snap, 0644)
+	mapped, err := OpenMmap(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mapped.Close()
+
+	// entries added to a mapped store are searchable before and after Compact
+	mapped.Add(1, 100)
+	for _, when := range []string{"before", "after"} {
+		if got, want := mapped.FindExact(1), []uint64{100}; !reflect.DeepEqual(got, want) {
+			t.Errorf("FindExact(1) %s Compact=%v, want %v", when, got, want)
+		}
+		mapped.Compact()
+	}
+}
+
+func TestOpenMmapShared(t *testing.T) {
+
+	build := func(docid uint64) []byte {
+		s := New3(1, NewU64Slice)
+		s.Add(0xdeadbeef, docid)
+		s.Finish()
+		var buf bytes.Buffer
+		s.WriteTo(&buf)
+		return buf.Bytes()
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "store.snap")
+	if err := os.WriteFile(path, build(1), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var stores []Storage
+	for i := 0; i < 2; i++ {
+		s, err := OpenMmap(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		stores = append(stores, s)
+	}
+
+	// a new snapshot renamed over the file doesn't affect the open mappings
+	next := filepath.Join(dir, "next.snap")
+	if err := os.WriteFile(next, build(2), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(next, path); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, s := range stores {
+		if got, want := s.Find(0xdeadbeef), []uint64{1}; !reflect.DeepEqual(got, want) {
+			t.Errorf("store %d: Find=%v, want %v", i, got, want)
+		}
+	}
+
+	s, err := OpenMmap(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if got, want := s.Find(0xdeadbeef), []uint64{2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("replaced snapshot: Find=%v, want %v", got, want)
+	}
+}
+
+func TestSnapshotMmap(t *testing.T) {
+
+	sig := func(i int) uint64 { return uint64(i) * 0x9e3779b97f4a7c15 }
+
+	s := New3(1000, NewU64Slice)
+	for i := 0; i < 1000; i++ {
+		s.Add(sig(i), uint64(i))
+	}
+	s.Finish()
+
+	var want bytes.Buffer
+	if _, err := s.WriteTo(&want); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "store.snap")
+	if err := os.WriteFile(path, want.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mapped, err := OpenMmap(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the copy of a copy keeps the mapping too
+	v := mapped.Snapshot().Snapshot()
+	mapped = nil
+
+	// the store's finalizer would unmap the copy's tables
+	runtime.GC()
+	runtime.GC()
+
+	if got := v.Find(sig(7)); !reflect.DeepEqual(got, []uint64{7}) {
+		t.Errorf("copy of a collected mapped store: Find=%v, want [7]", got)
+	}
+
+	var got bytes.Buffer
+	if _, err := v.WriteTo(&got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Errorf("copy of a collected mapped store wrote a different snapshot")
+	}
+
+	// closing a copy leaves the mapping alone
+	if err := v.Close(); err != nil {
+		t.Errorf("Close of a copy: %v", err)
+	}
+	if got := v.Find(sig(7)); !reflect.DeepEqual(got, []uint64{7}) {
+		t.Errorf("Find after Close of a copy=%v, want [7]", got)
+	}
+}
@@ -0,0 +1,149 @@
+package simstore
+
+import "sync"
+
+// MultiStore is a Storage over several child stores, such as one per day, so
+// a rolling window can be kept by adding a new partition with Push and
+// removing the oldest with Drop, instead of deleting their entries one by
+// one.  Add inserts into the newest child, and Find and Delete apply to them
+// all.  The children must only be changed through the MultiStore.
+type MultiStore struct {
+	mu     sync.RWMutex
+	stores []Storage
+}
+
+// NewMultiStore returns a MultiStore over stores, from the oldest to the
+// newest
+func NewMultiStore(stores ...Storage) *MultiStore {
+	return &MultiStore{stores: append([]Storage(nil), stores...)}
+}
+
+// Push makes s the newest child, into which later signatures are added
+func (m *MultiStore) Push(s Storage) {
+	m.mu.Lock()
+	m.stores = append(m.stores, s)
+	m.mu.Unlock()
+}
+
+// Drop removes the n oldest children, or all of them if there are fewer, and
+// returns them, oldest first
+func (m *MultiStore) Drop(n int) []Storage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if n > len(m.stores) {
+		n = len(m.stores)
+	}
+	dropped := append([]Storage(nil), m.stores[:n]...)
+	m.stores = append(m.stores[:0:0], m.stores[n:]...)
+	return dropped
+}
+
+// Stores returns the children, oldest first
+func (m *MultiStore) Stores() []Storage {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]Storage(nil), m.stores...)
+}
+
+// Add inserts into the newest child.  It does nothing if there are none.
+func (m *MultiStore) Add(sig, docid uint64) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if len(m.stores) == 0 {
+		return
+	}
+	m.stores[len(m.stores)-1].Add(sig, docid)
+}
+
+// Find returns the sorted, distinct docids found by any of the children
+func (m *MultiStore) Find(sig uint64) []uint64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var ids []uint64
+	for _, s := range m.stores {
+		ids = append(ids, s.Find(sig)...)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	return unique(ids)
+}
+
+// Finish finishes each child.  Those already finished, such as a Store, an
+// MIHStore or a BoltStore, ignore it.
+func (m *MultiStore) Finish() {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, s := range m.stores {
+		s.Finish()
+	}
+}
+
+// Delete removes docid from each child
+func (m *MultiStore) Delete(docid uint64) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, s := range m.stores {
+		s.Delete(docid)
+	}
+}
+
+// Compact compacts the children which support it, such as a Store, and
+// returns how many entries were removed
+func (m *MultiStore) Compact() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var n int
+	for _, s := range m.stores {
+		if c, ok := s.(interface{ Compact() int }); ok {
+			n += c.Compact()
+		}
+	}
+	return n
+}
+
+// Len returns the number of entries in all the children
+func (m *MultiStore) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var n int
+	for _, s := range m.stores {
+		n += s.Len()
+	}
+	return n
+}
+
+// Stats adds up the stats of the children, so a docid deleted from several is
+// counted by each of them in Deleted.  Tables is left nil, as the
+// children needn't have the same tables, BuildTime is the sum of theirs, and
+// DuplicateRatio is their average weighted by their entries in the tables.
+func (m *MultiStore) Stats() Stats {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var st Stats
+	var tabled, duplicates float64
+	for _, s := range m.stores {
+		c := s.Stats()
+		st.Entries += c.Entries
+		st.Pending += c.Pending
+		st.Deleted += c.Deleted
+		st.MemoryBytes += c.MemoryBytes
+		st.BuildTime += c.BuildTime
+
+		n := float64(c.Entries - c.Pending)
+		tabled += n
+		duplicates += c.DuplicateRatio * n
+	}
+	if tabled > 0 {
+		st.DuplicateRatio = duplicates / tabled
+	}
+	return st
+}
@@ -0,0 +1,55 @@
+package simstore
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMultiStore(t *testing.T) {
+
+	day := func(docids ...uint64) Storage {
+		s := New3(len(docids), NewU64Slice)
+		for _, id := range docids {
+			s.Add(0xff00ff00, id)
+		}
+		s.Finish()
+		return s
+	}
+
+	m := NewMultiStore(day(1, 2), day(2, 3))
+	var _ Storage = m
+
+	if got := m.Find(0xff00ff01); !reflect.DeepEqual(got, []uint64{1, 2, 3}) {
+		t.Errorf("Find=%v, want [1 2 3]", got)
+	}
+
+	// added to the newest day, and deleted from all of them
+	m.Push(New3(0, NewU64Slice))
+	m.Add(0xff00ff00, 4)
+	m.Finish()
+	m.Delete(2)
+
+	if got := m.Find(0xff00ff00); !reflect.DeepEqual(got, []uint64{1, 3, 4}) {
+		t.Errorf("Find after Push and Delete=%v, want [1 3 4]", got)
+	}
+	if got := m.Stores()[2].Find(0xff00ff00); !reflect.DeepEqual(got, []uint64{4}) {
+		t.Errorf("Find in the newest store=%v, want [4]", got)
+	}
+	// the deleted docid is counted by each store
+	if m.Len() != 5 || m.Stats().Entries != 5 || m.Stats().Deleted != 3 {
+		t.Errorf("Len=%d Stats=%+v, want 5 entries, 3 deleted", m.Len(), m.Stats())
+	}
+
+	if dropped := m.Drop(2); len(dropped) != 2 || len(m.Stores()) != 1 {
+		t.Errorf("Drop(2) returned %d stores and left %d, want 2 and 1", len(dropped), len(m.Stores()))
+	}
+	if got := m.Find(0xff00ff00); !reflect.DeepEqual(got, []uint64{4}) {
+		t.Errorf("Find after Drop=%v, want [4]", got)
+	}
+
+	m.Drop(5)
+	m.Add(1, 1)
+	if got := m.Find(1); got != nil || m.Len() != 0 {
+		t.Errorf("empty MultiStore: Find=%v Len=%d", got, m.Len())
+	}
+}
@@ -0,0 +1,75 @@
+package simstore
+
+import "sync"
+
+// PayloadStore is a Store whose documents are identified by a value of any
+// type, such as a struct locating the document, rather than by a uint64.  The
+// store assigns each document a docid, the index of its payload in a slice,
+// so a payload costs its own size plus nothing per signature.
+type PayloadStore[T any] struct {
+	s *Store
+
+	mu       sync.RWMutex
+	payloads []T
+}
+
+// NewPayload returns a PayloadStore keeping its signatures in s, which must be
+// empty.  Options such as IndexDocIDs apply as they do to s.
+func NewPayload[T any](s *Store) *PayloadStore[T] {
+	return &PayloadStore[T]{s: s}
+}
+
+// Add inserts a document with its payload and signatures, and returns the
+// docid it was given.  After Finish, Add may be called concurrently with
+// searches.
+func (p *PayloadStore[T]) Add(payload T, sigs ...uint64) uint64 {
+	p.mu.Lock()
+	docid := uint64(len(p.payloads))
+	p.payloads = append(p.payloads, payload)
+	p.mu.Unlock()
+
+	for _, sig := range sigs {
+		p.s.Add(sig, docid)
+	}
+
+	return docid
+}
+
+// Finish prepares the store for searching, as Store.Finish does
+func (p *PayloadStore[T]) Finish() {
+	p.s.Finish()
+}
+
+// Find returns the payloads of the documents Find would return for sig, in
+// the order they were added.
+func (p *PayloadStore[T]) Find(sig uint64) []T {
+	return p.Payloads(p.s.Find(sig))
+}
+
+// Payloads returns the payloads of docids, as returned by Add or by searches
+// of the underlying store.  Unknown docids are skipped.
+func (p *PayloadStore[T]) Payloads(docids []uint64) []T {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var r []T
+	for _, id := range docids {
+		if id < uint64(len(p.payloads)) {
+			r = append(r, p.payloads[id])
+		}
+	}
+	return r
+}
+
+// Delete removes the document with docid from the results of searches.  Its
+// payload is kept, as the docids of the other documents are indexes of the
+// payload slice.
+func (p *PayloadStore[T]) Delete(docid uint64) {
+	p.s.Delete(docid)
+}
+
+// Store returns the underlying store, for the searches PayloadStore doesn't
+// wrap.  Its results are docids, which Payloads converts.
+func (p *PayloadStore[T]) Store() *Store {
+	return p.s
+}
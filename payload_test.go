@@ -0,0 +1,47 @@
+package simstore
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPayloadStore(t *testing.T) {
+
+	type location struct {
+		Shard  int
+		Offset int64
+	}
+
+	p := NewPayload[location](New3(10, NewU64Slice))
+
+	const sig = 0xdeadbeefcafebabe
+
+	a := p.Add(location{1, 100}, sig, sig^0xff00ff)
+	b := p.Add(location{2, 200}, sig^1)
+	p.Add(location{3, 300}, ^uint64(sig))
+	p.Finish()
+
+	if got, want := p.Find(sig), []location{{1, 100}, {2, 200}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Find=%v, want %v", got, want)
+	}
+
+	// a document with several matching signatures is returned once
+	if got, want := p.Find(sig^0xff00fe), []location{{1, 100}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Find=%v, want %v", got, want)
+	}
+
+	c := p.Add(location{4, 400}, sig^3)
+	p.Delete(b)
+
+	if got, want := p.Find(sig), []location{{1, 100}, {4, 400}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Find after Add and Delete=%v, want %v", got, want)
+	}
+
+	if got, want := p.Payloads([]uint64{c, a, 99}), []location{{4, 400}, {1, 100}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Payloads=%v, want %v", got, want)
+	}
+
+	if got := p.Find(0); got != nil {
+		t.Errorf("Find with no matches=%v, want nil", got)
+	}
+}
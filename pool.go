@@ -0,0 +1,46 @@
+package simstore
+
+import "sync"
+
+// A Pool runs functions on a fixed set of worker goroutines.  Sharing one Pool
+// between all the searches of a process bounds the number of goroutines doing
+// search work, instead of each request spawning its own.
+type Pool struct {
+	work chan func()
+	wg   sync.WaitGroup
+}
+
+// NewPool returns a Pool with the given number of workers
+func NewPool(workers int) *Pool {
+	if workers < 1 {
+		workers = 1
+	}
+
+	p := &Pool{work: make(chan func(), workers)}
+
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for f := range p.work {
+				f()
+			}
+			p.wg.Done()
+		}()
+	}
+
+	return p
+}
+
+// Go runs f on one of the pool's workers, blocking if all the workers are busy
+// and the queue of pending functions is full.  A function running on the pool
+// must not wait for other functions it submits to the same pool, as all the
+// workers may be busy waiting.
+func (p *Pool) Go(f func()) {
+	p.work <- f
+}
+
+// Close stops the workers once the submitted functions have finished
+func (p *Pool) Close() {
+	close(p.work)
+	p.wg.Wait()
+}
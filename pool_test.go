@@ -0,0 +1,147 @@
+package simstore
+
+import (
+	"math/rand"
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPool(t *testing.T) {
+
+	p := NewPool(4)
+
+	var n int64
+	var wg sync.WaitGroup
+
+	for i := 0; i < 1000; i++ {
+		wg.Add(1)
+		p.Go(func() {
+			atomic.AddInt64(&n, 1)
+			wg.Done()
+		})
+	}
+
+	wg.Wait()
+	p.Close()
+
+	if n != 1000 {
+		t.Errorf("ran %d functions, want 1000", n)
+	}
+}
+
+// fanout runs a request that splits into 16 small tasks, like a search of the
+// 16 tables of New3
+func fanout(s *Store, sig uint64, spawn func(func())) {
+	var wg sync.WaitGroup
+	wg.Add(16)
+	for t := 0; t < 16; t++ {
+		t := t
+		spawn(func() {
+			p, mask := s.perm.shuffle(sig, t)
+			s.rhashes[t].Find(p, mask, 3)
+			wg.Done()
+		})
+	}
+	wg.Wait()
+}
+
+// BenchmarkFanout compares the throughput of many concurrent requests which
+// each start their own goroutines against sharing one Pool.
+func BenchmarkFanout(b *testing.B) {
+
+	s := New3(1<<16, NewU64Slice)
+	for i := 0; i < 1<<16; i++ {
+		s.Add(uint64(i)*0x9e3779b97f4a7c15, uint64(i))
+	}
+	s.Finish()
+
+	b.Run("goroutines", func(b *testing.B) {
+		b.SetParallelism(16)
+		b.RunParallel(func(pb *testing.PB) {
+			var sig uint64
+			for pb.Next() {
+				sig += 0x9e3779b97f4a7c15
+				fanout(s, sig, func(f func()) { go f() })
+			}
+		})
+	})
+
+	b.Run("pool", func(b *testing.B) {
+		p := NewPool(runtime.GOMAXPROCS(0))
+		defer p.Close()
+
+		b.SetParallelism(16)
+		b.RunParallel(func(pb *testing.PB) {
+			var sig uint64
+			for pb.Next() {
+				sig += 0x9e3779b97f4a7c15
+				fanout(s, sig, p.Go)
+			}
+		})
+	})
+}
+
+func TestFindParallel(t *testing.T) {
+
+	r := rand.New(rand.NewSource(0))
+
+	p := NewPool(4)
+	defer p.Close()
+
+	s := New6(10000, NewU64Slice)
+	sigs := make([]uint64, 10000)
+	for i := range sigs {
+		sigs[i] = uint64(r.Int63())
+		s.Add(sigs[i], uint64(i))
+	}
+	s.Finish()
+
+	s.Add(sigs[0]^1, 10000)
+	s.Delete(1)
+
+	if got := New3(0, NewU64Slice).FindParallel(0, p); got != nil {
+		t.Errorf("FindParallel on an empty store=%v, want nil", got)
+	}
+
+	for i := 0; i < 1000; i++ {
+		q := sigs[r.Intn(100)]
+		for j := r.Intn(8); j > 0; j-- {
+			q ^= 1 << uint(r.Intn(64))
+		}
+
+		if got, want := s.FindParallel(q, p), s.Find(q); !reflect.DeepEqual(got, want) {
+			t.Fatalf("FindParallel(%016x)=%v, want %v", q, got, want)
+		}
+	}
+}
+
+// BenchmarkFindParallel compares the latency of a single search of the 49
+// tables of New6 probed in turn and probed on a Pool.
+func BenchmarkFindParallel(b *testing.B) {
+
+	r := rand.New(rand.NewSource(0))
+
+	s := New6(1<<20, NewU64Slice)
+	for i := 0; i < 1<<20; i++ {
+		s.Add(uint64(r.Int63()), uint64(i))
+	}
+	s.Finish()
+
+	b.Run("Find", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			s.Find(uint64(r.Int63()))
+		}
+	})
+
+	b.Run("FindParallel", func(b *testing.B) {
+		p := NewPool(runtime.GOMAXPROCS(0))
+		defer p.Close()
+
+		for i := 0; i < b.N; i++ {
+			s.FindParallel(uint64(r.Int63()), p)
+		}
+	})
+}
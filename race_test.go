@@ -0,0 +1,7 @@
+//go:build race
+
+package simstore
+
+// raceEnabled is set when the race detector is on, which makes sync.Pool drop
+// items at random, so allocation counts aren't reliable
+const raceEnabled = true
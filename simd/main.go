@@ -3,43 +3,240 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"expvar"
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"mime"
 	"net/http"
 	_ "net/http/pprof"
 	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 	"unsafe"
 
 	"github.com/dgryski/go-simstore"
+	"github.com/dgryski/go-simstore/bktree"
+	"github.com/dgryski/go-simstore/hnsw"
+	"github.com/dgryski/go-simstore/simhash"
 	"github.com/dgryski/go-simstore/vptree"
 	"github.com/peterbourgon/g2g"
 )
 
 var Metrics = struct {
-	Requests   *expvar.Int
-	Signatures *expvar.Int
+	Requests     *expvar.Int
+	Signatures   *expvar.Int
+	Candidates   *expvar.Int
+	Matches      *expvar.Int
+	LoadProgress *expvar.Float
+
+	// VPTreeSearches and VPTreeNodes count the searches of the vptree, or
+	// of each tree of the forest, and the nodes they visited
+	VPTreeSearches *expvar.Int
+	VPTreeNodes    *expvar.Int
 }{
-	Requests:   expvar.NewInt("requests"),
-	Signatures: expvar.NewInt("signatures"),
+	Requests:       expvar.NewInt("requests"),
+	Signatures:     expvar.NewInt("signatures"),
+	Candidates:     expvar.NewInt("candidates"),
+	Matches:        expvar.NewInt("matches"),
+	LoadProgress:   expvar.NewFloat("load_progress"),
+	VPTreeSearches: expvar.NewInt("vptree_searches"),
+	VPTreeNodes:    expvar.NewInt("vptree_nodes"),
+}
+
+// pool runs the search work fanned out by requests
+var pool *simstore.Pool
+
+// scanStats enables counting the candidates examined by /search
+var scanStats bool
+
+// searchTimeout bounds the time spent by /search, in addition to the
+// deadline of the client's request
+var searchTimeout time.Duration
+
+// contextFinder is implemented by stores which can stop a search when its
+// context is done
+type contextFinder interface {
+	FindContext(ctx context.Context, sig uint64) ([]uint64, error)
+}
+
+// parallelSearch makes /search probe the tables of the store on the pool
+var parallelSearch bool
+
+// topkMaxNodes bounds the vptree nodes visited by each /topk search, trading
+// recall for latency, 0 for an exact search
+var topkMaxNodes int
+
+// parallelFinder is implemented by stores which can probe their tables
+// concurrently
+type parallelFinder interface {
+	FindParallel(sig uint64, pool *simstore.Pool) []uint64
+}
+
+// distanceFinder is implemented by stores which can report the distance of
+// each match
+type distanceFinder interface {
+	FindWithDistance(sig uint64) []simstore.Match
+}
+
+// signatureLister is implemented by stores which can return the signatures of
+// a document
+type signatureLister interface {
+	SignaturesOf(docid uint64) []uint64
+}
+
+// atMostFinder is implemented by stores which can tighten the search distance
+// per query
+type atMostFinder interface {
+	MaxDistance() int
+	FindAtMost(sig uint64, maxd int) ([]uint64, error)
+}
+
+// SearchHit is a match returned by /search with distances=1, which returns
+// them sorted by distance, then by id
+type SearchHit struct {
+	ID uint64 `json:"id"`
+	D  int    `json:"d"`
+}
+
+// scanCounter is implemented by stores which can report how many candidates
+// a search examined
+type scanCounter interface {
+	FindScanned(sig uint64) ([]uint64, int)
+}
+
+// logger writes the structured logs of simd.  Every record has an event field
+// naming what happened.
+var logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+// newLogger returns a logger writing to w in the given format, "text" or "json"
+func newLogger(w io.Writer, format string) (*slog.Logger, error) {
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, nil)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, nil)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q: expected text or json", format)
+}
+
+// fatal logs an error and exits
+func fatal(event string, err error) {
+	logger.Error(event, "event", event, "err", err)
+	os.Exit(1)
 }
 
 var BuildVersion string = "(development build)"
 
+// startedAt is when main was entered
+var startedAt time.Time
+
 type Config struct {
 	store  simstore.Storage
 	vptree *vptree.VPTree
+
+	// forest, if set, is the vptree and the others built with it, all
+	// searched by /topk
+	forest *vptree.Forest
+
+	// bktree, if set, is searched by /topk and /range instead of a vptree
+	bktree *bktree.Tree
+
+	// hnsw, if set, is searched by /topk and /range instead of a vptree
+	hnsw *hnsw.Index
+}
+
+// topkSearcher is implemented by the vptree, the forest, the BK-tree and the
+// HNSW index searched by /topk and /range
+type topkSearcher interface {
+	SearchApprox(target uint64, k int, maxNodes int) ([]vptree.Item, []float64)
+	SearchWithin(target uint64, k int, maxDist float64, maxNodes int) ([]vptree.Item, []float64)
+	InRange(sig uint64, maxDistance float64) []vptree.Item
+}
+
+// topk returns what /topk and /range search, the BK-tree, the HNSW index, the
+// forest or else the vptree, or nil if none is loaded
+func (cfg *Config) topk() topkSearcher {
+	if cfg.bktree != nil {
+		return bkSearcher{cfg.bktree}
+	}
+	if cfg.hnsw != nil {
+		return hnswSearcher{cfg.hnsw}
+	}
+	if cfg.forest != nil {
+		return cfg.forest
+	}
+	if cfg.vptree != nil {
+		return cfg.vptree
+	}
+	return nil
+}
+
+// bkSearcher adapts a BK-tree to topkSearcher
+type bkSearcher struct {
+	t *bktree.Tree
+}
+
+func (b bkSearcher) SearchApprox(target uint64, k int, maxNodes int) ([]vptree.Item, []float64) {
+	items, distances := b.t.SearchApprox(target, k, maxNodes)
+	return vptreeItems(items), distances
+}
+
+func (b bkSearcher) SearchWithin(target uint64, k int, maxDist float64, maxNodes int) ([]vptree.Item, []float64) {
+	items, distances := b.t.SearchWithin(target, k, maxDist, maxNodes)
+	return vptreeItems(items), distances
+}
+
+func (b bkSearcher) InRange(sig uint64, maxDistance float64) []vptree.Item {
+	return vptreeItems(b.t.InRange(sig, maxDistance))
+}
+
+func vptreeItems(items []bktree.Item) []vptree.Item {
+	var v []vptree.Item
+	for _, item := range items {
+		v = append(v, vptree.Item{Sig: item.Sig, ID: item.ID})
+	}
+	return v
+}
+
+// hnswSearcher adapts an HNSW index to topkSearcher.  Its searches keep the
+// -hnsw-ef-search nearest nodes found instead of visiting at most maxNodes.
+type hnswSearcher struct {
+	idx *hnsw.Index
+}
+
+func (h hnswSearcher) SearchApprox(target uint64, k int, maxNodes int) ([]vptree.Item, []float64) {
+	items, distances := h.idx.Search(target, k)
+	return hnswVPTreeItems(items), distances
+}
+
+func (h hnswSearcher) SearchWithin(target uint64, k int, maxDist float64, maxNodes int) ([]vptree.Item, []float64) {
+	items, distances := h.idx.SearchWithin(target, k, maxDist)
+	return hnswVPTreeItems(items), distances
+}
+
+func (h hnswSearcher) InRange(sig uint64, maxDistance float64) []vptree.Item {
+	return hnswVPTreeItems(h.idx.InRange(sig, maxDistance))
+}
+
+func hnswVPTreeItems(items []hnsw.Item) []vptree.Item {
+	var v []vptree.Item
+	for _, item := range items {
+		v = append(v, vptree.Item{Sig: item.Sig, ID: item.ID})
+	}
+	return v
 }
 
 var config unsafe.Pointer // actual type is *Config
@@ -51,63 +248,170 @@ func UpdateConfig(cfg *Config) { atomic.StorePointer(&config, unsafe.Pointer(cfg
 
 func main() {
 
+	startedAt = time.Now()
+
 	port := flag.Int("p", 8080, "port to listen on")
-	input := flag.String("f", "", "file with signatures to load")
+	input := flag.String("f", "", "comma-separated list of files with signatures to load")
 	useVPTree := flag.Bool("vptree", true, "load vptree")
 	useStore := flag.Bool("store", true, "load simstore")
-	storeSize := flag.Int("size", 6, "simstore size (3/6)")
+	storeSize := flag.Int("size", 6, "simstore search distance (1-8, or 1-16 with -engine=mih)")
+	engine := flag.String("engine", "perm", "simstore engine (perm/mih): permuted tables, or multi-index hashing for larger distances in fewer tables")
+	maxTables := flag.Int("max-tables", 0, "build the most tables up to this many, for the longest prefixes, instead of the default layout for -size")
 	cpus := flag.Int("cpus", runtime.NumCPU(), "value of GOMAXPROCS")
 	myNumber := flag.Int("no", 0, "id of this machine")
 	totalMachines := flag.Int("of", 1, "number of machines to distribute the table among")
-	small := flag.Bool("small", false, "use small memory for size 3")
+	small := flag.Bool("small", false, "use small memory store")
 	compressed := flag.Bool("z", false, "use compressed tables")
+	delta := flag.Bool("delta", false, "use delta+varint encoded tables")
+	buckets := flag.Bool("buckets", false, "partition the tables into buckets by their top bits, for a parallel build and shorter searches")
+	flag.BoolVar(&scanStats, "scanstats", false, "count candidates examined by each search")
+	flag.DurationVar(&searchTimeout, "search-timeout", 0, "abandon a /search after this long, 0 for no limit")
+	flag.BoolVar(&parallelSearch, "parallel-search", false, "probe the tables of each /search concurrently, for lower latency at low load")
+	flag.IntVar(&topkMaxNodes, "topk-max-nodes", 0, "visit at most this many vptree nodes per /topk search, returning approximate results sooner, 0 for exact searches")
 	graphiteHost := flag.String("graphite", "", "graphite destination host")
 	graphiteNamespace := flag.String("namespace", "", "graphite namespace")
+	logFormat := flag.String("log-format", "text", "log format (text/json)")
+	excludeList := flag.String("exclude", "", "file of docids to skip when loading")
+	maxScan := flag.Int("maxscan", 0, "maximum entries examined per table by a search, 0 for no limit")
+	longScan := flag.Int("longscan", 0, "count table scans examining more than this many entries in long_scans, 0 to disable")
+	mmapDir := flag.String("mmap-dir", "", "build the store into a snapshot in this directory and serve it memory-mapped")
+	dedup := flag.Bool("dedup", false, "store signatures repeated in the input once")
+	checkpoint := flag.String("checkpoint", "", "checkpoint the store being built to this file, and resume from it after a crash (needs -vptree=false)")
+	checkpointLines := flag.Int("checkpoint-lines", simstore.DefaultCheckpointLines, "lines of input between checkpoints")
+	loadWorkers := flag.Int("load-workers", runtime.NumCPU(), "number of goroutines parsing the inputs while loading")
+	docIDSets := flag.Bool("docid-sets", false, "store the docids of signatures shared by many documents as bitmaps")
+	indexDocIDs := flag.Bool("index-docids", false, "index the signatures by docid, for /doc and searches by docid")
+	prefixFilters := flag.Bool("prefix-filters", false, "filter the prefixes of each table, so searches skip the tables with no entries for theirs")
+	tableSearch := flag.String("table-search", "binary", "how searches find a prefix in each table (binary/interpolation)")
+	snapshot := flag.String("snapshot", "", "load the store from this snapshot, written by /snapshot, instead of building it from the input files")
+	vptreeSnapshot := flag.String("vptree-snapshot", "", "load the vptree from this file, written by /vptree/snapshot, instead of building it from the input files")
+	topkIndex := flag.String("topk-index", "vptree", "index searched by /topk and /range (vptree/bktree/hnsw): a vantage-point tree, a BK-tree, often faster for small distances, or an HNSW graph, approximate but much faster on very large datasets")
+	hnswM := flag.Int("hnsw-m", 16, "with -topk-index=hnsw, links of each node per layer: more give better recall for more memory")
+	hnswEfConstruction := flag.Int("hnsw-ef-construction", 200, "with -topk-index=hnsw, nearest nodes kept while linking each node: more give better recall for a slower load")
+	hnswEfSearch := flag.Int("hnsw-ef-search", 50, "with -topk-index=hnsw, nearest nodes kept by each search, at least k: more give better recall for slower searches")
+	vptreeForest := flag.Int("vptree-forest", 1, "build this many vptrees around different vantage points, merging their results for better recall with -topk-max-nodes")
+	vptreeFlat := flag.Bool("vptree-flat", false, "pack the vptree into an array once it's loaded, for less memory and faster searches, until /add unpacks it")
+	mmapSnapshot := flag.Bool("mmap", false, "memory-map the -snapshot file instead of reading it onto the heap, sharing its pages with other processes mapping it")
+	compactInterval := flag.Duration("compact-interval", time.Minute, "how often to merge signatures from /add and deletions into the store's tables, 0 to disable")
+	window := flag.Duration("window", 0, "partition the store into buckets of this duration, adding to the current one and dropping those older than -retention, 0 to disable")
+	retention := flag.Duration("retention", 24*time.Hour, "with -window, how long the signatures loaded and added are searchable")
 
 	flag.Parse()
 
+	l, err := newLogger(os.Stderr, *logFormat)
+	if err != nil {
+		fatal("flags", err)
+	}
+	logger = l
+
 	expvar.NewString("BuildVersion").Set(BuildVersion)
+	expvar.Publish("vptree", expvar.Func(vptreeStats))
+	expvar.Publish("long_scans", expvar.Func(longScans))
+	expvar.Publish("store", expvar.Func(storeStats))
 
-	log.Println("starting simd", BuildVersion)
+	logger.Info("starting simd", "event", "start", "version", BuildVersion, "cpus", *cpus)
 
-	log.Println("setting GOMAXPROCS=", *cpus)
 	runtime.GOMAXPROCS(*cpus)
 
-	if *input == "" {
-		log.Fatalln("no import hash list provided (-f)")
+	pool = simstore.NewPool(*cpus)
+
+	if *input == "" && ((*useStore && *snapshot == "") || (*useVPTree && *vptreeSnapshot == "")) {
+		fatal("flags", errors.New("no import hash list provided (-f)"))
 	}
 
-	err := loadConfig(*input, *useStore, *storeSize, *small, *compressed, *useVPTree, *myNumber, *totalMachines)
+	if *tableSearch != "binary" && *tableSearch != "interpolation" {
+		fatal("flags", fmt.Errorf("unknown table search %q: expected binary or interpolation", *tableSearch))
+	}
+
+	if *engine != "perm" && *engine != "mih" {
+		fatal("flags", fmt.Errorf("unknown engine %q: expected perm or mih", *engine))
+	}
+
+	var inputs []string
+	if *input != "" {
+		inputs = strings.Split(*input, ",")
+	}
+
+	var exclude map[uint64]struct{}
+	if *excludeList != "" {
+		exclude, err = loadExcludeList(*excludeList)
+		if err != nil {
+			fatal("exclude_failed", err)
+		}
+	}
+
+	opts := loadOptions{
+		inputs:          inputs,
+		useStore:        *useStore,
+		storeSize:       *storeSize,
+		mih:             *engine == "mih",
+		maxTables:       *maxTables,
+		small:           *small,
+		compressed:      *compressed,
+		delta:           *delta,
+		buckets:         *buckets,
+		useVPTree:       *useVPTree,
+		myNumber:        *myNumber,
+		totalMachines:   *totalMachines,
+		exclude:         exclude,
+		maxScan:         *maxScan,
+		longScan:        *longScan,
+		interpolate:     *tableSearch == "interpolation",
+		dedup:           *dedup,
+		docIDSets:       *docIDSets,
+		indexDocIDs:     *indexDocIDs,
+		prefixFilters:   *prefixFilters,
+		workers:         *loadWorkers,
+		checkpoint:      *checkpoint,
+		checkpointLines: *checkpointLines,
+		mmapDir:         *mmapDir,
+		snapshot:        *snapshot,
+		mmapSnapshot:    *mmapSnapshot,
+		vptreeSnapshot:  *vptreeSnapshot,
+		vptreeFlat:      *vptreeFlat,
+		vptreeForest:    *vptreeForest,
+		topkIndex:       *topkIndex,
+		hnsw:            hnsw.Params{M: *hnswM, EfConstruction: *hnswEfConstruction, EfSearch: *hnswEfSearch},
+		window:          *window,
+		retention:       *retention,
+		progress: func(processed, total int) {
+			logger.Info("load progress", "event", "load_progress", "lines", processed, "total", total)
+			if total > 0 {
+				Metrics.LoadProgress.Set(100 * float64(processed) / float64(total))
+			}
+		},
+	}
+
+	err = loadConfig(opts)
 	if err != nil {
-		log.Fatalln("unable to load config:", err)
+		fatal("load_failed", err)
 	}
 
 	if *useStore {
 		http.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) { searchHandler(w, r) })
+		http.HandleFunc("/snapshot", snapshotHandler)
+		http.HandleFunc("/doc", docHandler)
+
+		if *compactInterval > 0 {
+			go compactLoop(*compactInterval)
+		}
+	}
+
+	if *useStore || *useVPTree {
+		http.HandleFunc("/add", addHandler)
 	}
 
 	if *useVPTree {
+		http.HandleFunc("/vptree/snapshot", vptreeSnapshotHandler)
 		http.HandleFunc("/topk", func(w http.ResponseWriter, r *http.Request) { topkHandler(w, r) })
 		http.HandleFunc("/topk/multi", func(w http.ResponseWriter, r *http.Request) { topkMultiHandler(w, r) })
+		http.HandleFunc("/range", rangeHandler)
 	}
 
-	http.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
-		log.Println("reloading...")
-
-		inputUrl := r.FormValue("input")
-		if len(inputUrl) > 0 {
-			reloadConfigFromRemote(inputUrl, *input)
-		}
-
-		status := http.StatusOK
-		err = loadConfig(*input, *useStore, *storeSize, *small, *compressed, *useVPTree, *myNumber, *totalMachines)
-		if err != nil {
-			log.Println("reload failed: ignoring:", err)
-			status = http.StatusInternalServerError
-		}
+	http.HandleFunc("/", notFoundHandler)
+	http.HandleFunc("/version", versionHandler)
 
-		w.WriteHeader(status)
-	})
+	http.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) { reloadHandler(w, r, opts) })
 
 	if envhost := os.Getenv("GRAPHITEHOST") + ":" + os.Getenv("GRAPHITEPORT"); envhost != ":" || *graphiteHost != "" {
 		if *graphiteNamespace == "" {
@@ -125,69 +429,161 @@ func main() {
 			host = *graphiteHost
 		}
 
-		log.Println("Using graphite host", host)
+		logger.Info("using graphite host", "event", "graphite", "host", host)
 		graphite := g2g.NewGraphite(host, 60*time.Second, 5*time.Second)
 		hostname, _ := os.Hostname()
 		hostname = strings.Replace(hostname, ".", "_", -1)
-		namespace := fmt.Sprintf("%s.%s", graphiteNamespace, hostname)
+		namespace := fmt.Sprintf("%s.%s", *graphiteNamespace, hostname)
 		graphite.Register(namespace+".signatures", Metrics.Signatures)
 		graphite.Register(namespace+".requests", Metrics.Requests)
+		graphite.Register(namespace+".vptree_searches", Metrics.VPTreeSearches)
+		graphite.Register(namespace+".vptree_nodes", Metrics.VPTreeNodes)
 	}
 
 	go func() {
-		sigs := make(chan os.Signal)
+		sigs := make(chan os.Signal, 1)
 		signal.Notify(sigs, syscall.SIGHUP)
 
 		for range sigs {
-			log.Println("caught SIGHUP, reloading")
+			logger.Info("reloading", "event", "reload", "trigger", "sighup")
 
-			err := loadConfig(*input, *useStore, *storeSize, *small, *compressed, *useVPTree, *myNumber, *totalMachines)
+			err := loadConfig(opts)
 			if err != nil {
-				log.Println("reload failed: ignoring:", err)
+				logger.Error("reload failed, keeping the current config", "event", "reload_failed", "trigger", "sighup", "err", err)
 				break
 			}
 		}
 	}()
 
-	log.Println("listening on port", *port)
-	log.Fatal(http.ListenAndServe(":"+strconv.Itoa(*port), nil))
+	logger.Info("listening", "event", "listen", "port", *port)
+	fatal("listen", http.ListenAndServe(":"+strconv.Itoa(*port), nil))
+}
+
+// reloadHandler reloads the config, after fetching the input file if the
+// request gives a remote input or manifest
+func reloadHandler(w http.ResponseWriter, r *http.Request, opts loadOptions) {
+
+	if dryrun, _ := strconv.ParseBool(r.FormValue("dryrun")); dryrun {
+		logger.Info("validating reload", "event", "reload_dryrun", "input", r.FormValue("input"), "manifest", r.FormValue("manifest"))
+		dryRunHandler(w, r, opts)
+		return
+	}
+
+	logger.Info("reloading", "event", "reload", "trigger", "http", "input", r.FormValue("input"), "manifest", r.FormValue("manifest"))
+
+	inputUrl, status, err := remoteInput(r, &opts)
+	if err != nil {
+		logger.Error("reload failed, keeping the current config", "event", "reload_failed", "trigger", "http", "err", err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	if len(inputUrl) > 0 {
+		err := reloadConfigFromRemote(inputUrl, opts.inputs[0])
+		if err != nil {
+			logger.Error("reload failed, keeping the current config", "event", "reload_failed", "trigger", "http", "err", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+
+	err = loadConfig(opts)
+	if err != nil {
+		logger.Error("reload failed, keeping the current config", "event", "reload_failed", "trigger", "http", "err", err)
+		status = http.StatusInternalServerError
+	}
+
+	w.WriteHeader(status)
+}
+
+// vptreeStats reports the size and depth of the current vptree
+func vptreeStats() interface{} {
+	cfg := CurrentConfig()
+	if cfg == nil || cfg.vptree == nil {
+		return nil
+	}
+
+	return map[string]int{
+		"len":   cfg.vptree.Len(),
+		"depth": cfg.vptree.Depth(),
+	}
+}
+
+// storeStats reports the statistics of the current store
+func storeStats() interface{} {
+	cfg := CurrentConfig()
+	if cfg == nil || cfg.store == nil {
+		return nil
+	}
+
+	return cfg.store.Stats()
+}
+
+// longScans reports the number of table scans of the current store which
+// examined more entries than the -longscan threshold
+func longScans() interface{} {
+	cfg := CurrentConfig()
+	if cfg == nil {
+		return nil
+	}
+
+	ls, ok := cfg.store.(interface{ LongScans() uint64 })
+	if !ok {
+		return nil
+	}
+
+	return ls.LongScans()
 }
 
 // writes the input config file from a remote url endpoint
-// supplied as a url query parameter to /reload
-func reloadConfigFromRemote(inputUrl string, configPath string) {
-	log.Printf("> reloading input file \"%s\" from %s", configPath, inputUrl)
+// supplied as a url query parameter to /reload.  The file is downloaded next
+// to the input and renamed over it, so a failed download leaves the input as
+// it was.
+func reloadConfigFromRemote(inputUrl string, configPath string) error {
+	logger.Info("fetching input file", "event", "fetch", "input", configPath, "url", inputUrl)
 
 	_, err := url.ParseRequestURI(inputUrl)
 	if err != nil {
-		log.Println("invalid input URL: ", err)
-		return
+		logger.Error("invalid input url", "event", "fetch_failed", "url", inputUrl, "err", err)
+		return err
 	}
 
 	resp, err := http.Get(inputUrl)
 	if err != nil {
-		log.Println(err)
-		return
+		logger.Error("fetching input file failed", "event", "fetch_failed", "url", inputUrl, "err", err)
+		return err
 	}
 	defer resp.Body.Close()
 
-	err = os.Remove(configPath)
-	if err != nil {
-		log.Println(err)
-		return
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err := fmt.Errorf("fetching input file %s: %s", inputUrl, resp.Status)
+		logger.Error("fetching input file failed", "event", "fetch_failed", "url", inputUrl, "err", err)
+		return err
 	}
 
-	out, err := os.Create(configPath)
+	out, err := os.CreateTemp(filepath.Dir(configPath), "."+filepath.Base(configPath)+".*")
 	if err != nil {
-		log.Println(err)
-		return
+		logger.Error("fetching input file failed", "event", "fetch_failed", "url", inputUrl, "err", err)
+		return err
 	}
+	defer os.Remove(out.Name())
 
 	_, err = io.Copy(out, resp.Body)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
 	if err != nil {
-		log.Println(err)
-		return
+		logger.Error("fetching input file failed", "event", "fetch_failed", "url", inputUrl, "err", err)
+		return err
+	}
+
+	err = os.Rename(out.Name(), configPath)
+	if err != nil {
+		logger.Error("fetching input file failed", "event", "fetch_failed", "url", inputUrl, "err", err)
+		return err
 	}
+
+	return nil
 }
 
 // https://stackoverflow.com/questions/24562942/golang-how-do-i-determine-the-number-of-lines-in-a-file-efficiently
@@ -218,204 +614,853 @@ func lineCounter(input string) (int, error) {
 	return count, nil
 }
 
-func loadConfig(input string, useStore bool, storeSize int, small bool, compressed bool, useVPTree bool, myNumber int, totalMachines int) error {
-	var store simstore.Storage
-
-	totalLines, err := lineCounter(input)
-	if err != nil {
-		return fmt.Errorf("unable to load %q: %v", input, err)
-	}
-
-	var sigsEstimate = totalLines
-
-	log.Printf("totalLines=%+v\n", totalLines)
-
-	if totalMachines != 1 {
-		// estimate how many signatures will land on this machine, plus a fudge
-		sigsEstimate = totalLines / totalMachines
-		sigsEstimate += int(float64(sigsEstimate) * 0.05)
-	}
-
-	log.Printf("preallocating for %d estimated signatures\n", sigsEstimate)
-
-	factory := simstore.NewU64Slice
-	if compressed {
-		factory = simstore.NewZStore
-	}
-
-	if useStore {
-		switch storeSize {
-		case 3:
-			if small {
-				store = simstore.New3Small(sigsEstimate)
-			} else {
-				store = simstore.New3(sigsEstimate, factory)
-			}
-		case 6:
-			store = simstore.New6(sigsEstimate, factory)
-		default:
-			return fmt.Errorf("unknown storage size: %d", storeSize)
-		}
+// loadExcludeList reads a file of docids to skip at load, one per line.  A
+// missing file excludes nothing.
+func loadExcludeList(path string) (map[uint64]struct{}, error) {
 
-		log.Println("using simstore size", storeSize)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		logger.Warn("exclude list not found, excluding nothing", "event", "exclude_missing", "input", path)
+		return nil, nil
 	}
-
-	var vpt *vptree.VPTree
-
-	f, err := os.Open(input)
 	if err != nil {
-		return fmt.Errorf("unable to load %q: %v", input, err)
+		return nil, err
 	}
 	defer f.Close()
 
-	scanner := bufio.NewScanner(f)
-	var items []vptree.Item
+	exclude := make(map[uint64]struct{})
+
 	var lines int
-	var signatures int
+	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
+		lines++
 
-		fields := strings.Fields(scanner.Text())
-
-		id, err := strconv.Atoi(fields[0])
-		if err != nil {
-			log.Printf("%d: error parsing id: %v", lines, err)
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
 			continue
 		}
 
-		sig, err := strconv.ParseUint(fields[1], 16, 64)
+		id, err := strconv.ParseUint(line, 10, 64)
 		if err != nil {
-			log.Printf("%d: error parsing signature: %v", lines, err)
+			logger.Warn("error parsing excluded docid", "event", "parse_error", "input", path, "line", lines, "err", err)
 			continue
 		}
 
-		if sig%uint64(totalMachines) == uint64(myNumber) {
-			if useVPTree {
-				items = append(items, vptree.Item{sig, uint64(id)})
-			}
-			if useStore {
-				store.Add(sig, uint64(id))
-			}
-			signatures++
-		}
-		lines++
-
-		if lines%(1<<20) == 0 {
-			log.Printf("processed %d of %d", lines, totalLines)
-		}
+		exclude[id] = struct{}{}
 	}
 
 	if err := scanner.Err(); err != nil {
-		log.Println("error during scan: ", err)
-	}
-
-	log.Printf("loaded %d lines, %d signatues (%f%% of estimated)", lines, signatures, 100*float64(signatures)/float64(sigsEstimate))
-	Metrics.Signatures.Set(int64(signatures))
-	if useStore {
-		store.Finish()
-		log.Println("simstore done")
-	}
-
-	if useVPTree {
-		vpt = vptree.New(items)
-		log.Println("vptree done")
+		return nil, fmt.Errorf("unable to load %q: %v", path, err)
 	}
 
-	UpdateConfig(&Config{store: store, vptree: vpt})
-	return nil
-}
+	logger.Info("loaded exclude list", "event", "exclude_loaded", "input", path, "docids", len(exclude))
 
-type MultiRequest []struct {
-	ID  int    `json:"id"`
-	Sig string `json:"sig"`
+	return exclude, nil
 }
 
-type hit struct {
-	ID uint64  `json:"id"`
-	D  float64 `json:"d"`
+// countLines returns the total number of lines in the input files
+func countLines(inputs []string) (int, error) {
+	var total int
+	for _, input := range inputs {
+		n, err := lineCounter(input)
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
 }
 
-type MultiResponse struct {
-	RequestID int   `json:"rid"`
-	Matches   []hit `json:"m"`
+// loadOptions controls how loadConfig builds a config
+type loadOptions struct {
+	inputs        []string
+	useStore      bool
+	storeSize     int
+	maxTables     int
+	small         bool
+	compressed    bool
+	delta         bool
+	buckets       bool
+	useVPTree     bool
+	myNumber      int
+	totalMachines int
+
+	// mih makes the store an MIHStore, searching distance storeSize
+	mih bool
+
+	// exclude holds the docids to skip when loading
+	exclude map[uint64]struct{}
+
+	// presharded skips the sig % totalMachines filter, for input files
+	// holding only this machine's shard
+	presharded bool
+
+	// workers is the number of goroutines parsing the inputs and adding
+	// their signatures to the store
+	workers int
+
+	// maxScan and longScan set the MaxScan and LongScanThreshold options of
+	// the store
+	maxScan  int
+	longScan int
+
+	// interpolate sets the InterpolationSearch option of the store
+	interpolate bool
+
+	// dedup sets the Dedup option of the store.  The small stores always
+	// collapse repeated entries.
+	dedup bool
+
+	// docIDSets sets the DocIDSets option of the store
+	docIDSets bool
+
+	// indexDocIDs sets the IndexDocIDs option of the store
+	indexDocIDs bool
+
+	// prefixFilters sets the PrefixFilters option of the store
+	prefixFilters bool
+
+	// mmapDir, if set, is where the store is written as a snapshot before
+	// being memory-mapped
+	mmapDir string
+
+	// snapshot, if set, is a snapshot the store is read from instead of
+	// being built from the inputs, which then only feed the vptree.  The
+	// snapshot already holds only this machine's signatures, so myNumber,
+	// totalMachines and exclude don't apply to it.
+	snapshot string
+
+	// vptreeSnapshot, if set, is a file the vptree is read from instead of
+	// being built from the inputs
+	vptreeSnapshot string
+
+	// vptreeFlat flattens the vptree once it's loaded, for less memory and
+	// faster searches, until /add turns it back into nodes
+	vptreeFlat bool
+
+	// vptreeForest is the number of vptrees built from the inputs, which
+	// /topk merges the results of
+	vptreeForest int
+
+	// topkIndex is the index built for /topk and /range instead of the
+	// vptree: "bktree", "hnsw", or "vptree" or empty for the vptree
+	topkIndex string
+
+	// hnsw are the parameters of the HNSW index, with topkIndex "hnsw"
+	hnsw hnsw.Params
+
+	// mmapSnapshot serves the store memory-mapped from the snapshot file
+	// itself.  The file must be replaced by renaming a new one over it, never
+	// rewritten in place.
+	mmapSnapshot bool
+
+	// checkpoint, if set, is where the store being built is checkpointed
+	// every checkpointLines lines, and resumed from after a crash
+	checkpoint      string
+	checkpointLines int
+
+	// window, if not 0, makes the loaded store the first bucket of a
+	// WindowedStore with buckets of this duration, keeping retention
+	window    time.Duration
+	retention time.Duration
+
+	// progress, if not nil, is called periodically while loading with the
+	// number of lines processed so far and the total number of lines.
+	// Otherwise progress is logged.
+	progress func(processed, total int)
 }
 
-func topkMultiHandler(w http.ResponseWriter, r *http.Request) {
-	Metrics.Requests.Add(1)
-
-	// error response
-	var (
-		status int
-		err    error
-	)
+// loadConfig builds a new store and vptree from all the input files and makes
+// it the current config.  If any of the files can't be read, the current config
+// is left untouched.
+func loadConfig(opts loadOptions) error {
+	start := time.Now()
 
-	defer func() {
-		if nil != err {
-			log.Println(err)
-			http.Error(w, err.Error(), status)
+	progress := opts.progress
+	if progress == nil {
+		progress = func(processed, total int) {
+			logger.Info("load progress", "event", "load_progress", "lines", processed, "total", total)
 		}
-	}()
+	}
 
-	reqs := MultiRequest{}
-	err = json.NewDecoder(r.Body).Decode(&reqs)
+	var store simstore.Storage
+
+	totalLines, err := countLines(opts.inputs)
 	if err != nil {
-		status = http.StatusInternalServerError
-		return
+		return err
 	}
 
-	kstr := r.FormValue("k")
-	if kstr == "" {
-		kstr = "10"
-	}
+	var sigsEstimate = totalLines
 
-	k, err := strconv.Atoi(kstr)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+	if opts.totalMachines != 1 {
+		// estimate how many signatures will land on this machine, plus a fudge
+		sigsEstimate = totalLines / opts.totalMachines
+		sigsEstimate += int(float64(sigsEstimate) * 0.05)
 	}
 
-	res := make([]MultiResponse, 0)
+	logger.Info("loading", "event", "load_start", "inputs", opts.inputs, "lines", totalLines, "estimate", sigsEstimate)
 
-	for _, req := range reqs {
-		sig64, err := strconv.ParseUint(req.Sig, 16, 64)
-		if err != nil {
-			status = http.StatusBadRequest
-			return
-		}
+	factory, err := tableFactory(opts)
+	if err != nil {
+		return err
+	}
 
-		vpt := CurrentConfig().vptree
+	var storeOpts []simstore.Option
+	if opts.maxScan > 0 {
+		storeOpts = append(storeOpts, simstore.MaxScan(opts.maxScan))
+	}
+	if opts.longScan > 0 {
+		storeOpts = append(storeOpts, simstore.LongScanThreshold(opts.longScan))
+	}
+	if opts.interpolate {
+		storeOpts = append(storeOpts, simstore.InterpolationSearch())
+	}
+	if opts.dedup {
+		storeOpts = append(storeOpts, simstore.Dedup())
+	}
+	if opts.docIDSets {
+		storeOpts = append(storeOpts, simstore.DocIDSets())
+	}
+	if opts.indexDocIDs {
+		storeOpts = append(storeOpts, simstore.IndexDocIDs())
+	}
+	if opts.prefixFilters {
+		storeOpts = append(storeOpts, simstore.PrefixFilters())
+	}
 
-		matches, distances := vpt.Search(sig64, k)
+	if opts.snapshot != "" && (opts.small || opts.compressed || opts.delta || opts.buckets || opts.mmapDir != "") {
+		return errors.New("a store read from a snapshot can't be small, compressed, bucketed or built in -mmap-dir")
+	}
 
-		hits := make([]hit, 0)
-		for i, m := range matches {
-			hits = append(hits, hit{ID: m.ID, D: distances[i]})
-		}
+	if opts.mmapSnapshot && opts.snapshot == "" {
+		return errors.New("only a snapshot can be memory-mapped")
+	}
 
-		res = append(
-			res,
-			MultiResponse{
-				RequestID: req.ID,
-				Matches:   hits,
-			},
-		)
+	if opts.checkpoint != "" && (!opts.useStore || opts.small || opts.snapshot != "" || opts.useVPTree) {
+		return errors.New("only a store built without the vptree can be checkpointed, and it can't be small or read from a snapshot")
+	}
 
+	if opts.vptreeForest > 1 && opts.vptreeSnapshot != "" {
+		return errors.New("a vptree forest can't be read from a snapshot")
 	}
 
-	json.NewEncoder(w).Encode(res)
-}
+	switch opts.topkIndex {
+	case "", "vptree":
+	case "bktree":
+		if opts.vptreeSnapshot != "" || opts.vptreeForest > 1 || opts.vptreeFlat {
+			return errors.New("a BK-tree can't be read from a snapshot, flattened or a forest")
+		}
+	case "hnsw":
+		if opts.vptreeSnapshot != "" || opts.vptreeForest > 1 || opts.vptreeFlat {
+			return errors.New("an HNSW index can't be read from a snapshot, flattened or a forest")
+		}
+		if opts.hnsw.M < 0 || opts.hnsw.EfConstruction < 0 || opts.hnsw.EfSearch < 0 {
+			return fmt.Errorf("invalid HNSW parameters %+v: expected positive values, or 0 for the defaults", opts.hnsw)
+		}
+	default:
+		return fmt.Errorf("unknown topk index %q: expected vptree, bktree or hnsw", opts.topkIndex)
+	}
 
-func topkHandler(w http.ResponseWriter, r *http.Request) {
+	if opts.mmapDir != "" {
+		if opts.small || opts.compressed || opts.delta || opts.buckets {
+			return errors.New("a memory-mapped store can't be small, compressed or bucketed")
+		}
 
-	Metrics.Requests.Add(1)
+		// only the document table is kept while loading
+		factory = simstore.NewDiscard
+	}
 
-	sigstr := r.FormValue("sig")
-	sig64, err := strconv.ParseUint(sigstr, 16, 64)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+	if opts.mih && (opts.small || opts.compressed || opts.delta || opts.buckets || opts.maxTables > 0 || opts.snapshot != "" || opts.mmapDir != "" || opts.checkpoint != "") {
+		return errors.New("an MIH store can't be small, compressed, bucketed, have -max-tables, be read from a snapshot, built in -mmap-dir or checkpointed")
 	}
 
-	kstr := r.FormValue("k")
+	if opts.useStore && opts.mih {
+		s, err := simstore.NewMIH(opts.storeSize, sigsEstimate)
+		if err != nil {
+			return err
+		}
+		store = s
+	} else if opts.useStore && opts.snapshot != "" {
+		store, err = readSnapshot(opts.snapshot, opts.storeSize, opts.mmapSnapshot, storeOpts)
+		if err != nil {
+			return err
+		}
+	} else if opts.useStore && opts.maxTables > 0 {
+		if opts.small {
+			return errors.New("a small store can't choose its number of tables")
+		}
+		s, err := simstore.New(opts.storeSize, sigsEstimate, factory, append(storeOpts, simstore.MaxTables(opts.maxTables))...)
+		if err != nil {
+			return err
+		}
+		store = s
+	} else if opts.useStore {
+		switch opts.storeSize {
+		case 3:
+			if opts.small {
+				store = simstore.New3Small(sigsEstimate)
+			} else {
+				store = simstore.New3(sigsEstimate, factory, storeOpts...)
+			}
+		case 6:
+			if opts.small {
+				store = simstore.New6Small(sigsEstimate)
+			} else {
+				store = simstore.New6(sigsEstimate, factory, storeOpts...)
+			}
+		default:
+			if opts.small {
+				return fmt.Errorf("no small store for size %d", opts.storeSize)
+			}
+			s, err := simstore.New(opts.storeSize, sigsEstimate, factory, storeOpts...)
+			if err != nil {
+				return fmt.Errorf("unknown storage size: %d", opts.storeSize)
+			}
+			store = s
+		}
+	}
+
+	var vpt *vptree.VPTree
+	var forest *vptree.Forest
+	var bkt *bktree.Tree
+	var hidx *hnsw.Index
+
+	// the store is safe for concurrent Adds, the rest is guarded by mu, which
+	// the workers take once per batch of lines
+	var mu sync.Mutex
+	var items []vptree.Item
+	var signatures int
+
+	var skip int
+	var checkpoint func(lines int) error
+	if opts.checkpoint != "" {
+		cs := checkpointStore(store)
+
+		position, err := simstore.ResumeCheckpoint(opts.checkpoint, cs)
+		if err != nil {
+			return err
+		}
+
+		if position > 0 {
+			signatures = store.Len()
+			logger.Info("resuming from checkpoint", "event", "load_resume", "checkpoint", opts.checkpoint, "lines", position, "signatures", signatures)
+		}
+
+		skip = int(position)
+		checkpoint = func(lines int) error {
+			logger.Info("checkpoint", "event", "load_checkpoint", "checkpoint", opts.checkpoint, "lines", lines)
+			return simstore.SaveCheckpoint(opts.checkpoint, cs, uint64(lines))
+		}
+	}
+
+	counts, err := scanInputs(opts, totalLines, skip, checkpoint, progress, func(sigs, ids []uint64) {
+		if opts.useStore && opts.snapshot == "" {
+			if b, ok := store.(simstore.BatchAdder); ok {
+				b.AddBatch(sigs, ids)
+			} else {
+				for i, sig := range sigs {
+					store.Add(sig, ids[i])
+				}
+			}
+		}
+		mu.Lock()
+		if opts.useVPTree && opts.vptreeSnapshot == "" {
+			for i, sig := range sigs {
+				items = append(items, vptree.Item{Sig: sig, ID: ids[i]})
+			}
+		}
+		signatures += len(sigs)
+		mu.Unlock()
+	})
+	if err != nil {
+		return err
+	}
+
+	logger.Info("parsed inputs", "event", "load_parsed", "lines", counts.Lines, "invalid", counts.Invalid, "excluded", counts.Excluded, "signatures", signatures,
+		"duration", time.Since(start), "estimate_pct", 100*float64(signatures)/float64(sigsEstimate))
+	Metrics.Signatures.Set(int64(signatures))
+	if opts.useStore && opts.snapshot == "" {
+		if err := simstore.Checked(store).Finish(); err != nil {
+			return fmt.Errorf("unable to build the store: %v", err)
+		}
+
+		if opts.checkpoint != "" {
+			if err := os.Remove(opts.checkpoint); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+
+		if c, ok := store.(interface{ Collapsed() int }); ok && c.Collapsed() > 0 {
+			logger.Info("collapsed duplicate entries", "event", "load_dedup", "collapsed", c.Collapsed())
+		}
+
+		if opts.mmapDir != "" {
+			store, err = mmapStore(store, opts.mmapDir, storeOpts)
+			if err != nil {
+				return err
+			}
+		}
+
+		logger.Info("simstore done", "event", "load_store", "size", opts.storeSize, "signatures", signatures, "duration", time.Since(start))
+	}
+
+	if opts.useVPTree && opts.vptreeSnapshot != "" {
+		vpt, err = readVPTree(opts.vptreeSnapshot)
+		if err != nil {
+			return err
+		}
+		logger.Info("vptree read", "event", "load_vptree", "snapshot", opts.vptreeSnapshot, "items", vpt.Len(), "duration", time.Since(start))
+	} else if opts.useVPTree && opts.topkIndex == "bktree" {
+		bkItems := make([]bktree.Item, len(items))
+		for i, item := range items {
+			bkItems[i] = bktree.Item{Sig: item.Sig, ID: item.ID}
+		}
+		bkt = bktree.New(bkItems)
+		logger.Info("bktree done", "event", "load_bktree", "signatures", signatures, "duration", time.Since(start))
+	} else if opts.useVPTree && opts.topkIndex == "hnsw" {
+		hnswItems := make([]hnsw.Item, len(items))
+		for i, item := range items {
+			hnswItems[i] = hnsw.Item{Sig: item.Sig, ID: item.ID}
+		}
+		hidx = hnsw.New(hnswItems, opts.hnsw)
+		p := hidx.Params()
+		logger.Info("hnsw done", "event", "load_hnsw", "signatures", signatures, "m", p.M, "ef_construction", p.EfConstruction, "ef_search", p.EfSearch, "duration", time.Since(start))
+	} else if opts.useVPTree && opts.vptreeForest > 1 {
+		forest = vptree.NewForest(items, opts.vptreeForest)
+		vpt = forest.Trees()[0]
+		logger.Info("vptree forest done", "event", "load_vptree", "signatures", signatures, "trees", opts.vptreeForest, "duration", time.Since(start))
+	} else if opts.useVPTree {
+		vpt = vptree.New(items)
+		logger.Info("vptree done", "event", "load_vptree", "signatures", signatures, "duration", time.Since(start))
+	}
+
+	if forest != nil && opts.vptreeFlat {
+		items = nil
+		forest.Flatten()
+		logger.Info("vptree forest flattened", "event", "flatten_vptree", "duration", time.Since(start))
+	} else if vpt != nil && opts.vptreeFlat {
+		items = nil
+		vpt.Flatten()
+		logger.Info("vptree flattened", "event", "flatten_vptree", "duration", time.Since(start))
+	}
+
+	if opts.useStore && opts.window > 0 {
+		store, err = windowStore(store, opts, storeOpts)
+		if err != nil {
+			return err
+		}
+		logger.Info("windowed store", "event", "load_window", "window", opts.window, "retention", opts.retention)
+	}
+
+	hooks := vptree.Hooks{OnSearch: countVPTreeSearch}
+	if forest != nil {
+		forest.Instrument(hooks)
+	} else if vpt != nil {
+		vpt.Instrument(hooks)
+	}
+
+	UpdateConfig(&Config{store: store, vptree: vpt, forest: forest, bktree: bkt, hnsw: hidx})
+
+	logger.Info("loaded", "event", "load_done", "lines", counts.Lines, "signatures", signatures, "duration", time.Since(start))
+	return nil
+}
+
+// readSnapshot loads a store from the snapshot at path, which must have been
+// written by a store for the given search distance.  With mmap, the store is
+// the memory-mapped file, so every process serving the same file shares one
+// copy of it in the page cache.
+func readSnapshot(path string, size int, mmap bool, opts []simstore.Option) (simstore.Storage, error) {
+
+	var store *simstore.Store
+
+	if mmap {
+		s, err := simstore.OpenMmap(path, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("unable to map snapshot %q: %v", path, err)
+		}
+		store = s
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load snapshot %q: %v", path, err)
+		}
+		defer f.Close()
+
+		s, err := simstore.ReadFrom(bufio.NewReaderSize(f, 1<<20), opts...)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load snapshot %q: %v", path, err)
+		}
+		store = s
+	}
+
+	if d := store.MaxDistance(); d != size {
+		return nil, fmt.Errorf("snapshot %q is for size %d, not %d", path, d, size)
+	}
+
+	return store, nil
+}
+
+// countVPTreeSearch counts a search of the vptree in Metrics
+func countVPTreeSearch(d time.Duration, nodes, results int) {
+	Metrics.VPTreeSearches.Add(1)
+	Metrics.VPTreeNodes.Add(int64(nodes))
+}
+
+// readVPTree loads a vptree from the file at path, written by /vptree/snapshot
+func readVPTree(path string) (*vptree.VPTree, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load vptree %q: %v", path, err)
+	}
+	defer f.Close()
+
+	vpt, err := vptree.ReadFrom(bufio.NewReaderSize(f, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("unable to load vptree %q: %v", path, err)
+	}
+	return vpt, nil
+}
+
+// windowStore returns a WindowedStore whose first bucket, starting now, is the
+// loaded store, and whose later buckets, holding the signatures from /add,
+// are empty stores of the same kind
+func windowStore(store simstore.Storage, opts loadOptions, storeOpts []simstore.Option) (simstore.Storage, error) {
+
+	var newBucket func() simstore.Storage
+	switch {
+	case opts.mih:
+		if _, err := simstore.NewMIH(opts.storeSize, 0); err != nil {
+			return nil, err
+		}
+		newBucket = func() simstore.Storage {
+			s, _ := simstore.NewMIH(opts.storeSize, 0)
+			return s
+		}
+	case opts.small && opts.storeSize == 3:
+		newBucket = func() simstore.Storage { return simstore.New3Small(0) }
+	case opts.small && opts.storeSize == 6:
+		newBucket = func() simstore.Storage { return simstore.New6Small(0) }
+	default:
+		if opts.maxTables > 0 {
+			storeOpts = append(storeOpts, simstore.MaxTables(opts.maxTables))
+		}
+		if _, err := simstore.New(opts.storeSize, 0, simstore.NewU64Slice, storeOpts...); err != nil {
+			return nil, err
+		}
+		newBucket = func() simstore.Storage {
+			s, _ := simstore.New(opts.storeSize, 0, simstore.NewU64Slice, storeOpts...)
+			return s
+		}
+	}
+
+	w := simstore.NewWindowed(opts.window, opts.retention, newBucket)
+	if err := w.AddBucket(store, time.Now()); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// mmapStore writes a snapshot of store to a file in dir, and returns the store
+// memory-mapped from the snapshot.  The file is removed once it is mapped.
+func mmapStore(store simstore.Storage, dir string, opts []simstore.Option) (simstore.Storage, error) {
+
+	w, ok := store.(io.WriterTo)
+	if !ok {
+		return nil, errors.New("store does not support snapshots")
+	}
+
+	f, err := os.CreateTemp(dir, "simd-*.snap")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := w.WriteTo(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("writing snapshot: %v", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("writing snapshot: %v", err)
+	}
+
+	mapped, err := simstore.OpenMmap(f.Name(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return mapped, nil
+}
+
+// scanInputs parses every line of the input files with simstore.ScanBatches,
+// and calls add with the batches of signatures which belong on this machine
+// and whose docids aren't excluded.  With more than one of opts.workers, add
+// is called concurrently, and the slices are reused once it returns.  The first skip lines of the inputs were loaded before a
+// checkpoint and aren't parsed again.  If checkpoint isn't nil, it's called
+// every opts.checkpointLines lines of an input with the lines read so far.
+func scanInputs(opts loadOptions, totalLines int, skip int, checkpoint func(lines int) error, progress func(processed, total int), add func(sigs, ids []uint64)) (simstore.LoadCounts, error) {
+
+	var c simstore.LoadCounts
+
+	scan := simstore.LoadOptions{
+		Shard:           opts.myNumber,
+		Shards:          opts.totalMachines,
+		Workers:         opts.workers,
+		CheckpointLines: opts.checkpointLines,
+	}
+	if opts.presharded {
+		scan.Shards = 0
+	}
+	if opts.exclude != nil {
+		scan.Exclude = func(docid uint64) bool {
+			_, ok := opts.exclude[docid]
+			return ok
+		}
+	}
+
+	for _, input := range opts.inputs {
+		f, err := os.Open(input)
+		if err != nil {
+			return c, fmt.Errorf("unable to load %q: %v", input, err)
+		}
+
+		lines := c.Lines
+		scan.Skip = max(0, skip-lines)
+		scan.Progress = func(n int) { progress(lines+n, totalLines) }
+
+		// a failed checkpoint fails the load, unlike a read error
+		var ckptErr error
+		if checkpoint != nil {
+			scan.Checkpoint = func(n int) error {
+				ckptErr = checkpoint(lines + n)
+				return ckptErr
+			}
+		}
+		scan.Invalid = func(line int, err error) {
+			logger.Warn("invalid line", "event", "parse_error", "input", input, "line", line, "err", err)
+		}
+
+		n, err := simstore.ScanBatches(f, scan, add)
+		f.Close()
+
+		if ckptErr != nil {
+			return c, ckptErr
+		}
+
+		if err != nil {
+			logger.Error("error during scan", "event", "scan_error", "input", input, "line", n.Lines, "err", err)
+		}
+
+		c.Lines += n.Lines
+		c.Invalid += n.Invalid
+		c.Excluded += n.Excluded
+		c.Added += n.Added
+	}
+
+	progress(c.Lines, totalLines)
+
+	return c, nil
+}
+
+// ValidationSummary is the result of a dry-run reload
+type ValidationSummary struct {
+	Inputs         []string `json:"inputs"`
+	Lines          int      `json:"lines"`
+	Valid          int      `json:"valid"`
+	Invalid        int      `json:"invalid"`
+	Excluded       int      `json:"excluded"`
+	Signatures     int      `json:"signatures"`
+	EstimatedBytes int64    `json:"estimated_bytes"`
+}
+
+// validateInputs runs the parsing phase of loadConfig without building
+// anything, and reports what a reload with opts would load.
+func validateInputs(opts loadOptions) (ValidationSummary, error) {
+
+	sum := ValidationSummary{Inputs: opts.inputs}
+
+	totalLines, err := countLines(opts.inputs)
+	if err != nil {
+		return sum, err
+	}
+
+	progress := func(processed, total int) {}
+
+	counts, err := scanInputs(opts, totalLines, 0, nil, progress, func(sigs, ids []uint64) {})
+	if err != nil {
+		return sum, err
+	}
+
+	sum.Lines, sum.Invalid, sum.Excluded = counts.Lines, counts.Invalid, counts.Excluded
+	sum.Signatures = counts.Added
+
+	sum.Valid = sum.Lines - sum.Invalid
+	sum.EstimatedBytes = estimateBytes(opts, sum.Signatures)
+
+	return sum, nil
+}
+
+// tableFactory returns the factory of the tables of the store chosen by opts
+func tableFactory(opts loadOptions) (simstore.StorageFactory, error) {
+	switch {
+	case opts.compressed && opts.delta, opts.buckets && (opts.compressed || opts.delta):
+		return nil, errors.New("-z, -delta and -buckets are exclusive")
+	case opts.compressed:
+		return simstore.NewZStore, nil
+	case opts.delta:
+		return simstore.NewDeltaStore, nil
+	case opts.buckets:
+		return simstore.NewBucketStore, nil
+	}
+	return simstore.NewU64Slice, nil
+}
+
+// estimateBytes estimates the heap used by n signatures loaded with opts.  The
+// tables of a full store are estimated by simstore.EstimateMemory, and
+// memory-mapped tables aren't counted.
+func estimateBytes(opts loadOptions, n int) int64 {
+
+	var bytes int64
+
+	if opts.useStore {
+		switch {
+		case opts.mih:
+			bytes += int64(simstore.EstimateMIHMemory(n))
+		case opts.mmapSnapshot:
+			// the snapshot is only mapped
+		case opts.mmapDir != "":
+			bytes += 16 * int64(n) // only the document table is on the heap
+		case opts.small && opts.storeSize == 3:
+			bytes += 4 * 16 * int64(n) // 4 tables of (hash, docid)
+		case opts.small:
+			bytes += 7 * 16 * int64(n) // 7 tables of (hash, docid)
+		default:
+			factory, err := tableFactory(opts)
+			if err != nil {
+				factory = simstore.NewU64Slice
+			}
+			var storeOpts []simstore.Option
+			if opts.maxTables > 0 {
+				storeOpts = append(storeOpts, simstore.MaxTables(opts.maxTables))
+			}
+			if opts.indexDocIDs {
+				storeOpts = append(storeOpts, simstore.IndexDocIDs())
+			}
+			if opts.prefixFilters {
+				storeOpts = append(storeOpts, simstore.PrefixFilters())
+			}
+			bytes += int64(simstore.EstimateMemory(opts.storeSize, n, factory, storeOpts...))
+		}
+	}
+
+	trees := int64(1)
+	if opts.vptreeForest > 1 {
+		trees = int64(opts.vptreeForest)
+	}
+
+	if opts.useVPTree && opts.vptreeSnapshot != "" {
+		bytes += 64 * int64(n) // a tree node for each item read
+	} else if opts.useVPTree && opts.topkIndex == "bktree" {
+		bytes += (32 + 16 + 40 + 16) * int64(n) // the items, converted for the BK-tree, and a node and an edge to it for each
+	} else if opts.useVPTree && opts.topkIndex == "hnsw" {
+		m := int64(opts.hnsw.M)
+		if m < 1 {
+			m = 16
+		}
+		bytes += (32 + 16 + 64 + 8*m) * int64(n) // the items, converted for the HNSW index, and a node and its links for each
+	} else if opts.useVPTree {
+		bytes += (32 + 64*trees) * int64(n) // the items, and a node in each tree for each
+	}
+	if opts.useVPTree && opts.vptreeFlat {
+		bytes += 24 * trees * int64(n) // the arrays the nodes are packed into
+	}
+
+	return bytes
+}
+
+// dryRunHandler reports what /reload would load, without changing the current
+// config.  An input url is downloaded to a temporary file instead of replacing
+// the input file.
+func dryRunHandler(w http.ResponseWriter, r *http.Request, opts loadOptions) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	fail := func(status int, err error) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+	}
+
+	inputUrl, status, err := remoteInput(r, &opts)
+	if err != nil {
+		fail(status, err)
+		return
+	}
+
+	if len(inputUrl) > 0 {
+		tmp, err := os.CreateTemp("", "simd-dryrun-")
+		if err != nil {
+			fail(http.StatusInternalServerError, err)
+			return
+		}
+		tmp.Close()
+		defer os.Remove(tmp.Name())
+
+		if err := reloadConfigFromRemote(inputUrl, tmp.Name()); err != nil {
+			fail(http.StatusBadGateway, err)
+			return
+		}
+
+		opts.inputs = []string{tmp.Name()}
+	}
+
+	sum, err := validateInputs(opts)
+	if err != nil {
+		fail(http.StatusInternalServerError, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(sum)
+}
+
+type MultiRequest []struct {
+	ID  int    `json:"id"`
+	Sig string `json:"sig"`
+}
+
+type hit struct {
+	ID uint64  `json:"id"`
+	D  float64 `json:"d"`
+}
+
+type MultiResponse struct {
+	RequestID int   `json:"rid"`
+	Matches   []hit `json:"m"`
+}
+
+func topkMultiHandler(w http.ResponseWriter, r *http.Request) {
+	Metrics.Requests.Add(1)
+
+	// error response
+	var (
+		status int
+		err    error
+	)
+
+	defer func() {
+		if nil != err {
+			logger.Error("topk/multi request failed", "event", "request_error", "status", status, "err", err)
+			http.Error(w, err.Error(), status)
+		}
+	}()
+
+	reqs := MultiRequest{}
+	err = json.NewDecoder(r.Body).Decode(&reqs)
+	if err != nil {
+		status = http.StatusInternalServerError
+		return
+	}
+
+	kstr := r.FormValue("k")
 	if kstr == "" {
 		kstr = "10"
 	}
@@ -426,9 +1471,172 @@ func topkHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	vpt := CurrentConfig().vptree
+	if k <= 0 {
+		err = errors.New("k must be positive")
+		status = http.StatusBadRequest
+		return
+	}
+
+	vpt := CurrentConfig().topk()
+	if vpt == nil {
+		err = errors.New("vptree not loaded")
+		status = http.StatusServiceUnavailable
+		return
+	}
+
+	sigs := make([]uint64, len(reqs))
+	for i, req := range reqs {
+		sigs[i], err = strconv.ParseUint(req.Sig, 16, 64)
+		if err != nil {
+			status = http.StatusBadRequest
+			return
+		}
+	}
+
+	res := make([]MultiResponse, len(reqs))
+
+	var wg sync.WaitGroup
+	wg.Add(len(reqs))
+
+	for i := range reqs {
+		i := i
+		pool.Go(func() {
+			matches, distances := vpt.SearchApprox(sigs[i], k, topkMaxNodes)
+
+			hits := make([]hit, 0)
+			for j, m := range matches {
+				hits = append(hits, hit{ID: m.ID, D: distances[j]})
+			}
+
+			res[i] = MultiResponse{
+				RequestID: reqs[i].ID,
+				Matches:   hits,
+			}
+			wg.Done()
+		})
+	}
+
+	wg.Wait()
+
+	json.NewEncoder(w).Encode(res)
+}
+
+// QueryRequest holds the parameters accepted by /search, /topk and /range.  They are
+// read from a JSON body for POST requests with Content-Type application/json,
+// and from the form values otherwise.
+type QueryRequest struct {
+	Sig string `json:"sig"`
+	K   int    `json:"k"`
+
+	// Distances makes /search return the distance of each match
+	Distances bool `json:"distances"`
+
+	// D is the maximum distance of the matches returned by /search, or -1
+	// for the distance the store was built for.  /range requires it, and
+	// /topk returns only the matches within it, or the k nearest however
+	// far for -1.
+	D int `json:"d"`
+
+	// MaxD is D, as a JSON body may also name it
+	MaxD *int `json:"maxd"`
+}
+
+var errMissingSig = errors.New("missing required parameter: sig")
+
+// signature parses the hex-encoded signature of the request
+func (q QueryRequest) signature() (uint64, error) {
+
+	if q.Sig == "" {
+		return 0, errMissingSig
+	}
+
+	sig, err := strconv.ParseUint(q.Sig, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid sig %q: expected a hex-encoded 64-bit signature", q.Sig)
+	}
+
+	return sig, nil
+}
+
+func parseQueryRequest(r *http.Request) (QueryRequest, error) {
+
+	req := QueryRequest{K: 10, D: -1}
+
+	if r.Method == "POST" {
+		mediatype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mediatype == "application/json" {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				return req, fmt.Errorf("invalid json body: %v", err)
+			}
+			if req.MaxD != nil {
+				if *req.MaxD < 0 {
+					return req, fmt.Errorf("invalid maxd %d: expected a non-negative distance", *req.MaxD)
+				}
+				if req.D != -1 && req.D != *req.MaxD {
+					return req, fmt.Errorf("d %d and maxd %d differ", req.D, *req.MaxD)
+				}
+				req.D = *req.MaxD
+			}
+			return req, nil
+		}
+	}
+
+	req.Sig = r.FormValue("sig")
+	req.Distances, _ = strconv.ParseBool(r.FormValue("distances"))
+
+	if dstr := r.FormValue("d"); dstr != "" {
+		d, err := strconv.Atoi(dstr)
+		if err != nil || d < 0 {
+			return req, fmt.Errorf("invalid d %q: expected a non-negative distance", dstr)
+		}
+		req.D = d
+	}
+
+	if kstr := r.FormValue("k"); kstr != "" {
+		k, err := strconv.Atoi(kstr)
+		if err != nil {
+			return req, err
+		}
+		req.K = k
+	}
+
+	return req, nil
+}
+
+func topkHandler(w http.ResponseWriter, r *http.Request) {
 
-	matches, distances := vpt.Search(sig64, k)
+	Metrics.Requests.Add(1)
+
+	req, err := parseQueryRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sig64, err := req.signature()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.K <= 0 {
+		http.Error(w, "k must be positive", http.StatusBadRequest)
+		return
+	}
+
+	vpt := CurrentConfig().topk()
+	if vpt == nil {
+		http.Error(w, "vptree not loaded", http.StatusServiceUnavailable)
+		return
+	}
+
+	var matches []vptree.Item
+	var distances []float64
+	if req.D >= 0 {
+		matches, distances = vpt.SearchWithin(sig64, req.K, float64(req.D), topkMaxNodes)
+	} else {
+		matches, distances = vpt.SearchApprox(sig64, req.K, topkMaxNodes)
+	}
 
 	type hit struct {
 		ID uint64  `json:"id"`
@@ -444,16 +1652,271 @@ func topkHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(results)
 }
 
-func searchHandler(w http.ResponseWriter, r *http.Request) {
+// rangeHandler returns every signature in the vptree, or the BK-tree, within
+// distance d of sig, nearest first
+func rangeHandler(w http.ResponseWriter, r *http.Request) {
 
 	Metrics.Requests.Add(1)
 
-	sigstr := r.FormValue("sig")
+	req, err := parseQueryRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sig64, err := req.signature()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.D < 0 {
+		http.Error(w, "missing required parameter: d", http.StatusBadRequest)
+		return
+	}
+
+	vpt := CurrentConfig().topk()
+	if vpt == nil {
+		http.Error(w, "vptree not loaded", http.StatusServiceUnavailable)
+		return
+	}
+
+	results := make([]hit, 0)
+	for _, m := range vpt.InRange(sig64, float64(req.D)) {
+		results = append(results, hit{ID: m.ID, D: float64(simhash.Distance(m.Sig, sig64))})
+	}
+
+	json.NewEncoder(w).Encode(results)
+}
+
+// compacter is implemented by stores which merge the signatures added after
+// Finish and drop deleted entries on demand
+type compacter interface {
+	Compact() int
+}
+
+// compactLoop compacts the current store every interval
+func compactLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		compactStore(CurrentConfig())
+	}
+}
+
+// reclaimer is implemented by compacters which can report the memory
+// compaction freed
+type reclaimer interface {
+	CompactReclaimed() (int, int64)
+}
+
+// compactStore compacts the store of cfg, if it supports it
+func compactStore(cfg *Config) {
+	t0 := time.Now()
+
+	switch c := cfg.store.(type) {
+	case reclaimer:
+		removed, reclaimed := c.CompactReclaimed()
+		logger.Info("compacted store", "event", "compact", "removed", removed, "reclaimed_bytes", reclaimed, "duration", time.Since(t0))
+	case compacter:
+		removed := c.Compact()
+		logger.Info("compacted store", "event", "compact", "removed", removed, "duration", time.Since(t0))
+	}
+}
+
+// addHandler adds a signature for a document to the current store and vptree.
+// The signature is searchable by /search and /topk as soon as the request
+// returns, but is lost when the config is reloaded unless it is also in the
+// input files.
+func addHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sig64, err := QueryRequest{Sig: r.FormValue("sig")}.signature()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid id %q: expected a decimal document id", r.FormValue("id")), http.StatusBadRequest)
+		return
+	}
+
+	cfg := CurrentConfig()
+
+	if cfg.store != nil {
+		if err := simstore.Checked(cfg.store).Add(sig64, id); err != nil {
+			logger.Error("add failed", "event", "add_failed", "id", id, "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if cfg.bktree != nil {
+		cfg.bktree.Add(bktree.Item{Sig: sig64, ID: id})
+	} else if cfg.hnsw != nil {
+		cfg.hnsw.Add(hnsw.Item{Sig: sig64, ID: id})
+	} else if cfg.forest != nil {
+		cfg.forest.Add(vptree.Item{Sig: sig64, ID: id})
+	} else if cfg.vptree != nil {
+		cfg.vptree.Add(vptree.Item{Sig: sig64, ID: id})
+	}
+	Metrics.Signatures.Add(1)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DocResponse is the response of /doc
+type DocResponse struct {
+	ID         uint64   `json:"id"`
+	Signatures []string `json:"signatures"` // hex, like the sig of /search
+}
+
+// docHandler returns the signatures of the document given by id.  Without
+// -index-docids each request scans the whole store.
+func docHandler(w http.ResponseWriter, r *http.Request) {
+
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid id %q: expected a decimal document id", r.FormValue("id")), http.StatusBadRequest)
+		return
+	}
+
+	store, ok := CurrentConfig().store.(signatureLister)
+	if !ok {
+		http.Error(w, "store does not support lookups by docid", http.StatusNotImplemented)
+		return
+	}
+
+	sigs := store.SignaturesOf(id)
+	if len(sigs) == 0 {
+		http.Error(w, fmt.Sprintf("document %d not found", id), http.StatusNotFound)
+		return
+	}
+
+	resp := DocResponse{ID: id}
+	for _, sig := range sigs {
+		resp.Signatures = append(resp.Signatures, fmt.Sprintf("%016x", sig))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// snapshotter is implemented by stores which can write a binary snapshot
+type snapshotter interface {
+	io.WriterTo
+	SnapshotSize() int64
+}
+
+// viewer is implemented by stores which can copy themselves as they are, so
+// their changes don't affect a snapshot being written
+type viewer interface {
+	Snapshot() *simstore.Store
+}
+
+// snapshotHandler streams a snapshot of the current store, after compacting it.
+// The store is taken from the config once, so a reload during the download
+// doesn't affect it, and a store which can be copied is written from a copy,
+// so /add and compaction during the download don't either.
+func snapshotHandler(w http.ResponseWriter, r *http.Request) {
+
+	cfg := CurrentConfig()
+
+	store, ok := cfg.store.(snapshotter)
+	if !ok {
+		http.Error(w, "store does not support snapshots", http.StatusNotImplemented)
+		return
+	}
+
+	// the snapshot format has no room for signatures added since Finish
+	compactStore(cfg)
+
+	if v, ok := cfg.store.(viewer); ok {
+		// compacting the copy only costs anything for the changes since
+		snap := v.Snapshot()
+		snap.Compact()
+		store = snap
+	}
+
+	filename := fmt.Sprintf("simstore-%s.snap", time.Now().UTC().Format("20060102T150405Z"))
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("Content-Length", strconv.FormatInt(store.SnapshotSize(), 10))
+
+	if _, err := store.WriteTo(w); err != nil {
+		logger.Error("error writing snapshot", "event", "snapshot_error", "err", err)
+	}
+}
+
+// vptreeSnapshotHandler streams the current vptree, to be loaded with
+// -vptree-snapshot instead of being built again.  The tree is written to
+// memory first, so /add waits only for that and not for the download.
+func vptreeSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+
+	vpt := CurrentConfig().vptree
+	if vpt == nil {
+		http.Error(w, "no vptree loaded", http.StatusNotFound)
+		return
+	}
+
+	filename := fmt.Sprintf("vptree-%s.vpt", time.Now().UTC().Format("20060102T150405Z"))
+
+	var buf bytes.Buffer
+	if _, err := vpt.WriteTo(&buf); err != nil {
+		logger.Error("error writing vptree", "event", "vptree_snapshot_error", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+
+	if _, err := buf.WriteTo(w); err != nil {
+		logger.Error("error writing vptree", "event", "vptree_snapshot_error", "err", err)
+	}
+}
 
-	var sig64 uint64
+// VersionResponse is the response of /version
+type VersionResponse struct {
+	Version       string    `json:"version"`
+	StartedAt     time.Time `json:"started_at"`
+	UptimeSeconds float64   `json:"uptime_seconds"`
+}
+
+// versionHandler reports the build version and how long simd has been running
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(VersionResponse{
+		Version:       BuildVersion,
+		StartedAt:     startedAt,
+		UptimeSeconds: time.Since(startedAt).Seconds(),
+	})
+}
+
+// notFoundHandler handles all the paths without a registered handler
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(map[string]string{"error": "not found"})
+}
+
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+
+	Metrics.Requests.Add(1)
+
+	req, err := parseQueryRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	var err error
-	sig64, err = strconv.ParseUint(sigstr, 16, 64)
+	sig64, err := req.signature()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -461,7 +1924,80 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 
 	store := CurrentConfig().store
 
-	matches := store.Find(sig64)
+	if req.D >= 0 {
+		af, ok := store.(atMostFinder)
+		if !ok {
+			http.Error(w, "store does not support per-query distances", http.StatusNotImplemented)
+			return
+		}
+
+		if max := af.MaxDistance(); req.D > max {
+			http.Error(w, fmt.Sprintf("d=%d is larger than the store's distance %d", req.D, max), http.StatusBadRequest)
+			return
+		}
+
+		if !req.Distances {
+			matches, _ := af.FindAtMost(sig64, req.D)
+			json.NewEncoder(w).Encode(matches)
+			return
+		}
+	}
+
+	if req.Distances {
+		df, ok := store.(distanceFinder)
+		if !ok {
+			http.Error(w, "store does not report distances", http.StatusNotImplemented)
+			return
+		}
+
+		hits := make([]SearchHit, 0)
+		for _, m := range df.FindWithDistance(sig64) {
+			if req.D < 0 || m.Distance <= req.D {
+				hits = append(hits, SearchHit{ID: m.DocID, D: m.Distance})
+			}
+		}
+
+		json.NewEncoder(w).Encode(hits)
+		return
+	}
+
+	var matches []uint64
+	if sc, ok := store.(scanCounter); ok && scanStats {
+		var scanned int
+		matches, scanned = sc.FindScanned(sig64)
+		Metrics.Candidates.Add(int64(scanned))
+		Metrics.Matches.Add(int64(len(matches)))
+	} else if pf, ok := store.(parallelFinder); ok && parallelSearch {
+		matches = pf.FindParallel(sig64, pool)
+	} else if cf, ok := store.(contextFinder); ok {
+		ctx := r.Context()
+		if searchTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, searchTimeout)
+			defer cancel()
+		}
+
+		matches, err = cf.FindContext(ctx, sig64)
+		if err != nil {
+			logger.Warn("search abandoned", "event", "search_abandoned", "sig", req.Sig, "err", err)
+			http.Error(w, "search timed out", http.StatusServiceUnavailable)
+			return
+		}
+	} else {
+		matches = store.Find(sig64)
+	}
 
 	json.NewEncoder(w).Encode(matches)
 }
+
+// checkpointStore returns the Store of a store built by loadConfig, which can
+// be checkpointed
+func checkpointStore(store simstore.Storage) *simstore.Store {
+	switch s := store.(type) {
+	case *simstore.Store6:
+		return &s.Store
+	case *simstore.Store:
+		return s
+	}
+	return nil
+}
@@ -0,0 +1,1753 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgryski/go-simstore"
+	"github.com/dgryski/go-simstore/hnsw"
+	"github.com/dgryski/go-simstore/vptree"
+)
+
+var testSigs = []struct {
+	id  uint64
+	sig uint64
+}{
+	{1, 0x001122334455667788},
+	{2, 0x001122334455667789},
+	{3, 0x00112233445566778b},
+	{4, 0xdeadbeefcafebabe},
+	{5, 0x0123456789abcdef},
+}
+
+func TestMain(m *testing.M) {
+	pool = simstore.NewPool(runtime.GOMAXPROCS(0))
+	os.Exit(m.Run())
+}
+
+// loadTestConfig installs a config built from testSigs
+func loadTestConfig() {
+	store := simstore.New6(len(testSigs), simstore.NewU64Slice)
+
+	var items []vptree.Item
+	for _, s := range testSigs {
+		store.Add(s.sig, s.id)
+		items = append(items, vptree.Item{Sig: s.sig, ID: s.id})
+	}
+	store.Finish()
+
+	UpdateConfig(&Config{store: store, vptree: vptree.New(items)})
+}
+
+func TestSearchHandler(t *testing.T) {
+
+	loadTestConfig()
+
+	tests := []struct {
+		name   string
+		req    *http.Request
+		status int
+		want   []uint64
+	}{
+		{
+			name:   "GET",
+			req:    httptest.NewRequest("GET", "/search?sig=1122334455667788", nil),
+			status: http.StatusOK,
+			want:   []uint64{1, 2, 3},
+		},
+		{
+			name:   "POST json",
+			req:    jsonRequest("/search", `{"sig":"1122334455667788"}`),
+			status: http.StatusOK,
+			want:   []uint64{1, 2, 3},
+		},
+		{
+			name:   "POST form",
+			req:    formRequest("/search", url.Values{"sig": {"1122334455667788"}}),
+			status: http.StatusOK,
+			want:   []uint64{1, 2, 3},
+		},
+		{
+			name:   "POST bad json",
+			req:    jsonRequest("/search", `{"sig":`),
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		searchHandler(w, tt.req)
+
+		if w.Code != tt.status {
+			t.Errorf("%s: status=%d, want %d", tt.name, w.Code, tt.status)
+			continue
+		}
+
+		if tt.status != http.StatusOK {
+			continue
+		}
+
+		var got []uint64
+		if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+			t.Errorf("%s: error decoding response: %v", tt.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTopkHandler(t *testing.T) {
+
+	loadTestConfig()
+
+	tests := []struct {
+		name   string
+		req    *http.Request
+		status int
+		want   int
+	}{
+		{
+			name:   "GET",
+			req:    httptest.NewRequest("GET", "/topk?sig=1122334455667788&k=2", nil),
+			status: http.StatusOK,
+			want:   2,
+		},
+		{
+			name:   "GET default k",
+			req:    httptest.NewRequest("GET", "/topk?sig=1122334455667788", nil),
+			status: http.StatusOK,
+			want:   len(testSigs),
+		},
+		{
+			name:   "POST json",
+			req:    jsonRequest("/topk", `{"sig":"1122334455667788","k":3}`),
+			status: http.StatusOK,
+			want:   3,
+		},
+		{
+			name:   "POST json default k",
+			req:    jsonRequest("/topk", `{"sig":"1122334455667788"}`),
+			status: http.StatusOK,
+			want:   len(testSigs),
+		},
+		{
+			name:   "GET max distance",
+			req:    httptest.NewRequest("GET", "/topk?sig=1122334455667788&d=1", nil),
+			status: http.StatusOK,
+			want:   2,
+		},
+		{
+			name:   "POST json max distance",
+			req:    jsonRequest("/topk", `{"sig":"1122334455667788","k":2,"d":2}`),
+			status: http.StatusOK,
+			want:   2,
+		},
+		{
+			name:   "GET bad k",
+			req:    httptest.NewRequest("GET", "/topk?sig=1122334455667788&k=x", nil),
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		topkHandler(w, tt.req)
+
+		if w.Code != tt.status {
+			t.Errorf("%s: status=%d, want %d", tt.name, w.Code, tt.status)
+			continue
+		}
+
+		if tt.status != http.StatusOK {
+			continue
+		}
+
+		var got []hit
+		if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+			t.Errorf("%s: error decoding response: %v", tt.name, err)
+			continue
+		}
+
+		if len(got) != tt.want {
+			t.Errorf("%s: got %d results, want %d", tt.name, len(got), tt.want)
+		}
+
+		if len(got) > 0 && got[0].ID != 1 {
+			t.Errorf("%s: closest match=%d, want 1", tt.name, got[0].ID)
+		}
+	}
+}
+
+func TestTopkMaxNodes(t *testing.T) {
+
+	loadTestConfig()
+
+	topkMaxNodes = 1
+	defer func() { topkMaxNodes = 0 }()
+
+	// only the root is visited
+	w := httptest.NewRecorder()
+	topkHandler(w, httptest.NewRequest("GET", "/topk?sig=1122334455667788&k=3", nil))
+
+	var got []hit
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatalf("error decoding response: %v", err)
+	}
+	if len(got) != 1 {
+		t.Errorf("got %d results, want 1", len(got))
+	}
+}
+
+func TestRangeHandler(t *testing.T) {
+
+	loadTestConfig()
+
+	tests := []struct {
+		name   string
+		req    *http.Request
+		status int
+		want   []hit
+	}{
+		{"d=0", httptest.NewRequest("GET", "/range?sig=1122334455667788&d=0", nil), http.StatusOK, []hit{{1, 0}}},
+		{"d=2", httptest.NewRequest("GET", "/range?sig=1122334455667788&d=2", nil), http.StatusOK, []hit{{1, 0}, {2, 1}, {3, 2}}},
+		{"json", jsonRequest("/range", `{"sig":"1122334455667789","d":1}`), http.StatusOK, []hit{{2, 0}, {1, 1}, {3, 1}}},
+		{"none", httptest.NewRequest("GET", "/range?sig=ffffffffffffffff&d=3", nil), http.StatusOK, []hit{}},
+		{"missing d", httptest.NewRequest("GET", "/range?sig=1122334455667788", nil), http.StatusBadRequest, nil},
+		{"bad d", httptest.NewRequest("GET", "/range?sig=1122334455667788&d=-1", nil), http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		rangeHandler(w, tt.req)
+
+		if w.Code != tt.status {
+			t.Errorf("%s: status=%d, want %d", tt.name, w.Code, tt.status)
+			continue
+		}
+
+		if tt.status != http.StatusOK {
+			continue
+		}
+
+		var got []hit
+		if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+			t.Errorf("%s: error decoding response: %v", tt.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func jsonRequest(path, body string) *http.Request {
+	r := httptest.NewRequest("POST", path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
+
+func formRequest(path string, v url.Values) *http.Request {
+	r := httptest.NewRequest("POST", path, strings.NewReader(v.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+func TestTopkHandlerErrors(t *testing.T) {
+
+	loadTestConfig()
+
+	tests := []struct {
+		name   string
+		req    *http.Request
+		status int
+	}{
+		{"k=0", httptest.NewRequest("GET", "/topk?sig=1122334455667788&k=0", nil), http.StatusBadRequest},
+		{"k=-1", httptest.NewRequest("GET", "/topk?sig=1122334455667788&k=-1", nil), http.StatusBadRequest},
+		{"json k=0", jsonRequest("/topk", `{"sig":"1122334455667788","k":0}`), http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		topkHandler(w, tt.req)
+
+		if w.Code != tt.status {
+			t.Errorf("%s: status=%d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+
+	// a store-only instance has no vptree to search
+	cfg := CurrentConfig()
+	UpdateConfig(&Config{store: cfg.store})
+
+	w := httptest.NewRecorder()
+	topkHandler(w, httptest.NewRequest("GET", "/topk?sig=1122334455667788", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("no vptree: status=%d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	w = httptest.NewRecorder()
+	topkMultiHandler(w, httptest.NewRequest("POST", "/topk/multi", strings.NewReader(`[{"id":1,"sig":"1122334455667788"}]`)))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("multi no vptree: status=%d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestSearchHandlerScanStats(t *testing.T) {
+
+	loadTestConfig()
+
+	scanStats = true
+	defer func() { scanStats = false }()
+
+	candidates, matches := Metrics.Candidates.Value(), Metrics.Matches.Value()
+
+	w := httptest.NewRecorder()
+	searchHandler(w, httptest.NewRequest("GET", "/search?sig=1122334455667788", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status=%d, want %d", w.Code, http.StatusOK)
+	}
+
+	if got := Metrics.Matches.Value() - matches; got != 3 {
+		t.Errorf("matches=%d, want 3", got)
+	}
+
+	if got := Metrics.Candidates.Value() - candidates; got < 3 {
+		t.Errorf("candidates=%d, want >= 3", got)
+	}
+}
+
+func TestSearchHandlerDistances(t *testing.T) {
+
+	loadTestConfig()
+
+	want := []SearchHit{{1, 0}, {2, 1}, {3, 2}}
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "/search?sig=1122334455667788&distances=1", nil),
+		jsonRequest("/search", `{"sig":"1122334455667788","distances":true}`),
+	} {
+		w := httptest.NewRecorder()
+		searchHandler(w, req)
+
+		var got []SearchHit
+		if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+			t.Fatalf("%s: error decoding response: %v", req.Method, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", req.Method, got, want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	searchHandler(w, httptest.NewRequest("GET", "/search?sig=ffffffffffffffff&distances=1", nil))
+	if body := strings.TrimSpace(w.Body.String()); body != "[]" {
+		t.Errorf("no matches: body=%s, want []", body)
+	}
+
+	UpdateConfig(&Config{store: simstore.New3Small(1)})
+
+	w = httptest.NewRecorder()
+	searchHandler(w, httptest.NewRequest("GET", "/search?sig=1122334455667788&distances=1", nil))
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("small store: status=%d, want %d", w.Code, http.StatusNotImplemented)
+	}
+}
+
+func TestSearchHandlerMaxDistance(t *testing.T) {
+
+	loadTestConfig()
+
+	tests := []struct {
+		req    *http.Request
+		status int
+		want   string
+	}{
+		{httptest.NewRequest("GET", "/search?sig=1122334455667788&d=0", nil), http.StatusOK, `[1]`},
+		{httptest.NewRequest("GET", "/search?sig=1122334455667788&d=1", nil), http.StatusOK, `[1,2]`},
+		{jsonRequest("/search", `{"sig":"1122334455667788","d":1}`), http.StatusOK, `[1,2]`},
+		{jsonRequest("/search", `{"sig":"1122334455667788","maxd":1}`), http.StatusOK, `[1,2]`},
+		{jsonRequest("/search", `{"sig":"1122334455667788","d":1,"maxd":1}`), http.StatusOK, `[1,2]`},
+		{jsonRequest("/search", `{"sig":"1122334455667788","d":0,"maxd":1}`), http.StatusBadRequest, ""},
+		{jsonRequest("/search", `{"sig":"1122334455667788","maxd":-1}`), http.StatusBadRequest, ""},
+		{httptest.NewRequest("GET", "/search?sig=1122334455667788&d=1&distances=1", nil), http.StatusOK, `[{"id":1,"d":0},{"id":2,"d":1}]`},
+		{httptest.NewRequest("GET", "/search?sig=1122334455667788&d=7", nil), http.StatusBadRequest, ""},
+		{httptest.NewRequest("GET", "/search?sig=1122334455667788&d=-1", nil), http.StatusBadRequest, ""},
+		{httptest.NewRequest("GET", "/search?sig=1122334455667788&d=x", nil), http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		searchHandler(w, tt.req)
+
+		if w.Code != tt.status {
+			t.Errorf("%s: status=%d, want %d", tt.req.URL, w.Code, tt.status)
+			continue
+		}
+
+		if body := strings.TrimSpace(w.Body.String()); tt.status == http.StatusOK && body != tt.want {
+			t.Errorf("%s: body=%s, want %s", tt.req.URL, body, tt.want)
+		}
+	}
+}
+
+func TestSearchHandlerCancelled(t *testing.T) {
+
+	loadTestConfig()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	w := httptest.NewRecorder()
+	searchHandler(w, httptest.NewRequest("GET", "/search?sig=1122334455667788", nil).WithContext(ctx))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("cancelled request: status=%d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	searchTimeout = time.Nanosecond
+	defer func() { searchTimeout = 0 }()
+
+	w = httptest.NewRecorder()
+	searchHandler(w, httptest.NewRequest("GET", "/search?sig=1122334455667788", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("timed out request: status=%d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestSearchHandlerParallel(t *testing.T) {
+
+	loadTestConfig()
+
+	parallelSearch = true
+	defer func() { parallelSearch = false }()
+
+	w := httptest.NewRecorder()
+	searchHandler(w, httptest.NewRequest("GET", "/search?sig=1122334455667788", nil))
+
+	var got []uint64
+	json.NewDecoder(w.Body).Decode(&got)
+	if want := []uint64{1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parallel search=%v, want %v", got, want)
+	}
+}
+
+func TestLoadConfigMultipleFiles(t *testing.T) {
+
+	dir := t.TempDir()
+
+	day1 := filepath.Join(dir, "day1.txt")
+	day2 := filepath.Join(dir, "day2.txt")
+
+	if err := os.WriteFile(day1, []byte("1 1122334455667788\n2 deadbeefcafebabe\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(day2, []byte("3 1122334455667789\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := testLoadOptions(day1, day2)
+
+	if err := loadConfig(opts); err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+
+	cfg := CurrentConfig()
+
+	if got, want := cfg.store.Find(0x1122334455667788), []uint64{1, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Find()=%v, want %v", got, want)
+	}
+
+	if got := Metrics.Signatures.Value(); got != 3 {
+		t.Errorf("signatures=%d, want 3", got)
+	}
+
+	err := loadConfig(testLoadOptions(day1, filepath.Join(dir, "missing.txt"), day2))
+	if err == nil {
+		t.Errorf("loadConfig with a missing file succeeded")
+	}
+
+	if CurrentConfig() != cfg {
+		t.Errorf("failed load replaced the current config")
+	}
+}
+
+func TestLoadConfigWorkers(t *testing.T) {
+
+	input := filepath.Join(t.TempDir(), "sigs.txt")
+
+	// enough lines for several batches of the workers, with some invalid
+	const lines = 3*4096 + 10
+
+	var buf bytes.Buffer
+	for i := 0; i < lines; i++ {
+		if i%1000 == 999 {
+			fmt.Fprintf(&buf, "bad %016x\n", i)
+			continue
+		}
+		fmt.Fprintf(&buf, "%d %016x\n", i, uint64(i)*0x9e3779b97f4a7c15)
+	}
+	if err := os.WriteFile(input, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	find := func(workers int) [][]uint64 {
+		opts := testLoadOptions(input)
+		opts.workers = workers
+		if err := loadConfig(opts); err != nil {
+			t.Fatalf("loadConfig with %d workers failed: %v", workers, err)
+		}
+
+		var res [][]uint64
+		for i := uint64(0); i < 100; i++ {
+			res = append(res, CurrentConfig().store.Find(i*0x9e3779b97f4a7c15))
+		}
+		return res
+	}
+
+	want := find(1)
+	wantSigs := Metrics.Signatures.Value()
+
+	if got := find(8); !reflect.DeepEqual(got, want) {
+		t.Errorf("results with 8 workers differ from those with 1")
+	}
+	if got := Metrics.Signatures.Value(); got != wantSigs || got != lines-12 {
+		t.Errorf("signatures=%d with 8 workers, want %d", got, wantSigs)
+	}
+
+	sum, err := validateInputs(func() loadOptions { o := testLoadOptions(input); o.workers = 8; return o }())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum.Signatures != int(wantSigs) || sum.Invalid != 12 {
+		t.Errorf("validateInputs=%+v, want %d signatures and 12 invalid lines", sum, wantSigs)
+	}
+}
+
+func TestLoadConfigCheckpoint(t *testing.T) {
+
+	dir := t.TempDir()
+	input := filepath.Join(dir, "sigs.txt")
+	ckpt := filepath.Join(dir, "build.ckpt")
+
+	// a checkpoint of the first line, which has another docid in the input
+	// so it shows up in the results if it's parsed again
+	if err := os.WriteFile(input, []byte("99 1122334455667788\n2 1122334455667789\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	built := simstore.New6(1, simstore.NewU64Slice)
+	built.Add(0x1122334455667788, 1)
+	if err := simstore.SaveCheckpoint(ckpt, &built.Store, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := testLoadOptions(input)
+	opts.checkpoint = ckpt
+	if err := loadConfig(opts); err == nil {
+		t.Errorf("loadConfig checkpointing with the vptree succeeded")
+	}
+
+	opts.useVPTree = false
+	if err := loadConfig(opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := CurrentConfig().store.Find(0x1122334455667788), []uint64{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Find()=%v, want %v", got, want)
+	}
+	if got := Metrics.Signatures.Value(); got != 2 {
+		t.Errorf("signatures=%d, want 2", got)
+	}
+	if _, err := os.Stat(ckpt); !os.IsNotExist(err) {
+		t.Errorf("checkpoint not removed: %v", err)
+	}
+}
+
+func TestLoadConfigDedup(t *testing.T) {
+
+	// the same file loaded twice
+	input := filepath.Join(t.TempDir(), "sigs.txt")
+	if err := os.WriteFile(input, []byte("1 1122334455667788\n2 1122334455667789\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dedup := range []bool{false, true} {
+		opts := testLoadOptions(input, input)
+		opts.useVPTree = false
+		opts.dedup = dedup
+
+		if err := loadConfig(opts); err != nil {
+			t.Fatalf("dedup=%v: %v", dedup, err)
+		}
+
+		want := []uint64{1, 1, 2, 2}
+		if dedup {
+			want = []uint64{1, 2}
+		}
+
+		if got := CurrentConfig().store.Find(0x1122334455667788); !reflect.DeepEqual(got, want) {
+			t.Errorf("dedup=%v: Find()=%v, want %v", dedup, got, want)
+		}
+	}
+}
+
+func TestLoadConfigMaxTables(t *testing.T) {
+
+	input := filepath.Join(t.TempDir(), "sigs.txt")
+	if err := os.WriteFile(input, []byte("1 1122334455667788\n2 1122334455667789\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := testLoadOptions(input)
+	opts.useVPTree = false
+	opts.maxTables = 100
+
+	if err := loadConfig(opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// 3 prefix blocks of 9 for distance 6
+	if got := len(CurrentConfig().store.Stats().Tables); got != 84 {
+		t.Errorf("%d tables, want 84", got)
+	}
+	if got, want := CurrentConfig().store.Find(0x1122334455667788), []uint64{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Find()=%v, want %v", got, want)
+	}
+
+	opts.maxTables = 5
+	if err := loadConfig(opts); err == nil {
+		t.Errorf("-max-tables 5 for distance 6 didn't fail")
+	}
+}
+
+func TestLoadConfigMIH(t *testing.T) {
+
+	input := filepath.Join(t.TempDir(), "sigs.txt")
+	if err := os.WriteFile(input, []byte("1 1122334455667788\n2 11223344556677ff\n3 eedd334455667788\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := testLoadOptions(input)
+	opts.useVPTree = false
+	opts.mih = true
+	opts.storeSize = 10
+
+	if err := loadConfig(opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := CurrentConfig().store.(*simstore.MIHStore); !ok {
+		t.Fatalf("store is a %T, want an MIHStore", CurrentConfig().store)
+	}
+	if got, want := CurrentConfig().store.Find(0x1122334455667788), []uint64{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Find()=%v, want %v", got, want)
+	}
+
+	opts.compressed = true
+	if err := loadConfig(opts); err == nil {
+		t.Errorf("-engine=mih with -z didn't fail")
+	}
+}
+
+func TestLoadConfigWindow(t *testing.T) {
+
+	input := filepath.Join(t.TempDir(), "sigs.txt")
+	if err := os.WriteFile(input, []byte("1 1122334455667788\n2 11223344556677ff\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := testLoadOptions(input)
+	opts.useVPTree = false
+	opts.storeSize = 3
+	opts.window = time.Hour
+	opts.retention = 24 * time.Hour
+
+	if err := loadConfig(opts); err != nil {
+		t.Fatal(err)
+	}
+
+	w, ok := CurrentConfig().store.(*simstore.WindowedStore)
+	if !ok {
+		t.Fatalf("store is a %T, want a WindowedStore", CurrentConfig().store)
+	}
+
+	w.Add(0x1122334455667789, 3)
+	if got, want := w.Find(0x1122334455667788), []uint64{1, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Find()=%v, want %v", got, want)
+	}
+	if w.Buckets() != 1 && w.Buckets() != 2 {
+		t.Errorf("%d buckets, want the loaded one and maybe the current one", w.Buckets())
+	}
+}
+
+func TestLoadConfigForest(t *testing.T) {
+
+	input := filepath.Join(t.TempDir(), "sigs.txt")
+	var buf bytes.Buffer
+	for _, s := range testSigs {
+		fmt.Fprintf(&buf, "%d %016x\n", s.id, s.sig)
+	}
+	if err := os.WriteFile(input, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := testLoadOptions(input)
+	opts.vptreeForest = 3
+	opts.vptreeFlat = true
+
+	if err := loadConfig(opts); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := CurrentConfig()
+	if cfg.forest == nil || len(cfg.forest.Trees()) != 3 || cfg.vptree != cfg.forest.Trees()[0] {
+		t.Fatalf("loadConfig didn't build a forest of 3 trees: %+v", cfg)
+	}
+
+	topkMaxNodes = 2
+	defer func() { topkMaxNodes = 0 }()
+
+	searches, nodes := Metrics.VPTreeSearches.Value(), Metrics.VPTreeNodes.Value()
+
+	w := httptest.NewRecorder()
+	topkHandler(w, httptest.NewRequest("GET", "/topk?sig=1122334455667788&k=2", nil))
+
+	// each tree visits up to 2 nodes
+	if s, n := Metrics.VPTreeSearches.Value()-searches, Metrics.VPTreeNodes.Value()-nodes; s != 3 || n < 3 || n > 6 {
+		t.Errorf("vptree_searches +%d, vptree_nodes +%d, want +3 and +3 to +6", s, n)
+	}
+
+	var got []hit
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatalf("error decoding response: %v", err)
+	}
+	if len(got) != 2 || got[0].D > got[1].D {
+		t.Errorf("topk of the forest=%v, want 2 results, nearest first", got)
+	}
+
+	w = httptest.NewRecorder()
+	addHandler(w, formRequest("/add", url.Values{"sig": {"1122334455667780"}, "id": {"6"}}))
+	for _, tree := range cfg.forest.Trees() {
+		if tree.Len() != len(testSigs)+1 {
+			t.Errorf("tree of %d items after /add, want %d", tree.Len(), len(testSigs)+1)
+		}
+	}
+
+	opts.vptreeSnapshot = filepath.Join(t.TempDir(), "tree.vpt")
+	if err := loadConfig(opts); err == nil {
+		t.Errorf("loading a forest from a snapshot didn't fail")
+	}
+}
+
+func TestLoadConfigBKTree(t *testing.T) {
+
+	input := filepath.Join(t.TempDir(), "sigs.txt")
+	var buf bytes.Buffer
+	for _, s := range testSigs {
+		fmt.Fprintf(&buf, "%d %016x\n", s.id, s.sig)
+	}
+	if err := os.WriteFile(input, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(h http.HandlerFunc, url string) []hit {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", url, nil))
+		var got []hit
+		if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+			t.Fatalf("%s: error decoding response: %v", url, err)
+		}
+		return got
+	}
+
+	// the same results as the vptree
+	loadTestConfig()
+	wantTopk := get(topkHandler, "/topk?sig=1122334455667788&k=3")
+	wantRange := get(rangeHandler, "/range?sig=1122334455667788&d=2")
+
+	opts := testLoadOptions(input)
+	opts.topkIndex = "bktree"
+	if err := loadConfig(opts); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := CurrentConfig()
+	if cfg.bktree == nil || cfg.vptree != nil || cfg.bktree.Len() != len(testSigs) {
+		t.Fatalf("loadConfig didn't build a BK-tree of %d items: %+v", len(testSigs), cfg)
+	}
+
+	if got := get(topkHandler, "/topk?sig=1122334455667788&k=3"); !reflect.DeepEqual(got, wantTopk) {
+		t.Errorf("topk=%v, want %v", got, wantTopk)
+	}
+	if got := get(rangeHandler, "/range?sig=1122334455667788&d=2"); !reflect.DeepEqual(got, wantRange) {
+		t.Errorf("range=%v, want %v", got, wantRange)
+	}
+
+	w := httptest.NewRecorder()
+	addHandler(w, formRequest("/add", url.Values{"sig": {"1122334455667780"}, "id": {"6"}}))
+	if got, want := get(topkHandler, "/topk?sig=1122334455667780&k=1"), []hit{{6, 0}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("topk after add=%v, want %v", got, want)
+	}
+
+	for _, tt := range []struct {
+		name string
+		opt  func(*loadOptions)
+	}{
+		{"flat", func(o *loadOptions) { o.vptreeFlat = true }},
+		{"forest", func(o *loadOptions) { o.vptreeForest = 2 }},
+		{"unknown", func(o *loadOptions) { o.topkIndex = "kdtree" }},
+	} {
+		opts := testLoadOptions(input)
+		opts.topkIndex = "bktree"
+		tt.opt(&opts)
+		if err := loadConfig(opts); err == nil {
+			t.Errorf("%s: loadConfig succeeded", tt.name)
+		}
+	}
+}
+
+func TestLoadConfigHNSW(t *testing.T) {
+
+	input := filepath.Join(t.TempDir(), "sigs.txt")
+	var buf bytes.Buffer
+	for _, s := range testSigs {
+		fmt.Fprintf(&buf, "%d %016x\n", s.id, s.sig)
+	}
+	if err := os.WriteFile(input, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(h http.HandlerFunc, url string) []hit {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", url, nil))
+		var got []hit
+		if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+			t.Fatalf("%s: error decoding response: %v", url, err)
+		}
+		return got
+	}
+
+	// with ef above the number of items, the same results as the vptree
+	loadTestConfig()
+	wantTopk := get(topkHandler, "/topk?sig=1122334455667788&k=3")
+	wantRange := get(rangeHandler, "/range?sig=1122334455667788&d=2")
+
+	opts := testLoadOptions(input)
+	opts.topkIndex = "hnsw"
+	opts.hnsw = hnsw.Params{M: 4, EfSearch: 20}
+	if err := loadConfig(opts); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := CurrentConfig()
+	if cfg.hnsw == nil || cfg.vptree != nil || cfg.hnsw.Len() != len(testSigs) {
+		t.Fatalf("loadConfig didn't build an HNSW index of %d items: %+v", len(testSigs), cfg)
+	}
+	if p := cfg.hnsw.Params(); p.M != 4 || p.EfSearch != 20 {
+		t.Errorf("HNSW params=%+v, want M 4 and EfSearch 20", p)
+	}
+
+	if got := get(topkHandler, "/topk?sig=1122334455667788&k=3"); !reflect.DeepEqual(got, wantTopk) {
+		t.Errorf("topk=%v, want %v", got, wantTopk)
+	}
+	if got := get(rangeHandler, "/range?sig=1122334455667788&d=2"); !reflect.DeepEqual(got, wantRange) {
+		t.Errorf("range=%v, want %v", got, wantRange)
+	}
+
+	w := httptest.NewRecorder()
+	addHandler(w, formRequest("/add", url.Values{"sig": {"1122334455667780"}, "id": {"6"}}))
+	if got, want := get(topkHandler, "/topk?sig=1122334455667780&k=1"), []hit{{6, 0}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("topk after add=%v, want %v", got, want)
+	}
+
+	for _, tt := range []struct {
+		name string
+		opt  func(*loadOptions)
+	}{
+		{"flat", func(o *loadOptions) { o.vptreeFlat = true }},
+		{"forest", func(o *loadOptions) { o.vptreeForest = 2 }},
+		{"negative ef", func(o *loadOptions) { o.hnsw.EfSearch = -1 }},
+	} {
+		opts := testLoadOptions(input)
+		opts.topkIndex = "hnsw"
+		tt.opt(&opts)
+		if err := loadConfig(opts); err == nil {
+			t.Errorf("%s: loadConfig succeeded", tt.name)
+		}
+	}
+}
+
+func TestMissingSig(t *testing.T) {
+
+	loadTestConfig()
+
+	handlers := []struct {
+		name string
+		h    http.HandlerFunc
+	}{
+		{"search", searchHandler},
+		{"topk", topkHandler},
+		{"range", rangeHandler},
+	}
+
+	tests := []struct {
+		name string
+		req  func(path string) *http.Request
+		want string
+	}{
+		{
+			"missing",
+			func(path string) *http.Request { return httptest.NewRequest("GET", path, nil) },
+			"missing required parameter: sig",
+		},
+		{
+			"empty",
+			func(path string) *http.Request { return httptest.NewRequest("GET", path+"?sig=", nil) },
+			"missing required parameter: sig",
+		},
+		{
+			"json missing",
+			func(path string) *http.Request { return jsonRequest(path, `{"k":3}`) },
+			"missing required parameter: sig",
+		},
+		{
+			"malformed",
+			func(path string) *http.Request { return httptest.NewRequest("GET", path+"?sig=xyzzy", nil) },
+			`invalid sig "xyzzy": expected a hex-encoded 64-bit signature`,
+		},
+	}
+
+	for _, h := range handlers {
+		for _, tt := range tests {
+			w := httptest.NewRecorder()
+			h.h(w, tt.req("/"+h.name))
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%s %s: status=%d, want %d", h.name, tt.name, w.Code, http.StatusBadRequest)
+			}
+
+			if got := strings.TrimSpace(w.Body.String()); got != tt.want {
+				t.Errorf("%s %s: body=%q, want %q", h.name, tt.name, got, tt.want)
+			}
+		}
+	}
+}
+
+func testLoadOptions(inputs ...string) loadOptions {
+	return loadOptions{
+		inputs:        inputs,
+		useStore:      true,
+		storeSize:     6,
+		useVPTree:     true,
+		totalMachines: 1,
+	}
+}
+
+func TestLoadConfigProgress(t *testing.T) {
+
+	input := filepath.Join(t.TempDir(), "sigs.txt")
+
+	var buf bytes.Buffer
+	for i := 0; i < 1<<20+10; i++ {
+		fmt.Fprintf(&buf, "%d %016x\n", i, uint64(i)*0x9e3779b97f4a7c15)
+	}
+
+	if err := os.WriteFile(input, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	type call struct{ processed, total int }
+	var calls []call
+
+	// only the scan is being tested, so don't build anything
+	opts := testLoadOptions(input)
+	opts.useStore = false
+	opts.useVPTree = false
+	opts.progress = func(processed, total int) { calls = append(calls, call{processed, total}) }
+
+	if err := loadConfig(opts); err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+
+	want := []call{{1 << 20, 1<<20 + 10}, {1<<20 + 10, 1<<20 + 10}}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("progress calls=%v, want %v", calls, want)
+	}
+}
+
+func TestNotFound(t *testing.T) {
+
+	// main registers the catch-all on the default mux, alongside the
+	// pprof and expvar handlers
+	http.HandleFunc("/", notFoundHandler)
+
+	w := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, httptest.NewRequest("GET", "/no/such/path", nil))
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status=%d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type=%q, want application/json", ct)
+	}
+
+	if got, want := strings.TrimSpace(w.Body.String()), `{"error":"not found"}`; got != want {
+		t.Errorf("body=%s, want %s", got, want)
+	}
+
+	for _, path := range []string{"/debug/vars", "/debug/pprof/"} {
+		w := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: status=%d, want %d", path, w.Code, http.StatusOK)
+		}
+	}
+}
+
+func TestVPTreeStats(t *testing.T) {
+
+	loadTestConfig()
+
+	got := vptreeStats().(map[string]int)
+	if got["len"] != len(testSigs) {
+		t.Errorf("len=%d, want %d", got["len"], len(testSigs))
+	}
+
+	if got["depth"] < 3 || got["depth"] > len(testSigs) {
+		t.Errorf("depth=%d, want between 3 and %d", got["depth"], len(testSigs))
+	}
+
+	UpdateConfig(&Config{})
+
+	if got := vptreeStats(); got != nil {
+		t.Errorf("vptreeStats() without a vptree=%v, want nil", got)
+	}
+}
+
+func TestStoreStats(t *testing.T) {
+
+	loadTestConfig()
+
+	got, ok := storeStats().(simstore.Stats)
+	if !ok {
+		t.Fatalf("storeStats()=%v, want simstore.Stats", storeStats())
+	}
+
+	if got.Entries != len(testSigs) || len(got.Tables) != 49 {
+		t.Errorf("Entries=%d, %d tables, want %d and 49", got.Entries, len(got.Tables), len(testSigs))
+	}
+
+	if _, err := json.Marshal(got); err != nil {
+		t.Errorf("stats can't be published: %v", err)
+	}
+
+	UpdateConfig(&Config{})
+
+	if got := storeStats(); got != nil {
+		t.Errorf("storeStats() without a store=%v, want nil", got)
+	}
+}
+
+func TestTopkMultiHandler(t *testing.T) {
+
+	loadTestConfig()
+
+	body := `[{"id":7,"sig":"1122334455667788"},{"id":8,"sig":"deadbeefcafebabe"},{"id":9,"sig":"0123456789abcdef"}]`
+
+	w := httptest.NewRecorder()
+	topkMultiHandler(w, httptest.NewRequest("POST", "/topk/multi?k=1", strings.NewReader(body)))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status=%d, want %d", w.Code, http.StatusOK)
+	}
+
+	var got []MultiResponse
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatalf("error decoding response: %v", err)
+	}
+
+	want := []MultiResponse{
+		{RequestID: 7, Matches: []hit{{ID: 1}}},
+		{RequestID: 8, Matches: []hit{{ID: 4}}},
+		{RequestID: 9, Matches: []hit{{ID: 5}}},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	w = httptest.NewRecorder()
+	topkMultiHandler(w, httptest.NewRequest("POST", "/topk/multi", strings.NewReader(`[{"id":1,"sig":"xyzzy"}]`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("bad sig: status=%d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+// swapRecorder replaces the current config the first time the response is written to
+type swapRecorder struct {
+	*httptest.ResponseRecorder
+	next *Config
+}
+
+func (s *swapRecorder) Write(b []byte) (int, error) {
+	if s.next != nil {
+		UpdateConfig(s.next)
+		s.next = nil
+	}
+	return s.ResponseRecorder.Write(b)
+}
+
+func TestSnapshotHandler(t *testing.T) {
+
+	loadTestConfig()
+
+	var want bytes.Buffer
+	CurrentConfig().store.(snapshotter).WriteTo(&want)
+
+	// a reload while the snapshot is being streamed
+	next := simstore.New6(1, simstore.NewU64Slice)
+	next.Add(0xdeadbeef, 99)
+	next.Finish()
+
+	w := &swapRecorder{ResponseRecorder: httptest.NewRecorder(), next: &Config{store: next}}
+	snapshotHandler(w, httptest.NewRequest("GET", "/snapshot", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status=%d, want %d", w.Code, http.StatusOK)
+	}
+
+	if CurrentConfig().store != next {
+		t.Fatalf("config was not swapped during the snapshot")
+	}
+
+	if !bytes.Equal(w.Body.Bytes(), want.Bytes()) {
+		t.Errorf("snapshot differs from the store it was started with")
+	}
+
+	if got, want := w.Header().Get("Content-Length"), strconv.Itoa(want.Len()); got != want {
+		t.Errorf("Content-Length=%s, want %s", got, want)
+	}
+
+	if cd := w.Header().Get("Content-Disposition"); !strings.HasPrefix(cd, "attachment; filename=") {
+		t.Errorf("Content-Disposition=%q", cd)
+	}
+
+	UpdateConfig(&Config{store: simstore.New3Small(1)})
+
+	rec := httptest.NewRecorder()
+	snapshotHandler(rec, httptest.NewRequest("GET", "/snapshot", nil))
+	if rec.Code != http.StatusNotImplemented {
+		t.Errorf("small store: status=%d, want %d", rec.Code, http.StatusNotImplemented)
+	}
+}
+
+func TestDryRunReload(t *testing.T) {
+
+	loadTestConfig()
+	cfg := CurrentConfig()
+
+	dir := t.TempDir()
+	input := filepath.Join(dir, "sigs.txt")
+	lines := "1 00000000000000ff\n2 0000000000000fff\nbad 0000000000000001\n3 xyz\n4\n5 000000000000ffff\n"
+	if err := os.WriteFile(input, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := testLoadOptions(input)
+
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "7 0000000000000001\n8 0000000000000002\n")
+	}))
+	defer remote.Close()
+
+	tests := []struct {
+		query string
+		want  ValidationSummary
+	}{
+		{"", ValidationSummary{Lines: 6, Valid: 3, Invalid: 3, Signatures: 3}},
+		{"&input=" + url.QueryEscape(remote.URL), ValidationSummary{Lines: 2, Valid: 2, Signatures: 2}},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		dryRunHandler(rec, httptest.NewRequest("GET", "/reload?dryrun=1"+tt.query, nil), opts)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%q: status=%d, want %d: %s", tt.query, rec.Code, http.StatusOK, rec.Body)
+		}
+
+		var got ValidationSummary
+		if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+
+		if got.EstimatedBytes != estimateBytes(opts, tt.want.Signatures) || got.EstimatedBytes == 0 {
+			t.Errorf("%q: estimated_bytes=%d for %d signatures", tt.query, got.EstimatedBytes, got.Signatures)
+		}
+
+		got.Inputs, got.EstimatedBytes = nil, 0
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: summary=%+v, want %+v", tt.query, got, tt.want)
+		}
+
+		if CurrentConfig() != cfg {
+			t.Errorf("%q: dry run replaced the current config", tt.query)
+		}
+	}
+
+	// the remote dry run must not replace the input file
+	if b, _ := os.ReadFile(input); string(b) != lines {
+		t.Errorf("input file was modified: %q", b)
+	}
+
+	rec := httptest.NewRecorder()
+	dryRunHandler(rec, httptest.NewRequest("GET", "/reload?dryrun=1", nil), testLoadOptions(filepath.Join(dir, "missing.txt")))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("missing input: status=%d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+	if CurrentConfig() != cfg {
+		t.Errorf("failed dry run replaced the current config")
+	}
+}
+
+func TestStructuredLogs(t *testing.T) {
+
+	if _, err := newLogger(io.Discard, "xml"); err == nil {
+		t.Errorf("newLogger accepted an unknown format")
+	}
+
+	input := filepath.Join(t.TempDir(), "sigs.txt")
+	if err := os.WriteFile(input, []byte("1 00000000000000ff\nbad 0000000000000001\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	l, err := newLogger(&buf, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(old *slog.Logger) { logger = old }(logger)
+	logger = l
+
+	if err := loadConfig(testLoadOptions(input)); err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(map[string]map[string]interface{})
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var rec map[string]interface{}
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatalf("log output is not json: %v", err)
+		}
+		event, _ := rec["event"].(string)
+		if event == "" {
+			t.Errorf("record without an event: %v", rec)
+		}
+		events[event] = rec
+	}
+
+	perr := events["parse_error"]
+	if perr["input"] != input || perr["line"] != 2.0 {
+		t.Errorf("parse_error=%v, want input %q and line 2", perr, input)
+	}
+
+	done := events["load_done"]
+	if done["lines"] != 2.0 || done["signatures"] != 1.0 || done["duration"] == nil {
+		t.Errorf("load_done=%v, want 2 lines, 1 signature and a duration", done)
+	}
+}
+
+func TestExcludeList(t *testing.T) {
+
+	dir := t.TempDir()
+
+	input := filepath.Join(dir, "sigs.txt")
+	var buf bytes.Buffer
+	for _, ts := range testSigs {
+		fmt.Fprintf(&buf, "%d %016x\n", ts.id, ts.sig)
+	}
+	if err := os.WriteFile(input, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	excludeList := filepath.Join(dir, "exclude.txt")
+	if err := os.WriteFile(excludeList, []byte("2\n\n4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	exclude, err := loadExcludeList(excludeList)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(exclude) != 2 {
+		t.Fatalf("loaded %d excluded docids, want 2", len(exclude))
+	}
+
+	opts := testLoadOptions(input)
+	opts.exclude = exclude
+
+	if err := loadConfig(opts); err != nil {
+		t.Fatal(err)
+	}
+
+	store := CurrentConfig().store
+	for _, ts := range testSigs {
+		for _, id := range store.Find(ts.sig) {
+			if _, ok := exclude[id]; ok {
+				t.Errorf("Find(%016x) returned excluded docid %d", ts.sig, id)
+			}
+		}
+	}
+
+	if got := CurrentConfig().vptree.Len(); got != len(testSigs)-2 {
+		t.Errorf("vptree has %d items, want %d", got, len(testSigs)-2)
+	}
+
+	sum, err := validateInputs(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum.Excluded != 2 || sum.Signatures != len(testSigs)-2 {
+		t.Errorf("summary=%+v, want 2 excluded", sum)
+	}
+
+	// a missing list excludes nothing
+	exclude, err = loadExcludeList(filepath.Join(dir, "missing.txt"))
+	if err != nil || len(exclude) != 0 {
+		t.Errorf("missing list: exclude=%v err=%v, want nothing excluded", exclude, err)
+	}
+}
+
+func TestLongScans(t *testing.T) {
+
+	input := filepath.Join(t.TempDir(), "sigs.txt")
+	var buf bytes.Buffer
+	for i := 0; i < 100; i++ {
+		// the signatures differ only in their low bits, so they share a
+		// prefix in every table which doesn't use those bits
+		fmt.Fprintf(&buf, "%d %016x\n", i, i)
+	}
+	if err := os.WriteFile(input, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := testLoadOptions(input)
+	opts.longScan = 10
+
+	if err := loadConfig(opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := longScans(); n != uint64(0) {
+		t.Errorf("long_scans=%v before any search, want 0", n)
+	}
+
+	rec := httptest.NewRecorder()
+	searchHandler(rec, formRequest("/search", url.Values{"sig": {"0000000000000000"}}))
+
+	if n, _ := longScans().(uint64); n == 0 {
+		t.Errorf("long_scans=%v after a search of one prefix run, want > 0", n)
+	}
+}
+
+func TestVersionHandler(t *testing.T) {
+
+	defer func(old time.Time) { startedAt = old }(startedAt)
+	startedAt = time.Now().Add(-time.Minute)
+
+	rec := httptest.NewRecorder()
+	versionHandler(rec, httptest.NewRequest("GET", "/version", nil))
+
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type=%q, want application/json", ct)
+	}
+
+	var got VersionResponse
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Version != BuildVersion {
+		t.Errorf("version=%q, want %q", got.Version, BuildVersion)
+	}
+
+	if !got.StartedAt.Equal(startedAt) {
+		t.Errorf("started_at=%v, want %v", got.StartedAt, startedAt)
+	}
+
+	if got.UptimeSeconds < 60 || got.UptimeSeconds > 120 {
+		t.Errorf("uptime_seconds=%v, want about 60", got.UptimeSeconds)
+	}
+}
+
+// TestReloadUnderLoad runs searches continuously while the config is reloaded,
+// in memory and memory-mapped, and checks that every search succeeds with the
+// same results throughout.
+func TestReloadUnderLoad(t *testing.T) {
+
+	dir := t.TempDir()
+
+	input := filepath.Join(dir, "sigs.txt")
+	var buf bytes.Buffer
+	for _, ts := range testSigs {
+		fmt.Fprintf(&buf, "%d %016x\n", ts.id, ts.sig)
+	}
+	if err := os.WriteFile(input, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := testLoadOptions(input)
+	if err := loadConfig(opts); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(searchHandler))
+	defer srv.Close()
+
+	want := make(map[string]string)
+	for _, ts := range testSigs {
+		q := fmt.Sprintf("%016x", ts.sig)
+		rec := httptest.NewRecorder()
+		searchHandler(rec, formRequest("/search", url.Values{"sig": {q}}))
+		want[q] = rec.Body.String()
+	}
+
+	done := make(chan struct{})
+	errs := make(chan error, 1)
+	var searches int
+
+	go func() {
+		defer close(errs)
+		for {
+			for q, w := range want {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				resp, err := http.Get(srv.URL + "/search?sig=" + q)
+				if err != nil {
+					errs <- err
+					return
+				}
+				body, err := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				if resp.StatusCode != http.StatusOK || string(body) != w {
+					errs <- fmt.Errorf("search %s: status=%d body=%q, want %q", q, resp.StatusCode, body, w)
+					return
+				}
+				searches++
+			}
+		}
+	}()
+
+	mmapOpts := opts
+	mmapOpts.mmapDir = dir
+
+	for i := 0; i < 10; i++ {
+		o := opts
+		if i%2 == 0 {
+			o = mmapOpts
+		}
+		if err := loadConfig(o); err != nil {
+			t.Fatalf("reload %d: %v", i, err)
+		}
+		runtime.GC()
+	}
+
+	close(done)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	if searches == 0 {
+		t.Errorf("no searches ran during the reloads")
+	}
+
+	// the snapshots are removed once they are mapped
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.snap")); len(files) != 0 {
+		t.Errorf("snapshot files left behind: %v", files)
+	}
+}
+
+func TestLoadConfigSizes(t *testing.T) {
+
+	input := filepath.Join(t.TempDir(), "sigs.txt")
+	var buf bytes.Buffer
+	for _, ts := range testSigs {
+		fmt.Fprintf(&buf, "%d %016x\n", ts.id, ts.sig)
+	}
+	if err := os.WriteFile(input, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for size := 1; size <= 8; size++ {
+		for _, interpolate := range []bool{false, true} {
+			opts := testLoadOptions(input)
+			opts.storeSize = size
+			opts.useVPTree = false
+			opts.interpolate = interpolate
+
+			if err := loadConfig(opts); err != nil {
+				t.Fatalf("size %d: %v", size, err)
+			}
+
+			// testSigs 1-3 are within distance 2 of each other
+			got := CurrentConfig().store.Find(testSigs[0].sig)
+			want := []uint64{1, 2, 3}
+			if size == 1 {
+				want = []uint64{1, 2}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("size %d, interpolate=%v: Find=%v, want %v", size, interpolate, got, want)
+			}
+		}
+	}
+
+	opts := testLoadOptions(input)
+	opts.storeSize = 9
+	if err := loadConfig(opts); err == nil {
+		t.Errorf("size 9 didn't fail")
+	}
+}
+
+func TestAddHandler(t *testing.T) {
+
+	loadTestConfig()
+
+	add := func(sig, id string) int {
+		w := httptest.NewRecorder()
+		addHandler(w, formRequest("/add", url.Values{"sig": {sig}, "id": {id}}))
+		return w.Code
+	}
+
+	search := func(sig string) []uint64 {
+		w := httptest.NewRecorder()
+		searchHandler(w, httptest.NewRequest("GET", "/search?sig="+sig, nil))
+		var got []uint64
+		json.NewDecoder(w.Body).Decode(&got)
+		return got
+	}
+
+	if code := add("1122334455667780", "6"); code != http.StatusNoContent {
+		t.Fatalf("add: status=%d, want %d", code, http.StatusNoContent)
+	}
+
+	if got, want := search("1122334455667788"), []uint64{1, 2, 3, 6}; !reflect.DeepEqual(got, want) {
+		t.Errorf("search after add=%v, want %v", got, want)
+	}
+
+	topk := func(sig string) []hit {
+		w := httptest.NewRecorder()
+		topkHandler(w, httptest.NewRequest("GET", "/topk?k=1&sig="+sig, nil))
+		var got []hit
+		json.NewDecoder(w.Body).Decode(&got)
+		return got
+	}
+
+	if got, want := topk("1122334455667780"), []hit{{6, 0}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("topk after add=%v, want %v", got, want)
+	}
+
+	compactStore(CurrentConfig())
+
+	if got, want := search("1122334455667788"), []uint64{1, 2, 3, 6}; !reflect.DeepEqual(got, want) {
+		t.Errorf("search after compact=%v, want %v", got, want)
+	}
+
+	add("cafebabedeadbeef", "7")
+
+	rec := httptest.NewRecorder()
+	snapshotHandler(rec, httptest.NewRequest("GET", "/snapshot", nil))
+	if rec.Code != http.StatusOK || rec.Body.Len() == 0 {
+		t.Errorf("snapshot after add: status=%d, %d bytes", rec.Code, rec.Body.Len())
+	}
+
+	for _, tt := range []struct{ sig, id string }{
+		{"", "8"},
+		{"xyz", "8"},
+		{"cafebabedeadbeef", ""},
+		{"cafebabedeadbeef", "-1"},
+	} {
+		if code := add(tt.sig, tt.id); code != http.StatusBadRequest {
+			t.Errorf("add(sig=%q, id=%q): status=%d, want %d", tt.sig, tt.id, code, http.StatusBadRequest)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	addHandler(w, httptest.NewRequest("GET", "/add?sig=cafebabedeadbeef&id=8", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: status=%d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+
+	// an instance with only a vptree
+	UpdateConfig(&Config{vptree: vptree.New(nil)})
+	if code := add("cafebabedeadbeef", "8"); code != http.StatusNoContent {
+		t.Fatalf("add without a store: status=%d, want %d", code, http.StatusNoContent)
+	}
+	if got, want := topk("cafebabedeadbeee"), []hit{{8, 1}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("topk after add without a store=%v, want %v", got, want)
+	}
+}
+
+func TestDocHandler(t *testing.T) {
+
+	loadTestConfig()
+
+	doc := func(id string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		docHandler(w, httptest.NewRequest("GET", "/doc?id="+id, nil))
+		return w
+	}
+
+	w := doc("4")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status=%d, want %d", w.Code, http.StatusOK)
+	}
+	var got DocResponse
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if want := (DocResponse{ID: 4, Signatures: []string{"deadbeefcafebabe"}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("/doc?id=4=%+v, want %+v", got, want)
+	}
+
+	for _, tt := range []struct {
+		id     string
+		status int
+	}{
+		{"9", http.StatusNotFound},
+		{"", http.StatusBadRequest},
+		{"x", http.StatusBadRequest},
+	} {
+		if w := doc(tt.id); w.Code != tt.status {
+			t.Errorf("/doc?id=%s: status=%d, want %d", tt.id, w.Code, tt.status)
+		}
+	}
+}
+
+func TestLoadConfigSnapshot(t *testing.T) {
+
+	loadTestConfig()
+
+	rec := httptest.NewRecorder()
+	snapshotHandler(rec, httptest.NewRequest("GET", "/snapshot", nil))
+
+	path := filepath.Join(t.TempDir(), "store.snap")
+	if err := os.WriteFile(path, rec.Body.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := loadOptions{useStore: true, storeSize: 6, totalMachines: 1, snapshot: path}
+	if err := loadConfig(opts); err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+
+	if got, want := CurrentConfig().store.Find(testSigs[0].sig), []uint64{1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Find=%v, want %v", got, want)
+	}
+
+	opts.mmapSnapshot = true
+	if err := loadConfig(opts); err != nil {
+		t.Fatalf("loadConfig with mmap: %v", err)
+	}
+
+	if got, want := CurrentConfig().store.Find(testSigs[0].sig), []uint64{1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("mapped Find=%v, want %v", got, want)
+	}
+	opts.mmapSnapshot = false
+
+	opts.storeSize = 3
+	if err := loadConfig(opts); err == nil {
+		t.Errorf("loading a size 6 snapshot as size 3 didn't fail")
+	}
+
+	opts.storeSize = 6
+	opts.snapshot = filepath.Join(t.TempDir(), "missing.snap")
+	if err := loadConfig(opts); err == nil {
+		t.Errorf("loading a missing snapshot didn't fail")
+	}
+}
+
+func TestLoadConfigVPTreeSnapshot(t *testing.T) {
+
+	loadTestConfig()
+	want, wantDists := CurrentConfig().vptree.Search(testSigs[0].sig, 3)
+
+	rec := httptest.NewRecorder()
+	vptreeSnapshotHandler(rec, httptest.NewRequest("GET", "/vptree/snapshot", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status=%d, want %d", rec.Code, http.StatusOK)
+	}
+
+	path := filepath.Join(t.TempDir(), "tree.vpt")
+	if err := os.WriteFile(path, rec.Body.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// no inputs: neither the store nor the tree is built from them
+	opts := loadOptions{useVPTree: true, totalMachines: 1, vptreeSnapshot: path}
+	if err := loadConfig(opts); err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+
+	vpt := CurrentConfig().vptree
+	if got, dists := vpt.Search(testSigs[0].sig, 3); vpt.Len() != len(testSigs) || !reflect.DeepEqual(got, want) || !reflect.DeepEqual(dists, wantDists) {
+		t.Errorf("read tree of %d items: Search=%v %v, want %v %v", vpt.Len(), got, dists, want, wantDists)
+	}
+
+	// flattened, it searches and writes the same
+	opts.vptreeFlat = true
+	if err := loadConfig(opts); err != nil {
+		t.Fatalf("loadConfig flat: %v", err)
+	}
+	vpt = CurrentConfig().vptree
+	if got, dists := vpt.Search(testSigs[0].sig, 3); !reflect.DeepEqual(got, want) || !reflect.DeepEqual(dists, wantDists) {
+		t.Errorf("flattened tree: Search=%v %v, want %v %v", got, dists, want, wantDists)
+	}
+	flat := httptest.NewRecorder()
+	vptreeSnapshotHandler(flat, httptest.NewRequest("GET", "/vptree/snapshot", nil))
+	if !bytes.Equal(flat.Body.Bytes(), rec.Body.Bytes()) {
+		t.Errorf("snapshot of the flattened tree differs")
+	}
+	opts.vptreeFlat = false
+
+	opts.vptreeSnapshot = filepath.Join(t.TempDir(), "missing.vpt")
+	if err := loadConfig(opts); err == nil {
+		t.Errorf("loading a missing vptree didn't fail")
+	}
+
+	UpdateConfig(&Config{store: simstore.New3Small(1)})
+	rec = httptest.NewRecorder()
+	vptreeSnapshotHandler(rec, httptest.NewRequest("GET", "/vptree/snapshot", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("no vptree: status=%d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
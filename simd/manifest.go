@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// ShardManifest lists the pre-sharded input files of a corpus split across
+// simd instances with -of.  A remote reload with ?manifest=<url> downloads the
+// manifest, and then only the file for this instance's -no.
+//
+//	{
+//	  "shards": 4,
+//	  "urls": [
+//	    "http://example.com/sigs-0.txt",
+//	    "http://example.com/sigs-1.txt",
+//	    "http://example.com/sigs-2.txt",
+//	    "http://example.com/sigs-3.txt"
+//	  ]
+//	}
+//
+// shards must equal -of, and urls[i] is the file for -no i.  The shard files
+// have the same format as the -f input, and hold exactly the signatures with
+// sig % shards == i, so they are loaded without filtering.
+type ShardManifest struct {
+	Shards int      `json:"shards"`
+	URLs   []string `json:"urls"`
+}
+
+// shardURL returns the url of the file for shard of a corpus split into shards
+func (m ShardManifest) shardURL(shard, shards int) (string, error) {
+
+	if m.Shards != shards {
+		return "", fmt.Errorf("manifest has %d shards, expected %d", m.Shards, shards)
+	}
+
+	if len(m.URLs) != m.Shards {
+		return "", fmt.Errorf("manifest has %d urls for %d shards", len(m.URLs), m.Shards)
+	}
+
+	if shard < 0 || shard >= len(m.URLs) {
+		return "", fmt.Errorf("no shard %d in manifest", shard)
+	}
+
+	return m.URLs[shard], nil
+}
+
+// fetchManifest downloads and parses a shard manifest
+func fetchManifest(manifestUrl string) (ShardManifest, error) {
+
+	var m ShardManifest
+
+	if _, err := url.ParseRequestURI(manifestUrl); err != nil {
+		return m, err
+	}
+
+	resp, err := http.Get(manifestUrl)
+	if err != nil {
+		return m, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return m, fmt.Errorf("fetching manifest %s: %s", manifestUrl, resp.Status)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return m, fmt.Errorf("invalid manifest %s: %v", manifestUrl, err)
+	}
+
+	return m, nil
+}
+
+var errRemoteInputs = errors.New("remote reload requires a single input file")
+
+// remoteInput returns the url to fetch the input file from for a reload
+// request, either given directly with ?input= or looked up in the manifest
+// given with ?manifest=.  It returns "" if the reload isn't remote.  A manifest
+// marks opts as pre-sharded.
+func remoteInput(r *http.Request, opts *loadOptions) (string, int, error) {
+
+	inputUrl := r.FormValue("input")
+	manifestUrl := r.FormValue("manifest")
+
+	if inputUrl == "" && manifestUrl == "" {
+		return "", http.StatusOK, nil
+	}
+
+	if inputUrl != "" && manifestUrl != "" {
+		return "", http.StatusBadRequest, errors.New("only one of input and manifest may be given")
+	}
+
+	if len(opts.inputs) != 1 {
+		return "", http.StatusBadRequest, errRemoteInputs
+	}
+
+	if inputUrl != "" {
+		return inputUrl, http.StatusOK, nil
+	}
+
+	m, err := fetchManifest(manifestUrl)
+	if err != nil {
+		return "", http.StatusBadGateway, err
+	}
+
+	inputUrl, err = m.shardURL(opts.myNumber, opts.totalMachines)
+	if err != nil {
+		return "", http.StatusBadGateway, err
+	}
+
+	opts.presharded = true
+
+	return inputUrl, http.StatusOK, nil
+}
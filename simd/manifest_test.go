@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestManifestReload(t *testing.T) {
+
+	var mu sync.Mutex
+	var fetched []string
+
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched = append(fetched, r.URL.Path)
+		mu.Unlock()
+
+		switch r.URL.Path {
+		case "/manifest.json":
+			json.NewEncoder(w).Encode(ShardManifest{
+				Shards: 2,
+				URLs:   []string{srv.URL + "/shard-0.txt", srv.URL + "/shard-1.txt"},
+			})
+		case "/broken-manifest.json":
+			json.NewEncoder(w).Encode(ShardManifest{
+				Shards: 2,
+				URLs:   []string{srv.URL + "/broken-0.txt", srv.URL + "/broken-1.txt"},
+			})
+		case "/broken-1.txt":
+			http.Error(w, "shard unavailable", http.StatusInternalServerError)
+		case "/bad-manifest.json":
+			json.NewEncoder(w).Encode(ShardManifest{Shards: 3, URLs: []string{"a", "b", "c"}})
+		case "/shard-0.txt":
+			fmt.Fprintf(w, "10 %016x\n12 %016x\n", 10, 12)
+		case "/shard-1.txt":
+			fmt.Fprintf(w, "11 %016x\n13 %016x\n", 11, 13)
+		case "/all.txt":
+			for i := 10; i < 14; i++ {
+				fmt.Fprintf(w, "%d %016x\n", i, i)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	input := filepath.Join(t.TempDir(), "sigs.txt")
+	if err := os.WriteFile(input, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := testLoadOptions(input)
+	opts.myNumber = 1
+	opts.totalMachines = 2
+
+	// the signatures are all within distance 3 of each other
+	docids := func() []uint64 { return CurrentConfig().store.Find(10) }
+
+	reload := func(query url.Values) int {
+		rec := httptest.NewRecorder()
+		reloadHandler(rec, httptest.NewRequest("POST", "/reload?"+query.Encode(), nil), opts)
+		return rec.Code
+	}
+
+	if code := reload(url.Values{"manifest": {srv.URL + "/manifest.json"}}); code != http.StatusOK {
+		t.Fatalf("manifest reload: status=%d", code)
+	}
+
+	if want := []string{"/manifest.json", "/shard-1.txt"}; !reflect.DeepEqual(fetched, want) {
+		t.Errorf("fetched %v, want %v", fetched, want)
+	}
+
+	if got, want := docids(), []uint64{11, 13}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after manifest reload docids=%v, want %v", got, want)
+	}
+
+	cfg := CurrentConfig()
+
+	loaded, err := os.ReadFile(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		query url.Values
+		code  int
+	}{
+		{url.Values{"manifest": {srv.URL + "/bad-manifest.json"}}, http.StatusBadGateway},
+		{url.Values{"manifest": {srv.URL + "/missing.json"}}, http.StatusBadGateway},
+		{url.Values{"manifest": {srv.URL + "/broken-manifest.json"}}, http.StatusBadGateway},
+		{url.Values{"input": {srv.URL + "/broken-1.txt"}}, http.StatusBadGateway},
+		{url.Values{"manifest": {srv.URL + "/manifest.json"}, "input": {srv.URL + "/all.txt"}}, http.StatusBadRequest},
+	} {
+		if code := reload(tt.query); code != tt.code {
+			t.Errorf("%v: status=%d, want %d", tt.query, code, tt.code)
+		}
+		if CurrentConfig() != cfg {
+			t.Errorf("%v: failed reload replaced the config", tt.query)
+		}
+		if got, err := os.ReadFile(input); err != nil || !reflect.DeepEqual(got, loaded) {
+			t.Errorf("%v: failed reload changed the input file to %q, %v", tt.query, got, err)
+		}
+	}
+
+	// the monolithic file is still filtered by shard
+	if code := reload(url.Values{"input": {srv.URL + "/all.txt"}}); code != http.StatusOK {
+		t.Fatalf("input reload: status=%d", code)
+	}
+
+	if got, want := docids(), []uint64{11, 13}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after input reload docids=%v, want %v", got, want)
+	}
+}
@@ -6,14 +6,20 @@ for Web Crawling" by Manku, Jain, and Sarma,
 
     http://www2007.org/papers/paper215.pdf
 
-It is hard-coded for hamming distance 3 or 6.
+New3 and New6 use hand-written table permutations for hamming distance 3 or 6,
+and New generates them for any distance from 1 to 8.
 */
 package simstore
 
 import (
+	"context"
+	"errors"
 	"runtime"
+	"slices"
 	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/dgryski/go-bits"
 )
@@ -25,15 +31,73 @@ type entry struct {
 
 type table []entry
 
-func (t table) Len() int           { return len(t) }
-func (t table) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
-func (t table) Less(i, j int) bool { return t[i].hash < t[j].hash }
+func (t table) Len() int      { return len(t) }
+func (t table) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t table) Less(i, j int) bool {
+	if t[i].hash != t[j].hash {
+		return t[i].hash < t[j].hash
+	}
+	return t[i].docid < t[j].docid
+}
 
-const mask3 = 0xfffffff000000000
+// docTable is a table sorted by document id
+type docTable []entry
+
+func (t docTable) Len() int      { return len(t) }
+func (t docTable) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t docTable) Less(i, j int) bool {
+	if t[i].docid != t[j].docid {
+		return t[i].docid < t[j].docid
+	}
+	return t[i].hash < t[j].hash
+}
+
+func (t docTable) find(docid uint64) []uint64 {
+
+	i := sort.Search(len(t), func(i int) bool { return t[i].docid >= docid })
+
+	var sigs []uint64
+
+	for i < len(t) && t[i].docid == docid {
+		sigs = append(sigs, t[i].hash)
+		i++
+	}
+
+	return sigs
+}
 
-func (t table) find(sig uint64) []uint64 {
+// dedup removes adjacent duplicate entries from a sorted table and returns
+// how many were removed
+func (t *table) dedup() int {
+	tt := *t
+	if len(tt) == 0 {
+		return 0
+	}
+
+	j := 1
+	for i := 1; i < len(tt); i++ {
+		if tt[i] != tt[j-1] {
+			tt[j] = tt[i]
+			j++
+		}
+	}
 
-	i := sort.Search(len(t), func(i int) bool { return t[i].hash >= sig })
+	*t = tt[:j]
+	return len(tt) - j
+}
+
+// search returns the index of the first entry of t whose hash is >= sig,
+// found with interpolation search if interpolate is set
+func (t table) search(sig uint64, interpolate bool) int {
+	if interpolate {
+		return interpolationSearchFunc(len(t), sig, func(i int) uint64 { return t[i].hash })
+	}
+	return sort.Search(len(t), func(i int) bool { return t[i].hash >= sig })
+}
+
+func (t table) find(sig uint64, interpolate bool) []uint64 {
+
+	i := t.search(sig, interpolate)
 
 	var ids []uint64
 
@@ -45,15 +109,50 @@ func (t table) find(sig uint64) []uint64 {
 	return ids
 }
 
-func NewU64Slice(hashes int) u64store {
-	u := make(u64slice, 0, hashes)
-	return &u
+// U64Store is the storage backend for a single permuted table of a Store.  A
+// Store built with New3 or New6 creates one U64Store per table with the
+// StorageFactory it is given, so alternate table implementations can be
+// plugged in without changing the permutation logic.
+//
+// A U64Store holds only the permuted 64-bit hashes; the document ids are kept
+// by the Store itself.  Implementations must satisfy the following:
+//
+// Add is called once for every signature inserted into the Store, with the
+// signature permuted for this table, by Store.Finish.  Add is never called
+// concurrently and is never called after Finish.  Duplicate hashes may be
+// added.
+//
+// Finish is called exactly once, after all the hashes have been added.  It
+// should do whatever sorting or indexing Find needs.  Store.Finish calls the
+// Finish methods of the different tables concurrently.
+//
+// Find is only called after Finish, possibly from several goroutines at once.
+// It returns every stored hash h with h&mask == sig&mask and a hamming
+// distance from sig of d or less, in any order.  Returning duplicate hashes
+// is allowed.  The returned slice must not be retained by the U64Store, as
+// the caller modifies it in place.
+type U64Store interface {
+	Add(hash uint64)
+	Find(sig uint64, mask uint64, d int) []uint64
+	Finish()
 }
 
-type u64store interface {
-	add(hash uint64)
-	find(sig uint64, mask uint64, d int) []uint64
-	finish()
+// ScanCounter is an optional interface for a U64Store which can report how
+// much work a search did.
+type ScanCounter interface {
+	// FindScanned is like Find, but also returns the number of entries
+	// examined by the prefix scan before the distance filter was applied.
+	FindScanned(sig uint64, mask uint64, d int) ([]uint64, int)
+}
+
+// StorageFactory returns a new U64Store with space preallocated for the given
+// number of hashes.
+type StorageFactory func(hashes int) U64Store
+
+// NewU64Slice returns an uncompressed, sorted-slice backed U64Store
+func NewU64Slice(hashes int) U64Store {
+	u := make(u64slice, 0, hashes)
+	return &u
 }
 
 // a store for uint64s
@@ -63,79 +162,404 @@ func (u u64slice) Len() int               { return len(u) }
 func (u u64slice) Less(i int, j int) bool { return u[i] < u[j] }
 func (u u64slice) Swap(i int, j int)      { u[i], u[j] = u[j], u[i] }
 
-func (u u64slice) find(sig, mask uint64, d int) []uint64 {
+func (u u64slice) Find(sig, mask uint64, d int) []uint64 {
+	ids, _ := u.FindScanned(sig, mask, d)
+	return ids
+}
+
+func (u u64slice) FindScanned(sig, mask uint64, d int) ([]uint64, int) {
+	return u.findLimit(nil, sig, mask, d, 0, false)
+}
+
+// findLimit is FindScanned, but appends the hashes found to dst, examines at
+// most limit entries if limit > 0, and finds the start of the prefix run with
+// interpolation search if interpolate is set
+func (u u64slice) findLimit(dst []uint64, sig, mask uint64, d int, limit int, interpolate bool) ([]uint64, int) {
 
 	prefix := sig & mask
-	i := sort.Search(len(u), func(i int) bool { return u[i] >= prefix })
 
-	var ids []uint64
+	var i int
+	if interpolate {
+		i = interpolationSearch(u, prefix)
+	} else {
+		i = sort.Search(len(u), func(i int) bool { return u[i] >= prefix })
+	}
+	start := i
+
+	end := len(u)
+	if limit > 0 && start+limit < end {
+		end = start + limit
+	}
+
+	// find the end of the prefix run, so its distances are computed in one
+	// batch by appendWithin
+	run := u[start:end]
+	run = run[:runLength(run, prefix, mask)]
+
+	return appendWithin(dst, run, sig, d), len(run)
+}
+
+// findAny reports whether any hash in the prefix run of sig is within
+// distance d of it, stopping at the first, examines at most limit entries if
+// limit > 0, and finds the start of the run as findLimit does
+func (u u64slice) findAny(sig, mask uint64, d int, limit int, interpolate bool) bool {
 
-	for i < len(u) && u[i]&mask == prefix {
+	prefix := sig & mask
+
+	var i int
+	if interpolate {
+		i = interpolationSearch(u, prefix)
+	} else {
+		i = sort.Search(len(u), func(i int) bool { return u[i] >= prefix })
+	}
+
+	end := len(u)
+	if limit > 0 && i+limit < end {
+		end = i + limit
+	}
+
+	for ; i < end && u[i]&mask == prefix; i++ {
 		if distance(u[i], sig) <= d {
-			ids = append(ids, u[i])
+			return true
 		}
-		i++
 	}
 
-	return ids
+	return false
 }
 
-func (u *u64slice) add(p uint64) {
+// runLength returns the number of hashes at the start of the sorted slice u
+// with the prefix, which are at least the prefix.  Most runs are short, so it
+// searches ranges doubling in length before a binary search of the last one.
+func runLength(u []uint64, prefix, mask uint64) int {
+
+	lo, hi := 0, 1
+	for hi < len(u) && u[hi]&mask == prefix {
+		lo, hi = hi, 2*hi
+	}
+	if hi > len(u) {
+		hi = len(u)
+	}
+
+	return lo + sort.Search(hi-lo, func(i int) bool { return u[lo+i]&mask != prefix })
+}
+
+// maxInterpolationSteps bounds the number of interpolation steps before
+// interpolationSearch falls back to binary search.  On uniformly distributed
+// signatures a search takes about log2(log2(n)) steps, 5 for 2^32 entries.
+const maxInterpolationSteps = 8
+
+// interpolationSearch returns the index of the first element of the sorted
+// slice u which is >= key, as sort.Search would.  It guesses where key is from
+// its value relative to the ends of the range left, which takes far fewer
+// probes than bisection when the elements are uniformly distributed.  Skewed
+// data can make each guess shrink the range by very little, so after a few
+// steps it falls back to binary search of whatever range is left.
+func interpolationSearch(u []uint64, key uint64) int {
+	return interpolationSearchFunc(len(u), key, func(i int) uint64 { return u[i] })
+}
+
+// interpolationSearchFunc is interpolationSearch of n sorted keys, the ith of
+// which is at(i), such as the hashes of the entries of a table
+func interpolationSearchFunc(n int, key uint64, at func(i int) uint64) int {
+
+	// the answer is in [lo, hi]
+	lo, hi := 0, n
+
+	for steps := 0; hi-lo > 8 && steps < maxInterpolationSteps; steps++ {
+		l, h := at(lo), at(hi-1)
+		if key <= l {
+			return lo
+		}
+		if key > h {
+			return hi
+		}
+
+		// l < key <= h
+		mid := lo + int(float64(key-l)/float64(h-l)*float64(hi-1-lo))
+		if at(mid) < key {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+
+	return lo + sort.Search(hi-lo, func(i int) bool { return at(lo+i) >= key })
+}
+
+func (u *u64slice) Add(p uint64) {
 	*u = append(*u, p)
 }
 
-func (u u64slice) finish() {
+func (u u64slice) Finish() {
 	sort.Sort(u)
 }
 
+func (u *u64slice) dedup() int {
+	uu := *u
+	if len(uu) == 0 {
+		return 0
+	}
+
+	j := 1
+	for i := 1; i < len(uu); i++ {
+		if uu[i] != uu[j-1] {
+			uu[j] = uu[i]
+			j++
+		}
+	}
+
+	*u = uu[:j]
+	return len(uu) - j
+}
+
+// limitedFinder is implemented by U64Stores which can bound the number of
+// entries examined by a prefix scan, and append the hashes found to a slice
+type limitedFinder interface {
+	findLimit(dst []uint64, sig, mask uint64, d int, limit int, interpolate bool) ([]uint64, int)
+}
+
+// anyFinder is implemented by U64Stores which can stop a prefix scan at the
+// first hash within the distance
+type anyFinder interface {
+	findAny(sig, mask uint64, d int, limit int, interpolate bool) bool
+}
+
+// interpolatingFinder is implemented by U64Stores which can find the block
+// holding the start of a prefix run with interpolation search
+type interpolatingFinder interface {
+	findScanned(sig, mask uint64, d int, interpolate bool) ([]uint64, int)
+}
+
+// deduper is implemented by U64Stores which can remove duplicate hashes after
+// Finish has sorted them
+type deduper interface {
+	dedup() int
+}
+
 // Store is a storage engine for 64-bit hashes
 type Store struct {
-	docids  table
-	rhashes []u64store
+	docids   table
+	overflow slabTable // entries added beyond the capacity of docids, until Finish
+	rhashes  []U64Store
+	perm     permutation
+
+	prefixBlocks int // for New, with PrefixBlocks
+	prefixBits   int // for New and New3, with PrefixBits
+	maxTables    int // for New, with MaxTables
+
+	dedup     bool
+	collapsed int
+
+	docSets bool
+	sets    docSets // the signatures with many documents, with DocIDSets
+
+	indexDocIDs bool
+	bydocid     docTable
+
+	orderProbes bool
+	probes      []int     // order in which the tables are searched
+	runLength   []float64 // mean entries per distinct prefix, per table
+
+	prefixFilters bool
+	filters       []*xorFilter // of the prefixes of each table, with PrefixFilters
+
+	maxScan   int
+	longScan  int
+	longScans uint64 // accessed atomically
+
+	interpolate bool
+	sortBatches bool
+
+	mapped []byte // the snapshot a store opened with OpenMmap aliases
+
+	// owner is the store opened with OpenMmap whose mapping a copy made by
+	// Snapshot shares, kept reachable so its finalizer doesn't unmap it
+	owner *Store
+
+	newStore   StorageFactory
+	timestamps bool // Add records the time of each document, with Timestamps
+	hooks      Hooks
+	tombstones
+	wal *WAL // logs the changes to the store, once opened by OpenWAL
+
+	// compactMu is held by Compact and Merge from reading the tables to
+	// swapping in the new ones, so they run one at a time
+	compactMu sync.Mutex
+
+	finished  bool
+	pending   table // entries added after Finish, until Compact
+	buildTime time.Duration
 }
 
-// New3 returns a Store for searching hamming distance <= 3
-func New3(hashes int, newStore func(int) u64store) *Store {
-	s := Store{}
-	s.rhashes = make([]u64store, 16)
-	if hashes != 0 {
-		s.docids = make(table, 0, hashes)
-		for i := range s.rhashes {
-			s.rhashes[i] = newStore(hashes)
-		}
-	}
-	return &s
+// An Option configures a Store when it is created
+type Option func(*Store)
+
+// IndexDocIDs makes Finish build an index from document ids to signatures,
+// used by FindByDocID.  The index needs another 16 bytes per signature.
+func IndexDocIDs() Option {
+	return func(s *Store) { s.indexDocIDs = true }
 }
 
-// Add inserts a signature and document id into the store
-func (s *Store) Add(sig uint64, docid uint64) {
+// Dedup makes Finish collapse duplicate entries.  A signature added more than
+// once with the same document id is stored only once, and repeated signatures
+// are stored once in each permuted table, while all their distinct document
+// ids are kept.
+func Dedup() Option {
+	return func(s *Store) { s.dedup = true }
+}
 
-	var t int
+// OrderProbes makes Finish measure how selective the prefixes of each table are,
+// and searches then probe the tables with the shortest prefix runs first.  This
+// only changes the cost of a search, not its results, but lets an existence
+// check stop after the first few tables on a skewed corpus.
+func OrderProbes() Option {
+	return func(s *Store) { s.orderProbes = true }
+}
 
-	s.docids = append(s.docids, entry{hash: sig, docid: docid})
+// PrefixFilters makes Finish build an xor filter of the distinct prefixes in
+// each table, and a search skips the tables whose filter shows they have no
+// hashes with its prefix.  In a sparse store, where most prefixes are empty,
+// this saves the binary search of most probes that would find nothing.  A
+// filter wrongly passes 1 in 256 absent prefixes, and takes about 1.23 bytes
+// per distinct prefix.  A dense store, where a table has most of the possible
+// prefixes, gains nothing from it.
+func PrefixFilters() Option {
+	return func(s *Store) { s.prefixFilters = true }
+}
 
-	for i := 0; i < 4; i++ {
-		p := sig
-		s.rhashes[t].add(p)
-		t++
+// MaxScan bounds the number of entries a search examines in each table to n.
+// A corpus where many signatures share a table prefix can otherwise make a
+// single search scan millions of entries, but with the bound a search may miss
+// matches in those long prefix runs.  Only tables whose U64Store is created by
+// NewU64Slice are bounded.
+func MaxScan(n int) Option {
+	return func(s *Store) { s.maxScan = n }
+}
 
-		p = (sig & 0xffff000000ffffff) | (sig & 0x0000fff000000000 >> 12) | (sig & 0x0000000fff000000 << 12)
-		s.rhashes[t].add(p)
-		t++
+// LongScanThreshold makes the store count the table probes which examine more
+// than n entries, reported by LongScans.  Counting needs a U64Store which
+// implements ScanCounter.
+func LongScanThreshold(n int) Option {
+	return func(s *Store) { s.longScan = n }
+}
 
-		p = (sig & 0xffff000fff000fff) | (sig & 0x0000fff000000000 >> 24) | (sig & 0x0000000000fff000 << 24)
-		s.rhashes[t].add(p)
-		t++
+// InterpolationSearch makes searches find the prefix in each table with
+// interpolation search rather than binary search.  Signatures from a good hash
+// are uniformly distributed, so this cuts the entries examined to find a
+// prefix from about log2(n) to log2(log2(n)), but a skewed corpus can make it
+// slower.  The tables created by NewU64Slice and NewBucketStore use it to find
+// the prefix, those created by NewZStore, NewDeltaStore and NewBlockStore to
+// find its first block, and the document table to find a signature.
+func InterpolationSearch() Option {
+	return func(s *Store) { s.interpolate = true }
+}
 
-		p = (sig & 0xffff000ffffff000) | (sig & 0x0000fff000000000 >> 36) | (sig & 0x0000000000000fff << 36)
-		s.rhashes[t].add(p)
-		t++
+// SortBatches makes FindAll probe each table with the queries of a batch in
+// the order of their permuted signatures, so consecutive probes touch nearby
+// parts of the table.  This pays for sorting each batch once per table, and
+// helps most when the batch is large compared to the store.
+func SortBatches() Option {
+	return func(s *Store) { s.sortBatches = true }
+}
 
-		sig = (sig << 16) | (sig >> (64 - 16))
+// LongScans returns the number of table probes which examined more entries than
+// the LongScanThreshold option allows.  A probe cut short by MaxScan counts as a
+// long scan if the bound is above the threshold.
+func (s *Store) LongScans() uint64 {
+	return atomic.LoadUint64(&s.longScans)
+}
+
+// probe searches table t for the permuted signature p, applying the scan bound
+// and counting long scans
+func (s *Store) probe(t int, p, mask uint64, d int) []uint64 {
+
+	// a store created empty, which has only had entries added after Finish
+	if s.rhashes[t] == nil || !s.mayHavePrefix(t, p, mask) {
+		return nil
+	}
+
+	if s.maxScan == 0 && s.longScan == 0 && !s.interpolate {
+		return s.rhashes[t].Find(p, mask, d)
+	}
+
+	return s.probeAppend(nil, t, p, mask, d)
+}
+
+// probeAppend is probe, but appends the permuted hashes found to dst.  It
+// only allocates to grow dst, for tables which implement limitedFinder.
+func (s *Store) probeAppend(dst []uint64, t int, p, mask uint64, d int) []uint64 {
+
+	if s.rhashes[t] == nil || !s.mayHavePrefix(t, p, mask) {
+		return dst
 	}
+
+	var scanned int
+
+	switch st := s.rhashes[t].(type) {
+	case limitedFinder:
+		dst, scanned = st.findLimit(dst, p, mask, d, s.maxScan, s.interpolate)
+	case interpolatingFinder:
+		var found []uint64
+		found, scanned = st.findScanned(p, mask, d, s.interpolate)
+		dst = append(dst, found...)
+	case ScanCounter:
+		var found []uint64
+		found, scanned = st.FindScanned(p, mask, d)
+		dst = append(dst, found...)
+	default:
+		return append(dst, st.Find(p, mask, d)...)
+	}
+
+	if s.longScan > 0 && scanned > s.longScan {
+		atomic.AddUint64(&s.longScans, 1)
+	}
+
+	return dst
+}
+
+// permutation describes how a Store spreads signatures across its tables.
+// Each table holds the signatures with a different set of blocks moved to the
+// top bits, so that any signature within the search distance of a query shares
+// a prefix with it in at least one table.
+type permutation interface {
+	// tables returns the number of permuted tables
+	tables() int
+
+	// maxDistance returns the hamming distance the tables can search
+	maxDistance() int
+
+	// shuffle permutes sig for table t, and returns the permuted signature
+	// and the mask of the prefix that must match exactly in that table
+	shuffle(sig uint64, t int) (uint64, uint64)
+
+	// unshuffle reverses shuffle
+	unshuffle(sig uint64, t int) uint64
+}
+
+// perm3 splits a signature into 4 16-bit blocks, and then splits the
+// remaining 48 bits after each block into 4 12-bit blocks, for 16 tables
+type perm3 struct{}
+
+const mask3 = 0xfffffff000000000
+
+func (perm3) tables() int      { return 16 }
+func (perm3) maxDistance() int { return 3 }
+
+func (perm3) shuffle(sig uint64, t int) (uint64, uint64) {
+	const m2 = 0x0000fff000000000
+
+	r := 16 * (uint64(t) / 4)
+	sig = (sig << r) | (sig >> (64 - r))
+
+	shift := 12 * uint64(t%4)
+	m3 := uint64(m2 >> shift)
+	m1 := ^uint64(0) &^ (m2 | m3)
+
+	sig = (sig & m1) | (sig & m2 >> shift) | (sig & m3 << shift)
+	return sig, mask3
 }
 
-func (*Store) unshuffle(sig uint64, t int) uint64 {
+func (perm3) unshuffle(sig uint64, t int) uint64 {
 	const m2 = 0x0000fff000000000
 
 	t4 := t % 4
@@ -148,6 +572,137 @@ func (*Store) unshuffle(sig uint64, t int) uint64 {
 	return sig
 }
 
+// New3 returns a Store for searching hamming distance <= 3.  The tables are
+// created with newStore.
+func New3(hashes int, newStore StorageFactory, opts ...Option) *Store {
+	s := Store{}
+	s.init(hashes, perm3For(optionsOf(opts)), newStore, opts)
+	return &s
+}
+
+// perm3For returns the permutation of New3 with the options of o: perm3,
+// unless the PrefixBits option asks for prefixes which a blockPerm makes in
+// fewer tables, or which are longer than those of perm3
+func perm3For(o *Store) permutation {
+
+	if o.prefixBits == 0 {
+		return perm3{}
+	}
+
+	prefix := 1
+	for prefixBlockBits(64, 3, prefix) < o.prefixBits && validBlocks(3, prefix+1, maxBlocks) {
+		prefix++
+	}
+
+	if o.prefixBits <= int(bits.Popcnt(mask3)) && blockTables(3, prefix) > (perm3{}).tables() {
+		return perm3{}
+	}
+
+	return newBlockPerm(3, prefix)
+}
+
+func (s *Store) init(hashes int, perm permutation, newStore StorageFactory, opts []Option) {
+	for _, o := range opts {
+		o(s)
+	}
+
+	s.perm = perm
+	s.newStore = newStore
+	s.rhashes = make([]U64Store, perm.tables())
+	s.probes = make([]int, perm.tables())
+	for i := range s.probes {
+		s.probes[i] = i
+	}
+	if hashes != 0 {
+		s.docids = make(table, 0, hashes)
+	}
+}
+
+// Add inserts a signature and document id into the store.  Add may be called
+// from several goroutines at once, so a loader can parse its input in
+// parallel.  Before Finish, Add only appends to the document table, which the
+// size hint preallocates, and Finish creates each permuted table with room
+// for exactly the entries added and fills it, one goroutine per table.  A
+// store given too small a size hint isn't grown by copying: the entries past
+// the hint are kept in slabs until Finish.
+//
+// After Finish, the entry goes into a small unsorted table which every search
+// scans, until Compact merges it into the sorted tables.  Add may then be
+// called concurrently with searches.  A deleted docid added again after
+// Finish is found by the signatures added since, but not by its earlier ones.
+func (s *Store) Add(sig uint64, docid uint64) {
+	s.mu.Lock()
+	s.add(entry{hash: sig, docid: docid})
+	var t int64
+	if s.timestamps {
+		now := time.Now()
+		s.stamp(docid, now)
+		t = now.UnixNano()
+	}
+	s.wal.log(walAdd, sig, docid, t)
+	s.mu.Unlock()
+
+	if s.hooks.OnAdd != nil {
+		s.hooks.OnAdd(sig, docid)
+	}
+}
+
+// AddBatch adds each sigs[i] with docids[i], as Add does, but locks the store
+// once for the whole batch.  A loader whose workers each collect the entries
+// of a run of lines and add them with AddBatch scales with the number of
+// workers, where calling Add for each line would keep them waiting for the
+// lock.
+func (s *Store) AddBatch(sigs, docids []uint64) {
+	s.mu.Lock()
+	var now time.Time
+	var t int64
+	if s.timestamps {
+		now = time.Now()
+		t = now.UnixNano()
+	}
+	for i, sig := range sigs {
+		s.add(entry{hash: sig, docid: docids[i]})
+		if s.timestamps {
+			s.stamp(docids[i], now)
+		}
+		s.wal.log(walAdd, sig, docids[i], t)
+	}
+	s.mu.Unlock()
+
+	if s.hooks.OnAdd != nil {
+		for i, sig := range sigs {
+			s.hooks.OnAdd(sig, docids[i])
+		}
+	}
+}
+
+// add adds e to the pending entries of a finished store, or to the document
+// table of an unfinished one.  The caller must hold the lock.
+func (s *Store) add(e entry) {
+	if s.finished {
+		s.readd(e.docid, len(s.pending))
+		s.pending = append(s.pending, e)
+	} else {
+		s.addEntry(e)
+	}
+}
+
+// addEntry adds e to the document table of an unfinished store.  Once the
+// capacity the store was created with is used up, the entries go into slabs
+// instead, which Finish moves into a document table of the right size.  The
+// caller must hold the lock.
+func (s *Store) addEntry(e entry) {
+	if len(s.docids) < cap(s.docids) {
+		s.docids = append(s.docids, e)
+	} else {
+		s.overflow.add(e)
+	}
+}
+
+func (s *Store) unshuffle(sig uint64, t int) uint64 {
+	return s.perm.unshuffle(sig, t)
+}
+
 func (s *Store) unshuffleList(sigs []uint64, t int) []uint64 {
 	for i := range sigs {
 		sigs[i] = s.unshuffle(sigs[i], t)
@@ -165,83 +720,765 @@ func (l limiter) leave() { <-l }
 // the signatures have been added via Add().
 func (s *Store) Finish() {
 
-	// empty store
-	if len(s.docids) == 0 {
+	// empty, memory-mapped, or already finished store
+	if len(s.docids) == 0 && s.overflow.n == 0 || s.finished {
+		s.finished = true
 		return
 	}
 
+	start := time.Now()
+	defer func() {
+		s.finished = true
+		s.buildTime = time.Since(start)
+	}()
+
+	if s.overflow.n > 0 {
+		// more entries were added than the size hint
+		s.docids = s.overflow.moveTo(s.docids)
+	}
+
 	l := make(limiter, runtime.GOMAXPROCS(0))
 
 	var wg sync.WaitGroup
 
 	sort.Sort(s.docids)
 
+	collapsed := make([]int, len(s.rhashes))
+
 	for i := range s.rhashes {
 		l.enter()
 		wg.Add(1)
 		go func(i int) {
-			s.rhashes[i].finish()
+			s.fillTable(i)
+			s.rhashes[i].Finish()
+			if d, ok := s.rhashes[i].(deduper); ok && s.dedup {
+				collapsed[i] = d.dedup()
+			}
 			l.leave()
 			wg.Done()
 		}(i)
 	}
 	wg.Wait()
+
+	for _, n := range collapsed {
+		s.collapsed += n
+	}
+
+	if s.dedup {
+		s.collapsed += s.docids.dedup()
+	}
+
+	if s.indexDocIDs {
+		s.indexByDocID()
+	}
+
+	if s.prefixFilters {
+		s.filters = s.buildFilters(s.rhashes, s.docids)
+	}
+
+	if s.docSets {
+		s.docids, s.sets = groupDocIDs(s.docids)
+	}
+
+	if s.orderProbes {
+		s.sortProbes()
+	}
 }
 
-// Find searches the store for all hashes hamming distance 3 or less from the
-// query signature.  It returns the associated list of document ids.
+// fillTable creates table t, of the size of the document table, and adds the
+// permuted signature of every entry of the document table to it
+func (s *Store) fillTable(t int) {
+	s.rhashes[t] = s.newStore(len(s.docids))
+
+	for _, e := range s.docids {
+		p, _ := s.perm.shuffle(e.hash, t)
+		s.rhashes[t].Add(p)
+	}
+}
+
+// sortProbes orders the table probes by the mean length of their prefix runs,
+// so the tables whose prefixes split the signatures most finely are searched
+// first.
+func (s *Store) sortProbes() {
+
+	s.runLength = make([]float64, len(s.rhashes))
+
+	for t := range s.rhashes {
+		_, mask := s.perm.shuffle(0, t)
+		hashes := s.tableHashes(t)
+
+		prefixes := 0
+		for i, h := range hashes {
+			if i == 0 || h&mask != hashes[i-1]&mask {
+				prefixes++
+			}
+		}
+
+		if prefixes > 0 {
+			s.runLength[t] = float64(len(hashes)) / float64(prefixes)
+		}
+	}
+
+	sort.SliceStable(s.probes, func(i, j int) bool {
+		return s.runLength[s.probes[i]] < s.runLength[s.probes[j]]
+	})
+}
+
+// Contains reports whether any document has a signature within the store's
+// distance of sig.  It stops at the first match instead of collecting the
+// document ids, so it's much cheaper than Find for a duplicate check.
+func (s *Store) Contains(sig uint64) bool {
+	return s.contains(sig, s.perm.maxDistance())
+}
+
+// contains reports whether any signature is within distance d of sig.  It
+// stops at the first table with a match, so the probe order matters, and
+// within a table at the first match if nothing has been deleted.
+func (s *Store) contains(sig uint64, d int) bool {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// empty store
+	if s.entryCount() == 0 && len(s.pending) == 0 {
+		return false
+	}
+
+	for _, h := range s.findPending(sig, d) {
+		if len(s.find(h)) > 0 {
+			return true
+		}
+	}
+
+	for _, t := range s.probes {
+		p, mask := s.perm.shuffle(sig, t)
+		if !s.mayHavePrefix(t, p, mask) {
+			continue
+		}
+
+		if af, ok := s.rhashes[t].(anyFinder); ok && !s.hiding() {
+			if af.findAny(p, mask, d, s.maxScan, s.interpolate) {
+				return true
+			}
+			continue
+		}
+
+		found := s.probe(t, p, mask, d)
+		if !s.hiding() && len(found) > 0 {
+			return true
+		}
+
+		for _, h := range found {
+			if len(s.find(s.unshuffle(h, t))) > 0 {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// indexByDocID builds the index used by FindByDocID
+func (s *Store) indexByDocID() {
+	s.bydocid = make(docTable, len(s.docids))
+	copy(s.bydocid, s.docids)
+	sort.Sort(s.bydocid)
+}
+
+// Collapsed returns the number of duplicate entries removed by Finish from the
+// document table and the permuted tables of a store created with Dedup.
+func (s *Store) Collapsed() int {
+	return s.collapsed
+}
+
+// Find searches the store for all hashes within the store's hamming distance
+// (3 for New3, 6 for New6) of the query signature.  It returns the associated
+// list of document ids in ascending order, so the result for a given store and
+// query is always the same.
 func (s *Store) Find(sig uint64) []uint64 {
+	r, _ := s.Search(context.Background(), Query{Sig: sig})
+	return r.DocIDs
+}
+
+// FindContext is like Find, but checks ctx between table probes and returns
+// its error if it is cancelled before the search completes.  A single probe
+// isn't interrupted, so a scan of a long prefix run still finishes first; the
+// MaxScan option bounds those.
+func (s *Store) FindContext(ctx context.Context, sig uint64) ([]uint64, error) {
+	r, err := s.Search(ctx, Query{Sig: sig})
+	return r.DocIDs, err
+}
+
+// FindAtMost is like Find, but only returns the documents within hamming
+// distance maxd of sig, which must be no larger than the distance the store
+// was built for.  The tables are probed as for Find, but fewer candidates
+// pass the distance check.  FindAtMost with maxd 0 is FindExact.
+func (s *Store) FindAtMost(sig uint64, maxd int) ([]uint64, error) {
+	if maxd < 0 {
+		return nil, nil
+	}
+
+	if maxd == 0 {
+		return s.FindExact(sig), nil
+	}
+
+	r, err := s.Search(context.Background(), Query{Sig: sig, MaxDist: maxd})
+	return r.DocIDs, err
+}
+
+// Match is a document found by FindWithDistance
+type Match struct {
+	DocID    uint64
+	Distance int // hamming distance from the query signature
+}
+
+// FindWithDistance is like Find, but returns the hamming distance from sig of
+// the signature of each document found.  A document added with several
+// signatures within the distance of sig is returned once for each of them.
+// The matches are sorted by distance, then by docid, so the result for a given
+// store and query is always the same.
+func (s *Store) FindWithDistance(sig uint64) []Match {
+	r, _ := s.Search(context.Background(), Query{Sig: sig, Sorted: true})
+
+	var m []Match
+	for i, id := range r.DocIDs {
+		m = append(m, Match{DocID: id, Distance: r.Distances[i]})
+	}
+
+	return m
+}
+
+// Query describes a search of a Store.  The zero value of each option selects
+// the default behaviour.
+type Query struct {
+	// Sig is the signature to search for
+	Sig uint64
+
+	// MaxDist is the maximum hamming distance of the results.  Zero means
+	// the distance the store was built for; it can't be larger than that.
+	MaxDist int
+
+	// Limit is the maximum number of results returned.  Zero means no limit.
+	Limit int
+
+	// Sorted orders the results by distance from Sig, then by docid,
+	// instead of just by docid.
+	Sorted bool
+}
+
+// Result holds the matches for a Query
+type Result struct {
+	// DocIDs are the matching document ids
+	DocIDs []uint64
+
+	// Distances[i] is the hamming distance from the query to DocIDs[i]
+	Distances []int
+}
+
+type byDocID Result
+
+func (r byDocID) Len() int { return len(r.DocIDs) }
+func (r byDocID) Swap(i, j int) {
+	r.DocIDs[i], r.DocIDs[j] = r.DocIDs[j], r.DocIDs[i]
+	r.Distances[i], r.Distances[j] = r.Distances[j], r.Distances[i]
+}
+func (r byDocID) Less(i, j int) bool {
+	if r.DocIDs[i] != r.DocIDs[j] {
+		return r.DocIDs[i] < r.DocIDs[j]
+	}
+	return r.Distances[i] < r.Distances[j]
+}
+
+type byDistance struct{ byDocID }
+
+func (r byDistance) Less(i, j int) bool {
+	if r.Distances[i] != r.Distances[j] {
+		return r.Distances[i] < r.Distances[j]
+	}
+	return r.DocIDs[i] < r.DocIDs[j]
+}
+
+// MaxDistance returns the largest hamming distance the store can search
+func (s *Store) MaxDistance() int {
+	return s.perm.maxDistance()
+}
+
+// ErrMaxDistance is returned by Search for a query distance the store's
+// tables can't answer
+var ErrMaxDistance = errors.New("simstore: query distance larger than store distance")
+
+// Search runs the query against the store.  The context is checked between
+// table probes, and its error is returned if it is cancelled before the search
+// completes.
+func (s *Store) Search(ctx context.Context, q Query) (Result, error) {
+
+	if s.hooks.OnFind == nil {
+		r, _, err := s.search(ctx, q)
+		return r, err
+	}
+
+	start := time.Now()
+	r, candidates, err := s.search(ctx, q)
+	if err == nil {
+		s.hooks.OnFind(time.Since(start), candidates, len(r.DocIDs))
+	}
+	return r, err
+}
+
+// search runs the query, and also returns the number of signatures found in
+// the tables
+func (s *Store) search(ctx context.Context, q Query) (Result, int, error) {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	d := s.perm.maxDistance()
+	if q.MaxDist > d {
+		return Result{}, 0, ErrMaxDistance
+	}
+	if q.MaxDist > 0 {
+		d = q.MaxDist
+	}
+
+	// empty store
+	if s.entryCount() == 0 && len(s.pending) == 0 {
+		return Result{}, 0, nil
+	}
+
+	ids := s.findPending(q.Sig, d)
+
+	for _, t := range s.probes {
+		if err := ctx.Err(); err != nil {
+			return Result{}, 0, err
+		}
+
+		p, mask := s.perm.shuffle(q.Sig, t)
+		ids = append(ids, s.unshuffleList(s.probe(t, p, mask, d), t)...)
+	}
+
+	return s.result(ids, q), len(ids), nil
+}
+
+// result returns the Result of q for the matching signatures ids.  The caller
+// must hold the lock.
+func (s *Store) result(ids []uint64, q Query) Result {
+
+	ids = unique(ids)
+
+	var r Result
+	for _, v := range ids {
+		docids := s.find(v)
+		r.DocIDs = append(r.DocIDs, docids...)
+		for range docids {
+			r.Distances = append(r.Distances, distance(v, q.Sig))
+		}
+	}
+
+	if q.Sorted {
+		sort.Sort(byDistance{byDocID(r)})
+	} else {
+		sort.Sort(byDocID(r))
+	}
+
+	if q.Limit > 0 && len(r.DocIDs) > q.Limit {
+		r.DocIDs = r.DocIDs[:q.Limit]
+		r.Distances = r.Distances[:q.Limit]
+	}
+
+	return r
+}
+
+// FindAll searches the store for each of sigs, and returns the result Find
+// would give for sigs[i] in element i.  The lock is taken once for the whole
+// batch, and the queries are split between GOMAXPROCS goroutines.
+func (s *Store) FindAll(sigs []uint64) [][]uint64 {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	res := make([][]uint64, len(sigs))
+
+	// empty store
+	if s.entryCount() == 0 && len(s.pending) == 0 {
+		return res
+	}
+
+	workers := runtime.GOMAXPROCS(0)
+	chunk := (len(sigs) + workers - 1) / workers
+
+	var wg sync.WaitGroup
+	for lo := 0; lo < len(sigs); lo += chunk {
+		hi := lo + chunk
+		if hi > len(sigs) {
+			hi = len(sigs)
+		}
+
+		wg.Add(1)
+		go func(lo, hi int) {
+			s.findBatch(sigs[lo:hi], res[lo:hi])
+			wg.Done()
+		}(lo, hi)
+	}
+	wg.Wait()
+
+	return res
+}
+
+// findBatch stores the result of Find for each of sigs in res.  The caller
+// must hold the lock.
+func (s *Store) findBatch(sigs []uint64, res [][]uint64) {
+
+	d := s.perm.maxDistance()
+
+	found := make([][]uint64, len(sigs))
+	for i, sig := range sigs {
+		found[i] = s.findPending(sig, d)
+	}
+
+	permuted := make([]uint64, len(sigs))
+	order := make([]int, len(sigs))
+
+	for _, t := range s.probes {
+		var mask uint64
+		for i, sig := range sigs {
+			permuted[i], mask = s.perm.shuffle(sig, t)
+			order[i] = i
+		}
+
+		if s.sortBatches {
+			sort.Slice(order, func(i, j int) bool { return permuted[order[i]] < permuted[order[j]] })
+		}
+
+		for _, i := range order {
+			found[i] = append(found[i], s.unshuffleList(s.probe(t, permuted[i], mask, d), t)...)
+		}
+	}
+
+	for i, sig := range sigs {
+		res[i] = s.result(found[i], Query{Sig: sig}).DocIDs
+	}
+}
+
+// FindParallel is like Find, but probes the tables concurrently on the
+// workers of pool, which cuts the latency of a single search on an otherwise
+// idle machine.  Under a full load of concurrent searches it only adds
+// overhead, as the workers are already busy.  FindParallel must not be called
+// from a function running on pool.
+func (s *Store) FindParallel(sig uint64, pool *Pool) []uint64 {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
 	// empty store
-	if len(s.docids) == 0 {
+	if s.entryCount() == 0 && len(s.pending) == 0 {
 		return nil
 	}
 
+	d := s.perm.maxDistance()
+
+	found := make([][]uint64, len(s.rhashes))
+
+	var wg sync.WaitGroup
+	wg.Add(len(s.probes))
+	for _, t := range s.probes {
+		t := t
+		pool.Go(func() {
+			p, mask := s.perm.shuffle(sig, t)
+			found[t] = s.unshuffleList(s.probe(t, p, mask, d), t)
+			wg.Done()
+		})
+	}
+	wg.Wait()
+
+	ids := s.findPending(sig, d)
+	for _, f := range found {
+		ids = append(ids, f...)
+	}
+
+	return s.result(ids, Query{Sig: sig}).DocIDs
+}
+
+// FindN is like Find, but stops searching once it has found n distinct
+// document ids.  The result is a subset of the result of Find, sorted by docid,
+// and not necessarily the n closest matches: which documents are returned
+// depends on the order the tables are probed.  Use Search with Sorted and
+// Limit for the closest matches.  FindN returns nil if n <= 0.
+func (s *Store) FindN(sig uint64, n int) []uint64 {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// empty store
+	if (s.entryCount() == 0 && len(s.pending) == 0) || n <= 0 {
+		return nil
+	}
+
+	d := s.perm.maxDistance()
+
+	seen := make(map[uint64]struct{})
+	docids := make(map[uint64]struct{})
+
+	// add finds the docids of h, and reports whether there are now n
+	add := func(h uint64) bool {
+		if _, ok := seen[h]; ok {
+			return false
+		}
+		seen[h] = struct{}{}
+
+		for _, id := range s.find(h) {
+			docids[id] = struct{}{}
+			if len(docids) == n {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, h := range s.findPending(sig, d) {
+		if add(h) {
+			break
+		}
+	}
+
+probes:
+	for _, t := range s.probes {
+		if len(docids) == n {
+			break
+		}
+
+		p, mask := s.perm.shuffle(sig, t)
+		for _, h := range s.probe(t, p, mask, d) {
+			if add(s.unshuffle(h, t)) {
+				break probes
+			}
+		}
+	}
+
+	ids := make([]uint64, 0, len(docids))
+	for id := range docids {
+		ids = append(ids, id)
+	}
+
+	sort.Sort(u64slice(ids))
+
+	return ids
+}
+
+// FindScanned is like Find, but also returns the number of table entries
+// examined by the prefix scans before the distance filter was applied.  The
+// ratio of scanned entries to matches shows how selective the table prefixes
+// are for a given corpus.  Tables whose U64Store does not implement
+// ScanCounter only count their matches.
+func (s *Store) FindScanned(sig uint64) ([]uint64, int) {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// empty store
+	if s.entryCount() == 0 && len(s.pending) == 0 {
+		return nil, 0
+	}
+
+	d := s.perm.maxDistance()
+
+	ids := s.findPending(sig, d)
+	scanned := len(s.pending)
+
+	for _, t := range s.probes {
+		if s.rhashes[t] == nil {
+			continue
+		}
+
+		p, mask := s.perm.shuffle(sig, t)
+		if !s.mayHavePrefix(t, p, mask) {
+			continue
+		}
+
+		var found []uint64
+		if sc, ok := s.rhashes[t].(ScanCounter); ok {
+			var n int
+			found, n = sc.FindScanned(p, mask, d)
+			scanned += n
+		} else {
+			found = s.rhashes[t].Find(p, mask, d)
+			scanned += len(found)
+		}
+
+		ids = append(ids, s.unshuffleList(found, t)...)
+	}
+
+	return s.lookup(ids), scanned
+}
+
+// FindExact returns the sorted document ids stored with exactly the query
+// signature.  It does a single binary search of the document table instead of
+// the prefix scans of all the permuted tables done by Find.
+func (s *Store) FindExact(sig uint64) []uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.find(sig)
+}
+
+// find returns the sorted ids of the documents with exactly the signature sig
+// which haven't been deleted.  The caller must hold the lock.
+func (s *Store) find(sig uint64) []uint64 {
+
+	ids := s.docids.find(sig, s.interpolate)
+	if set := s.sets.find(sig); set != nil {
+		ids = set.appendTo(ids)
+	}
+	ids = s.live(sig, ids)
+
+	if n := len(ids); len(s.pending) > 0 {
+		for i, e := range s.pending {
+			if e.hash == sig && (!s.hiding() || !s.hiddenPending(i, e)) {
+				ids = append(ids, e.docid)
+			}
+		}
+		if len(ids) > n {
+			ids = unique(ids)
+		}
+	}
+
+	return ids
+}
+
+// findPending returns the signatures added after Finish within distance d of
+// sig.  The caller must hold the lock.
+func (s *Store) findPending(sig uint64, d int) []uint64 {
+	var sigs []uint64
+	for _, e := range s.pending {
+		if distance(e.hash, sig) <= d {
+			sigs = append(sigs, e.hash)
+		}
+	}
+	return sigs
+}
+
+// FindByDocID searches the store for the near-duplicates of a document already
+// in the store.  It returns the sorted document ids matching any of the
+// signatures added with docid, excluding docid itself, or nil if docid isn't in
+// the store.  Without the IndexDocIDs option, finding the signatures of docid
+// requires a scan of the entire store.
+func (s *Store) FindByDocID(docid uint64) []uint64 {
+
+	sigs := s.SignaturesOf(docid)
+
 	var ids []uint64
+	for _, sig := range sigs {
+		for _, id := range s.Find(sig) {
+			if id != docid {
+				ids = append(ids, id)
+			}
+		}
+	}
 
-	// TODO(dgryski): search in parallel
-	var t int
-	for i := 0; i < 4; i++ {
-		p := sig
-		ids = append(ids, s.unshuffleList(s.rhashes[t].find(p, mask3, 3), t)...)
-		t++
+	ids = unique(ids)
 
-		p = (sig & 0xffff000000ffffff) | (sig & 0x0000fff000000000 >> 12) | (sig & 0x0000000fff000000 << 12)
-		ids = append(ids, s.unshuffleList(s.rhashes[t].find(p, mask3, 3), t)...)
-		t++
+	return ids
+}
 
-		p = (sig & 0xffff000fff000fff) | (sig & 0x0000fff000000000 >> 24) | (sig & 0x0000000000fff000 << 24)
-		ids = append(ids, s.unshuffleList(s.rhashes[t].find(p, mask3, 3), t)...)
-		t++
+// SignaturesOf returns the sorted signatures added with docid, or nil if docid
+// isn't in the store or has been deleted.  The IndexDocIDs option keeps the
+// index it searches; without it, it scans the entire store.
+func (s *Store) SignaturesOf(docid uint64) []uint64 {
 
-		p = (sig & 0xffff000ffffff000) | (sig & 0x0000fff000000000 >> 36) | (sig & 0x0000000000000fff << 36)
-		ids = append(ids, s.unshuffleList(s.rhashes[t].find(p, mask3, 3), t)...)
-		t++
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-		sig = (sig << 16) | (sig >> (64 - 16))
+	// a deleted docid added again since Finish only has its later entries
+	start, readded := s.readded[docid]
+	if readded && s.expired(docid) || !readded && s.isDeleted(docid) {
+		return nil
 	}
 
+	var sigs []uint64
+	switch {
+	case readded:
+	case s.indexDocIDs:
+		sigs = s.bydocid.find(docid)
+	default:
+		for _, e := range s.docids {
+			if e.docid == docid {
+				sigs = append(sigs, e.hash)
+			}
+		}
+		for i, set := range s.sets.sets {
+			if set.contains(docid) {
+				sigs = append(sigs, s.sets.hashes[i])
+			}
+		}
+	}
+	for _, e := range s.pending[start:] {
+		if e.docid == docid {
+			sigs = append(sigs, e.hash)
+		}
+	}
+
+	return unique(sigs)
+}
+
+// Range calls fn with the signature and document id of each entry of the
+// store which hasn't been deleted, until fn returns false.  The entries are in
+// order of signature and then docid, followed by those added since Finish in
+// the order they were added.  A store only keeps its canonical table, so
+// Range can export an index without the input it was built from.  The store's
+// lock is held while fn runs, so fn must not modify the store.
+func (s *Store) Range(fn func(sig, docid uint64) bool) {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.rangeTables(fn, s.entries()) {
+		s.rangePending(fn, s.pending)
+	}
+}
+
+// lookup returns the sorted document ids for the list of matching hashes
+func (s *Store) lookup(ids []uint64) []uint64 {
+
 	ids = unique(ids)
 
 	var docids []uint64
 	for _, v := range ids {
-		docids = append(docids, s.docids.find(v)...)
+		docids = append(docids, s.find(v)...)
 	}
 
+	sort.Sort(u64slice(docids))
+
 	return docids
 }
 
-// SmallStore3 is a simstore for distance k=3 with smaller memory requirements
+// SmallStore3 is a simstore for distance k=3 with smaller memory requirements.
+//
+// Instead of the 16 permuted tables of Store, it keeps 4 copies of each
+// (signature, docid) entry, bucketed by one of the four 16-bit blocks of the
+// signature.  Any signature within distance 3 of the query must match it
+// exactly in at least one block, so Find only has to scan 4 buckets.  This
+// uses roughly 64 bytes per signature instead of 144, but each bucket holds
+// about n/2^16 entries, compared to the n/2^28 candidates examined per table
+// by Store, so queries against large stores are slower.
 type SmallStore3 struct {
 	tables [4][1 << 16]table
+	tombstones
+	finished  bool
+	buildTime time.Duration
+	collapsed int
 }
 
+// New3Small returns a SmallStore3 for searching hamming distance <= 3
 func New3Small(hashes int) *SmallStore3 {
 	return &SmallStore3{}
 }
 
+// Add inserts a signature and document id into the store.  Add may be called
+// from several goroutines at once, and after Finish concurrently with
+// searches.
 func (s *SmallStore3) Add(sig uint64, docid uint64) {
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	for i := 0; i < 4; i++ {
 		prefix := (sig & 0xffff000000000000) >> (64 - 16)
 		s.tables[i][prefix] = append(s.tables[i][prefix], entry{hash: sig, docid: docid})
@@ -249,44 +1486,69 @@ func (s *SmallStore3) Add(sig uint64, docid uint64) {
 	}
 }
 
+// Find searches the store for all hashes hamming distance 3 or less from the
+// query signature.  It returns the associated list of document ids in
+// ascending order.
 func (s *SmallStore3) Find(sig uint64) []uint64 {
+	ids, _ := s.FindScanned(sig)
+	return ids
+}
+
+// FindScanned is like Find, but also returns the number of entries examined
+// in the scanned buckets.
+func (s *SmallStore3) FindScanned(sig uint64) ([]uint64, int) {
 	var ids []uint64
+	var scanned int
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	for i := 0; i < 4; i++ {
 		prefix := (sig & 0xffff000000000000) >> (64 - 16)
 
 		t := s.tables[i][prefix]
+		scanned += len(t)
 
 		for i := range t {
-			if distance(t[i].hash, sig) <= 3 {
+			if distance(t[i].hash, sig) <= 3 && !s.isDeleted(t[i].docid) {
 				ids = append(ids, t[i].docid)
 			}
 		}
 		sig = (sig << 16) | (sig >> (64 - 16))
 	}
-	return unique(ids)
+
+	ids = unique(ids)
+
+	return ids, scanned
 }
 
+// Finish prepares the store for searching.  This must be called once after all
+// the signatures have been added via Add().  Entries added more than once with
+// the same signature and document id are stored once.
 func (s *SmallStore3) Finish() {
+	start := time.Now()
 	for i := range s.tables {
 		for p := range s.tables[i] {
 			sort.Sort(s.tables[i][p])
+			s.collapsed += s.tables[i][p].dedup()
 		}
 	}
+	s.finished = true
+	s.buildTime = time.Since(start)
 }
 
+// unique sorts ids and removes the duplicates in place.  Sorting doesn't
+// allocate, unlike collecting the ids in a map, and the callers want the
+// result sorted anyway.
 func unique(ids []uint64) []uint64 {
-	// dedup ids
-	uniq := make(map[uint64]struct{})
-	for _, id := range ids {
-		uniq[id] = struct{}{}
-	}
-
-	ids = ids[:0]
-	for k := range uniq {
-		ids = append(ids, k)
-	}
+	return ids[:sortUnique(ids)]
+}
 
-	return ids
+// sortUnique sorts u and moves its distinct values to the front, and returns
+// how many there are
+func sortUnique(u []uint64) int {
+	slices.Sort(u)
+	return len(slices.Compact(u))
 }
 
 // distance returns the hamming distance between v1 and v2
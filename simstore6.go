@@ -1,102 +1,86 @@
 package simstore
 
+import (
+	"sort"
+	"time"
+)
+
+// Storage is the interface implemented by all the stores in this package
 type Storage interface {
+	// Add inserts a signature and document id.  Add may be called from
+	// several goroutines at once.  Signatures added after Finish are
+	// searchable immediately.
 	Add(sig, docid uint64)
 	Find(sig uint64) []uint64
 	Finish()
+
+	// Delete removes docid from the results of later searches
+	Delete(docid uint64)
+
+	// Len returns the number of entries in the store, including those
+	// added since Finish and those of deleted docids not yet compacted away
+	Len() int
+
+	// Stats describes the contents and size of the store
+	Stats() Stats
 }
 
+// BatchAdder is implemented by the stores which can add a batch of entries
+// at once, locking the store once for the batch instead of once per entry, so
+// the workers of a loader don't wait for each other on every line
+type BatchAdder interface {
+	// AddBatch adds each sigs[i] with docids[i], as Add does
+	AddBatch(sigs, docids []uint64)
+}
+
+// Store6 is a storage engine for 64-bit hashes searching hamming distance <= 6
 type Store6 struct {
 	Store
 }
 
-func New6(hashes int, newStore func(hashes int) u64store) *Store6 {
+// New6 returns a Store6 for searching hamming distance <= 6.  The tables are
+// created with newStore.
+func New6(hashes int, newStore StorageFactory, opts ...Option) *Store6 {
 	var s Store6
-	s.rhashes = make([]u64store, 49)
-
-	if hashes != 0 {
-		s.docids = make(table, 0, hashes)
-		for i := range s.rhashes {
-			s.rhashes[i] = newStore(hashes)
-		}
-	}
-
+	s.init(hashes, perm6{}, newStore, opts)
 	return &s
 }
 
-// Add inserts a signature and document id into the store
-func (s *Store6) Add(sig uint64, docid uint64) {
-	t := 0
-
-	var p uint64
-
-	s.docids = append(s.docids, entry{hash: sig, docid: docid})
+// perm6 splits a signature into 6 9-bit blocks and a final 10-bit block, and
+// then splits the remaining bits after each block into 7 blocks of 8 or 7 bits,
+// for 49 tables
+type perm6 struct{}
 
-	for i := 0; i < 6; i++ {
-		p = sig
-		s.rhashes[t].add(p)
-		t++
-		p = (sig & 0xff80007fffffffff) | (sig & 0x007f800000000000 >> 8) | (sig & 0x00007f8000000000 << 8)
-		s.rhashes[t].add(p)
-		t++
-		p = (sig & 0xff807f807fffffff) | (sig & 0x007f800000000000 >> 16) | (sig & 0x0000007f80000000 << 16)
-		s.rhashes[t].add(p)
-		t++
-		p = (sig & 0xff807fff807fffff) | (sig & 0x007f800000000000 >> 24) | (sig & 0x000000007f800000 << 24)
-		s.rhashes[t].add(p)
-		t++
-		p = (sig & 0xff807fffff807fff) | (sig & 0x007f800000000000 >> 32) | (sig & 0x00000000007f8000 << 32)
-		s.rhashes[t].add(p)
-		t++
-		p = (sig & 0xff807fffffff807f) | (sig & 0x007f800000000000 >> 40) | (sig & 0x0000000000007f80 << 40)
-		s.rhashes[t].add(p)
-		t++
-		p = (sig & 0xff80ffffffffff80) | (sig & 0x007f000000000000 >> 48) | (sig & 0x000000000000007f << 48)
-		s.rhashes[t].add(p)
-		t++
-		sig = (sig << 9) | (sig >> (64 - 9))
-	}
+const mask6_9_8 = 0xffff800000000000
+const mask6_9_7 = 0xffff000000000000
+const mask6_10_8 = 0xffffc00000000000
+const mask6_10_7 = 0xffff800000000000
 
-	p = sig
-	s.rhashes[t].add(p)
-	t++
-	p = (sig & 0xffc0003fffffffff) | (sig & 0x003fc00000000000 >> 8) | (sig & 0x00003fc000000000 << 8)
-	s.rhashes[t].add(p)
-	t++
-	p = (sig & 0xffc03fc03fffffff) | (sig & 0x003fc00000000000 >> 16) | (sig & 0x0000003fc0000000 << 16)
-	s.rhashes[t].add(p)
-	t++
-	p = (sig & 0xffc03fffc03fffff) | (sig & 0x003fc00000000000 >> 24) | (sig & 0x000000003fc00000 << 24)
-	s.rhashes[t].add(p)
-	t++
-	p = (sig & 0xffc03fffffc03fff) | (sig & 0x003fc00000000000 >> 32) | (sig & 0x00000000003fc000 << 32)
-	s.rhashes[t].add(p)
-	t++
-	p = (sig & 0xffc07fffffffc07f) | (sig & 0x003f800000000000 >> 40) | (sig & 0x0000000000003f80 << 40)
-	s.rhashes[t].add(p)
-	t++
-	p = (sig & 0xffc07fffffffff80) | (sig & 0x003f800000000000 >> 47) | (sig & 0x000000000000007f << 47)
-	s.rhashes[t].add(p)
-}
+func (perm6) tables() int      { return 49 }
+func (perm6) maxDistance() int { return 6 }
 
-func (*Store6) unshuffle(sig uint64, t int) uint64 {
+// block returns the mask of the block swapped into the prefix for table t,
+// how far it is shifted, and the prefix mask for the table
+func (perm6) block(t int) (m2 uint64, shift uint64, mask uint64) {
 
 	t7 := t % 7
-	shift := 8 * uint64(t7)
-
-	var m2 uint64
+	shift = 8 * uint64(t7)
 
 	if t < 42 {
 		m2 = 0x007f800000000000
+		mask = mask6_9_8
 
 		if t7 == 6 {
 			m2 = 0x007f000000000000
+			mask = mask6_9_7
 		}
 	} else {
 		m2 = 0x003fc00000000000
+		mask = mask6_10_8
 
 		if t7 >= 5 {
 			m2 = 0x003f800000000000
+			mask = mask6_10_7
 
 			if t7 == 6 {
 				shift--
@@ -104,6 +88,27 @@ func (*Store6) unshuffle(sig uint64, t int) uint64 {
 		}
 	}
 
+	return m2, shift, mask
+}
+
+func (p perm6) shuffle(sig uint64, t int) (uint64, uint64) {
+
+	m2, shift, mask := p.block(t)
+
+	r := 9 * (uint64(t) / 7)
+	sig = (sig << r) | (sig >> (64 - r))
+
+	m3 := uint64(m2 >> shift)
+	m1 := ^uint64(0) &^ (m2 | m3)
+
+	sig = (sig & m1) | (sig & m2 >> shift) | (sig & m3 << shift)
+	return sig, mask
+}
+
+func (p perm6) unshuffle(sig uint64, t int) uint64 {
+
+	m2, shift, _ := p.block(t)
+
 	m3 := uint64(m2 >> shift)
 	m1 := ^uint64(0) &^ (m2 | m3)
 
@@ -112,89 +117,99 @@ func (*Store6) unshuffle(sig uint64, t int) uint64 {
 	return sig
 }
 
-func (s *Store6) unshuffleList(sigs []uint64, t int) []uint64 {
-	for i := range sigs {
-		sigs[i] = s.unshuffle(sigs[i], t)
-	}
+// SmallStore6 is a simstore for distance k=6 with smaller memory requirements.
+//
+// It applies the SmallStore3 layout to the blocks used by Store6: the
+// signature is split into six 9-bit blocks and one 10-bit block, and each
+// (signature, docid) entry is stored 7 times, bucketed by one of those blocks.
+// Any signature within distance 6 of the query must match it exactly in at
+// least one block.  This uses roughly 112 bytes per signature instead of the
+// 408 needed by Store6, but each bucket holds about n/2^9 entries, compared
+// to the n/2^17 candidates examined per table by Store6, so every query scans
+// a much larger candidate set.
+type SmallStore6 struct {
+	tables [7][1 << 10]table
+	tombstones
+	finished  bool
+	buildTime time.Duration
+	collapsed int
+}
 
-	return sigs
+// New6Small returns a SmallStore6 for searching hamming distance <= 6
+func New6Small(hashes int) *SmallStore6 {
+	return &SmallStore6{}
 }
 
-const mask6_9_8 = 0xffff800000000000
-const mask6_9_7 = 0xffff000000000000
-const mask6_10_8 = 0xffffc00000000000
-const mask6_10_7 = 0xffff800000000000
+// Add inserts a signature and document id into the store.  Add may be called
+// from several goroutines at once, and after Finish concurrently with
+// searches.
+func (s *SmallStore6) Add(sig uint64, docid uint64) {
 
-// Find searches the store for all hashes hamming distance 6 or less from the
-// query signature.  It returns the associated list of document ids.
-func (s *Store6) Find(sig uint64) []uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	// empty store
-	if len(s.docids) == 0 {
-		return nil
+	for i := 0; i < 6; i++ {
+		prefix := (sig & 0xff80000000000000) >> (64 - 9)
+		s.tables[i][prefix] = append(s.tables[i][prefix], entry{hash: sig, docid: docid})
+		sig = (sig << 9) | (sig >> (64 - 9))
 	}
 
+	prefix := (sig & 0xffc0000000000000) >> (64 - 10)
+	s.tables[6][prefix] = append(s.tables[6][prefix], entry{hash: sig, docid: docid})
+}
+
+// Find searches the store for all hashes hamming distance 6 or less from the
+// query signature.  It returns the associated list of document ids in
+// ascending order.
+func (s *SmallStore6) Find(sig uint64) []uint64 {
+	ids, _ := s.FindScanned(sig)
+	return ids
+}
+
+// FindScanned is like Find, but also returns the number of entries examined
+// in the scanned buckets.
+func (s *SmallStore6) FindScanned(sig uint64) ([]uint64, int) {
 	var ids []uint64
+	var scanned int
 
-	// TODO(dgryski): search in parallel
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	t := 0
+	for i := 0; i < 7; i++ {
+		var prefix uint64
+		if i < 6 {
+			prefix = (sig & 0xff80000000000000) >> (64 - 9)
+		} else {
+			prefix = (sig & 0xffc0000000000000) >> (64 - 10)
+		}
 
-	var p uint64
+		t := s.tables[i][prefix]
+		scanned += len(t)
 
-	for i := 0; i < 6; i++ {
-		p = sig
-		ids = append(ids, s.unshuffleList(s.rhashes[t].find(p, mask6_9_8, 6), t)...)
-		t++
-		p = (sig & 0xff80007fffffffff) | (sig & 0x007f800000000000 >> 8) | (sig & 0x00007f8000000000 << 8)
-		ids = append(ids, s.unshuffleList(s.rhashes[t].find(p, mask6_9_8, 6), t)...)
-		t++
-		p = (sig & 0xff807f807fffffff) | (sig & 0x007f800000000000 >> 16) | (sig & 0x0000007f80000000 << 16)
-		ids = append(ids, s.unshuffleList(s.rhashes[t].find(p, mask6_9_8, 6), t)...)
-		t++
-		p = (sig & 0xff807fff807fffff) | (sig & 0x007f800000000000 >> 24) | (sig & 0x000000007f800000 << 24)
-		ids = append(ids, s.unshuffleList(s.rhashes[t].find(p, mask6_9_8, 6), t)...)
-		t++
-		p = (sig & 0xff807fffff807fff) | (sig & 0x007f800000000000 >> 32) | (sig & 0x00000000007f8000 << 32)
-		ids = append(ids, s.unshuffleList(s.rhashes[t].find(p, mask6_9_8, 6), t)...)
-		t++
-		p = (sig & 0xff807fffffff807f) | (sig & 0x007f800000000000 >> 40) | (sig & 0x0000000000007f80 << 40)
-		ids = append(ids, s.unshuffleList(s.rhashes[t].find(p, mask6_9_8, 6), t)...)
-		t++
-		p = (sig & 0xff80ffffffffff80) | (sig & 0x007f000000000000 >> 48) | (sig & 0x000000000000007f << 48)
-		ids = append(ids, s.unshuffleList(s.rhashes[t].find(p, mask6_9_7, 6), t)...)
-		t++
+		for i := range t {
+			if distance(t[i].hash, sig) <= 6 && !s.isDeleted(t[i].docid) {
+				ids = append(ids, t[i].docid)
+			}
+		}
 		sig = (sig << 9) | (sig >> (64 - 9))
 	}
 
-	p = sig
-	ids = append(ids, s.unshuffleList(s.rhashes[t].find(p, mask6_10_8, 6), t)...)
-	t++
-	p = (sig & 0xffc0003fffffffff) | (sig & 0x003fc00000000000 >> 8) | (sig & 0x00003fc000000000 << 8)
-	ids = append(ids, s.unshuffleList(s.rhashes[t].find(p, mask6_10_8, 6), t)...)
-	t++
-	p = (sig & 0xffc03fc03fffffff) | (sig & 0x003fc00000000000 >> 16) | (sig & 0x0000003fc0000000 << 16)
-	ids = append(ids, s.unshuffleList(s.rhashes[t].find(p, mask6_10_8, 6), t)...)
-	t++
-	p = (sig & 0xffc03fffc03fffff) | (sig & 0x003fc00000000000 >> 24) | (sig & 0x000000003fc00000 << 24)
-	ids = append(ids, s.unshuffleList(s.rhashes[t].find(p, mask6_10_8, 6), t)...)
-	t++
-	p = (sig & 0xffc03fffffc03fff) | (sig & 0x003fc00000000000 >> 32) | (sig & 0x00000000003fc000 << 32)
-	ids = append(ids, s.unshuffleList(s.rhashes[t].find(p, mask6_10_8, 6), t)...)
-	t++
-	p = (sig & 0xffc07fffffffc07f) | (sig & 0x003f800000000000 >> 40) | (sig & 0x0000000000003f80 << 40)
-	ids = append(ids, s.unshuffleList(s.rhashes[t].find(p, mask6_10_7, 6), t)...)
-	t++
-	p = (sig & 0xffc07fffffffff80) | (sig & 0x003f800000000000 >> 47) | (sig & 0x000000000000007f << 47)
-	ids = append(ids, s.unshuffleList(s.rhashes[t].find(p, mask6_10_7, 6), t)...)
-	t++
-
 	ids = unique(ids)
 
-	var docids []uint64
-	for _, v := range ids {
-		docids = append(docids, s.docids.find(v)...)
-	}
+	return ids, scanned
+}
 
-	return docids
+// Finish prepares the store for searching.  This must be called once after all
+// the signatures have been added via Add().  Entries added more than once with
+// the same signature and document id are stored once.
+func (s *SmallStore6) Finish() {
+	start := time.Now()
+	for i := range s.tables {
+		for p := range s.tables[i] {
+			sort.Sort(s.tables[i][p])
+			s.collapsed += s.tables[i][p].dedup()
+		}
+	}
+	s.finished = true
+	s.buildTime = time.Since(start)
 }
@@ -2,6 +2,7 @@ package simstore
 
 import (
 	"math/rand"
+	"reflect"
 	"testing"
 )
 
@@ -78,3 +79,52 @@ func testAdd(t *testing.T, s Storage, size, queries, d int) {
 		t.Logf("fails = %f", 100*float64(fails)/float64(queries))
 	}
 }
+
+func TestSmall6(t *testing.T) {
+
+	const size = 100000
+
+	s := New6(size, NewU64Slice)
+	small := New6Small(size)
+
+	rand.Seed(0)
+
+	var sigs []uint64
+	for i := 0; i < size; i++ {
+		sig := uint64(rand.Int63())
+		sigs = append(sigs, sig)
+		s.Add(sig, uint64(i))
+		small.Add(sig, uint64(i))
+	}
+
+	// a cluster of near-duplicates so some queries have many matches
+	sig := uint64(0x001122334455667788)
+	for i := 0; i < 100; i++ {
+		q := sig
+		for j := 0; j < rand.Intn(7); j++ {
+			q ^= 1 << uint(rand.Intn(64))
+		}
+		s.Add(q, uint64(size+i))
+		small.Add(q, uint64(size+i))
+	}
+
+	s.Finish()
+	small.Finish()
+
+	for i := 0; i < 1000; i++ {
+		q := sig
+		if i%2 == 0 {
+			q = sigs[rand.Intn(len(sigs))]
+		}
+
+		for j := 0; j < rand.Intn(8); j++ {
+			q ^= 1 << uint(rand.Intn(64))
+		}
+
+		want := s.Find(q)
+		got := small.Find(q)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("New6Small.Find(%016x)=%v, want %v", q, got, want)
+		}
+	}
+}
@@ -1,6 +1,13 @@
 package simstore
 
 import (
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"testing/quick"
 )
@@ -10,6 +17,7 @@ func TestUnshuffle(t *testing.T) {
 	f := func(hash uint64) bool {
 		s := New3(1, NewU64Slice)
 		s.Add(hash, 0)
+		s.Finish()
 
 		for i := range s.rhashes {
 			if got := s.unshuffle((*s.rhashes[i].(*u64slice))[0], i); got != hash {
@@ -28,6 +36,7 @@ func TestUnshuffle6(t *testing.T) {
 	f := func(hash uint64) bool {
 		s := New6(1, NewU64Slice)
 		s.Add(hash, 0)
+		s.Finish()
 
 		for i := range s.rhashes {
 			if got := s.unshuffle((*s.rhashes[i].(*u64slice))[0], i); got != hash {
@@ -40,3 +49,1132 @@ func TestUnshuffle6(t *testing.T) {
 
 	quick.Check(f, nil)
 }
+
+func TestFindOrder(t *testing.T) {
+
+	stores := []struct {
+		name string
+		s    Storage
+		d    int
+	}{
+		{"New3", New3(1000, NewU64Slice), 3},
+		{"New3Small", New3Small(1000), 3},
+		{"New6", New6(1000, NewU64Slice), 6},
+		{"New6Small", New6Small(1000), 6},
+	}
+
+	for _, tt := range stores {
+		rand.Seed(0)
+
+		for i := 0; i < 1000; i++ {
+			tt.s.Add(uint64(rand.Int63()), uint64(i))
+		}
+
+		sig := uint64(0x001122334455667788)
+		for i := 0; i < 50; i++ {
+			q := sig
+			for j := 0; j < tt.d; j++ {
+				q ^= 1 << uint(rand.Intn(64))
+			}
+			tt.s.Add(q, uint64(rand.Int63()))
+		}
+
+		tt.s.Finish()
+
+		want := tt.s.Find(sig)
+		if len(want) == 0 {
+			t.Fatalf("%s: Find(%016x) returned no results", tt.name, sig)
+		}
+
+		for i := 1; i < len(want); i++ {
+			if want[i-1] > want[i] {
+				t.Errorf("%s: results not in ascending order: %v", tt.name, want)
+				break
+			}
+		}
+
+		for i := 0; i < 20; i++ {
+			got := tt.s.Find(sig)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: Find(%016x)=%v, want %v", tt.name, sig, got, want)
+				break
+			}
+		}
+	}
+}
+
+func TestFindScanned(t *testing.T) {
+
+	stores := []struct {
+		name string
+		s    interface {
+			Storage
+			FindScanned(sig uint64) ([]uint64, int)
+		}
+	}{
+		{"New3", New3(10000, NewU64Slice)},
+		{"New3Z", New3(10000, NewZStore)},
+		{"New3Small", New3Small(10000)},
+		{"New6", New6(10000, NewU64Slice)},
+		{"New6Small", New6Small(10000)},
+	}
+
+	for _, tt := range stores {
+		rand.Seed(0)
+
+		var sigs []uint64
+		for i := 0; i < 10000; i++ {
+			sig := uint64(rand.Int63())
+			sigs = append(sigs, sig)
+			tt.s.Add(sig, uint64(i))
+		}
+
+		tt.s.Finish()
+
+		for i := 0; i < 100; i++ {
+			q := sigs[rand.Intn(len(sigs))] ^ (1 << uint(rand.Intn(64)))
+
+			want := tt.s.Find(q)
+			got, scanned := tt.s.FindScanned(q)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: FindScanned(%016x)=%v, want %v", tt.name, q, got, want)
+			}
+
+			if scanned < len(got) {
+				t.Errorf("%s: FindScanned(%016x) scanned %d entries for %d matches", tt.name, q, scanned, len(got))
+			}
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+
+	s := New3(1000, NewU64Slice)
+
+	rand.Seed(0)
+
+	for i := 0; i < 1000; i++ {
+		s.Add(uint64(rand.Int63()), uint64(i))
+	}
+
+	sig := uint64(0x001122334455667788)
+	s.Add(sig, 2000)
+	s.Add(sig^0x1, 2003)
+	s.Add(sig^0x3, 2001)
+	s.Add(sig^0x7, 2002)
+
+	s.Finish()
+
+	ctx := context.Background()
+
+	tests := []struct {
+		q     Query
+		want  []uint64
+		wantd []int
+	}{
+		{Query{Sig: sig}, []uint64{2000, 2001, 2002, 2003}, []int{0, 2, 3, 1}},
+		{Query{Sig: sig, Sorted: true}, []uint64{2000, 2003, 2001, 2002}, []int{0, 1, 2, 3}},
+		{Query{Sig: sig, MaxDist: 2}, []uint64{2000, 2001, 2003}, []int{0, 2, 1}},
+		{Query{Sig: sig, Limit: 2}, []uint64{2000, 2001}, []int{0, 2}},
+		{Query{Sig: sig, Sorted: true, Limit: 2}, []uint64{2000, 2003}, []int{0, 1}},
+	}
+
+	for _, tt := range tests {
+		r, err := s.Search(ctx, tt.q)
+		if err != nil {
+			t.Errorf("Search(%+v) failed: %v", tt.q, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(r.DocIDs, tt.want) || !reflect.DeepEqual(r.Distances, tt.wantd) {
+			t.Errorf("Search(%+v)=%v %v, want %v %v", tt.q, r.DocIDs, r.Distances, tt.want, tt.wantd)
+		}
+	}
+
+	if r, _ := s.Search(ctx, Query{Sig: sig}); !reflect.DeepEqual(r.DocIDs, s.Find(sig)) {
+		t.Errorf("Search()=%v, Find()=%v", r.DocIDs, s.Find(sig))
+	}
+
+	for d, want := range [][]uint64{{2000}, {2000, 2003}, {2000, 2001, 2003}, {2000, 2001, 2002, 2003}} {
+		if got, err := s.FindAtMost(sig, d); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("FindAtMost(%d)=%v, %v, want %v", d, got, err, want)
+		}
+	}
+
+	if _, err := s.FindAtMost(sig, 4); err != ErrMaxDistance {
+		t.Errorf("FindAtMost(4) err=%v, want %v", err, ErrMaxDistance)
+	}
+
+	wantm := []Match{{2000, 0}, {2003, 1}, {2001, 2}, {2002, 3}}
+	if m := s.FindWithDistance(sig); !reflect.DeepEqual(m, wantm) {
+		t.Errorf("FindWithDistance()=%v, want %v", m, wantm)
+	}
+
+	if m := s.FindWithDistance(^sig); m != nil {
+		t.Errorf("FindWithDistance() with no matches=%v, want nil", m)
+	}
+
+	if _, err := s.Search(ctx, Query{Sig: sig, MaxDist: 4}); err != ErrMaxDistance {
+		t.Errorf("Search(MaxDist: 4) err=%v, want %v", err, ErrMaxDistance)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+
+	if _, err := s.Search(cctx, Query{Sig: sig}); err != context.Canceled {
+		t.Errorf("Search() with cancelled context err=%v, want %v", err, context.Canceled)
+	}
+
+	if ids, err := s.FindContext(cctx, sig); err != context.Canceled || ids != nil {
+		t.Errorf("FindContext() with cancelled context=%v, %v, want nil, %v", ids, err, context.Canceled)
+	}
+
+	if ids, err := s.FindContext(ctx, sig); err != nil || !reflect.DeepEqual(ids, s.Find(sig)) {
+		t.Errorf("FindContext()=%v, %v, want %v", ids, err, s.Find(sig))
+	}
+}
+
+func TestDedup(t *testing.T) {
+
+	const sig = 0x001122334455667788
+
+	// the same signature and docid added twice
+	s := New3(10, NewU64Slice, Dedup())
+	s.Add(sig, 1)
+	s.Add(sig, 1)
+	s.Add(0xdeadbeefcafebabe, 2)
+	s.Finish()
+
+	if got, want := s.Find(sig), []uint64{1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Find()=%v, want %v", got, want)
+	}
+
+	// one duplicate in the document table and one in each of the 16 permuted tables
+	if got, want := s.Collapsed(), 17; got != want {
+		t.Errorf("Collapsed()=%d, want %d", got, want)
+	}
+
+	// the same signature with different docids
+	s = New3(10, NewU64Slice, Dedup())
+	s.Add(sig, 1)
+	s.Add(sig, 2)
+	s.Add(sig, 1)
+	s.Finish()
+
+	if got, want := s.Find(sig), []uint64{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Find()=%v, want %v", got, want)
+	}
+
+	// one (sig, 1) pair plus two repeated hashes in each of the 16 permuted tables
+	if got, want := s.Collapsed(), 1+2*16; got != want {
+		t.Errorf("Collapsed()=%d, want %d", got, want)
+	}
+
+	// without the option nothing is collapsed
+	s = New3(10, NewU64Slice)
+	s.Add(sig, 1)
+	s.Add(sig, 1)
+	s.Finish()
+
+	if got, want := s.Find(sig), []uint64{1, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Find()=%v, want %v", got, want)
+	}
+
+	if got := s.Collapsed(); got != 0 {
+		t.Errorf("Collapsed()=%d, want 0", got)
+	}
+
+	// the small stores always collapse repeated (sig, docid) pairs
+	for _, small := range []interface {
+		Storage
+		Collapsed() int
+	}{New3Small(10), New6Small(10)} {
+		small.Add(sig, 1)
+		small.Add(sig, 1)
+		small.Add(sig, 2)
+		small.Finish()
+
+		if got, want := small.Find(sig), []uint64{1, 2}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%T: Find()=%v, want %v", small, got, want)
+		}
+
+		// one duplicate in each table
+		if got, want := small.Collapsed(), len(small.Stats().Tables); got != want {
+			t.Errorf("%T: Collapsed()=%d, want %d", small, got, want)
+		}
+	}
+}
+
+func TestFindByDocID(t *testing.T) {
+
+	for _, opts := range [][]Option{nil, {IndexDocIDs()}} {
+		s := New3(1000, NewU64Slice, opts...)
+
+		rand.Seed(0)
+
+		for i := 0; i < 1000; i++ {
+			s.Add(uint64(rand.Int63()), uint64(i))
+		}
+
+		const sig1 = 0x001122334455667788
+		const sig2 = 0xdeadbeefcafebabe
+
+		// document 2000 has two signatures
+		s.Add(sig1, 2000)
+		s.Add(sig2, 2000)
+
+		s.Add(sig1^0x1, 2001)
+		s.Add(sig1^0x3, 2002)
+		s.Add(sig2^0x7, 2003)
+		s.Add(sig2^0xf, 2004)
+
+		s.Finish()
+
+		if got, want := s.FindByDocID(2000), []uint64{2001, 2002, 2003}; !reflect.DeepEqual(got, want) {
+			t.Errorf("opts=%d: FindByDocID(2000)=%v, want %v", len(opts), got, want)
+		}
+
+		if got, want := s.FindByDocID(2001), []uint64{2000, 2002}; !reflect.DeepEqual(got, want) {
+			t.Errorf("opts=%d: FindByDocID(2001)=%v, want %v", len(opts), got, want)
+		}
+
+		if got := s.FindByDocID(3000); got != nil {
+			t.Errorf("opts=%d: FindByDocID(3000)=%v, want nil", len(opts), got)
+		}
+
+		if got, want := s.SignaturesOf(2000), []uint64{sig1, sig2}; !reflect.DeepEqual(got, want) {
+			t.Errorf("opts=%d: SignaturesOf(2000)=%x, want %x", len(opts), got, want)
+		}
+
+		// a signature added after Finish
+		s.Add(0xff, 2001)
+		if got, want := s.SignaturesOf(2001), []uint64{0xff, sig1 ^ 0x1}; !reflect.DeepEqual(got, want) {
+			t.Errorf("opts=%d: SignaturesOf(2001)=%x, want %x", len(opts), got, want)
+		}
+
+		s.Delete(2000)
+		for _, id := range []uint64{2000, 3000} {
+			if got := s.SignaturesOf(id); got != nil {
+				t.Errorf("opts=%d: SignaturesOf(%d)=%x, want nil", len(opts), id, got)
+			}
+		}
+	}
+}
+
+func TestRange(t *testing.T) {
+
+	for _, opts := range [][]Option{nil, {DocIDSets()}} {
+		s := New3(1000, NewU64Slice, opts...)
+
+		r := rand.New(rand.NewSource(0))
+
+		var want table
+		for i := 0; i < 1000; i++ {
+			sig := uint64(r.Int63())
+			if i%10 == 0 {
+				// a signature shared by enough documents for a docid set
+				sig = 0xff
+			}
+			s.Add(sig, uint64(i))
+			want = append(want, entry{sig, uint64(i)})
+		}
+		s.Finish()
+		sort.Sort(want)
+
+		s.Add(0xfe, 2000)
+		want = append(want, entry{0xfe, 2000})
+
+		s.Delete(10)
+		for i, e := range want {
+			if e.docid == 10 {
+				want = append(want[:i], want[i+1:]...)
+				break
+			}
+		}
+
+		var got table
+		s.Range(func(sig, docid uint64) bool {
+			got = append(got, entry{sig, docid})
+			return true
+		})
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("opts=%d: Range returned %d entries, want %d", len(opts), len(got), len(want))
+		}
+
+		var n int
+		s.Range(func(sig, docid uint64) bool {
+			n++
+			return n < 5
+		})
+		if n != 5 {
+			t.Errorf("opts=%d: Range called fn %d times, want 5", len(opts), n)
+		}
+	}
+}
+
+// verifyBanding checks that every stored signature is found when searching for
+// it with up to d bits flipped.  All 1- and 2-bit perturbations are checked;
+// larger ones are sampled.
+func verifyBanding(t *testing.T, name string, s Storage, d int) {
+
+	rand.Seed(0)
+
+	const sigs = 64
+	const samples = 200
+
+	var stored []uint64
+	for i := 0; i < sigs; i++ {
+		sig := uint64(rand.Int63())
+		stored = append(stored, sig)
+		s.Add(sig, uint64(i))
+	}
+
+	s.Finish()
+
+	check := func(docid int, q uint64) {
+		for _, id := range s.Find(q) {
+			if id == uint64(docid) {
+				return
+			}
+		}
+		sig := stored[docid]
+		t.Errorf("%s: Find(%016x) missing %016x (diff=%064b)", name, q, sig, sig^q)
+	}
+
+	for i, sig := range stored {
+		for b1 := uint(0); b1 < 64; b1++ {
+			check(i, sig^(1<<b1))
+			for b2 := b1 + 1; b2 < 64; b2++ {
+				check(i, sig^(1<<b1)^(1<<b2))
+			}
+		}
+
+		for bits := 3; bits <= d; bits++ {
+			for j := 0; j < samples; j++ {
+				q := sig
+				for _, b := range rand.Perm(64)[:bits] {
+					q ^= 1 << uint(b)
+				}
+				check(i, q)
+			}
+		}
+	}
+}
+
+func TestBanding3(t *testing.T) {
+	verifyBanding(t, "New3", New3(64, NewU64Slice), 3)
+	verifyBanding(t, "New3Small", New3Small(64), 3)
+}
+
+func TestBanding6(t *testing.T) {
+	verifyBanding(t, "New6", New6(64, NewU64Slice), 6)
+	verifyBanding(t, "New6Small", New6Small(64), 6)
+}
+
+func TestFindExact(t *testing.T) {
+
+	s := New6(10000, NewU64Slice)
+
+	rand.Seed(0)
+
+	var sigs []uint64
+	for i := 0; i < 10000; i++ {
+		sig := uint64(rand.Int63())
+		sigs = append(sigs, sig)
+		s.Add(sig, uint64(i))
+	}
+
+	// some exact duplicates, and some near-duplicates that must not be returned
+	for i := 0; i < 100; i++ {
+		sig := sigs[rand.Intn(len(sigs))]
+		s.Add(sig, uint64(20000+i))
+		s.Add(sig^1, uint64(30000+i))
+	}
+
+	s.Finish()
+
+	ctx := context.Background()
+
+	for i := 0; i < 1000; i++ {
+		q := sigs[rand.Intn(len(sigs))]
+		if i%2 == 1 {
+			q ^= 1 << uint(rand.Intn(64))
+		}
+
+		r, _ := s.Search(ctx, Query{Sig: q})
+
+		var want []uint64
+		for j, d := range r.Distances {
+			if d == 0 {
+				want = append(want, r.DocIDs[j])
+			}
+		}
+
+		if got := s.FindExact(q); !reflect.DeepEqual(got, want) {
+			t.Errorf("FindExact(%016x)=%v, want %v", q, got, want)
+		}
+	}
+}
+
+func TestContains(t *testing.T) {
+
+	r := rand.New(rand.NewSource(0))
+
+	sigs := make([]uint64, 10000)
+	for i := range sigs {
+		sigs[i] = uint64(r.Int63())
+	}
+
+	for _, tt := range []struct {
+		name string
+		s    *Store
+	}{
+		{"New3", New3(len(sigs), NewU64Slice)},
+		{"New6", &New6(len(sigs), NewU64Slice).Store},
+		{"ZStore", New3(len(sigs), NewZStore)},
+	} {
+		s := tt.s
+		for i, sig := range sigs {
+			s.Add(sig, uint64(i))
+		}
+		s.Finish()
+
+		check := func(q uint64) {
+			t.Helper()
+			if got, want := s.Contains(q), len(s.Find(q)) > 0; got != want {
+				t.Errorf("%s: Contains(%016x)=%v, want %v", tt.name, q, got, want)
+			}
+		}
+
+		queries := make([]uint64, 1000)
+		for i := range queries {
+			q := sigs[r.Intn(len(sigs))]
+			for j := r.Intn(8); j > 0; j-- {
+				q ^= 1 << uint(r.Intn(64))
+			}
+			queries[i] = q
+		}
+
+		for _, q := range queries {
+			check(q)
+		}
+
+		// a signature added after Finish, and one whose only document is
+		// deleted, which needs the slower search
+		s.Add(0xff, 1<<20)
+		s.Delete(0)
+
+		check(0xff ^ 3)
+		check(sigs[0])
+		for _, q := range queries[:100] {
+			check(q)
+		}
+	}
+}
+
+// skewedSignatures returns signatures where half of them share their top 16
+// bits, so the tables which use those bits as a prefix have long prefix runs
+func skewedSignatures(r *rand.Rand, n int) []uint64 {
+	sigs := make([]uint64, n)
+	for i := range sigs {
+		sigs[i] = uint64(r.Int63())
+		if i%2 == 0 {
+			sigs[i] &= 0x0000ffffffffffff
+		}
+	}
+	return sigs
+}
+
+func TestOrderProbes(t *testing.T) {
+
+	r := rand.New(rand.NewSource(0))
+	sigs := skewedSignatures(r, 10000)
+
+	fixed := New3(len(sigs), NewU64Slice)
+	ordered := New3(len(sigs), NewU64Slice, OrderProbes())
+	for i, sig := range sigs {
+		fixed.Add(sig, uint64(i))
+		ordered.Add(sig, uint64(i))
+	}
+	fixed.Finish()
+	ordered.Finish()
+
+	// the tables with the shared 16 bits in their prefix go last
+	seen := make(map[int]bool)
+	for i, tbl := range ordered.probes {
+		seen[tbl] = true
+		if i >= len(ordered.probes)-4 && tbl >= 4 {
+			t.Errorf("probes=%v, want tables 0-3 last", ordered.probes)
+			break
+		}
+	}
+	if len(seen) != len(ordered.probes) {
+		t.Errorf("probes=%v is not a permutation of the tables", ordered.probes)
+	}
+
+	for i := 0; i < 1000; i++ {
+		q := sigs[r.Intn(len(sigs))]
+		for j := r.Intn(6); j > 0; j-- {
+			q ^= 1 << uint(r.Intn(64))
+		}
+
+		want := fixed.Find(q)
+		if got := ordered.Find(q); !reflect.DeepEqual(got, want) {
+			t.Errorf("ordered Find(%016x)=%v, want %v", q, got, want)
+		}
+
+		if got := ordered.contains(q, 3); got != (len(want) > 0) {
+			t.Errorf("contains(%016x)=%v, want %v", q, got, len(want) > 0)
+		}
+	}
+}
+
+// BenchmarkOrderProbes compares the fixed and selectivity-ordered probe orders
+// for existence checks and full searches, on a skewed corpus where nearly every
+// query has a match.
+//
+//	go test -run=NONE -bench=OrderProbes -benchsigs=10000000
+func BenchmarkOrderProbes(b *testing.B) {
+
+	r := rand.New(rand.NewSource(0))
+	sigs := skewedSignatures(r, *benchSigs)
+
+	queries := make([]uint64, 1<<12)
+	for i := range queries {
+		q := sigs[r.Intn(len(sigs))]
+		for j := r.Intn(4); j > 0; j-- {
+			q ^= 1 << uint(r.Intn(64))
+		}
+		queries[i] = q
+	}
+
+	for _, order := range []struct {
+		name string
+		opts []Option
+	}{
+		{"fixed", nil},
+		{"ordered", []Option{OrderProbes()}},
+	} {
+		s := New3(len(sigs), NewU64Slice, order.opts...)
+		for i, sig := range sigs {
+			s.Add(sig, uint64(i))
+		}
+		s.Finish()
+
+		b.Run(order.name+"/contains", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				s.contains(queries[i%len(queries)], 3)
+			}
+		})
+
+		b.Run(order.name+"/find", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				s.Find(queries[i%len(queries)])
+			}
+		})
+	}
+}
+
+func TestMaxScan(t *testing.T) {
+
+	// a degenerate corpus where every signature shares its top 28 bits, so
+	// the first table is a single prefix run
+	const prefix = 0xabcdef1 << 36
+
+	r := rand.New(rand.NewSource(0))
+	sigs := make([]uint64, 100000)
+	for i := range sigs {
+		sigs[i] = prefix | uint64(r.Int63())>>28
+	}
+
+	u := make(u64slice, len(sigs))
+	copy(u, sigs)
+	u.Finish()
+
+	if _, n := u.FindScanned(sigs[0], mask3, 3); n != len(sigs) {
+		t.Errorf("unbounded scan examined %d entries, want %d", n, len(sigs))
+	}
+
+	if _, n := u.findLimit(nil, sigs[0], mask3, 3, 100, false); n != 100 {
+		t.Errorf("bounded scan examined %d entries, want 100", n)
+	}
+
+	s := New3(len(sigs), NewU64Slice, MaxScan(100), LongScanThreshold(50))
+	for i, sig := range sigs {
+		s.Add(sig, uint64(i))
+	}
+	s.Finish()
+
+	// the other tables still find exact matches past the bound of the first
+	for _, i := range []int{0, 5000, 99999} {
+		found := false
+		for _, id := range s.Find(sigs[i]) {
+			found = found || id == uint64(i)
+		}
+		if !found {
+			t.Errorf("Find(%016x) doesn't include docid %d", sigs[i], i)
+		}
+	}
+
+	if n := s.LongScans(); n < 3 {
+		t.Errorf("LongScans()=%d, want at least one per search", n)
+	}
+
+	unbounded := New3(len(sigs), NewU64Slice)
+	for i, sig := range sigs {
+		unbounded.Add(sig, uint64(i))
+	}
+	unbounded.Finish()
+
+	unbounded.Find(sigs[0])
+	if n := unbounded.LongScans(); n != 0 {
+		t.Errorf("LongScans()=%d without a threshold, want 0", n)
+	}
+}
+
+func TestFindN(t *testing.T) {
+
+	r := rand.New(rand.NewSource(0))
+
+	s := New3(2000, NewU64Slice)
+
+	// a dense cluster around 0, and some noise
+	for i := 0; i < 1000; i++ {
+		var sig uint64
+		for j := r.Intn(4); j > 0; j-- {
+			sig ^= 1 << uint(r.Intn(64))
+		}
+		s.Add(sig, uint64(i))
+		s.Add(uint64(r.Int63()), uint64(1000+i))
+	}
+	s.Finish()
+
+	all := s.Find(0)
+	if len(all) < 100 {
+		t.Fatalf("Find(0) found %d docids, want a dense cluster", len(all))
+	}
+
+	inAll := make(map[uint64]bool)
+	for _, id := range all {
+		inAll[id] = true
+	}
+
+	for _, n := range []int{1, 5, 100, len(all), len(all) + 10} {
+		got := s.FindN(0, n)
+
+		want := n
+		if want > len(all) {
+			want = len(all)
+		}
+		if len(got) != want {
+			t.Errorf("len(FindN(0, %d))=%d, want %d", n, len(got), want)
+		}
+
+		for i, id := range got {
+			if !inAll[id] {
+				t.Errorf("FindN(0, %d) returned %d, which Find doesn't", n, id)
+			}
+			if i > 0 && got[i-1] >= id {
+				t.Errorf("FindN(0, %d)=%v is not sorted and unique", n, got)
+				break
+			}
+		}
+	}
+
+	if got := s.FindN(0, 0); got != nil {
+		t.Errorf("FindN(0, 0)=%v, want nil", got)
+	}
+}
+
+// BenchmarkFindN compares FindN against Find for a query with thousands of
+// matches.
+func BenchmarkFindN(b *testing.B) {
+
+	r := rand.New(rand.NewSource(0))
+
+	s := New3(100000, NewU64Slice)
+	for i := 0; i < 50000; i++ {
+		var sig uint64
+		for j := r.Intn(4); j > 0; j-- {
+			sig ^= 1 << uint(r.Intn(64))
+		}
+		s.Add(sig, uint64(i))
+		s.Add(uint64(r.Int63()), uint64(50000+i))
+	}
+	s.Finish()
+
+	b.Run("Find", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			s.Find(0)
+		}
+	})
+
+	b.Run("FindN-5", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			s.FindN(0, 5)
+		}
+	})
+}
+
+func TestInterpolationSearch(t *testing.T) {
+
+	r := rand.New(rand.NewSource(0))
+
+	uniform := make(u64slice, 10000)
+	for i := range uniform {
+		uniform[i] = r.Uint64()
+	}
+	uniform.Finish()
+
+	// most entries in a narrow range, and a few spread across the rest
+	skewed := make(u64slice, 10000)
+	for i := range skewed {
+		skewed[i] = uint64(r.Intn(1000))
+		if i%100 == 0 {
+			skewed[i] = r.Uint64()
+		}
+	}
+	skewed.Finish()
+
+	for _, u := range []u64slice{uniform, skewed, {}, {5}, {5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5}} {
+		keys := []uint64{0, 1, 5, 6, ^uint64(0)}
+		for i := 0; i < 1000; i++ {
+			keys = append(keys, r.Uint64(), uint64(r.Intn(1000)))
+			if len(u) > 0 {
+				keys = append(keys, u[r.Intn(len(u))])
+			}
+		}
+
+		for _, key := range keys {
+			want := sort.Search(len(u), func(i int) bool { return u[i] >= key })
+			if got := interpolationSearch(u, key); got != want {
+				t.Fatalf("len=%d: interpolationSearch(%016x)=%d, want %d", len(u), key, got, want)
+			}
+		}
+	}
+
+	sigs := skewedSignatures(r, 20000)
+
+	// the document table is searched for each signature found
+	docids := make(table, len(sigs))
+	for i, sig := range sigs {
+		docids[i] = entry{hash: sig, docid: uint64(i)}
+	}
+	sort.Sort(docids)
+	for i := 0; i < 1000; i++ {
+		sig := sigs[r.Intn(len(sigs))] + uint64(r.Intn(2))
+		if got, want := docids.search(sig, true), docids.search(sig, false); got != want {
+			t.Fatalf("search(%016x) of the document table with interpolation=%d, want %d", sig, got, want)
+		}
+	}
+
+	for _, b := range backends {
+		switch b.factory(0).(type) {
+		case limitedFinder, interpolatingFinder:
+		default:
+			t.Errorf("%s tables ignore InterpolationSearch", b.name)
+		}
+
+		binary := New3(len(sigs), b.factory)
+		interp := New3(len(sigs), b.factory, InterpolationSearch())
+		for i, sig := range sigs {
+			binary.Add(sig, uint64(i))
+			interp.Add(sig, uint64(i))
+		}
+		binary.Finish()
+		interp.Finish()
+
+		for i := 0; i < 1000; i++ {
+			q := sigs[r.Intn(len(sigs))] ^ 1<<uint(r.Intn(64))
+			if got, want := interp.Find(q), binary.Find(q); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: Find(%016x) with interpolation search=%v, want %v", b.name, q, got, want)
+			}
+			if got, want := interp.Contains(q), binary.Contains(q); got != want {
+				t.Errorf("%s: Contains(%016x) with interpolation search=%v, want %v", b.name, q, got, want)
+			}
+		}
+	}
+}
+
+// BenchmarkTableSearch compares binary and interpolation search for the start
+// of a prefix run in a table of uniformly distributed signatures.
+func BenchmarkTableSearch(b *testing.B) {
+
+	r := rand.New(rand.NewSource(0))
+
+	u := make(u64slice, 1<<22)
+	for i := range u {
+		u[i] = r.Uint64()
+	}
+	u.Finish()
+
+	keys := make([]uint64, 1<<12)
+	for i := range keys {
+		keys[i] = r.Uint64() & mask3
+	}
+
+	b.Run("binary", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			key := keys[i%len(keys)]
+			sort.Search(len(u), func(i int) bool { return u[i] >= key })
+		}
+	})
+
+	b.Run("interpolation", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			interpolationSearch(u, keys[i%len(keys)])
+		}
+	})
+}
+
+func TestFindAll(t *testing.T) {
+
+	r := rand.New(rand.NewSource(0))
+
+	sigs := make([]uint64, 5000)
+	for i := range sigs {
+		sigs[i] = uint64(r.Int63())
+	}
+
+	queries := make([]uint64, 2000)
+	for i := range queries {
+		queries[i] = sigs[r.Intn(len(sigs))]
+		for j := r.Intn(5); j > 0; j-- {
+			queries[i] ^= 1 << uint(r.Intn(64))
+		}
+	}
+
+	for _, opts := range [][]Option{nil, {SortBatches()}} {
+		s := New3(len(sigs), NewU64Slice, opts...)
+		for i, sig := range sigs {
+			s.Add(sig, uint64(i))
+		}
+		s.Finish()
+		s.Add(queries[0], 5000)
+
+		got := s.FindAll(queries)
+		if len(got) != len(queries) {
+			t.Fatalf("FindAll returned %d results, want %d", len(got), len(queries))
+		}
+
+		for i, q := range queries {
+			if want := s.Find(q); !reflect.DeepEqual(got[i], want) {
+				t.Fatalf("FindAll result %d for %016x=%v, want %v", i, q, got[i], want)
+			}
+		}
+
+		if got := s.FindAll(nil); len(got) != 0 {
+			t.Errorf("FindAll(nil)=%v, want no results", got)
+		}
+	}
+
+	if got := New3(0, NewU64Slice).FindAll(queries[:2]); len(got) != 2 || got[0] != nil || got[1] != nil {
+		t.Errorf("FindAll on an empty store=%v, want 2 nil results", got)
+	}
+}
+
+// BenchmarkFindAll compares a batch of queries searched with Find in turn and
+// with FindAll, with and without sorting the batch.
+func BenchmarkFindAll(b *testing.B) {
+
+	r := rand.New(rand.NewSource(0))
+
+	sigs := make([]uint64, 1<<20)
+	for i := range sigs {
+		sigs[i] = uint64(r.Int63())
+	}
+
+	queries := make([]uint64, 1<<14)
+	for i := range queries {
+		queries[i] = uint64(r.Int63())
+	}
+
+	for _, bb := range []struct {
+		name string
+		opts []Option
+	}{
+		{"unsorted", nil},
+		{"sorted", []Option{SortBatches()}},
+	} {
+		s := New3(len(sigs), NewU64Slice, bb.opts...)
+		for i, sig := range sigs {
+			s.Add(sig, uint64(i))
+		}
+		s.Finish()
+
+		if bb.opts == nil {
+			b.Run("Find", func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					for _, q := range queries {
+						s.Find(q)
+					}
+				}
+			})
+		}
+
+		b.Run("FindAll/"+bb.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				s.FindAll(queries)
+			}
+		})
+	}
+}
+
+func TestUnique(t *testing.T) {
+	for _, tt := range []struct {
+		ids, want []uint64
+	}{
+		{nil, nil},
+		{[]uint64{3}, []uint64{3}},
+		{[]uint64{5, 1, 5, 3, 1, 1}, []uint64{1, 3, 5}},
+	} {
+		if got := unique(tt.ids); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("unique(%v)=%v, want %v", tt.ids, got, tt.want)
+		}
+	}
+}
+
+// uniqueMap is the map-based unique which unique replaced, kept to compare
+// them in BenchmarkUnique
+func uniqueMap(ids []uint64) []uint64 {
+	uniq := make(map[uint64]struct{})
+	for _, id := range ids {
+		uniq[id] = struct{}{}
+	}
+
+	ids = ids[:0]
+	for k := range uniq {
+		ids = append(ids, k)
+	}
+	sort.Sort(u64slice(ids))
+
+	return ids
+}
+
+// BenchmarkUnique compares deduplicating the matches of a search by sorting
+// with collecting them in a map, for result sizes typical of Find.  Each
+// signature matches about twice, once in each of two tables.
+func BenchmarkUnique(b *testing.B) {
+
+	r := rand.New(rand.NewSource(0))
+
+	for _, n := range []int{4, 32, 256, 2048} {
+		ids := make([]uint64, 2*n)
+		for i := 0; i < n; i++ {
+			ids[2*i] = uint64(r.Int63())
+			ids[2*i+1] = ids[2*i]
+		}
+		r.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+
+		buf := make([]uint64, len(ids))
+
+		for _, bb := range []struct {
+			name   string
+			unique func([]uint64) []uint64
+		}{
+			{"map", uniqueMap},
+			{"sort", unique},
+		} {
+			b.Run(fmt.Sprintf("%s/%d", bb.name, n), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					copy(buf, ids)
+					bb.unique(buf)
+				}
+			})
+		}
+	}
+}
+
+func TestAddConcurrent(t *testing.T) {
+
+	r := rand.New(rand.NewSource(0))
+	sigs := make([]uint64, 20000)
+	for i := range sigs {
+		sigs[i] = uint64(r.Int63())
+	}
+
+	for _, tt := range []struct {
+		name    string
+		want, s Storage
+	}{
+		{"New3", New3(len(sigs), NewU64Slice), New3(len(sigs), NewU64Slice)},
+		{"New3 no size hint", New3(len(sigs), NewU64Slice), New3(0, NewU64Slice)},
+		{"New6", New6(len(sigs), NewU64Slice), New6(len(sigs), NewU64Slice)},
+		{"New3Small", New3Small(len(sigs)), New3Small(len(sigs))},
+		{"New6Small", New6Small(len(sigs)), New6Small(len(sigs))},
+	} {
+		for i, sig := range sigs {
+			tt.want.Add(sig, uint64(i))
+		}
+
+		const workers = 8
+
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := w; i < len(sigs); i += workers {
+					tt.s.Add(sigs[i], uint64(i))
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		tt.want.Finish()
+		tt.s.Finish()
+
+		for i := 0; i < 500; i++ {
+			q := sigs[r.Intn(len(sigs))] ^ (1 << uint(r.Intn(64)))
+			if got, want := tt.s.Find(q), tt.want.Find(q); !reflect.DeepEqual(got, want) {
+				t.Fatalf("%s: Find(%016x)=%v, want %v", tt.name, q, got, want)
+			}
+		}
+	}
+}
+
+func TestAddBatch(t *testing.T) {
+
+	r := rand.New(rand.NewSource(0))
+	sigs := make([]uint64, 20000)
+	docids := make([]uint64, len(sigs))
+	for i := range sigs {
+		sigs[i], docids[i] = uint64(r.Int63()), uint64(i)
+	}
+
+	want := New3(len(sigs), NewU64Slice)
+	for i, sig := range sigs {
+		want.Add(sig, docids[i])
+	}
+	want.Finish()
+
+	// batches added concurrently before Finish, and one after
+	var adds int64
+	s := New3(0, NewU64Slice, Instrument(Hooks{OnAdd: func(sig, docid uint64) { atomic.AddInt64(&adds, 1) }}))
+
+	const batch = 1000
+	n := len(sigs) - batch
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i += batch {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s.AddBatch(sigs[i:i+batch], docids[i:i+batch])
+		}(i)
+	}
+	wg.Wait()
+	s.Finish()
+	s.AddBatch(sigs[n:], docids[n:])
+
+	if s.Len() != len(sigs) || adds != int64(len(sigs)) {
+		t.Errorf("Len()=%d, OnAdd called %d times, want %d", s.Len(), adds, len(sigs))
+	}
+	for i := 0; i < 500; i++ {
+		q := sigs[r.Intn(len(sigs))] ^ (1 << uint(r.Intn(64)))
+		if got, want := s.Find(q), want.Find(q); !reflect.DeepEqual(got, want) {
+			t.Fatalf("Find(%016x)=%v, want %v", q, got, want)
+		}
+	}
+}
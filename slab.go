@@ -0,0 +1,77 @@
+package simstore
+
+// slabMin and slabMax bound the number of entries in each slab of a slabTable:
+// 1MB to 64MB
+const (
+	slabMin = 1 << 16
+	slabMax = 1 << 22
+)
+
+// slabTable collects entries in slabs which are never copied as it grows.
+// Each slab is twice the size of the one before, up to slabMax entries, so a
+// table of n entries is in O(log n) slabs and has at most slabMax entries
+// unused.  Growing a slice by appending instead copies it each time it
+// doubles, and holds both copies while it does, which for a billion entries
+// is 48GB at the last step.
+type slabTable struct {
+	slabs []table
+	n     int
+}
+
+// add appends e to the last slab, starting a new one if it's full
+func (t *slabTable) add(e entry) {
+	if len(t.slabs) == 0 || len(t.slabs[len(t.slabs)-1]) == cap(t.slabs[len(t.slabs)-1]) {
+		size := slabMin
+		if len(t.slabs) > 0 {
+			size = 2 * cap(t.slabs[len(t.slabs)-1])
+			if size > slabMax {
+				size = slabMax
+			}
+		}
+		t.slabs = append(t.slabs, make(table, 0, size))
+	}
+
+	last := &t.slabs[len(t.slabs)-1]
+	*last = append(*last, e)
+	t.n++
+}
+
+// each calls fn with the entries in the order they were added
+func (t *slabTable) each(fn func(e entry)) {
+	for _, slab := range t.slabs {
+		for _, e := range slab {
+			fn(e)
+		}
+	}
+}
+
+// moveTo returns dst with the entries appended, growing it once to the size
+// needed, and empties t.  Each slab is released once it's been copied.
+func (t *slabTable) moveTo(dst table) table {
+	if t.n == 0 {
+		return dst
+	}
+
+	if need := len(dst) + t.n; need > cap(dst) {
+		grown := make(table, len(dst), need)
+		copy(grown, dst)
+		dst = grown
+	}
+
+	for i, slab := range t.slabs {
+		dst = append(dst, slab...)
+		t.slabs[i] = nil
+	}
+
+	*t = slabTable{}
+
+	return dst
+}
+
+func (t *slabTable) memoryBytes() int64 {
+	var n int64
+	for _, slab := range t.slabs {
+		n += 16 * int64(cap(slab))
+	}
+	return n
+}
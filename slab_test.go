@@ -0,0 +1,120 @@
+package simstore
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestSlabTable(t *testing.T) {
+
+	var st slabTable
+	var want table
+	for i := 0; i < 5*slabMin; i++ {
+		e := entry{hash: uint64(i) * 0x9e3779b97f4a7c15, docid: uint64(i)}
+		st.add(e)
+		want = append(want, e)
+	}
+
+	// slabs of 1, 2 and 4 times slabMin
+	var sizes []int
+	for _, slab := range st.slabs {
+		sizes = append(sizes, cap(slab))
+	}
+	if w := []int{slabMin, 2 * slabMin, 4 * slabMin}; !reflect.DeepEqual(sizes, w) {
+		t.Errorf("slab sizes=%v, want %v", sizes, w)
+	}
+
+	if got, w := st.memoryBytes(), int64(16*7*slabMin); got != w {
+		t.Errorf("memoryBytes=%d, want %d", got, w)
+	}
+
+	var got table
+	st.each(func(e entry) { got = append(got, e) })
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("each returned %d entries, want %d in order", len(got), len(want))
+	}
+
+	dst := make(table, 1, 10)
+	dst = st.moveTo(dst)
+	if len(dst) != len(want)+1 || cap(dst) != len(dst) || !reflect.DeepEqual(dst[1:], want) {
+		t.Errorf("moveTo returned %d entries with capacity %d, want %d", len(dst), cap(dst), len(want)+1)
+	}
+	if st.n != 0 || st.slabs != nil {
+		t.Errorf("moveTo left %d entries in %d slabs", st.n, len(st.slabs))
+	}
+}
+
+func TestAddBeyondHint(t *testing.T) {
+
+	r := rand.New(rand.NewSource(0))
+
+	sigs := make([]uint64, 3*slabMin)
+	for i := range sigs {
+		sigs[i] = uint64(r.Int63())
+	}
+
+	want := New3(len(sigs), NewU64Slice)
+	for i, sig := range sigs {
+		want.Add(sig, uint64(i))
+	}
+	want.Finish()
+
+	for _, hint := range []int{0, 1000} {
+		s := New3(hint, NewU64Slice)
+		for i, sig := range sigs {
+			s.Add(sig, uint64(i))
+		}
+
+		if got := s.Stats().Entries; got != len(sigs) {
+			t.Errorf("hint=%d: Entries=%d before Finish, want %d", hint, got, len(sigs))
+		}
+
+		// a checkpoint has the entries in the slabs
+		var buf bytes.Buffer
+		if _, err := s.WriteCheckpoint(&buf, 1); err != nil {
+			t.Fatal(err)
+		}
+		resumed := New3(hint, NewU64Slice)
+		if _, err := resumed.ReadCheckpoint(&buf); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, st := range []*Store{s, resumed} {
+			st.Finish()
+
+			if cap(st.docids) != len(sigs) || st.tableLen(0) != len(sigs) || cap(*st.rhashes[0].(*u64slice)) != len(sigs) {
+				t.Errorf("hint=%d: document table of capacity %d and table of %d/%d, want %d", hint, cap(st.docids), st.tableLen(0), cap(*st.rhashes[0].(*u64slice)), len(sigs))
+			}
+
+			for i := 0; i < 100; i++ {
+				q := sigs[r.Intn(len(sigs))] ^ 1<<uint(r.Intn(64))
+				if got, w := st.Find(q), want.Find(q); !reflect.DeepEqual(got, w) {
+					t.Fatalf("hint=%d: Find(%016x)=%v, want %v", hint, q, got, w)
+				}
+			}
+		}
+	}
+}
+
+func TestAddBelowHint(t *testing.T) {
+
+	s := New6(10000, NewU64Slice)
+	for i := 0; i < 100; i++ {
+		s.Add(uint64(i)*0x9e3779b97f4a7c15, uint64(i))
+	}
+
+	// only the document table is allocated before Finish
+	if got, want := s.MemoryBytes(), int64(16*10000); got != want {
+		t.Errorf("MemoryBytes=%d before Finish, want %d", got, want)
+	}
+
+	s.Finish()
+
+	for i, r := range s.rhashes {
+		if u := *r.(*u64slice); len(u) != 100 || cap(u) != 100 {
+			t.Fatalf("table %d of %d/%d entries, want 100", i, len(u), cap(u))
+		}
+	}
+}
@@ -0,0 +1,443 @@
+package simstore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+// The snapshot format written by Store.WriteTo, and read by ReadFrom and
+// OpenMmap.  Each section is followed by its checksum, so a snapshot corrupted
+// on disk is refused rather than searched.  All integers are little-endian.
+//
+//	magic    [8]byte  "simstore"
+//	version  uint32
+//	distance uint32   maximum search distance
+//	tables   uint32   number of permuted tables
+//	prefix   uint32   0 for the New3 and New6 permutations, or the number of
+//	                  prefix blocks of the permutations generated by New
+//	entries  uint64   number of (signature, docid) entries
+//	crc      uint64   CRC-32C of the header
+//	entries × (signature uint64, docid uint64), sorted by signature
+//	crc      uint64   CRC-32C of the entries
+//	tables × (
+//	  count  uint64
+//	  count × uint64  sorted permuted signatures
+//	  crc    uint64   CRC-32C of the count and signatures
+//	)
+//
+// Version 1 snapshots, which have no checksums, can still be read.
+const (
+	snapshotMagic   = "simstore"
+	snapshotVersion = 2
+
+	snapshotHeaderSize = 8 + 4 + 4 + 4 + 4 + 8
+)
+
+// ErrSnapshotFormat is returned when a snapshot is truncated, corrupt, or of
+// an unknown version
+var ErrSnapshotFormat = errors.New("simstore: invalid snapshot")
+
+// ErrSnapshotChecksum is returned, wrapped with the section it was found in,
+// when a section of a snapshot doesn't match its checksum
+var ErrSnapshotChecksum = errors.New("simstore: snapshot checksum mismatch")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// parseSnapshotHeader returns the permutation and number of entries of the
+// snapshot with header hdr, and whether its sections have checksums
+func parseSnapshotHeader(hdr []byte) (permutation, uint64, bool, error) {
+
+	if string(hdr[:8]) != snapshotMagic {
+		return nil, 0, false, ErrSnapshotFormat
+	}
+
+	version := binary.LittleEndian.Uint32(hdr[8:])
+	if version != 1 && version != snapshotVersion {
+		return nil, 0, false, fmt.Errorf("%w: version %d, want at most %d", ErrSnapshotFormat, version, snapshotVersion)
+	}
+
+	distance := binary.LittleEndian.Uint32(hdr[12:])
+	prefix := binary.LittleEndian.Uint32(hdr[20:])
+
+	var perm permutation
+	switch {
+	case prefix == 0 && distance == 3:
+		perm = perm3{}
+	case prefix == 0 && distance == 6:
+		perm = perm6{}
+	case distance >= 1 && distance <= 8 && prefix <= maxBlocks && validBlocks(int(distance), int(prefix), maxBlocks):
+		perm = newBlockPerm(int(distance), int(prefix))
+	default:
+		return nil, 0, false, ErrSnapshotFormat
+	}
+
+	if int(binary.LittleEndian.Uint32(hdr[16:])) != perm.tables() {
+		return nil, 0, false, ErrSnapshotFormat
+	}
+
+	return perm, binary.LittleEndian.Uint64(hdr[24:]), version >= 2, nil
+}
+
+// ReadFrom reads a snapshot written by WriteTo into a Store on the heap.  The
+// tables are read as they were written, without sorting, so loading is
+// limited by the speed of r.  ReadFrom reads exactly the bytes of the
+// snapshot from r, and the returned store is already finished.
+//
+// The options apply as they would to a store built in memory, except Dedup,
+// which only has an effect when a store is built.
+func ReadFrom(r io.Reader, opts ...Option) (*Store, error) {
+
+	var hdr [snapshotHeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, snapshotReadError(err)
+	}
+
+	perm, entries, checksums, err := parseSnapshotHeader(hdr[:])
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{}
+	s.init(0, perm, NewU64Slice, opts)
+
+	sr := snapshotReader{r: r, checksums: checksums}
+	sr.sum(hdr[:])
+	if err := sr.check("header"); err != nil {
+		return nil, err
+	}
+
+	s.docids = make(table, 0, capHint(entries))
+	var e entry
+	err = sr.words(2*entries, func(i uint64, v uint64) {
+		if i%2 == 0 {
+			e.hash = v
+			return
+		}
+		e.docid = v
+		s.docids = append(s.docids, e)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := sr.check("document table"); err != nil {
+		return nil, err
+	}
+
+	for t := range s.rhashes {
+		n, err := sr.word()
+		if err != nil {
+			return nil, err
+		}
+
+		u := make(u64slice, 0, capHint(n))
+		err = sr.words(n, func(_ uint64, v uint64) { u = append(u, v) })
+		if err != nil {
+			return nil, err
+		}
+		if err := sr.check(fmt.Sprintf("table %d", t)); err != nil {
+			return nil, err
+		}
+		s.rhashes[t] = &u
+	}
+
+	if s.indexDocIDs {
+		s.indexByDocID()
+	}
+
+	if s.prefixFilters {
+		s.filters = s.buildFilters(s.rhashes, s.docids)
+	}
+
+	if s.docSets {
+		s.docids, s.sets = groupDocIDs(s.docids)
+	}
+
+	if s.orderProbes {
+		s.sortProbes()
+	}
+
+	s.finished = true
+
+	return s, nil
+}
+
+// capHint limits the capacity preallocated for a count read from a snapshot,
+// so a corrupt count fails with ErrSnapshotFormat rather than exhausting memory
+func capHint(n uint64) int {
+	const max = 1 << 24
+	if n > max {
+		return max
+	}
+	return int(n)
+}
+
+// snapshotReader decodes the little-endian words of a snapshot, and checks
+// the checksum of each section
+type snapshotReader struct {
+	r   io.Reader
+	buf [4096 * 8]byte
+
+	checksums bool
+	crc       uint32 // of the section so far
+}
+
+// sum adds b to the checksum of the section
+func (sr *snapshotReader) sum(b []byte) {
+	if sr.checksums {
+		sr.crc = crc32.Update(sr.crc, castagnoli, b)
+	}
+}
+
+// check reads the checksum of the section which ends here, and returns
+// ErrSnapshotChecksum if it doesn't match.  It does nothing for a snapshot
+// without checksums.
+func (sr *snapshotReader) check(section string) error {
+	if !sr.checksums {
+		return nil
+	}
+
+	crc := sr.crc
+	if _, err := io.ReadFull(sr.r, sr.buf[:8]); err != nil {
+		return snapshotReadError(err)
+	}
+	if binary.LittleEndian.Uint64(sr.buf[:]) != uint64(crc) {
+		return fmt.Errorf("%w: %s", ErrSnapshotChecksum, section)
+	}
+
+	sr.crc = 0
+	return nil
+}
+
+func (sr *snapshotReader) word() (uint64, error) {
+	if _, err := io.ReadFull(sr.r, sr.buf[:8]); err != nil {
+		return 0, snapshotReadError(err)
+	}
+	sr.sum(sr.buf[:8])
+	return binary.LittleEndian.Uint64(sr.buf[:]), nil
+}
+
+// bytes reads the next n bytes
+func (sr *snapshotReader) bytes(n uint64) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(sr.r, b); err != nil {
+		return nil, snapshotReadError(err)
+	}
+	sr.sum(b)
+	return b, nil
+}
+
+// words reads the next n words, calling fn with the index and value of each
+func (sr *snapshotReader) words(n uint64, fn func(i uint64, v uint64)) error {
+	var i uint64
+	for i < n {
+		chunk := sr.buf[:]
+		if left := n - i; left < uint64(len(chunk)/8) {
+			chunk = chunk[:8*left]
+		}
+
+		if _, err := io.ReadFull(sr.r, chunk); err != nil {
+			return snapshotReadError(err)
+		}
+		sr.sum(chunk)
+
+		for j := 0; j < len(chunk); j += 8 {
+			fn(i, binary.LittleEndian.Uint64(chunk[j:]))
+			i++
+		}
+	}
+	return nil
+}
+
+// snapshotWriter encodes the little-endian words of a snapshot, and the
+// checksum of each section
+type snapshotWriter struct {
+	w   io.Writer
+	buf []byte
+	crc uint32 // of the section up to buf[summed:]
+	n   int64
+	err error
+
+	summed int // the bytes of buf already in crc
+}
+
+func newSnapshotWriter(w io.Writer) *snapshotWriter {
+	return &snapshotWriter{w: w, buf: make([]byte, 0, 4096*8)}
+}
+
+func (sw *snapshotWriter) put32(v uint32) {
+	sw.buf = binary.LittleEndian.AppendUint32(sw.buf, v)
+	if len(sw.buf)+8 > cap(sw.buf) {
+		sw.flush()
+	}
+}
+
+func (sw *snapshotWriter) put64(v uint64) {
+	sw.buf = binary.LittleEndian.AppendUint64(sw.buf, v)
+	if len(sw.buf)+8 > cap(sw.buf) {
+		sw.flush()
+	}
+}
+
+func (sw *snapshotWriter) writeString(s string) {
+	sw.buf = append(sw.buf, s...)
+	if len(sw.buf)+8 > cap(sw.buf) {
+		sw.flush()
+	}
+}
+
+// endSection writes the checksum of the section which ends here
+func (sw *snapshotWriter) endSection() {
+	sw.crc = crc32.Update(sw.crc, castagnoli, sw.buf[sw.summed:])
+	crc := sw.crc
+	sw.crc = 0
+	sw.put64(uint64(crc))
+	sw.summed = len(sw.buf)
+}
+
+// flush writes out the buffer, remembering the first error
+func (sw *snapshotWriter) flush() error {
+	sw.crc = crc32.Update(sw.crc, castagnoli, sw.buf[sw.summed:])
+	if sw.err == nil {
+		var n int
+		n, sw.err = sw.w.Write(sw.buf)
+		sw.n += int64(n)
+	}
+	sw.buf = sw.buf[:0]
+	sw.summed = 0
+	return sw.err
+}
+
+// snapshotReadError returns ErrSnapshotFormat for a snapshot which ended early
+func snapshotReadError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrSnapshotFormat
+	}
+	return err
+}
+
+// NewDiscard returns a U64Store which keeps nothing.  A Store built with it
+// can't be searched, but WriteTo regenerates each permuted table in turn from
+// the document table, so it writes a snapshot for OpenMmap using only the
+// memory of the document table and one permuted table.
+func NewDiscard(hashes int) U64Store {
+	return discard{}
+}
+
+type discard struct{}
+
+func (discard) Add(uint64)                        {}
+func (discard) Find(uint64, uint64, int) []uint64 { return nil }
+func (discard) Finish()                           {}
+
+// SnapshotSize returns the number of bytes WriteTo will write
+func (s *Store) SnapshotSize() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	n := int64(snapshotHeaderSize) + 8 + 16*int64(s.entryCount()) + 8
+	for t := range s.rhashes {
+		n += 8 + 8*int64(s.tableLen(t)) + 8
+	}
+	return n
+}
+
+func (s *Store) tableLen(t int) int {
+	switch u := s.rhashes[t].(type) {
+	case *u64slice:
+		return len(*u)
+	case *bucketStore:
+		return len(u.u)
+	}
+	return s.entryCount()
+}
+
+// tableHashes returns the sorted permuted signatures of table t.  Tables
+// which don't keep a plain slice are regenerated from the document table.
+// Like entries, the slice may alias the mapping of a store opened with
+// OpenMmap, so the caller must keep s reachable while using it.
+func (s *Store) tableHashes(t int) []uint64 {
+	if u := sortedHashes(s.rhashes[t]); u != nil {
+		return u
+	}
+	return s.permutedHashes(s.entries(), t)
+}
+
+// sortedHashes returns the hashes of a finished table which keeps them in a
+// plain slice, or nil
+func sortedHashes(r U64Store) []uint64 {
+	switch u := r.(type) {
+	case *u64slice:
+		return *u
+	case *bucketStore:
+		return u.u
+	}
+	return nil
+}
+
+// permutedHashes returns the sorted signatures of docids permuted for table t
+func (s *Store) permutedHashes(docids table, t int) []uint64 {
+	u := make(u64slice, len(docids))
+	for i, e := range docids {
+		u[i], _ = s.perm.shuffle(e.hash, t)
+	}
+	sort.Sort(u)
+	return u
+}
+
+// WriteTo writes a snapshot of the finished store to w.  A Store must not be
+// modified while the snapshot is being written.  A store with documents
+// deleted or added since Finish must be compacted before it can be written.
+func (s *Store) WriteTo(w io.Writer) (int64, error) {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.deleted) != 0 || len(s.pending) != 0 || s.stale != 0 {
+		return 0, errUncompacted
+	}
+
+	sw := newSnapshotWriter(w)
+
+	sw.writeString(snapshotMagic)
+	sw.put32(snapshotVersion)
+	sw.put32(uint32(s.perm.maxDistance()))
+	sw.put32(uint32(len(s.rhashes)))
+
+	var prefix uint32
+	if p, ok := s.perm.(*blockPerm); ok {
+		prefix = uint32(p.prefix)
+	}
+	sw.put32(prefix)
+	docids := s.entries()
+	sw.put64(uint64(len(docids)))
+	sw.endSection()
+
+	for _, e := range docids {
+		sw.put64(e.hash)
+		sw.put64(e.docid)
+	}
+	sw.endSection()
+
+	for t := range s.rhashes {
+		if len(docids) == 0 {
+			sw.put64(0)
+			sw.endSection()
+			continue
+		}
+
+		hashes := s.tableHashes(t)
+		sw.put64(uint64(len(hashes)))
+		for _, h := range hashes {
+			sw.put64(h)
+		}
+		sw.endSection()
+	}
+
+	err := sw.flush()
+
+	return sw.n, err
+}
@@ -0,0 +1,244 @@
+package simstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+
+	for _, factory := range []StorageFactory{NewU64Slice, NewZStore} {
+		s := New3(1000, factory)
+
+		rand.Seed(0)
+		for i := 0; i < 1000; i++ {
+			s.Add(uint64(rand.Int63()), uint64(i))
+		}
+		s.Finish()
+
+		var buf bytes.Buffer
+		n, err := s.WriteTo(&buf)
+		if err != nil {
+			t.Fatalf("WriteTo failed: %v", err)
+		}
+
+		if n != int64(buf.Len()) || n != s.SnapshotSize() {
+			t.Errorf("WriteTo()=%d, wrote %d bytes, SnapshotSize()=%d", n, buf.Len(), s.SnapshotSize())
+		}
+
+		b := buf.Bytes()
+		if string(b[:8]) != snapshotMagic {
+			t.Errorf("magic=%q, want %q", b[:8], snapshotMagic)
+		}
+
+		if v := binary.LittleEndian.Uint32(b[8:]); v != snapshotVersion {
+			t.Errorf("version=%d, want %d", v, snapshotVersion)
+		}
+
+		if d := binary.LittleEndian.Uint32(b[12:]); d != 3 {
+			t.Errorf("distance=%d, want 3", d)
+		}
+
+		if entries := binary.LittleEndian.Uint64(b[24:]); entries != 1000 {
+			t.Errorf("entries=%d, want 1000", entries)
+		}
+
+		// the first permuted table is the sorted signatures themselves,
+		// after the checksums of the header and the document table
+		offs := snapshotHeaderSize + 8 + 16*1000 + 8
+		if c := binary.LittleEndian.Uint64(b[offs:]); c != 1000 {
+			t.Fatalf("table 0 count=%d, want 1000", c)
+		}
+
+		for i := 0; i < 1000; i++ {
+			h := binary.LittleEndian.Uint64(b[offs+8+8*i:])
+			if h != s.docids[i].hash {
+				t.Fatalf("table 0 hash %d=%016x, want %016x", i, h, s.docids[i].hash)
+			}
+		}
+	}
+}
+
+func TestReadFrom(t *testing.T) {
+
+	r := rand.New(rand.NewSource(0))
+
+	for _, distance := range []int{2, 3, 6} {
+		s, _ := New(distance, 1000, NewU64Slice, IndexDocIDs())
+
+		sigs := make([]uint64, 1000)
+		for i := range sigs {
+			sigs[i] = uint64(r.Int63())
+			s.Add(sigs[i], uint64(i))
+		}
+		s.Finish()
+
+		var buf bytes.Buffer
+		s.WriteTo(&buf)
+		snap := append([]byte(nil), buf.Bytes()...)
+
+		// a trailing byte is left unread
+		buf.WriteByte(42)
+
+		loaded, err := ReadFrom(&buf, IndexDocIDs())
+		if err != nil {
+			t.Fatalf("d=%d: ReadFrom: %v", distance, err)
+		}
+
+		if buf.Len() != 1 {
+			t.Errorf("d=%d: %d bytes left unread, want 1", distance, buf.Len())
+		}
+
+		var again bytes.Buffer
+		loaded.WriteTo(&again)
+		if !bytes.Equal(again.Bytes(), snap) {
+			t.Errorf("d=%d: snapshot of the loaded store differs", distance)
+		}
+
+		for i := 0; i < 1000; i++ {
+			q := sigs[r.Intn(len(sigs))]
+			for j := r.Intn(distance + 2); j > 0; j-- {
+				q ^= 1 << uint(r.Intn(64))
+			}
+
+			if got, want := loaded.Find(q), s.Find(q); !reflect.DeepEqual(got, want) {
+				t.Errorf("d=%d: loaded Find(%016x)=%v, want %v", distance, q, got, want)
+			}
+		}
+
+		if got, want := loaded.FindByDocID(7), s.FindByDocID(7); !reflect.DeepEqual(got, want) {
+			t.Errorf("d=%d: loaded FindByDocID(7)=%v, want %v", distance, got, want)
+		}
+
+		// the loaded store is finished, and can be added to and compacted
+		loaded.Add(1, 1000)
+		loaded.Compact()
+		if got, want := loaded.FindExact(1), []uint64{1000}; !reflect.DeepEqual(got, want) {
+			t.Errorf("d=%d: FindExact(1) after Add=%v, want %v", distance, got, want)
+		}
+	}
+}
+
+func TestReadFromInvalid(t *testing.T) {
+
+	s := New3(10, NewU64Slice)
+	for i := 0; i < 10; i++ {
+		s.Add(uint64(i)<<40, uint64(i))
+	}
+	s.Finish()
+
+	var buf bytes.Buffer
+	s.WriteTo(&buf)
+	snap := buf.Bytes()
+
+	huge := append([]byte{}, snap...)
+	binary.LittleEndian.PutUint64(huge[24:], 1<<60)
+	binary.LittleEndian.PutUint64(huge[snapshotHeaderSize:], uint64(crc32.Checksum(huge[:snapshotHeaderSize], castagnoli)))
+
+	for _, tt := range []struct {
+		name string
+		data []byte
+	}{
+		{"truncated", snap[:len(snap)-8]},
+		{"header", snap[:10]},
+		{"magic", append([]byte("notsimst"), snap[8:]...)},
+		{"entries", huge},
+		{"empty", nil},
+	} {
+		if _, err := ReadFrom(bytes.NewReader(tt.data)); err != ErrSnapshotFormat {
+			t.Errorf("%s: ReadFrom error=%v, want ErrSnapshotFormat", tt.name, err)
+		}
+	}
+
+	future := append([]byte{}, snap...)
+	binary.LittleEndian.PutUint32(future[8:], snapshotVersion+1)
+	if _, err := ReadFrom(bytes.NewReader(future)); !errors.Is(err, ErrSnapshotFormat) {
+		t.Errorf("version %d: ReadFrom error=%v, want ErrSnapshotFormat", snapshotVersion+1, err)
+	}
+}
+
+func TestSnapshotChecksums(t *testing.T) {
+
+	s := New3(100, NewU64Slice)
+	for i := 0; i < 100; i++ {
+		s.Add(uint64(i)*0x9e3779b97f4a7c15, uint64(i))
+	}
+	s.Finish()
+
+	var buf bytes.Buffer
+	s.WriteTo(&buf)
+	snap := buf.Bytes()
+
+	docids := snapshotHeaderSize + 8
+	table2 := docids + 16*100 + 8 + 2*(8+8*100+8)
+
+	dir := t.TempDir()
+
+	for _, tt := range []struct {
+		section string
+		offset  int
+	}{
+		{"header", snapshotHeaderSize},
+		{"document table", docids + 16*50 + 3},
+		{"table 2", table2 + 8*7},
+	} {
+		bad := append([]byte{}, snap...)
+		bad[tt.offset] ^= 0x10
+
+		_, err := ReadFrom(bytes.NewReader(bad))
+		if !errors.Is(err, ErrSnapshotChecksum) || !strings.HasSuffix(err.Error(), tt.section) {
+			t.Errorf("%s: ReadFrom error=%v, want ErrSnapshotChecksum", tt.section, err)
+		}
+
+		path := filepath.Join(dir, tt.section)
+		os.WriteFile(path, bad, 0644)
+		_, err = OpenMmap(path)
+		if !errors.Is(err, ErrSnapshotChecksum) || !strings.HasSuffix(err.Error(), tt.section) {
+			t.Errorf("%s: OpenMmap error=%v, want ErrSnapshotChecksum", tt.section, err)
+		}
+	}
+
+	// a version 1 snapshot is the same without the checksums
+	v1 := append([]byte{}, snap[:snapshotHeaderSize]...)
+	binary.LittleEndian.PutUint32(v1[8:], 1)
+	rest := snap[snapshotHeaderSize+8:]
+	v1 = append(v1, rest[:16*100]...)
+	rest = rest[16*100+8:]
+	for len(rest) > 0 {
+		n := 8 + 8*int(binary.LittleEndian.Uint64(rest))
+		v1 = append(v1, rest[:n]...)
+		rest = rest[n+8:]
+	}
+
+	path := filepath.Join(dir, "v1")
+	os.WriteFile(path, v1, 0644)
+	mapped, err := OpenMmap(path)
+	if err != nil {
+		t.Fatalf("OpenMmap of a version 1 snapshot: %v", err)
+	}
+	defer mapped.Close()
+
+	loaded, err := ReadFrom(bytes.NewReader(v1))
+	if err != nil {
+		t.Fatalf("ReadFrom of a version 1 snapshot: %v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		sig := uint64(i) * 0x9e3779b97f4a7c15
+		want := s.Find(sig)
+		if got := loaded.Find(sig); !reflect.DeepEqual(got, want) {
+			t.Errorf("version 1 ReadFrom: Find(%016x)=%v, want %v", sig, got, want)
+		}
+		if got := mapped.Find(sig); !reflect.DeepEqual(got, want) {
+			t.Errorf("version 1 OpenMmap: Find(%016x)=%v, want %v", sig, got, want)
+		}
+	}
+}
@@ -0,0 +1,419 @@
+package simstore
+
+import (
+	"math"
+	"math/bits"
+	"math/rand"
+	"slices"
+	"time"
+)
+
+// Stats describes the contents and size of a store
+type Stats struct {
+	// Entries is the number of (signature, docid) entries in the store,
+	// including those added since Finish
+	Entries int
+
+	// Pending is the number of entries added since Finish which haven't
+	// been compacted into the tables
+	Pending int
+
+	// Deleted is the number of deleted docids whose entries haven't been
+	// compacted away
+	Deleted int
+
+	// Tables holds the number of entries in each table.  A table of a
+	// store created with Dedup may have fewer entries than the store.
+	Tables []int
+
+	// MemoryBytes estimates the heap used by the store's tables.  Tables
+	// memory-mapped by OpenMmap aren't counted.
+	MemoryBytes int64
+
+	// DuplicateRatio is the fraction of the entries in the tables whose
+	// signature is the same as that of another entry
+	DuplicateRatio float64
+
+	// BuildTime is how long Finish took
+	BuildTime time.Duration
+}
+
+// sizer is implemented by U64Stores which can report their heap usage
+type sizer interface {
+	memoryBytes() int64
+}
+
+func (u u64slice) memoryBytes() int64 { return 8 * int64(cap(u)) }
+
+func (z *zstore) memoryBytes() int64 {
+	return int64(len(z.b)) + 8*int64(len(z.index)) + 8*int64(cap(z.u))
+}
+
+func (z *bucketStore) memoryBytes() int64 {
+	return 8 * int64(cap(z.u)+len(z.offs))
+}
+
+func (z *blockStore) memoryBytes() int64 {
+	return int64(len(z.b)) + 16*int64(len(z.first)) + 8*int64(cap(z.u))
+}
+
+func (z *deltaStore) memoryBytes() int64 {
+	return int64(len(z.b)) + 16*int64(len(z.first)) + 8*int64(cap(z.u))
+}
+
+// Stats returns the statistics of the store.  Finding the duplicate ratio
+// scans the document table.
+func (s *Store) Stats() Stats {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	st := Stats{
+		Entries:   s.entryCount() + len(s.pending),
+		Pending:   len(s.pending),
+		Deleted:   len(s.deleted),
+		Tables:    make([]int, len(s.rhashes)),
+		BuildTime: s.buildTime,
+	}
+
+	for t := range s.rhashes {
+		st.Tables[t] = s.tableLen(t)
+	}
+
+	st.MemoryBytes = s.memoryBytes()
+
+	// the document table is sorted by signature, and the signatures of the
+	// docid sets aren't in it
+	var dups int
+	for i := 1; i < len(s.docids); i++ {
+		if s.docids[i].hash == s.docids[i-1].hash {
+			dups++
+		}
+	}
+	for _, set := range s.sets.sets {
+		dups += set.n - 1
+	}
+	st.DuplicateRatio = ratio(dups, s.entryCount())
+
+	return st
+}
+
+// Len returns the number of entries in the store, as in Stats, without
+// scanning the tables
+func (s *Store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.entryCount() + len(s.pending)
+}
+
+// MemoryBytes estimates the heap used by the store's tables, as in Stats,
+// without scanning them for duplicates
+func (s *Store) MemoryBytes() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.memoryBytes()
+}
+
+// memoryBytes estimates the heap used by the store's tables.  The caller must
+// hold the lock.
+func (s *Store) memoryBytes() int64 {
+	n := 16 * int64(cap(s.pending)+cap(s.bydocid))
+	if s.mapped == nil {
+		n += 16*int64(cap(s.docids)) + s.sets.memoryBytes() + s.overflow.memoryBytes()
+		for _, r := range s.rhashes {
+			if sz, ok := r.(sizer); ok {
+				n += sz.memoryBytes()
+			}
+		}
+	}
+	for _, f := range s.filters {
+		n += f.memoryBytes()
+	}
+	return n
+}
+
+// Stats returns the statistics of the store.  Finding the duplicate ratio
+// sorts a copy of each bucket of the first table.
+func (s *SmallStore3) Stats() Stats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tables := make([][]table, len(s.tables))
+	for i := range s.tables {
+		tables[i] = s.tables[i][:]
+	}
+	return bucketStats(tables, len(s.deleted), s.buildTime)
+}
+
+// Stats returns the statistics of the store.  Finding the duplicate ratio
+// sorts a copy of each bucket of the first table.
+func (s *SmallStore6) Stats() Stats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tables := make([][]table, len(s.tables))
+	for i := range s.tables {
+		tables[i] = s.tables[i][:]
+	}
+	return bucketStats(tables, len(s.deleted), s.buildTime)
+}
+
+// Len returns the number of entries in the store, as in Stats, without
+// sorting the buckets
+func (s *SmallStore3) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return bucketLen(s.tables[0][:])
+}
+
+// Len returns the number of entries in the store, as in Stats, without
+// sorting the buckets
+func (s *SmallStore6) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return bucketLen(s.tables[0][:])
+}
+
+// bucketLen returns the number of entries in the buckets of a table
+func bucketLen(buckets []table) int {
+	var n int
+	for _, b := range buckets {
+		n += len(b)
+	}
+	return n
+}
+
+// MemoryBytes estimates the heap used by the store's buckets, as in Stats
+func (s *SmallStore3) MemoryBytes() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var n int64
+	for i := range s.tables {
+		n += bucketMemoryBytes(s.tables[i][:])
+	}
+	return n
+}
+
+// MemoryBytes estimates the heap used by the store's buckets, as in Stats
+func (s *SmallStore6) MemoryBytes() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var n int64
+	for i := range s.tables {
+		n += bucketMemoryBytes(s.tables[i][:])
+	}
+	return n
+}
+
+// Stats returns the statistics of the store.  Each index is a table holding
+// every entry.
+func (s *MIHStore) Stats() Stats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	st := Stats{
+		Entries:   len(s.docids) + len(s.pending),
+		Pending:   len(s.pending),
+		Deleted:   len(s.deleted),
+		Tables:    make([]int, len(s.indexes)),
+		BuildTime: s.buildTime,
+	}
+
+	for i, ix := range s.indexes {
+		st.Tables[i] = len(ix.ents)
+	}
+
+	st.MemoryBytes = s.memoryBytes()
+
+	var dups int
+	for i := 1; i < len(s.docids); i++ {
+		if s.docids[i].hash == s.docids[i-1].hash {
+			dups++
+		}
+	}
+	st.DuplicateRatio = ratio(dups, len(s.docids))
+
+	return st
+}
+
+// Len returns the number of entries in the store, as in Stats
+func (s *MIHStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.docids) + len(s.pending)
+}
+
+// MemoryBytes estimates the heap used by the store's entries and indexes, as
+// in Stats
+func (s *MIHStore) MemoryBytes() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.memoryBytes()
+}
+
+func (s *MIHStore) memoryBytes() int64 {
+	n := 16 * int64(cap(s.docids)+cap(s.pending))
+	for _, ix := range s.indexes {
+		n += 4 * int64(cap(ix.offs)+cap(ix.ents))
+	}
+	return n
+}
+
+// bucketMemoryBytes estimates the heap used by a table of buckets
+func bucketMemoryBytes(buckets []table) int64 {
+	n := 24 * int64(len(buckets))
+	for _, b := range buckets {
+		n += 16 * int64(cap(b))
+	}
+	return n
+}
+
+// bucketStats returns the Stats of a small store with the given tables of
+// buckets.  Every entry is in one bucket of each table.
+func bucketStats(tables [][]table, deleted int, buildTime time.Duration) Stats {
+
+	st := Stats{
+		Deleted:   deleted,
+		Tables:    make([]int, len(tables)),
+		BuildTime: buildTime,
+	}
+
+	for t, buckets := range tables {
+		st.MemoryBytes += bucketMemoryBytes(buckets)
+		for _, b := range buckets {
+			st.Tables[t] += len(b)
+		}
+	}
+
+	if len(tables) == 0 {
+		return st
+	}
+
+	st.Entries = st.Tables[0]
+
+	// entries with the same signature are in the same bucket
+	var dups int
+	var hashes []uint64
+	for _, b := range tables[0] {
+		hashes = hashes[:0]
+		for _, e := range b {
+			hashes = append(hashes, e.hash)
+		}
+		slices.Sort(hashes)
+		dups += len(hashes) - len(slices.Compact(hashes))
+	}
+	st.DuplicateRatio = ratio(dups, st.Entries)
+
+	return st
+}
+
+// estimateSample is the number of hashes in the table EstimateMemory measures
+const estimateSample = 1 << 16
+
+// EstimateMemory estimates the heap used by a finished store of n signatures
+// searching maxDistance, created by NewBuilder with newStore and opts, without
+// building it.  The size of a table is measured on a sample of random hashes
+// as close together as those of n signatures, so the estimate holds for
+// compressed tables too.  The signatures are assumed to be distinct, which is
+// what the Dedup and DocIDSets options save space on.  It returns 0 if New
+// would fail for maxDistance and opts.
+func EstimateMemory(maxDistance int, n int, newStore StorageFactory, opts ...Option) uint64 {
+
+	o := optionsOf(opts)
+
+	var perm permutation
+	switch {
+	case o.prefixBlocks == 0 && o.maxTables == 0 && maxDistance == 3:
+		perm = perm3For(o)
+	case o.prefixBlocks == 0 && o.maxTables == 0 && o.prefixBits == 0 && maxDistance == 6:
+		perm = perm6{}
+	default:
+		prefix, err := prefixBlocks(maxDistance, o)
+		if err != nil {
+			return 0
+		}
+		perm = newBlockPerm(maxDistance, prefix)
+	}
+
+	// the document table, and its copy sorted by docid
+	entry := uint64(16)
+	if o.indexDocIDs {
+		entry += 16
+	}
+
+	bytes := uint64(n)*entry + uint64(perm.tables())*tableBytes(n, newStore)
+
+	if o.prefixFilters {
+		for t := 0; t < perm.tables(); t++ {
+			bytes += filterBytes(n, perm, t)
+		}
+	}
+
+	return bytes
+}
+
+// EstimateMIHMemory estimates the heap used by a finished MIHStore of n
+// distinct signatures created by NewMIH, without building it
+func EstimateMIHMemory(n int) uint64 {
+	m := mihSubstrings(n)
+
+	// the document table, and the entries and bucket offsets of each index
+	bytes := 16 * uint64(n)
+	for i := 0; i < m; i++ {
+		width := 64 / m
+		if i < 64%m {
+			width++
+		}
+		bytes += 4*uint64(n) + 4*(1<<uint(width)+1)
+	}
+	return bytes
+}
+
+// filterBytes estimates the size of the prefix filter of table t of perm for
+// n uniformly distributed signatures, from the expected number of the
+// prefixes they occupy
+func filterBytes(n int, perm permutation, t int) uint64 {
+	_, mask := perm.shuffle(0, t)
+	prefixes := math.Ldexp(1, bits.OnesCount64(mask))
+	occupied := prefixes * -math.Expm1(-float64(n)/prefixes)
+	return 32 + uint64(1.23*occupied)
+}
+
+// tableBytes estimates the heap used by a table of n uniformly distributed
+// hashes created by newStore, from a sample of at most estimateSample of them
+func tableBytes(n int, newStore StorageFactory) uint64 {
+
+	m := n
+	if m > estimateSample {
+		m = estimateSample
+	}
+	if m == 0 {
+		return 0
+	}
+
+	// m hashes from a range m/n of the whole, as far apart as n would be
+	span := math.Ldexp(float64(m)/float64(n), 64)
+
+	r := rand.New(rand.NewSource(0))
+	u := newStore(m)
+	for i := 0; i < m; i++ {
+		u.Add(uint64(r.Float64() * span))
+	}
+	u.Finish()
+
+	sz, ok := u.(sizer)
+	if !ok {
+		return 8 * uint64(n)
+	}
+
+	return uint64(float64(sz.memoryBytes()) * float64(n) / float64(m))
+}
+
+func ratio(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
+}
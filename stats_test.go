@@ -0,0 +1,149 @@
+package simstore
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+
+	// 1000 signatures, every tenth of which is added twice
+	add := func(s Storage) {
+		for i := 0; i < 1000; i++ {
+			sig := uint64(i) * 0x9e3779b97f4a7c15
+			s.Add(sig, uint64(i))
+			if i%10 == 0 {
+				s.Add(sig, uint64(i+1000))
+			}
+		}
+		s.Finish()
+	}
+
+	for _, tt := range []struct {
+		name   string
+		s      Storage
+		tables int
+	}{
+		{"New3", New3(1100, NewU64Slice), 16},
+		{"New6", New6(1100, NewU64Slice), 49},
+		{"New3 ZStore", New3(1100, NewZStore), 16},
+		{"New3Small", New3Small(1100), 4},
+		{"New6Small", New6Small(1100), 7},
+	} {
+		add(tt.s)
+
+		st := tt.s.Stats()
+
+		if st.Entries != 1100 {
+			t.Errorf("%s: Entries=%d, want 1100", tt.name, st.Entries)
+		}
+
+		if got := tt.s.Len(); got != st.Entries {
+			t.Errorf("%s: Len=%d, want the %d entries of Stats", tt.name, got, st.Entries)
+		}
+
+		if len(st.Tables) != tt.tables {
+			t.Fatalf("%s: %d tables, want %d", tt.name, len(st.Tables), tt.tables)
+		}
+
+		for i, n := range st.Tables {
+			if n != 1100 {
+				t.Errorf("%s: table %d has %d entries, want 1100", tt.name, i, n)
+			}
+		}
+
+		if want := 100.0 / 1100; st.DuplicateRatio != want {
+			t.Errorf("%s: DuplicateRatio=%v, want %v", tt.name, st.DuplicateRatio, want)
+		}
+
+		if st.MemoryBytes < 1100*16 {
+			t.Errorf("%s: MemoryBytes=%d, want at least %d", tt.name, st.MemoryBytes, 1100*16)
+		}
+
+		if got := tt.s.(interface{ MemoryBytes() int64 }).MemoryBytes(); got != st.MemoryBytes {
+			t.Errorf("%s: MemoryBytes()=%d, want the %d of Stats", tt.name, got, st.MemoryBytes)
+		}
+
+		if st.BuildTime <= 0 {
+			t.Errorf("%s: BuildTime=%v, want > 0", tt.name, st.BuildTime)
+		}
+
+		tt.s.Delete(1)
+		tt.s.Add(1, 2000)
+
+		st = tt.s.Stats()
+		if st.Entries != 1101 || st.Deleted != 1 {
+			t.Errorf("%s: after Add and Delete, Entries=%d Deleted=%d, want 1101 and 1", tt.name, st.Entries, st.Deleted)
+		}
+		if got := tt.s.Len(); got != 1101 {
+			t.Errorf("%s: after Add and Delete, Len=%d, want 1101", tt.name, got)
+		}
+	}
+
+	if st := New3(10, NewU64Slice).Stats(); st.Entries != 0 || st.DuplicateRatio != 0 {
+		t.Errorf("empty store: %+v", st)
+	}
+
+	s := New3(1100, NewU64Slice)
+	add(s)
+
+	var buf bytes.Buffer
+	s.WriteTo(&buf)
+	path := filepath.Join(t.TempDir(), "store.snap")
+	os.WriteFile(path, buf.Bytes(), 0644)
+
+	mapped, err := OpenMmap(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mapped.Close()
+
+	if st := mapped.Stats(); st.Entries != 1100 || st.MemoryBytes != 0 {
+		t.Errorf("mapped store: Entries=%d MemoryBytes=%d, want 1100 and 0", st.Entries, st.MemoryBytes)
+	}
+}
+
+func TestEstimateMemory(t *testing.T) {
+
+	// more signatures than the sample of a table
+	sigs := benchSignatures()[:2*estimateSample]
+
+	for _, tt := range []struct {
+		name     string
+		d        int
+		newStore StorageFactory
+		opts     []Option
+	}{
+		{"New3", 3, NewU64Slice, nil},
+		{"New(4)", 4, NewU64Slice, []Option{IndexDocIDs()}},
+		{"New(6) MaxTables", 6, NewU64Slice, []Option{MaxTables(30)}},
+		{"New3 ZStore", 3, NewZStore, nil},
+		{"New3 ZStore PrefixFilters", 3, NewZStore, []Option{PrefixFilters()}},
+		{"New3 DeltaStore", 3, NewDeltaStore, nil},
+		{"New6 BucketStore", 6, NewBucketStore, nil},
+	} {
+		b, err := NewBuilder(tt.d, len(sigs), tt.newStore, tt.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, sig := range sigs {
+			b.Add(sig, uint64(i))
+		}
+		x := b.Finish()
+
+		got := float64(EstimateMemory(tt.d, len(sigs), tt.newStore, tt.opts...))
+		want := float64(x.s.MemoryBytes())
+		if got < 0.9*want || got > 1.1*want {
+			t.Errorf("%s: EstimateMemory=%.0f, want within 10%% of %.0f", tt.name, got, want)
+		}
+	}
+
+	if got := EstimateMemory(9, 1000, NewU64Slice); got != 0 {
+		t.Errorf("EstimateMemory for distance 9=%d, want 0", got)
+	}
+	if got := EstimateMemory(3, 0, NewU64Slice); got != 0 {
+		t.Errorf("EstimateMemory of no signatures=%d, want 0", got)
+	}
+}
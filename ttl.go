@@ -0,0 +1,73 @@
+package simstore
+
+import "time"
+
+// Timestamps makes Add record the time each document was added, so Expire can
+// remove the documents older than a given time.  A document added more than
+// once keeps its latest time.  The times cost a map entry per document, and
+// aren't kept in snapshots or checkpoints.
+func Timestamps() Option {
+	return func(s *Store) { s.timestamps = true }
+}
+
+// TTL makes searches skip the documents added longer than d ago, as if they
+// had been deleted, so a store only finds near-duplicates among recent
+// documents.  It implies Timestamps.  Compact expires the documents older
+// than d, removing their entries.
+func TTL(d time.Duration) Option {
+	return func(s *Store) {
+		s.timestamps = true
+		s.ttl = d
+	}
+}
+
+// AddAt is like Add, but records t as the time the document was added, such
+// as the time of a document loaded from an archive, whether or not the store
+// was created with Timestamps.
+func (s *Store) AddAt(sig uint64, docid uint64, t time.Time) {
+	s.mu.Lock()
+	s.add(entry{hash: sig, docid: docid})
+	s.stamp(docid, t)
+	s.wal.log(walAdd, sig, docid, t.UnixNano())
+	s.mu.Unlock()
+
+	if s.hooks.OnAdd != nil {
+		s.hooks.OnAdd(sig, docid)
+	}
+}
+
+// stamp records t as the time docid was added, unless it has a later one.  The
+// caller must hold the lock.
+func (ts *tombstones) stamp(docid uint64, t time.Time) {
+	if ts.times == nil {
+		ts.times = make(map[uint64]int64)
+	}
+	if n := t.UnixNano(); n > ts.times[docid] {
+		ts.times[docid] = n
+	}
+}
+
+// Expire deletes the documents added before the given time, and returns how
+// many there were.  Like Delete, it only marks them as deleted until Compact
+// removes their entries.  Documents added without a time, by Add without
+// Timestamps, never expire.
+func (s *Store) Expire(before time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := before.UnixNano()
+
+	var n int
+	for docid, t := range s.times {
+		if t < cutoff {
+			s.markDeleted(docid)
+			n++
+		}
+	}
+
+	if n > 0 {
+		s.wal.log(walExpire, 0, 0, cutoff)
+	}
+
+	return n
+}
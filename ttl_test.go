@@ -0,0 +1,108 @@
+package simstore
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExpire(t *testing.T) {
+
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// docid i at hour i, the second half added after Finish
+	s := New3(100, NewU64Slice, Timestamps())
+	for i := 0; i < 100; i++ {
+		if i == 50 {
+			s.Finish()
+		}
+		s.AddAt(uint64(i)*0x9e3779b97f4a7c15, uint64(i), base.Add(time.Duration(i)*time.Hour))
+	}
+	// a later time keeps docid 0
+	s.AddAt(0xffff0000ffff0000, 0, base.Add(1000*time.Hour))
+	// stamped with the current time by Add
+	s.Add(0x00ff00ff00ff00ff, 1000)
+
+	if got := s.Expire(base.Add(75 * time.Hour)); got != 74 {
+		t.Errorf("Expire=%d, want 74", got)
+	}
+	if got := s.Expire(base.Add(75 * time.Hour)); got != 0 {
+		t.Errorf("second Expire=%d, want 0", got)
+	}
+
+	check := func(when string) {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			sig := uint64(i) * 0x9e3779b97f4a7c15
+			var want []uint64
+			if i == 0 || i >= 75 {
+				want = []uint64{uint64(i)}
+			}
+			if got := s.Find(sig); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: Find(%016x)=%v, want %v", when, sig, got, want)
+			}
+		}
+		for _, sig := range []uint64{0xffff0000ffff0000, 0x00ff00ff00ff00ff} {
+			if got := s.Find(sig); len(got) != 1 {
+				t.Errorf("%s: Find(%016x)=%v, want one document", when, sig, got)
+			}
+		}
+	}
+
+	check("expired")
+
+	s.Compact()
+	if got := s.Len(); got != 28 {
+		t.Errorf("Len=%d after Compact, want 28", got)
+	}
+
+	check("compacted")
+}
+
+func TestTTL(t *testing.T) {
+
+	now := time.Now()
+
+	s := New6(100, NewU64Slice, TTL(24*time.Hour))
+	for i := 0; i < 100; i++ {
+		sig := uint64(i) * 0x9e3779b97f4a7c15
+		if i%2 == 0 {
+			s.AddAt(sig, uint64(i), now.Add(-48*time.Hour))
+		} else {
+			s.Add(sig, uint64(i))
+		}
+	}
+	s.Finish()
+	s.AddAt(1, 1000, now.Add(-48*time.Hour))
+
+	check := func(when string) {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			sig := uint64(i) * 0x9e3779b97f4a7c15
+			var want []uint64
+			if i%2 == 1 {
+				want = []uint64{uint64(i)}
+			}
+			if got := s.Find(sig); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: Find(%016x)=%v, want %v", when, sig, got, want)
+			}
+			if got := s.Contains(sig); got != (want != nil) {
+				t.Errorf("%s: Contains(%016x)=%v, want %v", when, sig, got, want != nil)
+			}
+		}
+		if got := s.Find(1); got != nil {
+			t.Errorf("%s: Find(1)=%v, want nil", when, got)
+		}
+	}
+
+	check("before Compact")
+
+	if got := s.Compact(); got != 50 {
+		t.Errorf("Compact removed %d entries, want 50", got)
+	}
+	if st := s.Stats(); st.Entries != 50 || st.Deleted != 0 {
+		t.Errorf("after Compact, Entries=%d Deleted=%d, want 50 and 0", st.Entries, st.Deleted)
+	}
+
+	check("compacted")
+}
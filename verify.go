@@ -0,0 +1,156 @@
+package simstore
+
+import (
+	"log/slog"
+	"sync"
+	"sync/atomic"
+)
+
+// Mismatch is a search of a VerifiedStore whose result differed from that of
+// a linear scan
+type Mismatch struct {
+	Sig     uint64
+	Missing []uint64 // within the distance, but not returned
+	Extra   []uint64 // returned, but not within the distance or deleted
+}
+
+// VerifiedStore is a Storage which checks each Find of the store it wraps
+// against a linear scan of a copy of all its entries, for testing a new
+// permutation, table encoding or store.  It costs the copy, and a scan of it
+// per search, so it's meant for debugging rather than production.
+//
+// Only deleted documents are hidden from the scan, so a store hiding others,
+// such as one with TTL, reports them as extra.  A Find concurrent with an Add
+// or Delete may report a mismatch for the entry being changed.
+type VerifiedStore struct {
+	s          Storage
+	distance   int
+	onMismatch func(Mismatch)
+
+	verify     atomic.Bool
+	mismatches atomic.Uint64
+
+	mu      sync.RWMutex
+	entries table
+	deleted map[uint64]struct{}
+}
+
+// NewVerified returns a VerifiedStore wrapping the empty store s, which
+// searches the given distance.  Each mismatch is passed to onMismatch, or
+// logged with the default slog logger if it's nil.  Verification starts
+// enabled.
+func NewVerified(s Storage, distance int, onMismatch func(Mismatch)) *VerifiedStore {
+	if onMismatch == nil {
+		onMismatch = func(m Mismatch) {
+			slog.Warn("simstore: Find differs from a linear scan", "sig", m.Sig, "missing", m.Missing, "extra", m.Extra)
+		}
+	}
+
+	v := &VerifiedStore{
+		s:          s,
+		distance:   distance,
+		onMismatch: onMismatch,
+		deleted:    make(map[uint64]struct{}),
+	}
+	v.verify.Store(true)
+	return v
+}
+
+// SetVerify turns the checking of searches on or off.  The entries are copied
+// either way, so it can be turned on at any time.
+func (v *VerifiedStore) SetVerify(on bool) {
+	v.verify.Store(on)
+}
+
+// Mismatches returns the number of searches whose result differed from the
+// scan
+func (v *VerifiedStore) Mismatches() uint64 {
+	return v.mismatches.Load()
+}
+
+// Add inserts into the store and the copy
+func (v *VerifiedStore) Add(sig, docid uint64) {
+	v.s.Add(sig, docid)
+
+	v.mu.Lock()
+	v.entries = append(v.entries, entry{hash: sig, docid: docid})
+	v.mu.Unlock()
+}
+
+// Find returns the result of the store's Find, after checking it against the
+// scan
+func (v *VerifiedStore) Find(sig uint64) []uint64 {
+	got := v.s.Find(sig)
+	if !v.verify.Load() {
+		return got
+	}
+
+	want := v.scan(sig)
+
+	// both are sorted and distinct
+	var m Mismatch
+	i, j := 0, 0
+	for i < len(got) || j < len(want) {
+		switch {
+		case j == len(want) || i < len(got) && got[i] < want[j]:
+			m.Extra = append(m.Extra, got[i])
+			i++
+		case i == len(got) || want[j] < got[i]:
+			m.Missing = append(m.Missing, want[j])
+			j++
+		default:
+			i++
+			j++
+		}
+	}
+
+	if m.Missing != nil || m.Extra != nil {
+		m.Sig = sig
+		v.mismatches.Add(1)
+		v.onMismatch(m)
+	}
+
+	return got
+}
+
+// scan returns the sorted, distinct docids of the entries within the distance
+// of sig which haven't been deleted
+func (v *VerifiedStore) scan(sig uint64) []uint64 {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	var ids []uint64
+	for _, e := range v.entries {
+		if distance(e.hash, sig) <= v.distance {
+			if _, ok := v.deleted[e.docid]; !ok {
+				ids = append(ids, e.docid)
+			}
+		}
+	}
+
+	return unique(ids)
+}
+
+// Finish finishes the store
+func (v *VerifiedStore) Finish() {
+	v.s.Finish()
+}
+
+// Delete removes docid from the store and the scan
+func (v *VerifiedStore) Delete(docid uint64) {
+	v.s.Delete(docid)
+
+	v.mu.Lock()
+	v.deleted[docid] = struct{}{}
+	v.mu.Unlock()
+}
+
+// Len returns the number of entries in the store
+func (v *VerifiedStore) Len() int {
+	return v.s.Len()
+}
+
+// Stats returns the stats of the store
+func (v *VerifiedStore) Stats() Stats {
+	return v.s.Stats()
+}
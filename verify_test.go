@@ -0,0 +1,48 @@
+package simstore
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestVerifiedStore(t *testing.T) {
+
+	sig := func(i int) uint64 { return uint64(i) * 0x9e3779b97f4a7c15 }
+
+	var mismatches []Mismatch
+	record := func(m Mismatch) { mismatches = append(mismatches, m) }
+
+	add := func(v *VerifiedStore) {
+		for i := 0; i < 200; i++ {
+			v.Add(sig(i), uint64(i))
+			v.Add(sig(i)^0x7, uint64(i+1000))
+		}
+		v.Finish()
+		v.Delete(5)
+	}
+
+	v := NewVerified(New3(400, NewU64Slice), 3, record)
+	add(v)
+	for i := 0; i < 200; i++ {
+		v.Find(sig(i) ^ 1)
+	}
+	if v.Mismatches() != 0 || mismatches != nil {
+		t.Errorf("New3: %d mismatches: %v", v.Mismatches(), mismatches)
+	}
+
+	// a store searching a shorter distance than it's checked against
+	v = NewVerified(New3(400, NewU64Slice), 4, record)
+	add(v)
+	if got := v.Find(sig(7) ^ 0x8); !reflect.DeepEqual(got, []uint64{7}) {
+		t.Errorf("Find=%v, want the store's result, [7]", got)
+	}
+	if want := []Mismatch{{Sig: sig(7) ^ 0x8, Missing: []uint64{1007}}}; !reflect.DeepEqual(mismatches, want) || v.Mismatches() != 1 {
+		t.Errorf("%d mismatches %v, want %v", v.Mismatches(), mismatches, want)
+	}
+
+	v.SetVerify(false)
+	v.Find(sig(7) ^ 0x8)
+	if v.Mismatches() != 1 {
+		t.Errorf("a search was checked with verification off")
+	}
+}
@@ -0,0 +1,67 @@
+package simstore
+
+// version is the latest version of a document added with AddVersion, and its
+// signature
+type version struct {
+	n   uint64
+	sig uint64
+}
+
+// AddVersion adds a version of a document, such as a page crawled again whose
+// signature has changed.  Searches only find a document by the signature of
+// its latest version, so the entries of the earlier versions are hidden, like
+// those of deleted documents, until Compact removes them.  It reports whether
+// the version was added: a version no later than one already added is
+// ignored.  Plain Add doesn't take part, so a signature added with Add for a
+// document with versions is hidden.  The versions cost a map entry per
+// document, and aren't kept in snapshots or checkpoints.
+func (s *Store) AddVersion(sig, docid, n uint64) bool {
+	s.mu.Lock()
+	added := s.addVersion(sig, docid, n)
+	if added {
+		s.wal.log(walAddVersion, sig, docid, int64(n))
+	}
+	s.mu.Unlock()
+
+	if added && s.hooks.OnAdd != nil {
+		s.hooks.OnAdd(sig, docid)
+	}
+	return added
+}
+
+// addVersion adds version n of docid, unless it has a later one.  The caller
+// must hold the lock.
+func (s *Store) addVersion(sig, docid, n uint64) bool {
+	v, ok := s.versions[docid]
+	if ok && v.n >= n {
+		return false
+	}
+
+	if s.versions == nil {
+		s.versions = make(map[uint64]version)
+	}
+	s.versions[docid] = version{n: n, sig: sig}
+	if ok && v.sig != sig {
+		s.stale++
+	}
+
+	s.add(entry{hash: sig, docid: docid})
+	return true
+}
+
+// Version returns the latest version of docid added with AddVersion, and
+// whether it has one
+func (s *Store) Version(docid uint64) (uint64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	v, ok := s.versions[docid]
+	return v.n, ok
+}
+
+// superseded reports whether sig is the signature of an earlier version of
+// docid than its latest.  The caller must hold the lock.
+func (ts *tombstones) superseded(sig, docid uint64) bool {
+	v, ok := ts.versions[docid]
+	return ok && v.sig != sig
+}
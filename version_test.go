@@ -0,0 +1,84 @@
+package simstore
+
+import (
+	"io"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestAddVersion(t *testing.T) {
+
+	const v1, v2, v3 = 0xffff0000ffff0000, 0x00ff00ff00ff00ff, 0x0f0f0f0f0f0f0f0f
+
+	s := New3(10, NewU64Slice)
+	s.AddVersion(v1, 1, 1)
+	s.AddVersion(v2, 1, 2)
+	s.Add(v1, 2)
+	s.Finish()
+
+	find := func(when string, sig uint64, want []uint64) {
+		t.Helper()
+		if got := s.Find(sig); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: Find(%016x)=%v, want %v", when, sig, got, want)
+		}
+		if got := s.FindInto(sig, nil); !reflect.DeepEqual(got, want) && len(got)+len(want) > 0 {
+			t.Errorf("%s: FindInto(%016x)=%v, want %v", when, sig, got, want)
+		}
+	}
+
+	find("finished", v1, []uint64{2})
+	find("finished", v2, []uint64{1})
+
+	if s.AddVersion(v3, 1, 2) {
+		t.Errorf("AddVersion of a version already added succeeded")
+	}
+	find("an old version", v3, nil)
+
+	// a later version, added since Finish
+	if !s.AddVersion(v3, 1, 5) {
+		t.Errorf("AddVersion of a later version failed")
+	}
+	find("a new version", v2, nil)
+	find("a new version", v3, []uint64{1})
+	if n, ok := s.Version(1); n != 5 || !ok {
+		t.Errorf("Version(1)=%d,%v, want 5,true", n, ok)
+	}
+	if _, ok := s.Version(2); ok {
+		t.Errorf("Version of a document added with Add")
+	}
+
+	if _, err := s.WriteTo(io.Discard); err == nil {
+		t.Errorf("WriteTo of a store with superseded versions succeeded")
+	}
+
+	if removed := s.Compact(); removed != 2 {
+		t.Errorf("Compact removed %d entries, want the 2 earlier versions", removed)
+	}
+	if s.Len() != 2 {
+		t.Errorf("Len after Compact=%d, want 2", s.Len())
+	}
+	find("compacted", v3, []uint64{1})
+	if _, err := s.WriteTo(io.Discard); err != nil {
+		t.Errorf("WriteTo after Compact: %v", err)
+	}
+
+	// the versions are logged
+	path := filepath.Join(t.TempDir(), "store.wal")
+	w, err := OpenWAL(path, New3(0, NewU64Slice))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.s.AddVersion(v1, 1, 1)
+	w.s.AddVersion(v2, 1, 2)
+	w.Close()
+
+	s = New3(0, NewU64Slice)
+	if w, err = OpenWAL(path, s); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	s.Finish()
+	find("replayed", v1, nil)
+	find("replayed", v2, []uint64{1})
+}
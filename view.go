@@ -0,0 +1,98 @@
+package simstore
+
+// Snapshot returns a copy of the store as it is now, which the store's later
+// Adds, Deletes and compactions don't change, for a consistent export or
+// backup of a store which keeps serving.  The copy shares the store's tables,
+// which are never changed once built, so it only costs copies of the entries
+// added since Finish and of the deleted docids.  Changes to the copy don't
+// affect the store either.  A copy of an unfinished store copies its document
+// table, and must be finished itself.  The copy of a store opened with
+// OpenMmap shares its mapping, so it can't be used after the store is closed,
+// but it keeps the store from being garbage collected, which would unmap it.
+//
+// The copy has the store's options, but not its hooks or write-ahead log.
+func (s *Store) Snapshot() *Store {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	v := &Store{
+		docids:  s.docids,
+		rhashes: append([]U64Store(nil), s.rhashes...),
+		perm:    s.perm,
+
+		prefixBlocks: s.prefixBlocks,
+		prefixBits:   s.prefixBits,
+		maxTables:    s.maxTables,
+
+		dedup:     s.dedup,
+		collapsed: s.collapsed,
+
+		docSets: s.docSets,
+		sets:    s.sets,
+
+		indexDocIDs: s.indexDocIDs,
+		bydocid:     s.bydocid,
+
+		orderProbes: s.orderProbes,
+		probes:      append([]int(nil), s.probes...),
+		runLength:   append([]float64(nil), s.runLength...),
+
+		prefixFilters: s.prefixFilters,
+		filters:       append([]*xorFilter(nil), s.filters...),
+
+		maxScan:  s.maxScan,
+		longScan: s.longScan,
+
+		interpolate: s.interpolate,
+		sortBatches: s.sortBatches,
+
+		mapped: s.mapped,
+		owner:  s.owner,
+
+		newStore:   s.newStore,
+		timestamps: s.timestamps,
+
+		finished:  s.finished,
+		pending:   append(table(nil), s.pending...),
+		buildTime: s.buildTime,
+	}
+
+	if s.mapped != nil && s.owner == nil {
+		v.owner = s
+	}
+
+	// Finish sorts the document table in place
+	if !s.finished {
+		v.docids = make(table, 0, len(s.docids)+s.overflow.n)
+		v.docids = append(v.docids, s.docids...)
+		s.overflow.each(func(e entry) { v.docids = append(v.docids, e) })
+	}
+
+	v.ttl, v.stale = s.ttl, s.stale
+	if s.deleted != nil {
+		v.deleted = make(map[uint64]struct{}, len(s.deleted))
+		for id := range s.deleted {
+			v.deleted[id] = struct{}{}
+		}
+	}
+	if s.readded != nil {
+		v.readded = make(map[uint64]int, len(s.readded))
+		for id, i := range s.readded {
+			v.readded[id] = i
+		}
+	}
+	if s.times != nil {
+		v.times = make(map[uint64]int64, len(s.times))
+		for id, t := range s.times {
+			v.times[id] = t
+		}
+	}
+	if s.versions != nil {
+		v.versions = make(map[uint64]version, len(s.versions))
+		for id, ver := range s.versions {
+			v.versions[id] = ver
+		}
+	}
+
+	return v
+}
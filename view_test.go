@@ -0,0 +1,70 @@
+package simstore
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestSnapshotView(t *testing.T) {
+
+	sig := func(i int) uint64 { return uint64(i) * 0x9e3779b97f4a7c15 }
+
+	s := New3(100, NewU64Slice, IndexDocIDs())
+	for i := 0; i < 100; i++ {
+		s.Add(sig(i), uint64(i))
+	}
+	s.Finish()
+	s.Add(sig(100), 100)
+	s.Delete(1)
+
+	v := s.Snapshot()
+
+	// later changes to the store
+	s.Add(sig(101), 101)
+	s.Delete(2)
+	s.Compact()
+
+	same := func(id int, want []uint64) {
+		t.Helper()
+		if got := v.Find(sig(id)); !reflect.DeepEqual(got, want) {
+			t.Errorf("snapshot: Find(sig(%d))=%v, want %v", id, got, want)
+		}
+	}
+	same(1, nil)
+	same(2, []uint64{2})
+	same(100, []uint64{100})
+	same(101, nil)
+
+	// changes to the snapshot
+	v.Delete(3)
+	v.Compact()
+	if got := s.Find(sig(3)); !reflect.DeepEqual(got, []uint64{3}) {
+		t.Errorf("Find in the store after a Delete from the snapshot=%v, want [3]", got)
+	}
+
+	var buf bytes.Buffer
+	if _, err := v.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	r, err := ReadFrom(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Len() != 99 || r.Find(sig(100)) == nil || r.Find(sig(101)) != nil {
+		t.Errorf("snapshot written with %d entries, want 99 without 101", r.Len())
+	}
+
+	// a copy of an unfinished store, past its size hint, is finished apart
+	u := New3(10, NewU64Slice)
+	for i := 0; i < 50; i++ {
+		u.Add(sig(i), uint64(i))
+	}
+	uv := u.Snapshot()
+	u.Add(sig(50), 50)
+	u.Finish()
+	uv.Finish()
+	if uv.Len() != 50 || uv.Find(sig(49)) == nil || uv.Find(sig(50)) != nil || u.Len() != 51 {
+		t.Errorf("copy of an unfinished store has %d entries, want 50, and the store %d, want 51", uv.Len(), u.Len())
+	}
+}
@@ -0,0 +1,50 @@
+package vptree
+
+import (
+	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// SearchAll searches the tree for the k nearest neighbours of each of sigs,
+// as Search does, returning the items and distances found for sigs[i] in
+// results[i] and distances[i].  The searches are shared between GOMAXPROCS
+// goroutines, each reusing its priority queue, for batch jobs such as
+// joining one set of signatures to the nearest of another.
+func (vp *VPTree) SearchAll(sigs []uint64, k int) (results [][]Item, distances [][]float64) {
+
+	results = make([][]Item, len(sigs))
+	distances = make([][]float64, len(sigs))
+
+	if k < 1 || len(sigs) == 0 {
+		return
+	}
+
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(sigs) {
+		workers = len(sigs)
+	}
+
+	// the index of the next signature to search for
+	var next int64
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			h := make(priorityQueue, 0, k)
+			for {
+				i := int(atomic.AddInt64(&next, 1) - 1)
+				if i >= len(sigs) {
+					return
+				}
+				results[i], distances[i] = vp.searchHeap(sigs[i], k, math.MaxFloat64, 0, nil, &h)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return
+}
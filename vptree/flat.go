@@ -0,0 +1,183 @@
+package vptree
+
+import "container/heap"
+
+// flatNode is a node of a flattened tree.  The nodes are in an array in
+// preorder, as they are written by WriteTo, so the left child of a node, if
+// it has one, is the next, and only the index of the right is kept.  It takes
+// 24 bytes, against 64 for a node and the pointers to it.
+type flatNode struct {
+	sig       uint64
+	id        uint64
+	right     uint32 // index of the right child, if flags has hasRight
+	threshold uint8
+	flags     uint8 // hasLeft, hasRight and hasRemoved, as written by WriteTo
+}
+
+// Flatten packs the nodes of the tree into a single array, in the layout of
+// an implicit tree: each node is followed by its left subtree, so only the
+// position of the right child is stored.  Searches of the flattened tree
+// follow no pointers, finding each left child next to its parent, and the
+// tree takes less than half the memory, with nothing for the garbage
+// collector to scan but the payloads.
+// Remove works on the flattened tree, but Add turns it back into nodes first.
+// The tree can have at most 2^32 nodes.
+func (vp *VPTree) Flatten() {
+
+	vp.mu.Lock()
+	defer vp.mu.Unlock()
+
+	vp.flatten()
+}
+
+func (vp *VPTree) flatten() {
+
+	if vp.flat != nil || vp.root == nil {
+		return
+	}
+
+	vp.flat = make([]flatNode, 0, vp.count+vp.removed)
+	vp.payloads = nil
+	vp.appendFlat(vp.root)
+	vp.root = nil
+}
+
+// appendFlat appends the subtree of n to vp.flat in preorder
+func (vp *VPTree) appendFlat(n *node) {
+
+	i := len(vp.flat)
+	vp.flat = append(vp.flat, flatNode{sig: n.Item.Sig, id: n.Item.ID, threshold: uint8(n.Threshold)})
+
+	if n.Item.Payload != nil {
+		if vp.payloads == nil {
+			vp.payloads = make([]interface{}, vp.count+vp.removed)
+		}
+		vp.payloads[i] = n.Item.Payload
+	}
+
+	if n.removed {
+		vp.flat[i].flags |= hasRemoved
+	}
+	if n.Left != nil {
+		vp.flat[i].flags |= hasLeft
+		vp.appendFlat(n.Left)
+	}
+	if n.Right != nil {
+		vp.flat[i].flags |= hasRight
+		vp.flat[i].right = uint32(len(vp.flat))
+		vp.appendFlat(n.Right)
+	}
+}
+
+// unflatten turns a flattened tree back into nodes
+func (vp *VPTree) unflatten() {
+
+	if vp.flat == nil {
+		return
+	}
+
+	vp.root = vp.nodeAt(0)
+	vp.flat = nil
+	vp.payloads = nil
+}
+
+// nodeAt returns the subtree of vp.flat[i] as nodes
+func (vp *VPTree) nodeAt(i uint32) *node {
+
+	f := &vp.flat[i]
+	n := &node{
+		Item:      vp.flatItem(i),
+		Threshold: float64(f.threshold),
+		removed:   f.flags&hasRemoved != 0,
+	}
+	if f.flags&hasLeft != 0 {
+		n.Left = vp.nodeAt(i + 1)
+	}
+	if f.flags&hasRight != 0 {
+		n.Right = vp.nodeAt(f.right)
+	}
+	return n
+}
+
+func (vp *VPTree) flatItem(i uint32) Item {
+	item := Item{Sig: vp.flat[i].sig, ID: vp.flat[i].id}
+	if vp.payloads != nil {
+		item.Payload = vp.payloads[i]
+	}
+	return item
+}
+
+// appendFlatItems appends the items of the flattened tree to dst, leaving out
+// those removed
+func (vp *VPTree) appendFlatItems(dst []Item) []Item {
+	for i := range vp.flat {
+		if vp.flat[i].flags&hasRemoved == 0 {
+			dst = append(dst, vp.flatItem(uint32(i)))
+		}
+	}
+	return dst
+}
+
+// searchFlat is search, for the subtree of vp.flat[i]
+func (vp *VPTree) searchFlat(i uint32, tau *float64, target uint64, k int, keep func(Item) bool, h *priorityQueue, budget *int) {
+	if *budget == 0 {
+		return
+	}
+	*budget--
+
+	f := &vp.flat[i]
+	dist := hamming(f.sig, target)
+
+	if f.flags&hasRemoved == 0 && (dist < *tau || dist == *tau && (h.Len() < k || f.id < h.Top().(*heapItem).Item.ID)) && (keep == nil || keep(vp.flatItem(i))) {
+		if h.Len() == k {
+			heap.Pop(h)
+		}
+		heap.Push(h, &heapItem{vp.flatItem(i), dist})
+		if h.Len() == k {
+			*tau = h.Top().(*heapItem).Dist
+		}
+	}
+
+	threshold := float64(f.threshold)
+	hasL, hasR := f.flags&hasLeft != 0, f.flags&hasRight != 0
+
+	if dist < threshold {
+		if hasL && dist-*tau <= threshold {
+			vp.searchFlat(i+1, tau, target, k, keep, h, budget)
+		}
+
+		if hasR && dist+*tau >= threshold {
+			vp.searchFlat(f.right, tau, target, k, keep, h, budget)
+		}
+	} else {
+		if hasR && dist+*tau >= threshold {
+			vp.searchFlat(f.right, tau, target, k, keep, h, budget)
+		}
+
+		if hasL && dist-*tau <= threshold {
+			vp.searchFlat(i+1, tau, target, k, keep, h, budget)
+		}
+	}
+}
+
+// inRangeFlat is inRange, for the subtree of vp.flat[i]
+func (vp *VPTree) inRangeFlat(i uint32, target uint64, tau float64, h *[]heapItem, nodes *int) {
+	*nodes++
+
+	f := &vp.flat[i]
+	dist := hamming(f.sig, target)
+
+	if f.flags&hasRemoved == 0 && dist <= tau {
+		*h = append(*h, heapItem{vp.flatItem(i), dist})
+	}
+
+	threshold := float64(f.threshold)
+
+	if f.flags&hasLeft != 0 && dist-tau <= threshold {
+		vp.inRangeFlat(i+1, target, tau, h, nodes)
+	}
+
+	if f.flags&hasRight != 0 && dist+tau >= threshold {
+		vp.inRangeFlat(f.right, target, tau, h, nodes)
+	}
+}
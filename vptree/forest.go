@@ -0,0 +1,144 @@
+package vptree
+
+import "sort"
+
+// A Forest is a set of VP-trees of the same items, each built around
+// different vantage points.  An approximate search of the forest merges the
+// nearest items found in each tree, so where the budget of one tree runs out
+// before it reaches some of the nearest items, another tree is likely to have
+// found them, for better recall than a single tree searching as many nodes.
+type Forest struct {
+	trees []*VPTree
+}
+
+// NewForest builds a forest of size trees of items, or of one tree if
+// size < 1
+func NewForest(items []Item, size int) *Forest {
+
+	if size < 1 {
+		size = 1
+	}
+
+	f := &Forest{}
+	for i := 0; i < size; i++ {
+		f.trees = append(f.trees, New(append([]Item(nil), items...)))
+	}
+
+	return f
+}
+
+// Trees returns the trees of the forest
+func (f *Forest) Trees() []*VPTree {
+	return f.trees
+}
+
+// Len returns the number of items in the forest, which is the number in each
+// tree
+func (f *Forest) Len() int {
+	return f.trees[0].Len()
+}
+
+// Search is VPTree.Search.  Each tree finds the same nearest items, so it
+// searches only the first.
+func (f *Forest) Search(target uint64, k int) (results []Item, distances []float64) {
+	return f.trees[0].Search(target, k)
+}
+
+// SearchApprox is VPTree.SearchApprox, searching each tree with a budget of
+// maxNodes and merging the results.  With maxNodes < 1, each tree would find
+// the same items, so it searches only the first, as Search does.
+func (f *Forest) SearchApprox(target uint64, k int, maxNodes int) (results []Item, distances []float64) {
+	if maxNodes < 1 {
+		return f.Search(target, k)
+	}
+	return f.merge(k, func(t *VPTree) ([]Item, []float64) { return t.SearchApprox(target, k, maxNodes) })
+}
+
+// SearchWithin is VPTree.SearchWithin, searching each tree with a budget of
+// maxNodes and merging the results, as SearchApprox does
+func (f *Forest) SearchWithin(target uint64, k int, maxDist float64, maxNodes int) (results []Item, distances []float64) {
+	if maxNodes < 1 {
+		return f.trees[0].SearchWithin(target, k, maxDist, maxNodes)
+	}
+	return f.merge(k, func(t *VPTree) ([]Item, []float64) { return t.SearchWithin(target, k, maxDist, maxNodes) })
+}
+
+// SearchFilter is VPTree.SearchFilter, which is exact, so it searches only
+// the first tree
+func (f *Forest) SearchFilter(target uint64, k int, keep func(Item) bool) (results []Item, distances []float64) {
+	return f.trees[0].SearchFilter(target, k, keep)
+}
+
+// InRange is VPTree.InRange, which is exact, so it searches only the first
+// tree
+func (f *Forest) InRange(sig uint64, maxDistance float64) []Item {
+	return f.trees[0].InRange(sig, maxDistance)
+}
+
+// Add adds item to each tree
+func (f *Forest) Add(item Item) {
+	for _, t := range f.trees {
+		t.Add(item)
+	}
+}
+
+// Remove removes the items with the given ID from each tree, reporting
+// whether there were any
+func (f *Forest) Remove(id uint64) bool {
+	var found bool
+	for _, t := range f.trees {
+		if t.Remove(id) {
+			found = true
+		}
+	}
+	return found
+}
+
+// Instrument makes each tree call the hooks of h, so a search of the forest
+// reports a search of each tree it searches
+func (f *Forest) Instrument(h Hooks) {
+	for _, t := range f.trees {
+		t.Instrument(h)
+	}
+}
+
+// Flatten flattens each tree
+func (f *Forest) Flatten() {
+	for _, t := range f.trees {
+		t.Flatten()
+	}
+}
+
+// merge returns the k nearest of the items found by search in each tree,
+// each once, in order of distance and then of ID
+func (f *Forest) merge(k int, search func(t *VPTree) ([]Item, []float64)) (results []Item, distances []float64) {
+
+	type key struct{ sig, id uint64 }
+	seen := make(map[key]bool)
+
+	var found []heapItem
+	for _, t := range f.trees {
+		items, dists := search(t)
+		for i, item := range items {
+			if key := (key{item.Sig, item.ID}); !seen[key] {
+				seen[key] = true
+				found = append(found, heapItem{item, dists[i]})
+			}
+		}
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].Dist < found[j].Dist || found[i].Dist == found[j].Dist && found[i].Item.ID < found[j].Item.ID
+	})
+
+	if len(found) > k {
+		found = found[:k]
+	}
+
+	for _, hi := range found {
+		results = append(results, hi.Item)
+		distances = append(distances, hi.Dist)
+	}
+
+	return results, distances
+}
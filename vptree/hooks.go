@@ -0,0 +1,23 @@
+package vptree
+
+import "time"
+
+// Hooks are functions a VPTree calls on its operations, so a program can
+// feed them to its own metrics, and tune the budget of its approximate
+// searches.  Each is called on the goroutine of the operation, once it has
+// released the tree's lock, so it must be safe for concurrent use.  A nil
+// hook isn't called.
+type Hooks struct {
+	// OnSearch is called after each search by Search, SearchApprox,
+	// SearchWithin, SearchFilter, SearchAll and InRange, with how long it
+	// took, the number of nodes visited, each costing one distance
+	// computation, and the number of items returned
+	OnSearch func(d time.Duration, nodes, results int)
+}
+
+// Instrument makes the tree call the hooks of h
+func (vp *VPTree) Instrument(h Hooks) {
+	vp.mu.Lock()
+	vp.hooks = h
+	vp.mu.Unlock()
+}
@@ -0,0 +1,113 @@
+package vptree
+
+import "math"
+
+// alpha is how unbalanced a subtree may get by Add before it's rebuilt: each
+// child of a node holds at most this fraction of the node's subtree
+const alpha = 0.7
+
+// Add inserts item into the tree, so later searches can find it without the
+// tree being built again.  The item goes where a search would look for it,
+// and when that makes the path to it much longer than a balanced tree's, the
+// smallest subtree on the path which is too unbalanced is rebuilt, as in a
+// scapegoat tree, so a tree grown by Add stays about as deep as one built by
+// New, at an amortized cost of O(log n) distance computations per item.  The
+// rebuilt subtree leaves out the items removed from it.
+func (vp *VPTree) Add(item Item) {
+
+	vp.mu.Lock()
+	defer vp.mu.Unlock()
+
+	vp.unflatten()
+
+	vp.count++
+
+	if vp.root == nil {
+		vp.root = &node{Item: item}
+		vp.depth = 1
+		return
+	}
+
+	// the nodes from the root to the parent of the new one
+	var path []*node
+	n := vp.root
+	for {
+		path = append(path, n)
+		dist := hamming(item.Sig, n.Item.Sig)
+
+		if n.Left == nil && n.Right == nil {
+			// a leaf becomes the vantage point of its first item
+			n.Threshold = dist
+			n.Left = &node{Item: item}
+			break
+		}
+
+		if dist < n.Threshold || dist == n.Threshold && n.Left == nil {
+			if n.Left == nil {
+				n.Left = &node{Item: item}
+				break
+			}
+			n = n.Left
+		} else {
+			if n.Right == nil {
+				n.Right = &node{Item: item}
+				break
+			}
+			n = n.Right
+		}
+	}
+
+	d := len(path) + 1
+	if d > vp.depth {
+		vp.depth = d
+	}
+
+	if float64(d) <= math.Log(float64(vp.count+vp.removed))/math.Log(1/alpha)+1 {
+		return
+	}
+
+	// find the scapegoat, the lowest node on the path with a child too large
+	// for it, counting the sizes of the subtrees on the way up
+	size := 1
+	for i := len(path) - 1; i >= 0; i-- {
+		p := path[i]
+		total := 1 + subtreeLen(p.Left) + subtreeLen(p.Right)
+		if float64(size) > alpha*float64(total) {
+			live := appendItems(nil, p)
+			vp.removed -= total - len(live)
+			rebuilt := vp.buildFromPoints(live)
+			switch {
+			case i == 0:
+				vp.root = rebuilt
+			case path[i-1].Left == p:
+				path[i-1].Left = rebuilt
+			default:
+				path[i-1].Right = rebuilt
+			}
+			vp.depth = depth(vp.root)
+			return
+		}
+		size = total
+	}
+}
+
+// subtreeLen returns the number of nodes in the subtree of n
+func subtreeLen(n *node) int {
+	if n == nil {
+		return 0
+	}
+	return 1 + subtreeLen(n.Left) + subtreeLen(n.Right)
+}
+
+// appendItems appends the items of the subtree of n to dst, leaving out
+// those removed
+func appendItems(dst []Item, n *node) []Item {
+	if n == nil {
+		return dst
+	}
+	if !n.removed {
+		dst = append(dst, n.Item)
+	}
+	dst = appendItems(dst, n.Left)
+	return appendItems(dst, n.Right)
+}
@@ -5,8 +5,12 @@ type priorityQueue []*heapItem
 func (pq priorityQueue) Len() int { return len(pq) }
 
 func (pq priorityQueue) Less(i, j int) bool {
-	// We want a max-heap, so we use greater-than here
-	return pq[i].Dist > pq[j].Dist
+	// We want a max-heap, so we use greater-than here.  Ties are broken by
+	// ID, so the k nearest are the same whatever the shape of the tree.
+	if pq[i].Dist != pq[j].Dist {
+		return pq[i].Dist > pq[j].Dist
+	}
+	return pq[i].Item.ID > pq[j].Item.ID
 }
 
 func (pq priorityQueue) Swap(i, j int) {
@@ -0,0 +1,54 @@
+package vptree
+
+// Remove removes the items with the given ID from the tree, reporting whether
+// there were any.  The nodes of the items are kept, marked as removed, since
+// they split the rest of the tree, and searches skip them.  They're dropped
+// when Add rebuilds a subtree holding them, or, once they outnumber the items
+// left, by rebuilding the whole tree.  Finding the items takes time linear in
+// the size of the tree, and searches wait for it.
+func (vp *VPTree) Remove(id uint64) bool {
+
+	vp.mu.Lock()
+	defer vp.mu.Unlock()
+
+	var found bool
+
+	for i := range vp.flat {
+		if f := &vp.flat[i]; f.id == id && f.flags&hasRemoved == 0 {
+			f.flags |= hasRemoved
+			vp.count--
+			vp.removed++
+			found = true
+		}
+	}
+
+	stack := []*node{vp.root}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if n == nil {
+			continue
+		}
+		if n.Item.ID == id && !n.removed {
+			n.removed = true
+			vp.count--
+			vp.removed++
+			found = true
+		}
+		stack = append(stack, n.Left, n.Right)
+	}
+
+	if vp.removed > vp.count {
+		flat := vp.flat != nil
+		items := appendItems(vp.appendFlatItems(nil), vp.root)
+		vp.flat, vp.payloads = nil, nil
+		vp.root = vp.buildFromPoints(items)
+		vp.removed = 0
+		vp.depth = depth(vp.root)
+		if flat {
+			vp.flatten()
+		}
+	}
+
+	return found
+}
@@ -0,0 +1,223 @@
+package vptree
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// The format written by WriteTo and read by ReadFrom.  The nodes are in
+// preorder, each followed by its left subtree, if it has one, and then its
+// right.  All integers are little-endian.
+//
+//	magic     [8]byte  "simvptre"
+//	version   uint32
+//	count     uint64   number of nodes, including those removed
+//	count × (
+//	  sig       uint64
+//	  id        uint64
+//	  threshold uint8  hamming distance splitting the subtrees
+//	  flags     uint8  1 if it has a left subtree, | 2 if a right, | 4 if
+//	                   its item was removed
+//	)
+//	crc       uint32   CRC-32C of everything before it
+const (
+	fileMagic   = "simvptre"
+	fileVersion = 1
+
+	headerSize = 8 + 4 + 8
+	nodeSize   = 8 + 8 + 1 + 1
+
+	hasLeft    = 1
+	hasRight   = 2
+	hasRemoved = 4
+)
+
+// ErrFormat is returned by ReadFrom for a tree which is truncated, corrupt or
+// of an unknown version
+var ErrFormat = errors.New("vptree: invalid tree file")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// WriteTo writes the tree to w, to be loaded by ReadFrom instead of being
+// built again.  Each node takes 18 bytes.  Payloads aren't written, so the
+// items of the tree read back have none.  Add and Remove wait until it's
+// written.
+func (vp *VPTree) WriteTo(w io.Writer) (int64, error) {
+
+	vp.mu.RLock()
+	defer vp.mu.RUnlock()
+
+	cw := &crcWriter{w: bufio.NewWriterSize(w, 1<<16)}
+
+	var buf [headerSize]byte
+	copy(buf[:], fileMagic)
+	binary.LittleEndian.PutUint32(buf[8:], fileVersion)
+	binary.LittleEndian.PutUint64(buf[12:], uint64(vp.count+vp.removed))
+	cw.Write(buf[:])
+
+	// a flattened tree is in preorder already
+	for i := range vp.flat {
+		f := &vp.flat[i]
+		var rec [nodeSize]byte
+		binary.LittleEndian.PutUint64(rec[0:], f.sig)
+		binary.LittleEndian.PutUint64(rec[8:], f.id)
+		rec[16] = f.threshold
+		rec[17] = f.flags
+		cw.Write(rec[:])
+	}
+
+	// preorder, without recursion
+	stack := []*node{vp.root}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if n == nil {
+			continue
+		}
+
+		var rec [nodeSize]byte
+		binary.LittleEndian.PutUint64(rec[0:], n.Item.Sig)
+		binary.LittleEndian.PutUint64(rec[8:], n.Item.ID)
+		rec[16] = uint8(n.Threshold)
+		if n.Left != nil {
+			rec[17] |= hasLeft
+		}
+		if n.Right != nil {
+			rec[17] |= hasRight
+		}
+		if n.removed {
+			rec[17] |= hasRemoved
+		}
+		cw.Write(rec[:])
+
+		stack = append(stack, n.Right, n.Left)
+	}
+
+	var crc [4]byte
+	binary.LittleEndian.PutUint32(crc[:], cw.crc)
+	cw.Write(crc[:])
+
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.n, cw.err
+}
+
+// crcWriter writes to a buffered writer, keeping the checksum and length of
+// what was written and the first error
+type crcWriter struct {
+	w   *bufio.Writer
+	crc uint32
+	n   int64
+	err error
+}
+
+func (cw *crcWriter) Write(b []byte) {
+	if cw.err != nil {
+		return
+	}
+	cw.crc = crc32.Update(cw.crc, castagnoli, b)
+	var n int
+	n, cw.err = cw.w.Write(b)
+	cw.n += int64(n)
+}
+
+// ReadFrom reads a tree written by WriteTo.  It reads exactly the bytes of
+// the tree from r.
+func ReadFrom(r io.Reader) (*VPTree, error) {
+
+	var crc uint32
+	read := func(b []byte) error {
+		if _, err := io.ReadFull(r, b); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return ErrFormat
+			}
+			return err
+		}
+		crc = crc32.Update(crc, castagnoli, b)
+		return nil
+	}
+
+	var hdr [headerSize]byte
+	if err := read(hdr[:]); err != nil {
+		return nil, err
+	}
+	if string(hdr[:8]) != fileMagic || binary.LittleEndian.Uint32(hdr[8:]) != fileVersion {
+		return nil, ErrFormat
+	}
+	count := binary.LittleEndian.Uint64(hdr[12:])
+
+	// each node waits on the stack for the subtree its next child is the
+	// root of
+	type pending struct {
+		n        *node
+		children uint8
+	}
+
+	vp := &VPTree{}
+	var stack []pending
+	var rec [nodeSize]byte
+	for i := uint64(0); i < count; i++ {
+		if err := read(rec[:]); err != nil {
+			return nil, err
+		}
+
+		n := &node{
+			Item:      Item{Sig: binary.LittleEndian.Uint64(rec[0:]), ID: binary.LittleEndian.Uint64(rec[8:])},
+			Threshold: float64(rec[16]),
+		}
+
+		switch {
+		case i == 0:
+			vp.root = n
+		case len(stack) == 0:
+			// a node after the whole tree
+			return nil, ErrFormat
+		default:
+			p := &stack[len(stack)-1]
+			if p.children&hasLeft != 0 {
+				p.n.Left = n
+				p.children &^= hasLeft
+			} else {
+				p.n.Right = n
+				p.children &^= hasRight
+			}
+			if p.children == 0 {
+				stack = stack[:len(stack)-1]
+			}
+		}
+
+		flags := rec[17]
+		if flags&^(hasLeft|hasRight|hasRemoved) != 0 {
+			return nil, ErrFormat
+		}
+		if flags&hasRemoved != 0 {
+			n.removed = true
+			vp.removed++
+		}
+		if c := flags & (hasLeft | hasRight); c != 0 {
+			stack = append(stack, pending{n: n, children: c})
+		}
+	}
+
+	// a node still missing a subtree
+	if len(stack) > 0 {
+		return nil, ErrFormat
+	}
+
+	want := crc
+	var sum [4]byte
+	if err := read(sum[:]); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(sum[:]) != want {
+		return nil, ErrFormat
+	}
+
+	vp.count = int(count) - vp.removed
+	vp.depth = depth(vp.root)
+	return vp, nil
+}
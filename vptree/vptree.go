@@ -4,13 +4,20 @@ import (
 	"container/heap"
 	"math"
 	"math/rand"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/dgryski/go-simstore/simhash"
 )
 
 type Item struct {
-	Sig  uint64
-	ID uint64
+	Sig uint64
+	ID  uint64
+
+	// Payload is carried with the item and returned with it by searches,
+	// for metadata the caller would otherwise look up by ID
+	Payload interface{}
 }
 
 func hamming(a, b uint64) float64 { return float64(simhash.Distance(a, b)) }
@@ -20,6 +27,10 @@ type node struct {
 	Threshold float64
 	Left      *node
 	Right     *node
+
+	// removed is set by Remove; the node still splits its subtrees, but
+	// its item isn't returned by searches
+	removed bool
 }
 
 type heapItem struct {
@@ -29,34 +40,145 @@ type heapItem struct {
 
 // A VPTree struct represents a Vantage-point tree. Vantage-point trees are
 // useful for nearest-neighbour searches in high-dimensional metric spaces.
+// Its methods are safe for concurrent use: searches run in parallel, and Add
+// and Remove wait for them to finish.
 type VPTree struct {
-	root *node
+	// mu is held for writing by Add and Remove, and for reading by the
+	// rest
+	mu sync.RWMutex
+
+	root  *node
+	count int
+	depth int
+
+	// removed is the number of nodes whose items were removed
+	removed int
+
+	// flat holds the nodes instead of root once the tree is flattened, and
+	// payloads the payloads of their items, if any have one
+	flat     []flatNode
+	payloads []interface{}
+
+	hooks Hooks
 }
 
 // New creates a new VP-tree using the metric and items provided. The metric
 // measures the distance between two items, so that the VP-tree can find the
 // nearest neighbour(s) of a target item.
 func New(items []Item) (t *VPTree) {
-	t = &VPTree{}
+	t = &VPTree{count: len(items)}
 	t.root = t.buildFromPoints(items)
+	t.depth = depth(t.root)
 	return
 }
 
+// Len returns the number of items in the tree, not counting those removed
+func (vp *VPTree) Len() int {
+	vp.mu.RLock()
+	defer vp.mu.RUnlock()
+	return vp.count
+}
+
+// Depth returns the number of nodes on the longest path from the root to a
+// leaf.  A balanced tree has a depth of about log2(Len()).
+func (vp *VPTree) Depth() int {
+	vp.mu.RLock()
+	defer vp.mu.RUnlock()
+	return vp.depth
+}
+
+func depth(n *node) int {
+	if n == nil {
+		return 0
+	}
+
+	l, r := depth(n.Left), depth(n.Right)
+	if l > r {
+		return l + 1
+	}
+	return r + 1
+}
+
 // Search searches the VP-tree for the k nearest neighbours of target. It
 // returns the up to k narest neighbours and the corresponding distances in
-// order of least distance to largest distance.
+// order of least distance to largest distance, and then of ID.  Of the items
+// tied at the distance of the k-th, those with the lowest IDs are returned,
+// so trees built from the same items give the same results, even though
+// their vantage points are chosen at random.
 func (vp *VPTree) Search(target uint64, k int) (results []Item, distances []float64) {
+	return vp.SearchApprox(target, k, 0)
+}
+
+// SearchApprox is Search, visiting at most maxNodes nodes of the tree, or all
+// of them if maxNodes < 1.  The nearest subtrees are visited first, so a
+// small budget returns items close to target quickly, though some of the k
+// nearest may be missed for others farther away.  The distances returned are
+// exact.
+func (vp *VPTree) SearchApprox(target uint64, k int, maxNodes int) (results []Item, distances []float64) {
 	if k < 1 {
 		return
 	}
 
 	h := make(priorityQueue, 0, k)
+	return vp.searchHeap(target, k, math.MaxFloat64, maxNodes, nil, &h)
+}
+
+// SearchWithin is SearchApprox, returning only the items within maxDist of
+// target, so there may be fewer than k.  It's faster than filtering the
+// results of SearchApprox, since the subtrees farther away are skipped.
+func (vp *VPTree) SearchWithin(target uint64, k int, maxDist float64, maxNodes int) (results []Item, distances []float64) {
+	if k < 1 || maxDist < 0 {
+		return
+	}
 
-	tau := math.MaxFloat64
-	vp.search(vp.root, &tau, target, k, &h)
+	h := make(priorityQueue, 0, k)
+	return vp.searchHeap(target, k, maxDist, maxNodes, nil, &h)
+}
+
+// SearchFilter is Search, returning the k nearest items for which keep
+// returns true.  The others are skipped as removed items are, so it's faster
+// than searching for more than k items and filtering them, and never returns
+// fewer than k while there are more to find.  keep is called during the
+// search, with the tree locked for reading, so it mustn't Add to or Remove
+// from it, and only for items near enough to be among the k nearest.
+func (vp *VPTree) SearchFilter(target uint64, k int, keep func(Item) bool) (results []Item, distances []float64) {
+	if k < 1 {
+		return
+	}
+
+	h := make(priorityQueue, 0, k)
+	return vp.searchHeap(target, k, math.MaxFloat64, 0, keep, &h)
+}
+
+// searchHeap is SearchWithin, or SearchFilter if keep isn't nil, with h an
+// empty heap to keep the nearest items in.  It's left empty again, to be
+// reused.
+func (vp *VPTree) searchHeap(target uint64, k int, maxDist float64, maxNodes int, keep func(Item) bool, h *priorityQueue) (results []Item, distances []float64) {
+
+	var start time.Time
+	vp.mu.RLock()
+	onSearch := vp.hooks.OnSearch
+	if onSearch != nil {
+		start = time.Now()
+	}
+
+	budget := maxNodes
+	if budget < 1 {
+		// never reaches 0
+		budget = -1
+	}
+	initial := budget
+
+	tau := maxDist
+	if vp.flat != nil {
+		vp.searchFlat(0, &tau, target, k, keep, h, &budget)
+	} else {
+		vp.search(vp.root, &tau, target, k, keep, h, &budget)
+	}
+	vp.mu.RUnlock()
 
 	for h.Len() > 0 {
-		hi := heap.Pop(&h)
+		hi := heap.Pop(h)
 		results = append(results, hi.(*heapItem).Item)
 		distances = append(distances, hi.(*heapItem).Dist)
 	}
@@ -68,9 +190,71 @@ func (vp *VPTree) Search(target uint64, k int) (results []Item, distances []floa
 		distances[i], distances[j] = distances[j], distances[i]
 	}
 
+	if onSearch != nil {
+		onSearch(time.Since(start), initial-budget, len(results))
+	}
+
 	return
 }
 
+// InRange returns every item within maxDistance of sig, in order of least
+// distance to largest, and then of ID.
+func (vp *VPTree) InRange(sig uint64, maxDistance float64) []Item {
+
+	var start time.Time
+	var h []heapItem
+	var nodes int
+	vp.mu.RLock()
+	onSearch := vp.hooks.OnSearch
+	if onSearch != nil {
+		start = time.Now()
+	}
+	if vp.flat != nil {
+		vp.inRangeFlat(0, sig, maxDistance, &h, &nodes)
+	} else {
+		vp.inRange(vp.root, sig, maxDistance, &h, &nodes)
+	}
+	vp.mu.RUnlock()
+
+	sort.Slice(h, func(i, j int) bool {
+		return h[i].Dist < h[j].Dist || h[i].Dist == h[j].Dist && h[i].Item.ID < h[j].Item.ID
+	})
+
+	var results []Item
+	for _, hi := range h {
+		results = append(results, hi.Item)
+	}
+
+	if onSearch != nil {
+		onSearch(time.Since(start), nodes, len(results))
+	}
+
+	return results
+}
+
+// inRange appends the items of the subtree of n within tau of target to h,
+// counting the nodes visited in nodes
+func (vp *VPTree) inRange(n *node, target uint64, tau float64, h *[]heapItem, nodes *int) {
+	if n == nil {
+		return
+	}
+	*nodes++
+
+	dist := hamming(n.Item.Sig, target)
+
+	if !n.removed && dist <= tau {
+		*h = append(*h, heapItem{n.Item, dist})
+	}
+
+	if dist-tau <= n.Threshold {
+		vp.inRange(n.Left, target, tau, h, nodes)
+	}
+
+	if dist+tau >= n.Threshold {
+		vp.inRange(n.Right, target, tau, h, nodes)
+	}
+}
+
 func (vp *VPTree) buildFromPoints(items []Item) (n *node) {
 	if len(items) == 0 {
 		return nil
@@ -108,14 +292,18 @@ func (vp *VPTree) buildFromPoints(items []Item) (n *node) {
 	return
 }
 
-func (vp *VPTree) search(n *node, tau *float64, target uint64, k int, h *priorityQueue) {
-	if n == nil {
+// search visits the subtree of n while budget, the number of nodes left to
+// visit, isn't 0, skipping the items keep, if set, returns false for
+func (vp *VPTree) search(n *node, tau *float64, target uint64, k int, keep func(Item) bool, h *priorityQueue, budget *int) {
+	if n == nil || *budget == 0 {
 		return
 	}
+	*budget--
 
 	dist := hamming(n.Item.Sig, target)
 
-	if dist < *tau {
+	// a removed node's item is skipped, but it still guides the search
+	if !n.removed && (dist < *tau || dist == *tau && (h.Len() < k || n.Item.ID < h.Top().(*heapItem).Item.ID)) && (keep == nil || keep(n.Item)) {
 		if h.Len() == k {
 			heap.Pop(h)
 		}
@@ -131,19 +319,19 @@ func (vp *VPTree) search(n *node, tau *float64, target uint64, k int, h *priorit
 
 	if dist < n.Threshold {
 		if dist-*tau <= n.Threshold {
-			vp.search(n.Left, tau, target, k, h)
+			vp.search(n.Left, tau, target, k, keep, h, budget)
 		}
 
 		if dist+*tau >= n.Threshold {
-			vp.search(n.Right, tau, target, k, h)
+			vp.search(n.Right, tau, target, k, keep, h, budget)
 		}
 	} else {
 		if dist+*tau >= n.Threshold {
-			vp.search(n.Right, tau, target, k, h)
+			vp.search(n.Right, tau, target, k, keep, h, budget)
 		}
 
 		if dist-*tau <= n.Threshold {
-			vp.search(n.Left, tau, target, k, h)
+			vp.search(n.Left, tau, target, k, keep, h, budget)
 		}
 	}
 }
@@ -1,8 +1,15 @@
 package vptree
 
 import (
+	"bytes"
 	"container/heap"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
+	"unsafe"
 )
 
 // This helper function compares two sets of coordinates/distances to make sure
@@ -80,10 +87,10 @@ func TestEmpty(t *testing.T) {
 // the right results
 func TestSmall(t *testing.T) {
 	items := []Item{
-		Item{0xdeadbeef, 57},
-		Item{0xcabba9e5, 28},
-		Item{0xcafebabe, 48},
-		Item{0xc0cac0ca, 42},
+		Item{Sig: 0xdeadbeef, ID: 57},
+		Item{Sig: 0xcabba9e5, ID: 28},
+		Item{Sig: 0xcafebabe, ID: 48},
+		Item{Sig: 0xc0cac0ca, ID: 42},
 	}
 
 	target := uint64(0xcafef00d)
@@ -98,3 +105,673 @@ func TestSmall(t *testing.T) {
 
 	compareCoordDistSets(t, coords1, coords2, distances1, distances2)
 }
+
+// This test checks the size and depth reported for known and built trees
+func TestLenDepth(t *testing.T) {
+	vp := New(nil)
+	if vp.Len() != 0 || vp.Depth() != 0 {
+		t.Errorf("empty tree: Len()=%d Depth()=%d, want 0 0", vp.Len(), vp.Depth())
+	}
+
+	// a hand-built tree with a longest path of 3 nodes
+	vp = &VPTree{root: &node{
+		Left: &node{
+			Right: &node{},
+		},
+		Right: &node{},
+	}}
+	if d := depth(vp.root); d != 3 {
+		t.Errorf("depth()=%d, want 3", d)
+	}
+
+	var items []Item
+	for i := 0; i < 1000; i++ {
+		items = append(items, Item{Sig: uint64(rand.Int63()), ID: uint64(i)})
+	}
+
+	vp = New(items)
+
+	if vp.Len() != 1000 {
+		t.Errorf("Len()=%d, want 1000", vp.Len())
+	}
+
+	// log2(1000) ~ 10; allow some slack for the uneven hamming distance splits
+	if d := vp.Depth(); d < 10 || d > 30 {
+		t.Errorf("Depth()=%d, want ~10", d)
+	}
+}
+
+func TestTies(t *testing.T) {
+
+	// many items at each distance from the target
+	var items []Item
+	for i := 0; i < 1000; i++ {
+		items = append(items, Item{Sig: 1<<uint(i%64) | 1<<uint((i/64)%64), ID: uint64(i)})
+	}
+	rand.Shuffle(len(items), func(i, j int) { items[i], items[j] = items[j], items[i] })
+
+	for _, k := range []int{1, 10, 100, 500} {
+		wantCoords, wantDists := nearestNeighbours(0, items, k)
+		for i := 0; i < 5; i++ {
+			vp := New(append([]Item(nil), items...))
+			coords, dists := vp.Search(0, k)
+			compareCoordDistSets(t, coords, wantCoords, dists, wantDists)
+		}
+	}
+}
+
+func TestSearchApprox(t *testing.T) {
+
+	var items []Item
+	for i := 0; i < 1000; i++ {
+		items = append(items, Item{Sig: uint64(rand.Int63()), ID: uint64(i)})
+	}
+
+	vp := New(append([]Item(nil), items...))
+
+	for i := 0; i < 20; i++ {
+		target := uint64(rand.Int63())
+		wantCoords, wantDists := nearestNeighbours(target, items, 10)
+
+		// a budget of every node is exact
+		coords, dists := vp.SearchApprox(target, 10, len(items))
+		compareCoordDistSets(t, coords, wantCoords, dists, wantDists)
+
+		for _, maxNodes := range []int{1, 10, 50, 200} {
+			coords, dists := vp.SearchApprox(target, 10, maxNodes)
+
+			want := 10
+			if maxNodes < want {
+				want = maxNodes
+			}
+			if len(coords) != want || len(dists) != want {
+				t.Fatalf("SearchApprox(%d) returned %d items, want %d", maxNodes, len(coords), want)
+			}
+
+			// the i-th nearest found is never nearer than the true i-th
+			for j := range coords {
+				if d := hamming(coords[j].Sig, target); d != dists[j] || d < wantDists[j] || j > 0 && d < dists[j-1] {
+					t.Errorf("SearchApprox(%d)[%d]: distance %v (reported %v), true %d-th nearest %v", maxNodes, j, d, dists[j], j, wantDists[j])
+				}
+			}
+		}
+	}
+}
+
+func TestSearchWithin(t *testing.T) {
+
+	var items []Item
+	for i := 0; i < 1000; i++ {
+		items = append(items, Item{Sig: uint64(rand.Int63()), ID: uint64(i)})
+	}
+
+	vp := New(append([]Item(nil), items...))
+
+	for i := 0; i < 20; i++ {
+		target := uint64(rand.Int63())
+		for _, maxDist := range []float64{0, 20, 24, 64} {
+			wantCoords, wantDists := nearestNeighbours(target, items, 10)
+			for len(wantCoords) > 0 && wantDists[len(wantCoords)-1] > maxDist {
+				wantCoords, wantDists = wantCoords[:len(wantCoords)-1], wantDists[:len(wantDists)-1]
+			}
+
+			coords, dists := vp.SearchWithin(target, 10, maxDist, 0)
+			compareCoordDistSets(t, coords, wantCoords, dists, wantDists)
+		}
+	}
+
+	if coords, _ := vp.SearchWithin(items[0].Sig, 10, -1, 0); coords != nil {
+		t.Errorf("SearchWithin(maxDist=-1) returned %v, want nothing", coords)
+	}
+}
+
+func TestSearchFilter(t *testing.T) {
+
+	var items []Item
+	for i := 0; i < 1000; i++ {
+		items = append(items, Item{Sig: uint64(rand.Int63()), ID: uint64(i)})
+	}
+
+	vp := New(append([]Item(nil), items...))
+
+	// the odd ids, of which there are fewer than k for a large k
+	odd := func(item Item) bool { return item.ID%2 == 1 }
+	var kept []Item
+	for _, item := range items {
+		if odd(item) {
+			kept = append(kept, item)
+		}
+	}
+
+	for _, flat := range []bool{false, true} {
+		if flat {
+			vp.Flatten()
+		}
+		for i := 0; i < 20; i++ {
+			target := uint64(rand.Int63())
+			for _, k := range []int{1, 10, 600} {
+				wantCoords, wantDists := nearestNeighbours(target, kept, k)
+				coords, dists := vp.SearchFilter(target, k, odd)
+				compareCoordDistSets(t, coords, wantCoords, dists, wantDists)
+			}
+		}
+	}
+}
+
+func TestSearchAll(t *testing.T) {
+
+	var items []Item
+	for i := 0; i < 1000; i++ {
+		items = append(items, Item{Sig: uint64(rand.Int63()), ID: uint64(i)})
+	}
+
+	vp := New(append([]Item(nil), items...))
+
+	var sigs []uint64
+	for i := 0; i < 100; i++ {
+		sigs = append(sigs, uint64(rand.Int63()))
+	}
+
+	results, distances := vp.SearchAll(sigs, 10)
+	if len(results) != len(sigs) || len(distances) != len(sigs) {
+		t.Fatalf("SearchAll returned %d results and %d distances, want %d", len(results), len(distances), len(sigs))
+	}
+
+	for i, sig := range sigs {
+		wantCoords, wantDists := nearestNeighbours(sig, items, 10)
+		compareCoordDistSets(t, results[i], wantCoords, distances[i], wantDists)
+	}
+
+	if results, _ := vp.SearchAll(sigs, 0); len(results) != len(sigs) || results[0] != nil {
+		t.Errorf("SearchAll(k=0) returned %v, want no items for each", results[:1])
+	}
+}
+
+func TestForest(t *testing.T) {
+
+	var items []Item
+	for i := 0; i < 1000; i++ {
+		items = append(items, Item{Sig: uint64(rand.Int63()), ID: uint64(i)})
+	}
+
+	f := NewForest(items, 4)
+	if len(f.Trees()) != 4 || f.Len() != len(items) {
+		t.Fatalf("NewForest: %d trees of %d items, want 4 of %d", len(f.Trees()), f.Len(), len(items))
+	}
+
+	for i := 0; i < 20; i++ {
+		target := uint64(rand.Int63())
+		wantCoords, wantDists := nearestNeighbours(target, items, 10)
+
+		coords, dists := f.SearchApprox(target, 10, 0)
+		compareCoordDistSets(t, coords, wantCoords, dists, wantDists)
+
+		// merging finds each of the nearest at least as near as any one
+		// tree does
+		coords, dists = f.SearchApprox(target, 10, 50)
+		if len(coords) != 10 {
+			t.Fatalf("SearchApprox returned %d items, want 10", len(coords))
+		}
+		for _, tree := range f.Trees() {
+			_, treeDists := tree.SearchApprox(target, 10, 50)
+			for j := range dists {
+				if dists[j] > treeDists[j] || dists[j] < wantDists[j] {
+					t.Errorf("SearchApprox[%d]=%v, a tree found %v, the nearest is %v", j, dists[j], treeDists[j], wantDists[j])
+				}
+			}
+		}
+		seen := make(map[uint64]bool)
+		for _, c := range coords {
+			if seen[c.ID] {
+				t.Errorf("SearchApprox returned %d twice", c.ID)
+			}
+			seen[c.ID] = true
+		}
+	}
+
+	if !f.Remove(0) || f.Remove(0) || f.Len() != len(items)-1 {
+		t.Errorf("Remove(0) twice: Len()=%d, want %d", f.Len(), len(items)-1)
+	}
+	f.Add(items[0])
+	for _, tree := range f.Trees() {
+		if tree.Len() != len(items) {
+			t.Errorf("tree of %d items after Add, want %d", tree.Len(), len(items))
+		}
+	}
+}
+
+func TestInRange(t *testing.T) {
+
+	var items []Item
+	for i := 0; i < 1000; i++ {
+		items = append(items, Item{Sig: uint64(rand.Int63()), ID: uint64(i)})
+	}
+
+	vp := New(append([]Item(nil), items...))
+
+	for i := 0; i < 20; i++ {
+		target := uint64(rand.Int63())
+		for _, r := range []float64{0, 20, 28, 64} {
+			// all the items, nearest first, up to the last within r
+			want, dists := nearestNeighbours(target, items, len(items))
+			for len(want) > 0 && dists[len(want)-1] > r {
+				want = want[:len(want)-1]
+			}
+
+			got := vp.InRange(target, r)
+			if len(got) != len(want) {
+				t.Errorf("InRange(%x, %v) returned %d items, want %d", target, r, len(got), len(want))
+				continue
+			}
+			for j := range got {
+				if got[j] != want[j] {
+					t.Errorf("InRange(%x, %v)[%d]=%v, want %v", target, r, j, got[j], want[j])
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestAdd(t *testing.T) {
+
+	var items []Item
+	for i := 0; i < 2000; i++ {
+		items = append(items, Item{Sig: uint64(rand.Int63()), ID: uint64(i)})
+	}
+
+	// half built up front and half added, and all added to an empty tree
+	half := New(append([]Item(nil), items[:1000]...))
+	empty := New(nil)
+	for i, item := range items {
+		if i >= 1000 {
+			half.Add(item)
+		}
+		empty.Add(item)
+	}
+
+	for _, vp := range []*VPTree{half, empty} {
+		if vp.Len() != len(items) {
+			t.Errorf("Len()=%d, want %d", vp.Len(), len(items))
+		}
+
+		if d := vp.Depth(); d != depth(vp.root) || d > 40 {
+			t.Errorf("Depth()=%d depth()=%d, want ~11", d, depth(vp.root))
+		}
+
+		for i := 0; i < 20; i++ {
+			target := uint64(rand.Int63())
+			wantCoords, wantDists := nearestNeighbours(target, items, 10)
+			coords, dists := vp.Search(target, 10)
+			compareCoordDistSets(t, coords, wantCoords, dists, wantDists)
+		}
+	}
+}
+
+func TestRemove(t *testing.T) {
+
+	var items []Item
+	for i := 0; i < 1000; i++ {
+		items = append(items, Item{Sig: uint64(rand.Int63()), ID: uint64(i)})
+	}
+
+	vp := New(append([]Item(nil), items...))
+
+	if vp.Remove(5000) {
+		t.Errorf("Remove(5000)=true for a missing id")
+	}
+
+	check := func(live []Item) {
+		t.Helper()
+		if vp.Len() != len(live) {
+			t.Errorf("Len()=%d, want %d", vp.Len(), len(live))
+		}
+		for i := 0; i < 20; i++ {
+			target := uint64(rand.Int63())
+			wantCoords, wantDists := nearestNeighbours(target, live, 10)
+			coords, dists := vp.Search(target, 10)
+			compareCoordDistSets(t, coords, wantCoords, dists, wantDists)
+		}
+	}
+
+	// tombstones: every third item
+	var live []Item
+	for _, item := range items {
+		if item.ID%3 == 0 {
+			if !vp.Remove(item.ID) {
+				t.Errorf("Remove(%d)=false", item.ID)
+			}
+		} else {
+			live = append(live, item)
+		}
+	}
+	if vp.Remove(0) {
+		t.Errorf("Remove(0)=true for an id already removed")
+	}
+	if vp.removed != 334 {
+		t.Errorf("removed=%d, want 334", vp.removed)
+	}
+	check(live)
+
+	// removed nodes survive a round trip
+	var buf bytes.Buffer
+	if _, err := vp.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	vp, err := ReadFrom(&buf)
+	if err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+	if vp.removed != 334 {
+		t.Errorf("removed=%d after ReadFrom, want 334", vp.removed)
+	}
+	check(live)
+
+	// once removed items outnumber the rest the tree is rebuilt without them
+	var rest []Item
+	for _, item := range live {
+		if item.ID%3 == 1 {
+			vp.Remove(item.ID)
+		} else {
+			rest = append(rest, item)
+		}
+	}
+	if vp.removed >= 334 || vp.removed > vp.Len() || subtreeLen(vp.root) != len(rest)+vp.removed || vp.Depth() != depth(vp.root) {
+		t.Errorf("removed=%d nodes=%d Depth()=%d, want a rebuild", vp.removed, subtreeLen(vp.root), vp.Depth())
+	}
+	check(rest)
+
+	// and a removed item can be added back
+	vp.Add(items[0])
+	check(append(rest, items[0]))
+}
+
+func TestConcurrent(t *testing.T) {
+
+	var items []Item
+	for i := 0; i < 2000; i++ {
+		items = append(items, Item{Sig: uint64(rand.Int63()), ID: uint64(i)})
+	}
+
+	vp := New(append([]Item(nil), items[:1000]...))
+
+	var wg sync.WaitGroup
+	wg.Add(4)
+	go func() {
+		defer wg.Done()
+		for _, item := range items[1000:] {
+			vp.Add(item)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for id := uint64(0); id < 1000; id += 10 {
+			vp.Remove(id)
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				vp.Search(uint64(rand.Int63()), 10)
+				vp.InRange(uint64(rand.Int63()), 16)
+				vp.Len()
+			}
+		}()
+	}
+	wg.Wait()
+
+	var live []Item
+	for _, item := range items {
+		if item.ID >= 1000 || item.ID%10 != 0 {
+			live = append(live, item)
+		}
+	}
+
+	if vp.Len() != len(live) {
+		t.Errorf("Len()=%d, want %d", vp.Len(), len(live))
+	}
+	for i := 0; i < 20; i++ {
+		target := uint64(rand.Int63())
+		wantCoords, wantDists := nearestNeighbours(target, live, 10)
+		coords, dists := vp.Search(target, 10)
+		compareCoordDistSets(t, coords, wantCoords, dists, wantDists)
+	}
+}
+
+func TestInstrument(t *testing.T) {
+
+	var items []Item
+	for i := 0; i < 1000; i++ {
+		items = append(items, Item{Sig: uint64(rand.Int63()), ID: uint64(i)})
+	}
+
+	vp := New(append([]Item(nil), items...))
+
+	var calls, nodes, results int
+	vp.Instrument(Hooks{OnSearch: func(d time.Duration, n, r int) {
+		calls++
+		nodes, results = n, r
+	}})
+
+	for _, flat := range []bool{false, true} {
+		if flat {
+			vp.Flatten()
+		}
+
+		// every node is visited to find them all
+		vp.Search(0, len(items))
+		if nodes != len(items) || results != len(items) {
+			t.Errorf("flat=%v: Search of all: %d nodes, %d results, want %d", flat, nodes, results, len(items))
+		}
+
+		vp.SearchApprox(0, 10, 50)
+		if nodes != 50 || results != 10 {
+			t.Errorf("flat=%v: SearchApprox: %d nodes, %d results, want 50 10", flat, nodes, results)
+		}
+
+		vp.InRange(0, 64)
+		if nodes != len(items) || results != len(items) {
+			t.Errorf("flat=%v: InRange of all: %d nodes, %d results, want %d", flat, nodes, results, len(items))
+		}
+
+		// a near search visits few
+		vp.Search(items[0].Sig, 1)
+		if nodes == 0 || nodes >= len(items) || results != 1 {
+			t.Errorf("flat=%v: Search: %d nodes, %d results", flat, nodes, results)
+		}
+	}
+
+	if calls != 8 {
+		t.Errorf("OnSearch called %d times, want 8", calls)
+	}
+}
+
+func TestPayload(t *testing.T) {
+
+	type doc struct{ url string }
+
+	var items []Item
+	for i := 0; i < 100; i++ {
+		items = append(items, Item{Sig: uint64(rand.Int63()), ID: uint64(i), Payload: &doc{fmt.Sprint("doc", i)}})
+	}
+
+	vp := New(append([]Item(nil), items[:50]...))
+	for _, item := range items[50:] {
+		vp.Add(item)
+	}
+
+	for _, item := range items {
+		found, _ := vp.Search(item.Sig, 1)
+		if len(found) != 1 || found[0].Payload != item.Payload {
+			t.Errorf("Search(%x) returned %v, want %v", item.Sig, found, item)
+		}
+
+		found = vp.InRange(item.Sig, 0)
+		if len(found) != 1 || found[0].Payload.(*doc).url != fmt.Sprint("doc", item.ID) {
+			t.Errorf("InRange(%x, 0) returned %v, want %v", item.Sig, found, item)
+		}
+	}
+
+	// payloads aren't written
+	var buf bytes.Buffer
+	if _, err := vp.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	vp, err := ReadFrom(&buf)
+	if err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+	found, _ := vp.Search(items[0].Sig, 1)
+	if want := (Item{Sig: items[0].Sig, ID: items[0].ID}); len(found) != 1 || found[0] != want {
+		t.Errorf("Search after ReadFrom returned %v, want %v", found, want)
+	}
+}
+
+func TestFlatten(t *testing.T) {
+
+	if size := unsafe.Sizeof(flatNode{}); size != 24 {
+		t.Errorf("flatNode takes %d bytes, want 24", size)
+	}
+
+	var items []Item
+	for i := 0; i < 1000; i++ {
+		items = append(items, Item{Sig: uint64(rand.Int63()), ID: uint64(i), Payload: i})
+	}
+
+	vp := New(append([]Item(nil), items...))
+	for id := uint64(0); id < 100; id++ {
+		vp.Remove(id)
+	}
+
+	var before bytes.Buffer
+	vp.WriteTo(&before)
+
+	// two copies of the tree, one of them flattened
+	vp, _ = ReadFrom(bytes.NewReader(before.Bytes()))
+	flat, _ := ReadFrom(bytes.NewReader(before.Bytes()))
+	flat.Flatten()
+	if flat.root != nil || len(flat.flat) != 1000 || flat.Len() != 900 || flat.Depth() != vp.Depth() {
+		t.Fatalf("Flatten: root=%v nodes=%d Len()=%d Depth()=%d", flat.root, len(flat.flat), flat.Len(), flat.Depth())
+	}
+
+	// the same nodes are visited in the same order, even by an
+	// approximate search
+	for i := 0; i < 20; i++ {
+		target := uint64(rand.Int63())
+		for _, maxNodes := range []int{0, 10, 100} {
+			wantCoords, wantDists := vp.SearchApprox(target, 10, maxNodes)
+			coords, dists := flat.SearchApprox(target, 10, maxNodes)
+			compareCoordDistSets(t, coords, wantCoords, dists, wantDists)
+		}
+		if got, want := flat.InRange(target, 24), vp.InRange(target, 24); !reflect.DeepEqual(got, want) {
+			t.Errorf("InRange(%x)=%v, want %v", target, got, want)
+		}
+	}
+
+	var after bytes.Buffer
+	flat.WriteTo(&after)
+	if !bytes.Equal(before.Bytes(), after.Bytes()) {
+		t.Errorf("WriteTo of the flattened tree differs")
+	}
+
+	// removing from the flattened tree, until it's rebuilt, flattened
+	for id := uint64(100); id < 600; id++ {
+		if !flat.Remove(id) {
+			t.Errorf("Remove(%d)=false", id)
+		}
+	}
+	if flat.flat == nil || flat.Len() != 400 || flat.removed > flat.Len() {
+		t.Errorf("after Remove: flattened=%v Len()=%d removed=%d", flat.flat != nil, flat.Len(), flat.removed)
+	}
+
+	// payloads are kept when flattening, and when adding turns a tree back
+	// into nodes
+	payloads := New(append([]Item(nil), items...))
+	payloads.Flatten()
+	for _, item := range items[:10] {
+		if found, _ := payloads.Search(item.Sig, 1); len(found) != 1 || found[0] != item {
+			t.Errorf("Search(%x) of the flattened tree returned %v, want %v", item.Sig, found, item)
+		}
+	}
+	payloads.Add(Item{Sig: 1, ID: 1000})
+	for _, item := range items[:10] {
+		if found, _ := payloads.Search(item.Sig, 1); len(found) != 1 || found[0] != item {
+			t.Errorf("Search(%x) after Add returned %v, want %v", item.Sig, found, item)
+		}
+	}
+
+	// and adding to flat turns it back into nodes
+	flat.Add(Item{Sig: items[0].Sig, ID: items[0].ID})
+	if flat.flat != nil || flat.Len() != 401 {
+		t.Errorf("after Add: flattened=%v Len()=%d", flat.flat != nil, flat.Len())
+	}
+
+	// flat was read back, without payloads
+	var live []Item
+	for _, item := range append([]Item{items[0]}, items[600:]...) {
+		live = append(live, Item{Sig: item.Sig, ID: item.ID})
+	}
+	for i := 0; i < 20; i++ {
+		target := uint64(rand.Int63())
+		wantCoords, wantDists := nearestNeighbours(target, live, 10)
+		coords, dists := flat.Search(target, 10)
+		compareCoordDistSets(t, coords, wantCoords, dists, wantDists)
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+
+	var items []Item
+	for i := 0; i < 1000; i++ {
+		items = append(items, Item{Sig: uint64(rand.Int63()), ID: uint64(i)})
+	}
+	vp := New(append([]Item(nil), items...))
+
+	var buf bytes.Buffer
+	n, err := vp.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) || n != headerSize+1000*nodeSize+4 {
+		t.Errorf("WriteTo=%d, wrote %d bytes, want %d", n, buf.Len(), headerSize+1000*nodeSize+4)
+	}
+	data := buf.Bytes()
+
+	read, err := ReadFrom(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.Len() != vp.Len() || read.Depth() != vp.Depth() {
+		t.Errorf("read tree of %d items and depth %d, want %d and %d", read.Len(), read.Depth(), vp.Len(), vp.Depth())
+	}
+
+	for i := 0; i < 100; i++ {
+		target := uint64(rand.Int63())
+		coords, dists := read.Search(target, 10)
+		wantCoords, wantDists := vp.Search(target, 10)
+		compareCoordDistSets(t, coords, wantCoords, dists, wantDists)
+	}
+
+	var empty bytes.Buffer
+	New(nil).WriteTo(&empty)
+	if vp, err := ReadFrom(&empty); err != nil || vp.Len() != 0 {
+		t.Errorf("ReadFrom of an empty tree=%v, %v", vp, err)
+	}
+
+	corrupt := append([]byte(nil), data...)
+	corrupt[headerSize+3] ^= 1
+	for _, tt := range []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"magic", append([]byte("simstore"), data[8:]...)},
+		{"truncated", data[:len(data)-1]},
+		{"corrupt", corrupt},
+	} {
+		if _, err := ReadFrom(bytes.NewReader(tt.data)); err != ErrFormat {
+			t.Errorf("%s: ReadFrom=%v, want ErrFormat", tt.name, err)
+		}
+	}
+}
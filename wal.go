@@ -0,0 +1,274 @@
+package simstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// The write-ahead log format written by a WAL.  A header is followed by one
+// fixed-size record per operation, in the order they were applied.  All
+// integers are little-endian.
+//
+//	magic    [8]byte  "simwalog"
+//	version  uint32
+//	records × (
+//	  op     byte     'a' for Add, 'd' for Delete, 'e' for Expire, 'v' for
+//	                  AddVersion
+//	  sig    uint64   the signature of an Add or AddVersion
+//	  docid  uint64   the docid of an Add, Delete or AddVersion
+//	  time   int64    unix nanoseconds: the time of an Add, 0 if it had
+//	                  none, or the time given to Expire; the version of an
+//	                  AddVersion
+//	  crc    uint32   CRC-32C of the preceding fields of the record
+//	)
+const (
+	walMagic   = "simwalog"
+	walVersion = 1
+
+	walHeaderSize = 8 + 4
+	walRecordSize = 1 + 8 + 8 + 8 + 4
+)
+
+const (
+	walAdd        = 'a'
+	walDelete     = 'd'
+	walExpire     = 'e'
+	walAddVersion = 'v'
+)
+
+// ErrWALFormat is returned when a write-ahead log has an unknown header
+var ErrWALFormat = errors.New("simstore: invalid write-ahead log")
+
+var (
+	errWALClosed = errors.New("simstore: write-ahead log closed")
+	errWALOpen   = errors.New("simstore: the store already has a write-ahead log")
+)
+
+// WAL is a write-ahead log of the changes to a Store, so a store can be
+// restored after a restart from its latest snapshot and the log of the
+// changes since.  Each Add, AddAt, AddVersion, Delete and Expire of the store
+// is written to the log's file before it returns, so it survives a crash of
+// the process; Sync makes the logged changes survive a crash of the machine.
+//
+// The first error writing to the log is returned by Err, and the changes
+// after it aren't logged.
+type WAL struct {
+	s *Store
+
+	mu  sync.Mutex
+	f   *os.File
+	buf [walRecordSize]byte
+	err error
+}
+
+// OpenWAL opens the write-ahead log at path, creating it if it doesn't exist,
+// and applies the changes logged in it to s, which would usually have just
+// been read from the snapshot written when the log was last truncated.  The
+// later changes to s are then logged to it.  A record left incomplete by a
+// crash ends the log, and is removed.
+func OpenWAL(path string, s *Store) (*WAL, error) {
+
+	// replaying onto a store with a log would log the changes again
+	s.mu.RLock()
+	logged := s.wal != nil
+	s.mu.RUnlock()
+	if logged {
+		return nil, errWALOpen
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &WAL{s: s, f: f}
+
+	end, err := w.replay()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// drop the incomplete record, if any, and append after the rest
+	if err := f.Truncate(end); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(end, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.wal != nil {
+		f.Close()
+		return nil, errWALOpen
+	}
+	s.wal = w
+
+	return w, nil
+}
+
+// replay applies the records of the log to the store, writing the header of
+// an empty log, and returns the offset of the end of the last whole record
+func (w *WAL) replay() (int64, error) {
+
+	var hdr [walHeaderSize]byte
+	n, err := io.ReadFull(w.f, hdr[:])
+	if n == 0 && err == io.EOF {
+		copy(hdr[:], walMagic)
+		binary.LittleEndian.PutUint32(hdr[8:], walVersion)
+		if _, err := w.f.Write(hdr[:]); err != nil {
+			return 0, err
+		}
+		return walHeaderSize, nil
+	}
+	if err != nil {
+		return 0, ErrWALFormat
+	}
+	if string(hdr[:8]) != walMagic || binary.LittleEndian.Uint32(hdr[8:]) != walVersion {
+		return 0, ErrWALFormat
+	}
+
+	r := bufio.NewReader(w.f)
+	end := int64(walHeaderSize)
+
+	var rec [walRecordSize]byte
+	for {
+		if _, err := io.ReadFull(r, rec[:]); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return end, nil
+		} else if err != nil {
+			return 0, err
+		}
+
+		if crc32.Checksum(rec[:walRecordSize-4], castagnoli) != binary.LittleEndian.Uint32(rec[walRecordSize-4:]) {
+			return end, nil
+		}
+
+		sig := binary.LittleEndian.Uint64(rec[1:])
+		docid := binary.LittleEndian.Uint64(rec[9:])
+		t := int64(binary.LittleEndian.Uint64(rec[17:]))
+
+		s := w.s
+		switch rec[0] {
+		case walAdd:
+			s.mu.Lock()
+			s.add(entry{hash: sig, docid: docid})
+			if t != 0 {
+				s.stamp(docid, time.Unix(0, t))
+			}
+			s.mu.Unlock()
+		case walAddVersion:
+			s.mu.Lock()
+			s.addVersion(sig, docid, uint64(t))
+			s.mu.Unlock()
+		case walDelete:
+			s.Delete(docid)
+		case walExpire:
+			s.Expire(time.Unix(0, t))
+		default:
+			return end, nil
+		}
+
+		end += walRecordSize
+	}
+}
+
+// log writes a record of an operation to the log.  It does nothing for a nil
+// WAL, so a store without a log can call it.
+func (w *WAL) log(op byte, sig, docid uint64, t int64) {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return
+	}
+
+	w.buf[0] = op
+	binary.LittleEndian.PutUint64(w.buf[1:], sig)
+	binary.LittleEndian.PutUint64(w.buf[9:], docid)
+	binary.LittleEndian.PutUint64(w.buf[17:], uint64(t))
+	binary.LittleEndian.PutUint32(w.buf[walRecordSize-4:], crc32.Checksum(w.buf[:walRecordSize-4], castagnoli))
+
+	_, w.err = w.f.Write(w.buf[:])
+}
+
+// Sync commits the logged changes to stable storage
+func (w *WAL) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return w.err
+	}
+	return w.f.Sync()
+}
+
+// Truncate empties the log, once a snapshot of the store holding all the
+// logged changes has been written.  Changes made to the store between the
+// snapshot and Truncate would be lost, so the caller must hold them off.
+func (w *WAL) Truncate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return w.err
+	}
+
+	if w.err = w.f.Truncate(walHeaderSize); w.err != nil {
+		return w.err
+	}
+	_, w.err = w.f.Seek(walHeaderSize, io.SeekStart)
+	return w.err
+}
+
+// Err returns the first error writing to the log of s, if it has one, so a
+// change which couldn't be logged fails with Checked
+func (s *Store) Err() error {
+	s.mu.RLock()
+	w := s.wal
+	s.mu.RUnlock()
+
+	if w == nil {
+		return nil
+	}
+	return w.Err()
+}
+
+// Err returns the first error writing to the log, if any
+func (w *WAL) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Close stops logging the changes to the store and closes the log's file
+func (w *WAL) Close() error {
+
+	w.s.mu.Lock()
+	if w.s.wal == w {
+		w.s.wal = nil
+	}
+	w.s.mu.Unlock()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	err := w.f.Close()
+	if w.err == nil {
+		w.err = errWALClosed
+	}
+	return err
+}
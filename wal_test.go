@@ -0,0 +1,142 @@
+package simstore
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWAL(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "store.wal")
+	sig := func(i int) uint64 { return uint64(i) * 0x9e3779b97f4a7c15 }
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	s := New3(100, NewU64Slice)
+	w, err := OpenWAL(path, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		s.Add(sig(i), uint64(i))
+	}
+	s.Finish()
+	for i := 50; i < 100; i++ {
+		s.AddAt(sig(i), uint64(i), base.Add(time.Duration(i)*time.Hour))
+	}
+	s.Delete(3)
+	s.Delete(60)
+	if got := s.Expire(base.Add(80 * time.Hour)); got != 29 {
+		t.Fatalf("Expire=%d, want 29", got)
+	}
+
+	if err := w.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// changes after Close aren't logged
+	s.Add(sig(1000), 1000)
+
+	// the changes of the log, applied to a new store
+	same := func(when string, got *Store) {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			if g, w := got.Find(sig(i)), s.Find(sig(i)); !reflect.DeepEqual(g, w) {
+				t.Errorf("%s: Find(%016x)=%v, want %v", when, sig(i), g, w)
+			}
+		}
+		if got.Find(sig(1000)) != nil {
+			t.Errorf("%s: found a signature added after Close", when)
+		}
+	}
+
+	replay := func(s *Store) *WAL {
+		t.Helper()
+		w, err := OpenWAL(path, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	restored := New3(100, NewU64Slice)
+	w = replay(restored)
+	restored.Finish()
+	same("replayed", restored)
+
+	// a record cut short by a crash is dropped, and the log continues after
+	// the whole ones
+	w.Close()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{walAdd, 1, 2, 3})
+	f.Close()
+
+	torn := New3(100, NewU64Slice)
+	w = replay(torn)
+	torn.Finish()
+	same("torn", torn)
+	torn.Add(sig(100), 100)
+	w.Close()
+
+	again := New3(100, NewU64Slice)
+	w = replay(again)
+	again.Finish()
+	if got := again.Find(sig(100)); !reflect.DeepEqual(got, []uint64{100}) {
+		t.Errorf("Find after a torn record=%v, want [100]", got)
+	}
+
+	// a snapshot, then the changes since
+	again.Compact()
+	var buf bytes.Buffer
+	if _, err := again.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Truncate(); err != nil {
+		t.Fatal(err)
+	}
+	again.Add(sig(101), 101)
+	again.Delete(100)
+	w.Close()
+
+	if fi, err := os.Stat(path); err != nil || fi.Size() != walHeaderSize+2*walRecordSize {
+		t.Errorf("log of %v bytes after Truncate and 2 changes, want %d", fi.Size(), walHeaderSize+2*walRecordSize)
+	}
+
+	snap, err := ReadFrom(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = replay(snap)
+	defer w.Close()
+	same("snapshot", snap)
+	if got := snap.Find(sig(101)); !reflect.DeepEqual(got, []uint64{101}) {
+		t.Errorf("Find after the snapshot=%v, want [101]", got)
+	}
+	if got := snap.Find(sig(100)); got != nil {
+		t.Errorf("Find of a document deleted after the snapshot=%v", got)
+	}
+
+	if _, err := OpenWAL(path, snap); err == nil {
+		t.Errorf("OpenWAL of a store with a log succeeded")
+	}
+}
+
+func TestWALFormat(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "store.wal")
+	os.WriteFile(path, []byte("simstore\x01\x00\x00\x00"), 0644)
+
+	if _, err := OpenWAL(path, New3(0, NewU64Slice)); err != ErrWALFormat {
+		t.Errorf("OpenWAL of a snapshot: %v, want ErrWALFormat", err)
+	}
+}
@@ -0,0 +1,315 @@
+package simstore
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"runtime"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// maxWideWords bounds the width of the signatures of a WideStore to
+// 64*maxWideWords bits
+const maxWideWords = 4
+
+// WideStore is a storage engine for signatures of any number of 64-bit words,
+// such as 128 or 256-bit simhashes.  Like a store created by New, it splits
+// the signatures into maxDistance+k blocks and has a table for each choice of
+// k of them as its prefix, but the permutations are computed for the width
+// given to NewWide.  Each table keeps the first 64 bits of the prefix of each
+// signature and its index in the document table, and a search checks the
+// distance of each signature found against the whole query.
+//
+// All the signatures must be added before Finish, which sorts the tables, and
+// a WideStore is safe for concurrent searches after it.  It holds at most 2^32
+// signatures.
+type WideStore struct {
+	words    int
+	distance int
+	perm     widePerm
+
+	sigs   []uint64 // the signatures, words at a time
+	docids []uint64
+
+	tables []wideTable
+
+	finished bool
+}
+
+// wideTable is the keys of one table, sorted, and the index of the signature
+// of each in the document table
+type wideTable struct {
+	keys []uint64
+	idx  []uint32
+}
+
+// NewWide returns a WideStore for signatures of words 64-bit words, from 1 to
+// 4, searching hamming distance <= maxDistance.  A signature is split into at
+// most 16 blocks per word, and the PrefixBlocks, PrefixBits and MaxTables
+// options choose the number of prefix blocks as for New, 2 by default; the
+// other options have no effect.  hashes is the expected number of signatures.
+func NewWide(words, maxDistance int, hashes int, opts ...Option) (*WideStore, error) {
+
+	if words < 1 || words > maxWideWords {
+		return nil, fmt.Errorf("simstore: signatures must be 1 to %d words", maxWideWords)
+	}
+
+	if maxDistance < 1 {
+		return nil, errors.New("simstore: distance must be at least 1")
+	}
+
+	prefix, err := choosePrefixBlocks(maxDistance, 64*words, optionsOf(opts))
+	if err != nil {
+		return nil, err
+	}
+
+	return &WideStore{
+		words:    words,
+		distance: maxDistance,
+		perm:     newWidePerm(words, maxDistance, prefix),
+		sigs:     make([]uint64, 0, words*hashes),
+		docids:   make([]uint64, 0, hashes),
+	}, nil
+}
+
+// Words returns the number of 64-bit words of the store's signatures
+func (s *WideStore) Words() int {
+	return s.words
+}
+
+// MaxDistance returns the maximum hamming distance the store can search
+func (s *WideStore) MaxDistance() int {
+	return s.distance
+}
+
+// Len returns the number of signatures in the store
+func (s *WideStore) Len() int {
+	return len(s.docids)
+}
+
+// Add adds the signature sig of the document docid.  sig must have Words
+// words, the most significant first, and is copied.
+func (s *WideStore) Add(sig []uint64, docid uint64) {
+	if s.finished {
+		panic("simstore: WideStore.Add after Finish")
+	}
+	if len(sig) != s.words {
+		panic(fmt.Sprintf("simstore: signature of %d words, want %d", len(sig), s.words))
+	}
+	if uint64(len(s.docids)) > math.MaxUint32 {
+		panic("simstore: too many signatures for a WideStore")
+	}
+
+	s.sigs = append(s.sigs, sig...)
+	s.docids = append(s.docids, docid)
+}
+
+// sig returns signature i of the document table
+func (s *WideStore) sig(i int) []uint64 {
+	return s.sigs[i*s.words : (i+1)*s.words]
+}
+
+// Finish prepares the store for searching.  This must be called once after all
+// the signatures have been added via Add().
+func (s *WideStore) Finish() {
+
+	if s.finished {
+		return
+	}
+	s.finished = true
+
+	s.tables = make([]wideTable, len(s.perm.orders))
+
+	l := make(limiter, runtime.GOMAXPROCS(0))
+
+	var wg sync.WaitGroup
+	for t := range s.tables {
+		l.enter()
+		wg.Add(1)
+		go func(t int) {
+			s.fillTable(t)
+			l.leave()
+			wg.Done()
+		}(t)
+	}
+	wg.Wait()
+}
+
+// fillTable sorts the keys of the signatures for table t
+func (s *WideStore) fillTable(t int) {
+
+	type keyIndex struct {
+		key uint64
+		idx uint32
+	}
+
+	entries := make([]keyIndex, len(s.docids))
+	for i := range entries {
+		entries[i] = keyIndex{s.perm.key(s.sig(i), t), uint32(i)}
+	}
+
+	slices.SortFunc(entries, func(a, b keyIndex) int {
+		switch {
+		case a.key < b.key:
+			return -1
+		case a.key > b.key:
+			return 1
+		}
+		return int(a.idx) - int(b.idx)
+	})
+
+	tbl := wideTable{keys: make([]uint64, len(entries)), idx: make([]uint32, len(entries))}
+	for i, e := range entries {
+		tbl.keys[i], tbl.idx[i] = e.key, e.idx
+	}
+	s.tables[t] = tbl
+}
+
+// Find searches the store for all the signatures within the store's hamming
+// distance of sig, which must have Words words.  It returns the associated
+// list of document ids in ascending order.
+func (s *WideStore) Find(sig []uint64) []uint64 {
+
+	if len(sig) != s.words {
+		panic(fmt.Sprintf("simstore: signature of %d words, want %d", len(sig), s.words))
+	}
+
+	var found []uint32
+
+	for t, tbl := range s.tables {
+		key, mask := s.perm.key(sig, t), s.perm.orders[t].mask
+		prefix := key & mask
+
+		i := sort.Search(len(tbl.keys), func(i int) bool { return tbl.keys[i] >= prefix })
+		for ; i < len(tbl.keys) && tbl.keys[i]&mask == prefix; i++ {
+			if wideDistance(s.sig(int(tbl.idx[i])), sig) <= s.distance {
+				found = append(found, tbl.idx[i])
+			}
+		}
+	}
+
+	if len(found) == 0 {
+		return nil
+	}
+
+	ids := make([]uint64, 0, len(found))
+	for _, i := range found {
+		ids = append(ids, s.docids[i])
+	}
+
+	return unique(ids)
+}
+
+// wideDistance returns the hamming distance between the signatures a and b,
+// of the same number of words
+func wideDistance(a, b []uint64) int {
+	var d int
+	for i := range a {
+		d += bits.OnesCount64(a[i] ^ b[i])
+	}
+	return d
+}
+
+// widePerm splits a signature of words words into distance+prefix blocks of
+// nearly equal width, and has one table for each choice of prefix blocks, as
+// blockPerm does for a single word.  The key of a signature in a table is the
+// first 64 bits of its prefix blocks.
+type widePerm struct {
+	orders []wideOrder
+}
+
+// wideOrder is the arrangement of the prefix blocks of a signature in the key
+// of one table
+type wideOrder struct {
+	moves []wideMove
+	mask  uint64
+}
+
+// wideMove moves bits from one shift of a word of the signature to another of
+// the key
+type wideMove struct {
+	word     int
+	bits     uint64
+	from, to uint
+}
+
+func newWidePerm(words, distance, prefix int) widePerm {
+
+	n := distance + prefix
+	width := 64 * words
+
+	// the widths and offsets of the blocks, from the top of the signature
+	widths := make([]int, n)
+	starts := make([]int, n)
+	start := 0
+	for i := range widths {
+		widths[i] = width / n
+		if i < width%n {
+			widths[i]++
+		}
+		starts[i] = start
+		start += widths[i]
+	}
+
+	var p widePerm
+
+	// each combination of prefix blocks, in lexicographic order
+	c := make([]int, prefix)
+	for i := range c {
+		c[i] = i
+	}
+
+	for {
+		var o wideOrder
+		used := 0
+
+		for _, i := range c {
+			// the block, split at word boundaries and cut at 64 bits
+			pos, w := starts[i], widths[i]
+			for w > 0 && used < 64 {
+				off := pos % 64
+				take := min(w, 64-off, 64-used)
+				o.moves = append(o.moves, wideMove{
+					word: pos / 64,
+					bits: 1<<uint(take) - 1,
+					from: uint(64 - off - take),
+					to:   uint(64 - used - take),
+				})
+				pos += take
+				w -= take
+				used += take
+			}
+		}
+
+		o.mask = ^uint64(0) << uint(64-used)
+		p.orders = append(p.orders, o)
+
+		// the next combination: advance the last block which can be, and
+		// follow it with the blocks after it
+		j := prefix - 1
+		for j >= 0 && c[j] == n-prefix+j {
+			j--
+		}
+		if j < 0 {
+			break
+		}
+		c[j]++
+		for k := j + 1; k < prefix; k++ {
+			c[k] = c[k-1] + 1
+		}
+	}
+
+	return p
+}
+
+// key returns the key of sig in table t
+func (p *widePerm) key(sig []uint64, t int) uint64 {
+	var k uint64
+	for _, m := range p.orders[t].moves {
+		k |= (sig[m.word] >> m.from & m.bits) << m.to
+	}
+	return k
+}
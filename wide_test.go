@@ -0,0 +1,137 @@
+package simstore
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestWideStore(t *testing.T) {
+
+	r := rand.New(rand.NewSource(0))
+
+	for _, tt := range []struct {
+		words, d int
+		opts     []Option
+		tables   int
+	}{
+		{1, 3, nil, 10},
+		{2, 6, nil, 28},
+		{2, 10, []Option{MaxTables(100)}, 66},
+		{4, 12, []Option{PrefixBlocks(1)}, 13},
+		{4, 24, nil, 325},
+	} {
+		s, err := NewWide(tt.words, tt.d, 0, tt.opts...)
+		if err != nil {
+			t.Fatalf("words=%d d=%d: %v", tt.words, tt.d, err)
+		}
+		if got := len(s.perm.orders); got != tt.tables {
+			t.Errorf("words=%d d=%d: %d tables, want %d", tt.words, tt.d, got, tt.tables)
+		}
+
+		// random signatures, and some close to the first
+		var sigs [][]uint64
+		for i := 0; i < 2000; i++ {
+			sig := make([]uint64, tt.words)
+			for w := range sig {
+				sig[w] = r.Uint64()
+			}
+			if i%2 == 1 {
+				copy(sig, sigs[r.Intn(len(sigs))])
+				flipBits(r, sig, r.Intn(2*tt.d))
+			}
+			sigs = append(sigs, sig)
+			s.Add(sig, uint64(i))
+		}
+		s.Finish()
+
+		if s.Len() != len(sigs) || s.Words() != tt.words || s.MaxDistance() != tt.d {
+			t.Errorf("words=%d d=%d: Len=%d Words=%d MaxDistance=%d", tt.words, tt.d, s.Len(), s.Words(), s.MaxDistance())
+		}
+
+		for i := 0; i < 200; i++ {
+			q := append([]uint64(nil), sigs[r.Intn(len(sigs))]...)
+			flipBits(r, q, r.Intn(2*tt.d))
+
+			var want []uint64
+			for id, sig := range sigs {
+				if wideDistance(sig, q) <= tt.d {
+					want = append(want, uint64(id))
+				}
+			}
+
+			if got := s.Find(q); !reflect.DeepEqual(got, want) {
+				t.Fatalf("words=%d d=%d: Find(%x)=%v, want %v", tt.words, tt.d, q, got, want)
+			}
+		}
+	}
+}
+
+// flipBits flips n distinct random bits of sig
+func flipBits(r *rand.Rand, sig []uint64, n int) {
+	for _, b := range r.Perm(64 * len(sig))[:n] {
+		sig[b/64] ^= 1 << uint(63-b%64)
+	}
+}
+
+func TestWideStoreOneWord(t *testing.T) {
+
+	sigs := benchSignatures()[:20000]
+
+	want, err := New(4, len(sigs), NewU64Slice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewWide(1, 4, len(sigs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, sig := range sigs {
+		want.Add(sig, uint64(i))
+		s.Add([]uint64{sig}, uint64(i))
+	}
+	want.Finish()
+	s.Finish()
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		q := sigs[r.Intn(len(sigs))]
+		for j := r.Intn(6); j > 0; j-- {
+			q ^= 1 << uint(r.Intn(64))
+		}
+		if got, w := s.Find([]uint64{q}), want.Find(q); !reflect.DeepEqual(got, w) {
+			t.Fatalf("Find(%016x)=%v, want %v", q, got, w)
+		}
+	}
+}
+
+func TestNewWideErrors(t *testing.T) {
+
+	for _, tt := range []struct {
+		words, d int
+		opts     []Option
+	}{
+		{0, 3, nil},
+		{5, 3, nil},
+		{2, 0, nil},
+		{1, 15, nil},                       // 17 blocks of 64 bits
+		{2, 10, []Option{PrefixBlocks(5)}}, // 3003 tables
+		{2, 10, []Option{MaxTables(5)}},
+	} {
+		if _, err := NewWide(tt.words, tt.d, 0, tt.opts...); err == nil {
+			t.Errorf("NewWide(%d, %d) succeeded", tt.words, tt.d)
+		}
+	}
+
+	s, err := NewWide(2, 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Add of a signature of the wrong width didn't panic")
+		}
+	}()
+	s.Add([]uint64{1}, 1)
+}
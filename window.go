@@ -0,0 +1,155 @@
+package simstore
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// WindowedStore is a Storage over the documents added in the last retention
+// period, partitioned into buckets of a fixed duration.  Add inserts into the
+// bucket of the current time, starting a new one when it's due, Find searches
+// them all, and a bucket is dropped whole once all of it is older than the
+// retention, without deleting or compacting its entries.
+type WindowedStore struct {
+	bucket    time.Duration
+	retention time.Duration
+	newBucket func() Storage
+	now       func() time.Time
+
+	mu     sync.RWMutex
+	stores *MultiStore
+	starts []time.Time // the start of each bucket of stores, oldest first
+}
+
+// NewWindowed returns a WindowedStore keeping the documents of the last
+// retention, in buckets of the given duration, each of them a store returned
+// by newBucket, which the WindowedStore finishes.  A retention shorter than a
+// bucket is one bucket.
+func NewWindowed(bucket, retention time.Duration, newBucket func() Storage) *WindowedStore {
+	if retention < bucket {
+		retention = bucket
+	}
+	return &WindowedStore{
+		bucket:    bucket,
+		retention: retention,
+		newBucket: newBucket,
+		now:       time.Now,
+		stores:    NewMultiStore(),
+	}
+}
+
+var errBucketOrder = errors.New("simstore: bucket no later than the newest")
+
+// AddBucket adds the finished store s as the bucket starting at start, such
+// as a store loaded at startup, which is then dropped with the other buckets
+// of its time.  Its start is truncated to a multiple of the bucket duration,
+// and must be after that of the newest bucket.
+func (w *WindowedStore) AddBucket(s Storage, start time.Time) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	start = start.Truncate(w.bucket)
+	if n := len(w.starts); n > 0 && !w.starts[n-1].Before(start) {
+		return errBucketOrder
+	}
+
+	w.stores.Push(s)
+	w.starts = append(w.starts, start)
+	w.expire(w.now())
+	return nil
+}
+
+// advance starts the bucket of the current time and drops the expired ones,
+// if they're due
+func (w *WindowedStore) advance() {
+	now := w.now()
+	current := now.Truncate(w.bucket)
+
+	w.mu.RLock()
+	n := len(w.starts)
+	due := n == 0 || w.starts[n-1].Before(current) || w.starts[0].Add(w.bucket).Before(now.Add(-w.retention))
+	w.mu.RUnlock()
+
+	if !due {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if n := len(w.starts); n == 0 || w.starts[n-1].Before(current) {
+		s := w.newBucket()
+		s.Finish()
+		w.stores.Push(s)
+		w.starts = append(w.starts, current)
+	}
+	w.expire(now)
+}
+
+// expire drops the buckets which ended more than the retention before now.
+// The caller must hold the lock.
+func (w *WindowedStore) expire(now time.Time) {
+	cutoff := now.Add(-w.retention)
+
+	var n int
+	for n < len(w.starts) && w.starts[n].Add(w.bucket).Before(cutoff) {
+		n++
+	}
+	if n > 0 {
+		w.stores.Drop(n)
+		w.starts = append(w.starts[:0:0], w.starts[n:]...)
+	}
+}
+
+// Add inserts into the bucket of the current time
+func (w *WindowedStore) Add(sig, docid uint64) {
+	w.advance()
+	w.stores.Add(sig, docid)
+}
+
+// Find returns the sorted, distinct docids found by any of the buckets
+// within the retention
+func (w *WindowedStore) Find(sig uint64) []uint64 {
+	w.advance()
+	return w.stores.Find(sig)
+}
+
+// Finish finishes the buckets added with AddBucket, if they weren't already
+func (w *WindowedStore) Finish() {
+	w.stores.Finish()
+}
+
+// Delete removes docid from each bucket
+func (w *WindowedStore) Delete(docid uint64) {
+	w.stores.Delete(docid)
+}
+
+// Len returns the number of entries in the buckets within the retention
+func (w *WindowedStore) Len() int {
+	w.advance()
+	return w.stores.Len()
+}
+
+// Stats adds up the stats of the buckets within the retention, as
+// MultiStore.Stats does
+func (w *WindowedStore) Stats() Stats {
+	w.advance()
+	return w.stores.Stats()
+}
+
+// Compact compacts the buckets which support it, and returns how many
+// entries were removed
+func (w *WindowedStore) Compact() int {
+	w.advance()
+	return w.stores.Compact()
+}
+
+// Buckets returns the number of buckets within the retention
+func (w *WindowedStore) Buckets() int {
+	w.advance()
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return len(w.starts)
+}
@@ -0,0 +1,59 @@
+package simstore
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWindowedStore(t *testing.T) {
+
+	const sig = 0xffff0000ffff0000
+
+	now := time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)
+
+	w := NewWindowed(time.Hour, 3*time.Hour, func() Storage { return New3(0, NewU64Slice) })
+	w.now = func() time.Time { return now }
+
+	// a store loaded an hour ago
+	loaded := New3(1, NewU64Slice)
+	loaded.Add(sig, 1)
+	loaded.Finish()
+	if err := w.AddBucket(loaded, now.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddBucket(New3(0, NewU64Slice), now.Add(-2*time.Hour)); err == nil {
+		t.Errorf("AddBucket of an older bucket succeeded")
+	}
+
+	w.Add(sig^1, 2)
+	now = now.Add(time.Hour)
+	w.Add(sig^2, 3)
+	w.Delete(3)
+
+	if got := w.Find(sig); !reflect.DeepEqual(got, []uint64{1, 2}) {
+		t.Errorf("Find=%v, want [1 2]", got)
+	}
+	if w.Buckets() != 3 || w.Len() != 3 {
+		t.Errorf("%d buckets of %d entries, want 3 of 3", w.Buckets(), w.Len())
+	}
+	w.Compact()
+	if w.Len() != 2 {
+		t.Errorf("Len after Compact=%d, want the deleted entry removed", w.Len())
+	}
+
+	// the loaded bucket ended at 00:00, so it's dropped after 03:00
+	now = time.Date(2024, 1, 1, 3, 0, 0, 1, time.UTC)
+	if got := w.Find(sig); !reflect.DeepEqual(got, []uint64{2}) {
+		t.Errorf("Find after the loaded bucket expired=%v, want [2]", got)
+	}
+
+	// with no adds for longer than the retention, only an empty bucket is left
+	now = now.Add(24 * time.Hour)
+	if got := w.Find(sig); got != nil {
+		t.Errorf("Find after everything expired=%v", got)
+	}
+	if w.Buckets() != 1 || w.Len() != 0 {
+		t.Errorf("%d buckets of %d entries, want 1 empty one", w.Buckets(), w.Len())
+	}
+}
@@ -1,7 +1,10 @@
 package simstore
 
 import (
+	"compress/flate"
+	"flag"
 	"math/rand"
+	"runtime"
 	"sort"
 	"testing"
 	"time"
@@ -17,11 +20,11 @@ func TestCompress(t *testing.T) {
 	u := make(u64slice, signatures)
 	for i := range u {
 		u[i] = uint64(rand.Int63())
-		z.add(u[i])
+		z.Add(u[i])
 	}
 	sort.Sort(u)
 
-	z.finish()
+	z.Finish()
 
 	sz := len(u) * int(unsafe.Sizeof(u[0]))
 	csz := len(z.b)
@@ -63,11 +66,11 @@ func BenchmarkDecompress(b *testing.B) {
 	u := make(u64slice, signatures)
 	for i := range u {
 		u[i] = uint64(rand.Int63())
-		z.add(u[i])
+		z.Add(u[i])
 	}
 	sort.Sort(u)
 
-	z.finish()
+	z.Finish()
 
 	b.ResetTimer()
 
@@ -87,12 +90,12 @@ func TestDuplicateSignatures(t *testing.T) {
 	u := make(u64slice, signatures)
 	for i := range u {
 		u[i] = uint64(rand.Int63())
-		z.add(u[i])
-		z.add(u[i])
+		z.Add(u[i])
+		z.Add(u[i])
 	}
 	sort.Sort(u)
 
-	z.finish()
+	z.Finish()
 
 	d, err := z.decompressBlock(0)
 	if err != nil {
@@ -108,3 +111,133 @@ func TestDuplicateSignatures(t *testing.T) {
 		}
 	}
 }
+
+var benchSigs = flag.Int("benchsigs", 1<<20, "number of signatures in the store for the backend benchmarks")
+var benchDistance = flag.Int("benchdistance", 3, "store distance (3 or 6) for the backend benchmarks")
+
+var backends = []struct {
+	name    string
+	factory StorageFactory
+}{
+	{"U64Slice", NewU64Slice},
+	{"ZStore", NewZStore},
+	{"DeltaStore", NewDeltaStore},
+	{"BucketStore", NewBucketStore},
+	{"BlockStore", NewBlockStore(flateSpeed)},
+}
+
+var flateSpeed, _ = FlateCodec(flate.BestSpeed)
+
+func newBenchStore(factory StorageFactory, sigs []uint64) Storage {
+
+	var s Storage
+	if *benchDistance == 6 {
+		s = New6(len(sigs), factory)
+	} else {
+		s = New3(len(sigs), factory)
+	}
+
+	for i, sig := range sigs {
+		s.Add(sig, uint64(i))
+	}
+	s.Finish()
+
+	return s
+}
+
+func benchSignatures() []uint64 {
+	r := rand.New(rand.NewSource(0))
+	sigs := make([]uint64, *benchSigs)
+	for i := range sigs {
+		sigs[i] = uint64(r.Int63())
+	}
+	return sigs
+}
+
+// BenchmarkBuild measures the time to build a store with each backend, and the
+// heap used by the finished store.
+//
+//	go test -run=NONE -bench=Build -benchmem -benchsigs=10000000
+func BenchmarkBuild(b *testing.B) {
+
+	sigs := benchSignatures()
+
+	for _, bb := range backends {
+		b.Run(bb.name, func(b *testing.B) {
+			b.ReportAllocs()
+
+			var heap uint64
+
+			for i := 0; i < b.N; i++ {
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+
+				s := newBenchStore(bb.factory, sigs)
+
+				b.StopTimer()
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				heap = after.HeapAlloc - before.HeapAlloc
+				runtime.KeepAlive(s)
+				b.StartTimer()
+			}
+
+			b.ReportMetric(float64(heap)/float64(len(sigs)), "heapbytes/sig")
+		})
+	}
+}
+
+// BenchmarkFind measures Find latency with each backend for queries which
+// match a stored signature, queries which don't, and an even mix of the two.
+//
+//	go test -run=NONE -bench=Find -benchsigs=10000000 -benchdistance=6
+func BenchmarkFind(b *testing.B) {
+
+	sigs := benchSignatures()
+
+	r := rand.New(rand.NewSource(1))
+
+	const nqueries = 1 << 12
+
+	hits := make([]uint64, nqueries)
+	misses := make([]uint64, nqueries)
+	mixed := make([]uint64, nqueries)
+
+	for i := range hits {
+		q := sigs[r.Intn(len(sigs))]
+		for j := r.Intn(*benchDistance + 1); j > 0; j-- {
+			q ^= 1 << uint(r.Intn(64))
+		}
+		hits[i] = q
+		misses[i] = uint64(r.Int63())
+
+		if i%2 == 0 {
+			mixed[i] = hits[i]
+		} else {
+			mixed[i] = misses[i]
+		}
+	}
+
+	workloads := []struct {
+		name    string
+		queries []uint64
+	}{
+		{"hit", hits},
+		{"miss", misses},
+		{"mixed", mixed},
+	}
+
+	for _, bb := range backends {
+		s := newBenchStore(bb.factory, sigs)
+
+		for _, w := range workloads {
+			b.Run(bb.name+"/"+w.name, func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					s.Find(w.queries[i%len(w.queries)])
+				}
+			})
+		}
+	}
+}